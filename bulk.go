@@ -0,0 +1,314 @@
+/*
+ * Copyright (C) 2015-2019 Virgil Security Inc.
+ *
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ *     (1) Redistributions of source code must retain the above copyright
+ *     notice, this list of conditions and the following disclaimer.
+ *
+ *     (2) Redistributions in binary form must reproduce the above copyright
+ *     notice, this list of conditions and the following disclaimer in
+ *     the documentation and/or other materials provided with the
+ *     distribution.
+ *
+ *     (3) Neither the name of the copyright holder nor the names of its
+ *     contributors may be used to endorse or promote products derived from
+ *     this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ''AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+ * IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ *
+ * Lead Maintainer: Virgil Security Inc. <support@virgilsecurity.com>
+ */
+
+package phe
+
+import (
+	"context"
+	"math/big"
+	"runtime"
+	"sync"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/pkg/errors"
+)
+
+const defaultBulkBatchSize = 1000
+
+// StoredRecord is an enrollment record together with the key it's stored under
+type StoredRecord struct {
+	Key    string
+	Record []byte
+}
+
+// RecordSource lists the records to be updated
+type RecordSource interface {
+	// Next returns up to limit records with keys greater than after, in ascending key order.
+	// after is empty on the first call. An empty result means there are no more records
+	Next(ctx context.Context, after string, limit int) ([]StoredRecord, error)
+}
+
+// RecordSink stores updated records
+type RecordSink interface {
+	// Write replaces the records stored under the given keys
+	Write(ctx context.Context, records []StoredRecord) error
+}
+
+// Checkpoint keeps the key of the last record BulkUpdater has finished with, so that an interrupted update can be resumed
+type Checkpoint interface {
+	// Load returns the saved key or an empty string if there is none
+	Load(ctx context.Context) (string, error)
+	// Save replaces the saved key
+	Save(ctx context.Context, key string) error
+}
+
+// BulkUpdateProgress describes the work done by BulkUpdater.Run
+type BulkUpdateProgress struct {
+	// Processed is the number of records read from the source
+	Processed int64
+	// Updated is the number of records written to the sink
+	Updated int64
+	// Skipped is the number of records which already had the token's version
+	Skipped int64
+	// LastKey is the key of the last processed record
+	LastKey string
+}
+
+// BulkUpdateConfig configures BulkUpdater. Zero fields get default values
+type BulkUpdateConfig struct {
+	// Workers is the number of records updated in parallel, runtime.NumCPU() by default
+	Workers int
+	// BatchSize is the number of records read, written and checkpointed at once, 1000 by default
+	BatchSize int
+	// Progress is called after every batch
+	Progress func(BulkUpdateProgress)
+}
+
+// BulkUpdater applies an update token to every record of a source and writes the results to a sink.
+// Records are processed in batches, a batch is checkpointed after it has been written,
+// so a failed or cancelled update continues from the last complete batch when it's run again
+type BulkUpdater struct {
+	source     RecordSource
+	sink       RecordSink
+	checkpoint Checkpoint
+	config     BulkUpdateConfig
+}
+
+// NewBulkUpdater creates an updater. checkpoint may be nil, the update then always starts from the beginning
+func NewBulkUpdater(source RecordSource, sink RecordSink, checkpoint Checkpoint, config BulkUpdateConfig) *BulkUpdater {
+	if config.Workers <= 0 {
+		config.Workers = runtime.NumCPU()
+	}
+	if config.BatchSize <= 0 {
+		config.BatchSize = defaultBulkBatchSize
+	}
+
+	return &BulkUpdater{
+		source:     source,
+		sink:       sink,
+		checkpoint: checkpoint,
+		config:     config,
+	}
+}
+
+// Run updates all records which follow the checkpoint. serverPublic is the server public key the token was issued for,
+// the token's proof is verified against it before any record is read, so a forged token can't corrupt the records.
+// The token must have a version, as issued by ServerKeyRing.Rotate,
+// because records which are written again after a crash must be recognized as already updated.
+// Every updated record is parsed and validated before it's written
+func (u *BulkUpdater) Run(ctx context.Context, serverPublic, tokenBytes []byte) (progress BulkUpdateProgress, err error) {
+	token := &UpdateToken{}
+	if err = proto.Unmarshal(tokenBytes, token); err != nil {
+		return progress, ErrInvalidToken
+	}
+
+	pub, err := PointUnmarshal(serverPublic)
+	if err != nil {
+		return progress, ErrInvalidPublicKey
+	}
+
+	a, b, err := token.validate(pub.group())
+	if err != nil {
+		return
+	}
+
+	if _, err = verifyUpdateToken(pub, serverPublic, token, a, b); err != nil {
+		return
+	}
+
+	if token.Version == 0 {
+		return progress, errors.New("bulk updates require a versioned update token")
+	}
+
+	if u.checkpoint != nil {
+		if progress.LastKey, err = u.checkpoint.Load(ctx); err != nil {
+			return progress, errors.Wrap(err, "could not load checkpoint")
+		}
+	}
+
+	for {
+		if err = ctx.Err(); err != nil {
+			return
+		}
+
+		batch, err := u.source.Next(ctx, progress.LastKey, u.config.BatchSize)
+		if err != nil {
+			return progress, errors.Wrap(err, "could not read records")
+		}
+
+		if len(batch) == 0 {
+			return progress, nil
+		}
+
+		if len(batch) > u.config.BatchSize {
+			return progress, errors.New("source returned more records than requested")
+		}
+
+		last := progress.LastKey
+		for _, rec := range batch {
+			if rec.Key <= last {
+				return progress, errors.Errorf("source returned record %q out of order", rec.Key)
+			}
+			last = rec.Key
+		}
+
+		updated, err := u.updateBatch(ctx, batch, token, a, b)
+		if err != nil {
+			return progress, err
+		}
+
+		if len(updated) > 0 {
+			if err = u.sink.Write(ctx, updated); err != nil {
+				return progress, errors.Wrap(err, "could not write records")
+			}
+		}
+
+		if u.checkpoint != nil {
+			if err = u.checkpoint.Save(ctx, last); err != nil {
+				return progress, errors.Wrap(err, "could not save checkpoint")
+			}
+		}
+
+		progress.Processed += int64(len(batch))
+		progress.Updated += int64(len(updated))
+		progress.Skipped += int64(len(batch) - len(updated))
+		progress.LastKey = last
+
+		if u.config.Progress != nil {
+			u.config.Progress(progress)
+		}
+	}
+}
+
+// updateBatch updates the records of a batch in parallel and returns the changed ones in the batch order
+func (u *BulkUpdater) updateBatch(ctx context.Context, batch []StoredRecord, token *UpdateToken, a, b *big.Int) ([]StoredRecord, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make([][]byte, len(batch))
+	indices := make(chan int)
+
+	var (
+		wg       sync.WaitGroup
+		errOnce  sync.Once
+		firstErr error
+	)
+
+	workers := u.config.Workers
+	if workers > len(batch) {
+		workers = len(batch)
+	}
+
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indices {
+				res, err := updateStoredRecord(batch[i].Record, token, a, b)
+				if err != nil {
+					errOnce.Do(func() {
+						firstErr = errors.Wrapf(err, "record %q", batch[i].Key)
+						cancel()
+					})
+					continue
+				}
+				results[i] = res
+			}
+		}()
+	}
+
+feed:
+	for i := range batch {
+		select {
+		case indices <- i:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(indices)
+	wg.Wait()
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	var updated []StoredRecord
+	for i, res := range results {
+		if res != nil {
+			updated = append(updated, StoredRecord{Key: batch[i].Key, Record: res})
+		}
+	}
+	return updated, nil
+}
+
+// updateStoredRecord returns nil if the record is already up to date
+func updateStoredRecord(recBytes []byte, token *UpdateToken, a, b *big.Int) ([]byte, error) {
+	rec := &EnrollmentRecord{}
+	if err := proto.Unmarshal(recBytes, rec); err != nil {
+		return nil, ErrInvalidRecord
+	}
+
+	upd, err := updateRecord(rec, token, a, b)
+	if err != nil || upd == nil {
+		return nil, err
+	}
+
+	res, err := proto.Marshal(upd)
+	if err != nil {
+		return nil, err
+	}
+
+	// make sure what gets written can be read back
+	check := &EnrollmentRecord{}
+	if err = proto.Unmarshal(res, check); err != nil {
+		return nil, errors.WithMessage(ErrInvalidRecord, "updated record does not parse")
+	}
+
+	g, err := getGroup(Suite(token.Suite))
+	if err != nil {
+		return nil, err
+	}
+
+	if _, _, err = check.validate(g); err != nil || check.Version != token.Version {
+		return nil, errors.New("updated record is invalid")
+	}
+
+	return res, nil
+}
@@ -0,0 +1,278 @@
+/*
+ * Copyright (C) 2015-2019 Virgil Security Inc.
+ *
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ *     (1) Redistributions of source code must retain the above copyright
+ *     notice, this list of conditions and the following disclaimer.
+ *
+ *     (2) Redistributions in binary form must reproduce the above copyright
+ *     notice, this list of conditions and the following disclaimer in
+ *     the documentation and/or other materials provided with the
+ *     distribution.
+ *
+ *     (3) Neither the name of the copyright holder nor the names of its
+ *     contributors may be used to endorse or promote products derived from
+ *     this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ''AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+ * IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ *
+ * Lead Maintainer: Virgil Security Inc. <support@virgilsecurity.com>
+ */
+
+package phe
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+// memoryRecords is an in-memory RecordSource, RecordSink and Checkpoint
+type memoryRecords struct {
+	mu         sync.Mutex
+	records    map[string][]byte
+	checkpoint string
+	writes     int
+	failWrite  int
+}
+
+func (m *memoryRecords) Next(ctx context.Context, after string, limit int) ([]StoredRecord, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var keys []string
+	for k := range m.records {
+		if k > after {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	if len(keys) > limit {
+		keys = keys[:limit]
+	}
+
+	res := make([]StoredRecord, len(keys))
+	for i, k := range keys {
+		res[i] = StoredRecord{Key: k, Record: m.records[k]}
+	}
+	return res, nil
+}
+
+func (m *memoryRecords) Write(ctx context.Context, records []StoredRecord) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.writes++
+	if m.writes == m.failWrite {
+		return errors.New("write failed")
+	}
+
+	for _, r := range records {
+		m.records[r.Key] = r.Record
+	}
+	return nil
+}
+
+func (m *memoryRecords) Load(ctx context.Context) (string, error) {
+	return m.checkpoint, nil
+}
+
+func (m *memoryRecords) Save(ctx context.Context, key string) error {
+	m.checkpoint = key
+	return nil
+}
+
+type bulkSetup struct {
+	servers *ServerKeyRing
+	clients *ClientKeyRing
+	store   *memoryRecords
+	keys    map[string][]byte
+	pub     []byte
+	token   []byte
+}
+
+func newBulkSetup(t *testing.T, n int) *bulkSetup {
+	serverKeypair, err := GenerateServerKeypair()
+	require.NoError(t, err)
+
+	s := &bulkSetup{
+		servers: NewServerKeyRing(),
+		clients: NewClientKeyRing(),
+		store:   &memoryRecords{records: make(map[string][]byte)},
+		keys:    make(map[string][]byte),
+	}
+	require.NoError(t, s.servers.Add(1, serverKeypair))
+	s.pub, err = s.servers.GetPublicKey(1)
+	require.NoError(t, err)
+	require.NoError(t, s.clients.Add(1, s.pub, generateClientKey(t)))
+
+	for i := 0; i < n; i++ {
+		enrollment, err := s.servers.GetEnrollment()
+		require.NoError(t, err)
+		rec, key, err := s.clients.EnrollAccount(pwd, enrollment)
+		require.NoError(t, err)
+
+		k := fmt.Sprintf("user%04d", i)
+		s.store.records[k] = rec
+		s.keys[k] = key
+	}
+
+	s.token, _, err = s.servers.Rotate()
+	require.NoError(t, err)
+	_, _, err = s.clients.Rotate(s.token)
+	require.NoError(t, err)
+	return s
+}
+
+func (s *bulkSetup) requireUpdated(t *testing.T) {
+	for k, rec := range s.store.records {
+		requireRecordVersion(t, rec, 2)
+		requireLogin(t, s.servers, s.clients, rec, s.keys[k])
+	}
+}
+
+func TestBulkUpdater_Full(t *testing.T) {
+	s := newBulkSetup(t, 50)
+
+	var calls int
+	u := NewBulkUpdater(s.store, s.store, s.store, BulkUpdateConfig{
+		Workers:   4,
+		BatchSize: 8,
+		Progress: func(p BulkUpdateProgress) {
+			calls++
+		},
+	})
+
+	progress, err := u.Run(context.Background(), s.pub, s.token)
+	require.NoError(t, err)
+	require.Equal(t, int64(50), progress.Processed)
+	require.Equal(t, int64(50), progress.Updated)
+	require.Equal(t, int64(0), progress.Skipped)
+	require.Equal(t, "user0049", progress.LastKey)
+	require.Equal(t, 7, calls)
+	s.requireUpdated(t)
+
+	// a repeated run without checkpoint finds nothing to update
+	progress, err = NewBulkUpdater(s.store, s.store, nil, BulkUpdateConfig{}).Run(context.Background(), s.pub, s.token)
+	require.NoError(t, err)
+	require.Equal(t, int64(50), progress.Skipped)
+	require.Equal(t, int64(0), progress.Updated)
+}
+
+func TestBulkUpdater_Resume(t *testing.T) {
+	s := newBulkSetup(t, 30)
+	s.store.failWrite = 3
+
+	u := NewBulkUpdater(s.store, s.store, s.store, BulkUpdateConfig{BatchSize: 10})
+
+	progress, err := u.Run(context.Background(), s.pub, s.token)
+	require.Error(t, err)
+	require.Equal(t, int64(20), progress.Processed)
+	require.Equal(t, "user0019", s.store.checkpoint)
+
+	progress, err = u.Run(context.Background(), s.pub, s.token)
+	require.NoError(t, err)
+	require.Equal(t, int64(10), progress.Processed)
+	require.Equal(t, "user0029", progress.LastKey)
+	s.requireUpdated(t)
+}
+
+func TestBulkUpdater_Cancel(t *testing.T) {
+	s := newBulkSetup(t, 20)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	u := NewBulkUpdater(s.store, s.store, s.store, BulkUpdateConfig{
+		BatchSize: 5,
+		Progress: func(p BulkUpdateProgress) {
+			cancel()
+		},
+	})
+
+	progress, err := u.Run(ctx, s.pub, s.token)
+	require.Equal(t, context.Canceled, err)
+	require.Equal(t, int64(5), progress.Processed)
+	require.Equal(t, "user0004", s.store.checkpoint)
+
+	progress, err = u.Run(context.Background(), s.pub, s.token)
+	require.NoError(t, err)
+	require.Equal(t, int64(15), progress.Processed)
+	s.requireUpdated(t)
+}
+
+func TestBulkUpdater_InvalidRecord(t *testing.T) {
+	s := newBulkSetup(t, 10)
+	s.store.records["user0005"] = []byte{0x01, 0x02}
+
+	u := NewBulkUpdater(s.store, s.store, s.store, BulkUpdateConfig{BatchSize: 4})
+	progress, err := u.Run(context.Background(), s.pub, s.token)
+	require.True(t, errors.Is(err, ErrInvalidRecord))
+	require.Contains(t, err.Error(), "user0005")
+	require.Equal(t, "user0003", progress.LastKey)
+}
+
+func TestBulkUpdater_UnversionedToken(t *testing.T) {
+	serverKeypair, err := GenerateServerKeypair()
+	require.NoError(t, err)
+	pub, err := GetPublicKey(serverKeypair)
+	require.NoError(t, err)
+	token, _, err := Rotate(serverKeypair)
+	require.NoError(t, err)
+
+	store := &memoryRecords{records: make(map[string][]byte)}
+	_, err = NewBulkUpdater(store, store, store, BulkUpdateConfig{}).Run(context.Background(), pub, token)
+	require.Error(t, err)
+}
+
+func TestBulkUpdater_InvalidToken(t *testing.T) {
+	s := newBulkSetup(t, 10)
+	u := NewBulkUpdater(s.store, s.store, s.store, BulkUpdateConfig{})
+
+	// a token issued by another server
+	otherKeypair, err := GenerateServerKeypair()
+	require.NoError(t, err)
+	otherPub, err := GetPublicKey(otherKeypair)
+	require.NoError(t, err)
+	_, err = u.Run(context.Background(), otherPub, s.token)
+	require.True(t, errors.Is(err, ErrInvalidToken))
+
+	// a token whose proof doesn't match its scalars
+	token := &UpdateToken{}
+	require.NoError(t, proto.Unmarshal(s.token, token))
+	token.B[len(token.B)-1] ^= 1
+	forged, err := proto.Marshal(token)
+	require.NoError(t, err)
+	_, err = u.Run(context.Background(), s.pub, forged)
+	require.True(t, errors.Is(err, ErrInvalidToken))
+
+	_, err = u.Run(context.Background(), s.pub, []byte{0x01, 0x02})
+	require.Equal(t, ErrInvalidToken, err)
+
+	_, err = u.Run(context.Background(), []byte{0x01, 0x02}, s.token)
+	require.Equal(t, ErrInvalidPublicKey, err)
+
+	// nothing was touched
+	require.Equal(t, 0, s.store.writes)
+	require.Empty(t, s.store.checkpoint)
+}
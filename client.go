@@ -38,10 +38,9 @@ package phe
 
 import (
 	"crypto/sha512"
+	"io"
 	"math/big"
 
-	"github.com/VirgilSecurity/virgil-phe-go/swu"
-
 	"github.com/golang/protobuf/proto"
 	"github.com/pkg/errors"
 	"golang.org/x/crypto/hkdf"
@@ -49,40 +48,57 @@ import (
 
 // Client is responsible for protecting & checking passwords at the client (website) side
 type Client struct {
-	clientPrivateKey      *big.Int
+	clientPrivateKey      []byte // padded to the fixed length
 	clientPrivateKeyBytes []byte
 	serverPublicKey       *Point
 	serverPublicKeyBytes  []byte
-	negKey                *big.Int
-	invKey                *big.Int
+	negKey                []byte
+	invKey                []byte
+	version               uint32
+	random                io.Reader
+	g                     *group
 }
 
-// GenerateClientKey creates a new random key used on the Client side
-func GenerateClientKey() []byte {
-	return randomZ().Bytes()
+// GenerateClientKey creates a new random key used on the Client side. WithSuite selects the curve,
+// it must match the one of the server keypair
+func GenerateClientKey(opts ...Option) ([]byte, error) {
+	o := applyOptions(opts)
+	g, err := getGroup(o.suite)
+	if err != nil {
+		return nil, err
+	}
+
+	return g.randomScalar(o.rand())
 }
 
-//NewClient creates new client instance using client's private key and server's public key used for verification
-func NewClient(serverPublicKey []byte, privateKey []byte) (*Client, error) {
+//NewClient creates new client instance using client's private key and server's public key used for verification.
+//WithRandom replaces the source of enrollment nonces and data encryption keys
+func NewClient(serverPublicKey []byte, privateKey []byte, opts ...Option) (*Client, error) {
 	if len(privateKey) == 0 {
-		return nil, errors.New("invalid private key")
+		return nil, ErrInvalidPrivateKey
 	}
 
 	pub, err := PointUnmarshal(serverPublicKey)
 
 	if err != nil {
-		return nil, errors.Wrap(err, "invalid public key")
+		return nil, ErrInvalidPublicKey
 	}
 
-	sk := new(big.Int).SetBytes(privateKey)
+	g := pub.group()
+	sk, err := g.privateScalar(privateKey)
+	if err != nil {
+		return nil, err
+	}
 
 	return &Client{
 		clientPrivateKey:      sk,
 		serverPublicKey:       pub,
 		clientPrivateKeyBytes: privateKey,
 		serverPublicKeyBytes:  serverPublicKey,
-		negKey:                gf.Neg(sk),
-		invKey:                gf.Inv(sk),
+		negKey:                g.zNeg(sk),
+		invKey:                g.zInv(sk),
+		random:                applyOptions(opts).rand(),
+		g:                     g,
 	}, nil
 
 }
@@ -95,69 +111,141 @@ func (c *Client) EnrollAccount(password []byte, respBytes []byte) (rec []byte, k
 	resp := &EnrollmentResponse{}
 
 	if err = proto.Unmarshal(respBytes, resp); err != nil {
+		return nil, nil, ErrInvalidResponse
+	}
+
+	return c.enrollAccount(password, resp)
+}
+
+func (c *Client) enrollAccount(password []byte, resp *EnrollmentResponse) (rec []byte, key []byte, err error) {
+
+	if resp.Version != c.version {
+		err = &VersionMismatchError{Object: "enrollment", Version: resp.Version, Expected: c.version}
 		return
 	}
 
-	c0, err := PointUnmarshal(resp.C0)
-	if err != nil {
+	if err = c.g.checkSuite(resp.Suite); err != nil {
 		return
 	}
 
-	c1, err := PointUnmarshal(resp.C1)
+	protocol, err := checkProtocol(resp.Protocol)
 	if err != nil {
 		return
 	}
 
-	proofValid := c.validateProofOfSuccess(resp.Proof, resp.Ns, c0, c1, resp.C0, resp.C1)
+	c0, err := c.g.unmarshalPoint(resp.C0)
+	if err != nil {
+		return nil, nil, ErrInvalidResponse
+	}
+
+	c1, err := c.g.unmarshalPoint(resp.C1)
+	if err != nil {
+		return nil, nil, ErrInvalidResponse
+	}
+
+	proofValid := c.validateProofOfSuccess(protocol, resp.Proof, resp.Ns, c0, c1, resp.C0, resp.C1)
 	if !proofValid {
-		err = errors.New("invalid proof")
+		err = ErrInvalidProof
 		return
 	}
 
 	// client nonce and 2 points
 	nc := make([]byte, pheNonceLen)
-	randRead(nc)
-	hc0 := hashToPoint(dhc0, nc, password)
-	hc1 := hashToPoint(dhc1, nc, password)
+	if err = randRead(c.random, nc); err != nil {
+		return
+	}
 
-	// encryption key in a form of a random point
-	mBuf := make([]byte, swu.PointHashLen)
-	randRead(mBuf)
-	m := hashToPoint(mBuf)
+	hc0, err := c.g.hashToPoint(protocol, dhc0, nc, password)
+	if err != nil {
+		return
+	}
 
-	kdf := hkdf.New(sha512.New, m.Marshal(), nil, kdfInfoClientKey)
-	key = make([]byte, pheClientKeyLen)
-	_, err = kdf.Read(key)
+	hc1, err := c.g.hashToPoint(protocol, dhc1, nc, password)
+	if err != nil {
+		return
+	}
+
+	// encryption key in a form of a random point
+	m, key, err := randomKey(c.random, c.g, protocol)
+	if err != nil {
+		return
+	}
 
 	// calculate two enrollment points
-	t0 := c0.Add(hc0.ScalarMultInt(c.clientPrivateKey))
-	t1 := c1.Add(hc1.ScalarMultInt(c.clientPrivateKey)).Add(m.ScalarMultInt(c.clientPrivateKey))
+	t0 := c0.Add(hc0.ScalarMult(c.clientPrivateKey))
+	t1 := c1.Add(hc1.ScalarMult(c.clientPrivateKey)).Add(m.ScalarMult(c.clientPrivateKey))
+	if t0.isInfinity() || t1.isInfinity() {
+		return nil, nil, ErrInvalidResponse
+	}
 
 	rec, err = proto.Marshal(&EnrollmentRecord{
-		Ns: resp.Ns,
-		Nc: nc,
-		T0: t0.Marshal(),
-		T1: t1.Marshal(),
+		Ns:       resp.Ns,
+		Nc:       nc,
+		T0:       t0.Marshal(),
+		T1:       t1.Marshal(),
+		Version:  resp.Version,
+		Suite:    resp.Suite,
+		Protocol: resp.Protocol,
 	})
 
 	return
 }
 
-func (c *Client) validateProofOfSuccess(proof *ProofOfSuccess, nonce []byte, c0 *Point, c1 *Point, c0b, c1b []byte) bool {
+// randomKey generates an encryption key in a form of a random point
+func randomKey(random io.Reader, g *group, protocol Protocol) (m *Point, key []byte, err error) {
+	mBuf := make([]byte, g.swu.HashLen())
+	if err = randRead(random, mBuf); err != nil {
+		return
+	}
 
-	term1, term2, term3, blindX, err := proof.validate()
+	if m, err = g.hashToPoint(protocol, mBuf); err != nil {
+		return
+	}
 
+	key, err = deriveKey(m)
+	return
+}
+
+// deriveKey derives the client's encryption key from a point
+func deriveKey(m *Point) (key []byte, err error) {
+	if m.isInfinity() {
+		return nil, ErrInvalidPoint
+	}
+
+	kdf := hkdf.New(sha512.New, m.Marshal(), nil, kdfInfoClientKey)
+	key = make([]byte, pheClientKeyLen)
+	_, err = kdf.Read(key)
+	return
+}
+
+func (c *Client) validateProofOfSuccess(protocol Protocol, proof *ProofOfSuccess, nonce []byte, c0 *Point, c1 *Point, c0b, c1b []byte) bool {
+	return validateProofOfSuccess(protocol, c.serverPublicKey, c.serverPublicKeyBytes, proof, nonce, c0, c1, c0b, c1b)
+}
+
+// validateProofOfSuccess checks that c0 and c1 were calculated with the private key of the given public key
+func validateProofOfSuccess(protocol Protocol, pub *Point, pubBytes []byte, proof *ProofOfSuccess, nonce []byte, c0 *Point, c1 *Point, c0b, c1b []byte) bool {
+
+	g := pub.group()
+	term1, term2, term3, blindX, err := proof.validate(g)
+
+	if err != nil {
+		return false
+	}
+
+	hs0, err := g.hashToPoint(protocol, dhs0, nonce)
 	if err != nil {
 		return false
 	}
 
-	hs0 := hashToPoint(dhs0, nonce)
-	hs1 := hashToPoint(dhs1, nonce)
+	hs1, err := g.hashToPoint(protocol, dhs1, nonce)
+	if err != nil {
+		return false
+	}
 
-	challenge := hashZ(proofOk, c.serverPublicKeyBytes, curveG, c0b, c1b, proof.Term1, proof.Term2, proof.Term3)
+	challenge := g.hashZ(proofOk, pubBytes, g.generator, c0b, c1b, proof.Term1, proof.Term2, proof.Term3)
 
 	//if term1 * (c0 ** challenge) != hs0 ** blind_x:
-	// return False
+	//return False
 
 	t1 := term1.Add(c0.ScalarMultInt(challenge))
 	t2 := hs0.ScalarMultInt(blindX)
@@ -167,7 +255,7 @@ func (c *Client) validateProofOfSuccess(proof *ProofOfSuccess, nonce []byte, c0
 	}
 
 	// if term2 * (c1 ** challenge) != hs1 ** blind_x:
-	// return False
+	//return False
 
 	t1 = term2.Add(c1.ScalarMultInt(challenge))
 	t2 = hs1.ScalarMultInt(blindX)
@@ -177,10 +265,10 @@ func (c *Client) validateProofOfSuccess(proof *ProofOfSuccess, nonce []byte, c0
 	}
 
 	//if term3 * (self.X ** challenge) != self.G ** blind_x:
-	// return False
+	//return False
 
-	t1 = term3.Add(c.serverPublicKey.ScalarMultInt(challenge))
-	t2 = new(Point).ScalarBaseMultInt(blindX)
+	t1 = term3.Add(pub.ScalarMultInt(challenge))
+	t2 = g.base(blindX)
 
 	if !t1.Equal(t2) {
 		return false
@@ -195,105 +283,220 @@ func (c *Client) CreateVerifyPasswordRequest(password []byte, recBytes []byte) (
 	rec := &EnrollmentRecord{}
 
 	if err = proto.Unmarshal(recBytes, rec); err != nil {
-		return
+		return nil, ErrInvalidRecord
 	}
 
+	return c.createVerifyPasswordRequest(password, rec)
+}
+
+func (c *Client) createVerifyPasswordRequest(password []byte, rec *EnrollmentRecord) (req []byte, err error) {
+
 	if rec == nil || len(rec.Nc) == 0 || len(rec.Ns) == 0 || len(rec.T0) == 0 {
-		return nil, errors.New("invalid client record")
+		return nil, ErrInvalidRecord
 	}
 
-	hc0 := hashToPoint(dhc0, rec.Nc, password)
-	minusY := gf.Neg(c.clientPrivateKey)
+	if rec.Version != c.version {
+		return nil, &VersionMismatchError{Object: "record", Version: rec.Version, Expected: c.version}
+	}
+
+	if err = c.g.checkSuite(rec.Suite); err != nil {
+		return nil, err
+	}
 
-	t0, err := PointUnmarshal(rec.T0)
+	protocol, err := checkProtocol(rec.Protocol)
 	if err != nil {
-		return nil, errors.New("invalid proof")
+		return nil, err
+	}
+
+	hc0, err := c.g.hashToPoint(protocol, dhc0, rec.Nc, password)
+	if err != nil {
+		return nil, err
+	}
+	minusY := c.negKey
+
+	t0, err := c.g.unmarshalPoint(rec.T0)
+	if err != nil {
+		return nil, errors.WithMessage(ErrInvalidRecord, "invalid t0")
+	}
+
+	c0 := t0.Add(hc0.ScalarMult(minusY))
+	if c0.isInfinity() {
+		return nil, errors.WithMessage(ErrInvalidRecord, "invalid t0")
 	}
 
-	c0 := t0.Add(hc0.ScalarMultInt(minusY))
 	return proto.Marshal(&VerifyPasswordRequest{
-		C0: c0.Marshal(),
-		Ns: rec.Ns,
+		C0:       c0.Marshal(),
+		Ns:       rec.Ns,
+		Version:  rec.Version,
+		Suite:    rec.Suite,
+		Protocol: rec.Protocol,
 	})
 }
 
-// CheckResponseAndDecrypt verifies server's answer and extracts data encryption key on success
+// CheckResponseAndDecrypt verifies server's answer and extracts data encryption key on success.
+// If the server has proven that the password is wrong, ErrWrongPassword is returned.
+// ErrInvalidProof means that the response can't be trusted
 func (c *Client) CheckResponseAndDecrypt(password []byte, recBytes []byte, respBytes []byte) (key []byte, err error) {
 
 	rec := &EnrollmentRecord{}
 
 	if err = proto.Unmarshal(recBytes, rec); err != nil {
-		return
+		return nil, ErrInvalidRecord
 	}
 
 	resp := &VerifyPasswordResponse{}
 	if err = proto.Unmarshal(respBytes, resp); err != nil {
-		return
+		return nil, ErrInvalidResponse
+	}
+
+	return c.checkResponseAndDecrypt(password, rec, resp)
+}
+
+func (c *Client) checkResponseAndDecrypt(password []byte, rec *EnrollmentRecord, resp *VerifyPasswordResponse) (key []byte, err error) {
+
+	if rec.Version != c.version {
+		return nil, &VersionMismatchError{Object: "record", Version: rec.Version, Expected: c.version}
+	}
+
+	t0, t1, err := rec.validate(c.g)
+	if err != nil {
+		return nil, err
+	}
+
+	protocol, err := checkProtocol(rec.Protocol)
+	if err != nil {
+		return nil, err
 	}
 
-	t0, t1, err := rec.validate()
+	c1, err := c.g.unmarshalPoint(resp.C1)
 	if err != nil {
-		return nil, errors.Wrap(err, "invalid record")
+		return nil, ErrInvalidResponse
 	}
 
-	c1, err := PointUnmarshal(resp.C1)
+	hc0, err := c.g.hashToPoint(protocol, dhc0, rec.Nc, password)
 	if err != nil {
 		return nil, err
 	}
 
-	hc0 := hashToPoint(dhc0, rec.Nc, password)
-	hc1 := hashToPoint(dhc1, rec.Nc, password)
+	hc1, err := c.g.hashToPoint(protocol, dhc1, rec.Nc, password)
+	if err != nil {
+		return nil, err
+	}
 
 	//c0 = t0 * (hc0 ** (-self.y))
 
 	minusY := c.negKey
 
-	c0 := t0.Add(hc0.ScalarMultInt(minusY))
+	c0 := t0.Add(hc0.ScalarMult(minusY))
+	if c0.isInfinity() {
+		return nil, errors.WithMessage(ErrInvalidRecord, "invalid t0")
+	}
 
 	if resp.Res {
 
 		proof := resp.GetSuccess()
 
 		if proof == nil {
-			return nil, errors.New("result is ok but proof is empty")
+			return nil, errors.WithMessage(ErrInvalidProof, "result is ok but proof is empty")
 		}
 
-		if !c.validateProofOfSuccess(proof, rec.Ns, c0, c1, c0.Marshal(), resp.C1) {
-			return nil, errors.New("result is ok but proof is invalid")
+		if !c.validateProofOfSuccess(protocol, proof, rec.Ns, c0, c1, c0.Marshal(), resp.C1) {
+			return nil, errors.WithMessage(ErrInvalidProof, "result is ok but proof is invalid")
 		}
 
 		//return ((t1 * (c1 ** (-1))) * (hc1 ** (-self.y))) ** (self.y ** (-1))
 
-		m := (t1.Add(c1.Neg()).Add(hc1.ScalarMultInt(minusY))).ScalarMultInt(c.invKey)
+		m := (t1.Add(c1.Neg()).Add(hc1.ScalarMult(minusY))).ScalarMult(c.invKey)
 
-		kdf := hkdf.New(sha512.New, m.Marshal(), nil, kdfInfoClientKey)
-		key = make([]byte, pheClientKeyLen)
-		_, err = kdf.Read(key)
+		return deriveKey(m)
 
-		return
+	}
+
+	hs0, err := c.g.hashToPoint(protocol, dhs0, rec.Ns)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = c.validateProofOfFail(protocol, resp, c0, c1, hs0); err != nil {
+		return nil, err
+	}
+
+	return nil, ErrWrongPassword
+}
 
+// ChangePassword enrolls the account again with a new password once the old one has been verified.
+// verifyResp is the server's answer to the request created by CreateVerifyPasswordRequest for the old password,
+// enrollment is a fresh Enrollment Response. If wrappedKey is not nil, it is a data encryption key wrapped by WrapKey
+// or by WrapDataKey under PasswordWrapper with the old record key and it is rewrapped with the new one, keeping the other wrappers,
+// so the data it protects doesn't have to be encrypted again.
+// Nothing is returned unless every step succeeds, the caller must then replace the record and the wrapped key together
+func (c *Client) ChangePassword(oldPassword, newPassword, recBytes, verifyResp, enrollment, wrappedKey []byte) (newRec, newKey, newWrappedKey []byte, err error) {
+	rec := &EnrollmentRecord{}
+	if err = proto.Unmarshal(recBytes, rec); err != nil {
+		return nil, nil, nil, ErrInvalidRecord
+	}
+
+	resp := &VerifyPasswordResponse{}
+	if err = proto.Unmarshal(verifyResp, resp); err != nil {
+		return nil, nil, nil, ErrInvalidResponse
+	}
+
+	enrollResp := &EnrollmentResponse{}
+	if err = proto.Unmarshal(enrollment, enrollResp); err != nil {
+		return nil, nil, nil, ErrInvalidResponse
+	}
+
+	return changePassword(c, c, oldPassword, newPassword, rec, resp, enrollResp, wrappedKey)
+}
+
+// changePassword verifies the old password with the client of the record's key version
+// and enrolls the new one with the client of the enrollment's key version
+func changePassword(old, cur *Client, oldPassword, newPassword []byte, rec *EnrollmentRecord, resp *VerifyPasswordResponse,
+	enrollment *EnrollmentResponse, wrappedKey []byte) (newRec, newKey, newWrappedKey []byte, err error) {
+
+	oldKey, err := old.checkResponseAndDecrypt(oldPassword, rec, resp)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	var dataKey []byte
+	if wrappedKey != nil {
+		if dataKey, err = unwrapPasswordKey(wrappedKey, oldKey); err != nil {
+			return nil, nil, nil, errors.Wrap(err, "could not unwrap data key")
+		}
 	}
 
-	hs0 := hashToPoint(dhs0, rec.Ns)
-	err = c.validateProofOfFail(resp, c0, c1, hs0)
+	newRec, newKey, err = cur.enrollAccount(newPassword, enrollment)
+	if err != nil {
+		return nil, nil, nil, err
+	}
 
-	return nil, err
+	if dataKey != nil {
+		if newWrappedKey, err = rewrapPasswordKey(cur.random, wrappedKey, dataKey, newKey); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	return newRec, newKey, newWrappedKey, nil
 }
 
-func (c *Client) validateProofOfFail(resp *VerifyPasswordResponse, c0, c1, hs0 *Point) error {
+func (c *Client) validateProofOfFail(protocol Protocol, resp *VerifyPasswordResponse, c0, c1, hs0 *Point) error {
 
 	proof := resp.GetFail()
 
 	if proof == nil {
-		return errors.New("result is ok but proof is invalid")
+		return errors.WithMessage(ErrInvalidProof, "result is not ok but proof is empty")
 	}
 
-	term1, term2, term3, term4, blindA, blindB, err := proof.validate()
+	if protocol >= ProtocolV3 {
+		return c.validateProofOfFailV3(proof, c0, c1, hs0)
+	}
+
+	term1, term2, term3, term4, blindA, blindB, err := proof.validate(c.g)
 	if err != nil {
-		return errors.New("invalid public key")
+		return err
 	}
 
-	challenge := hashZ(proofError, c.serverPublicKeyBytes, curveG, c0.Marshal(), resp.C1, proof.Term1, proof.Term2, proof.Term3, proof.Term4)
+	challenge := c.g.hashZ(proofError, c.serverPublicKeyBytes, c.g.generator, c0.Marshal(), resp.C1, proof.Term1, proof.Term2, proof.Term3, proof.Term4)
 	//if term1 * term2 * (c1 ** challenge) != (c0 ** blind_a) * (hs0 ** blind_b):
 	//return False
 	//
@@ -304,14 +507,39 @@ func (c *Client) validateProofOfFail(resp *VerifyPasswordResponse, c0, c1, hs0 *
 	t2 := c0.ScalarMultInt(blindA).Add(hs0.ScalarMultInt(blindB))
 
 	if !t1.Equal(t2) {
-		return errors.New("proof verification failed")
+		return ErrInvalidProof
 	}
 
+	// I is the point at infinity for an honest server, so I ** challenge is left out
 	t1 = term3.Add(term4)
-	t2 = c.serverPublicKey.ScalarMultInt(blindA).Add(new(Point).ScalarBaseMultInt(blindB))
+	t2 = c.serverPublicKey.ScalarMultInt(blindA).Add(c.g.base(blindB))
 
 	if !t1.Equal(t2) {
-		return errors.New("verification failed")
+		return ErrInvalidProof
+	}
+	return nil
+}
+
+// validateProofOfFailV3 checks the failure proof of ProtocolV3, see Server.proveFailureV3
+func (c *Client) validateProofOfFailV3(proof *ProofOfFail, c0, c1, hs0 *Point) error {
+	term1, term2, blindA, blindB, err := proof.validateV3(c.g)
+	if err != nil {
+		return err
+	}
+
+	challenge := c.g.hashZ(proofErrorV3, c.serverPublicKeyBytes, c.g.generator, hs0.Marshal(), c0.Marshal(), c1.Marshal(), proof.Term1, proof.Term2)
+
+	// c0 * blind_a + hs0 * blind_b == term1 + c1 * challenge
+	t1 := c0.ScalarMultInt(blindA).Add(hs0.ScalarMultInt(blindB))
+	t2 := term1.Add(c1.ScalarMultInt(challenge))
+	if !t1.Equal(t2) {
+		return ErrInvalidProof
+	}
+
+	// X * blind_a + G * blind_b == term2 + I * challenge, where I is the point at infinity
+	t1 = c.serverPublicKey.ScalarMultInt(blindA).Add(c.g.base(blindB))
+	if !t1.Equal(term2) {
+		return ErrInvalidProof
 	}
 	return nil
 }
@@ -319,6 +547,15 @@ func (c *Client) validateProofOfFail(resp *VerifyPasswordResponse, c0, c1, hs0 *
 // Rotate updates client's secret key and server's public key with server's update token
 func (c *Client) Rotate(tokenBytes []byte) error {
 
+	token := &UpdateToken{}
+	if err := proto.Unmarshal(tokenBytes, token); err != nil {
+		return ErrInvalidToken
+	}
+
+	if err := checkTokenVersion(c.version, token.Version); err != nil {
+		return err
+	}
+
 	newPriv, newPub, err := RotateClientKeys(c.serverPublicKeyBytes, c.clientPrivateKeyBytes, tokenBytes)
 	if err != nil {
 		return err
@@ -330,78 +567,243 @@ func (c *Client) Rotate(tokenBytes []byte) error {
 	}
 
 	c.clientPrivateKeyBytes = newPriv
-	c.clientPrivateKey = new(big.Int).SetBytes(newPriv)
+	c.clientPrivateKey = newPriv
 	c.serverPublicKeyBytes = newPub
 	c.serverPublicKey = pub
-	c.negKey = gf.Neg(c.clientPrivateKey)
-	c.invKey = gf.Inv(c.clientPrivateKey)
+	c.negKey = c.g.zNeg(newPriv)
+	c.invKey = c.g.zInv(newPriv)
+	c.version = token.Version
 
 	return nil
 }
 
-// UpdateRecord needs to be applied to every database record to correspond to new private and public keys
-func UpdateRecord(recBytes []byte, tokenBytes []byte) (updRec []byte, err error) {
+// checkTokenVersion makes sure an update token moves keys or records exactly one version forward.
+// Unversioned tokens can only be applied to unversioned keys and records
+func checkTokenVersion(current, token uint32) error {
+	if token == 0 && current == 0 {
+		return nil
+	}
+
+	if token != current+1 {
+		return &VersionMismatchError{Object: "update token", Version: token, Expected: current + 1}
+	}
+	return nil
+}
+
+// UpdateRecord needs to be applied to every database record to correspond to new private and public keys.
+// serverPublic is the server public key the record was enrolled with, the token's proof is verified against it
+// before the record is changed, so a forged token can't corrupt records.
+// Records which already have the token's version are returned unchanged so the update can be safely repeated
+func UpdateRecord(serverPublic, recBytes, tokenBytes []byte) (updRec []byte, err error) {
 
 	rec := &EnrollmentRecord{}
+	if err = proto.Unmarshal(recBytes, rec); err != nil {
+		return nil, ErrInvalidRecord
+	}
 
+	token := &UpdateToken{}
+	if err = proto.Unmarshal(tokenBytes, token); err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	pub, err := PointUnmarshal(serverPublic)
+	if err != nil {
+		return nil, ErrInvalidPublicKey
+	}
+
+	a, b, err := token.validate(pub.group())
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err = verifyUpdateToken(pub, serverPublic, token, a, b); err != nil {
+		return nil, err
+	}
+
+	return marshalUpdatedRecord(recBytes, rec, token, a, b)
+}
+
+// UpdateRecordUnverified applies an update token to a record like UpdateRecord, but doesn't verify the token's proof.
+// It has the signature and the behaviour UpdateRecord had before it started to verify tokens.
+//
+// Deprecated: a forged token silently corrupts every record it is applied to. Use UpdateRecord,
+// or verify the token once with VerifyUpdateToken before applying it to many records
+func UpdateRecordUnverified(recBytes []byte, tokenBytes []byte) (updRec []byte, err error) {
+
+	rec := &EnrollmentRecord{}
 	if err = proto.Unmarshal(recBytes, rec); err != nil {
-		return
+		return nil, ErrInvalidRecord
 	}
 
 	token := &UpdateToken{}
 	if err = proto.Unmarshal(tokenBytes, token); err != nil {
-		return
+		return nil, ErrInvalidToken
+	}
+
+	g, err := getGroup(Suite(rec.Suite))
+	if err != nil {
+		return nil, err
+	}
+
+	a, b, err := token.validate(g)
+	if err != nil {
+		return nil, err
+	}
+
+	return marshalUpdatedRecord(recBytes, rec, token, a, b)
+}
+
+func marshalUpdatedRecord(recBytes []byte, rec *EnrollmentRecord, token *UpdateToken, a, b *big.Int) ([]byte, error) {
+	upd, err := updateRecord(rec, token, a, b)
+	if err != nil {
+		return nil, err
+	}
+
+	if upd == nil {
+		return recBytes, nil
+	}
+
+	return proto.Marshal(upd)
+}
+
+// updateRecord returns nil if the record already has the token's version
+func updateRecord(rec *EnrollmentRecord, token *UpdateToken, a, b *big.Int) (*EnrollmentRecord, error) {
+
+	if token.Version != 0 && rec.Version == token.Version {
+		return nil, nil
 	}
-	a, b, err := token.validate()
+
+	if err := checkTokenVersion(rec.Version, token.Version); err != nil {
+		return nil, err
+	}
+
+	g, err := getGroup(Suite(token.Suite))
 	if err != nil {
 		return nil, err
 	}
 
-	t0, t1, err := rec.validate()
+	t0, t1, err := rec.validate(g)
 	if err != nil {
 		return nil, err
 	}
 
-	hs0 := hashToPoint(dhs0, rec.Ns)
-	hs1 := hashToPoint(dhs1, rec.Ns)
+	if rec.Protocol != token.Protocol {
+		return nil, ErrProtocolMismatch
+	}
+
+	protocol, err := checkProtocol(rec.Protocol)
+	if err != nil {
+		return nil, err
+	}
+
+	hs0, err := g.hashToPoint(protocol, dhs0, rec.Ns)
+	if err != nil {
+		return nil, err
+	}
+
+	hs1, err := g.hashToPoint(protocol, dhs1, rec.Ns)
+	if err != nil {
+		return nil, err
+	}
 
 	t00 := t0.ScalarMultInt(a).Add(hs0.ScalarMultInt(b))
 	t11 := t1.ScalarMultInt(a).Add(hs1.ScalarMultInt(b))
-
-	return proto.Marshal(&EnrollmentRecord{
-		T0: t00.Marshal(),
-		T1: t11.Marshal(),
-		Ns: rec.Ns,
-		Nc: rec.Nc,
-	})
+	if t00.isInfinity() || t11.isInfinity() {
+		return nil, errors.WithMessage(ErrInvalidToken, "updated record has the point at infinity")
+	}
+
+	return &EnrollmentRecord{
+		T0:       t00.Marshal(),
+		T1:       t11.Marshal(),
+		Ns:       rec.Ns,
+		Nc:       rec.Nc,
+		Version:  token.Version,
+		Suite:    rec.Suite,
+		Protocol: rec.Protocol,
+	}, nil
 }
 
 // RotateClientKeys returns a new pair of keys given old keys and an update token
+// The token's proof is verified against the old server public key before the keys are changed
 func RotateClientKeys(serverPublic, clientPrivate, tokenBytes []byte) (newClientPrivate, newServerPublic []byte, err error) {
 
 	token := &UpdateToken{}
 	if err = proto.Unmarshal(tokenBytes, token); err != nil {
+		return nil, nil, ErrInvalidToken
+	}
+
+	pub, err := PointUnmarshal(serverPublic)
+
+	if err != nil {
+		return nil, nil, ErrInvalidPublicKey
+	}
+
+	a, b, err := token.validate(pub.group())
+	if err != nil {
 		return
 	}
 
-	a, b, err := token.validate()
+	if clientPrivate, err = pub.group().privateScalar(clientPrivate); err != nil {
+		return
+	}
+
+	pub, err = verifyUpdateToken(pub, serverPublic, token, a, b)
 	if err != nil {
 		return
 	}
 
+	g := pub.group()
+	newClientPrivate = g.zMulAdd(clientPrivate, g.padZ(a.Bytes()), nil)
+	newServerPublic = pub.Marshal()
+	return
+}
+
+// VerifyUpdateToken checks that the update token was issued by the owner of the server public key
+func VerifyUpdateToken(serverPublic, tokenBytes []byte) error {
+	token := &UpdateToken{}
+	if err := proto.Unmarshal(tokenBytes, token); err != nil {
+		return ErrInvalidToken
+	}
+
 	pub, err := PointUnmarshal(serverPublic)
+	if err != nil {
+		return ErrInvalidPublicKey
+	}
 
+	a, b, err := token.validate(pub.group())
 	if err != nil {
-		return
+		return err
 	}
 
-	if len(clientPrivate) == 0 {
-		err = errors.New("invalid private key")
+	_, err = verifyUpdateToken(pub, serverPublic, token, a, b)
+	return err
+}
+
+// verifyUpdateToken derives new server public key and validates token's proof for it
+func verifyUpdateToken(pub *Point, pubBytes []byte, token *UpdateToken, a, b *big.Int) (newPub *Point, err error) {
+
+	g := pub.group()
+	term, blindX, err := token.Proof.validate(g)
+	if err != nil {
 		return
 	}
 
-	newClientPrivate = padZ(gf.MulBytes(clientPrivate, a).Bytes())
-	pub = pub.ScalarMultInt(a).Add(new(Point).ScalarBaseMultInt(b))
-	newServerPublic = pub.Marshal()
-	return
+	newPub = pub.ScalarMultInt(a).Add(g.base(b))
+	if newPub.isInfinity() {
+		return nil, ErrInvalidToken
+	}
+
+	challenge := g.hashZ(proofRotation, pubBytes, newPub.Marshal(), g.generator, token.A, token.B, token.Proof.Term)
+
+	//if term * (newX ** challenge) != self.G ** blind_x:
+	//return False
+
+	t1 := term.Add(newPub.ScalarMultInt(challenge))
+	t2 := g.base(blindX)
+
+	if !t1.Equal(t2) {
+		return nil, errors.WithMessage(ErrInvalidToken, "proof of rotation doesn't verify")
+	}
+
+	return newPub, nil
 }
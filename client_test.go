@@ -0,0 +1,291 @@
+/*
+ * Copyright (C) 2015-2019 Virgil Security Inc.
+ *
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ *     (1) Redistributions of source code must retain the above copyright
+ *     notice, this list of conditions and the following disclaimer.
+ *
+ *     (2) Redistributions in binary form must reproduce the above copyright
+ *     notice, this list of conditions and the following disclaimer in
+ *     the documentation and/or other materials provided with the
+ *     distribution.
+ *
+ *     (3) Neither the name of the copyright holder nor the names of its
+ *     contributors may be used to endorse or promote products derived from
+ *     this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ''AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+ * IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ *
+ * Lead Maintainer: Virgil Security Inc. <support@virgilsecurity.com>
+ */
+package phe
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+// generateClientKey is GenerateClientKey which fails the test on error
+func generateClientKey(t testing.TB, opts ...Option) []byte {
+	key, err := GenerateClientKey(opts...)
+	require.NoError(t, err)
+	return key
+}
+
+func TestGenerateClientKey(t *testing.T) {
+	kp, err := GenerateServerKeypair(WithSuite(SuiteP384))
+	require.NoError(t, err)
+	pub, err := GetPublicKey(kp)
+	require.NoError(t, err)
+	key, err := GenerateClientKey(WithSuite(SuiteP384))
+	require.NoError(t, err)
+	_, err = NewClient(pub, key)
+	require.NoError(t, err)
+
+	_, err = GenerateClientKey(WithSuite(Suite(42)))
+	require.Equal(t, ErrUnsupportedSuite, errors.Cause(err))
+
+	_, err = GenerateClientKey(WithRandom(bytes.NewReader(nil)))
+	require.Error(t, err)
+}
+
+// The fuzz targets below feed attacker-controllable bytes to the client. Besides not panicking,
+// every output the client accepts must be usable, and no response or token which fails
+// proof verification may ever yield a key
+
+func newVectorsClient(t testing.TB) *Client {
+	c, err := NewClient(serverPublic, clientPrivate)
+	require.NoError(t, err)
+	return c
+}
+
+func FuzzClient_EnrollAccount(f *testing.F) {
+	f.Add(enrollmentResponse, password)
+	f.Add(enrollmentResponse, badPassword)
+	f.Add(verifyPasswordResp, password)
+	f.Add([]byte{}, []byte{})
+
+	c := newVectorsClient(f)
+	s, err := NewServer(getServerKeypair())
+	require.NoError(f, err)
+
+	f.Fuzz(func(t *testing.T, respBytes, pwd []byte) {
+		rec, key, err := c.EnrollAccount(pwd, respBytes)
+		if err != nil {
+			require.Nil(t, rec)
+			require.Nil(t, key)
+			return
+		}
+
+		// an accepted enrollment was proven to come from the server, so the password verifies
+		req, err := c.CreateVerifyPasswordRequest(pwd, rec)
+		require.NoError(t, err)
+		resp, res, err := s.VerifyPasswordExtended(req)
+		require.NoError(t, err)
+		require.True(t, res.Res)
+		keyDec, err := c.CheckResponseAndDecrypt(pwd, rec, resp)
+		require.NoError(t, err)
+		require.Equal(t, key, keyDec)
+	})
+}
+
+func FuzzClient_CreateVerifyPasswordRequest(f *testing.F) {
+	f.Add(enrollmentRecord, password)
+	f.Add(updatedRecord, password)
+	f.Add(enrollmentRecord, badPassword)
+	f.Add(verifyPasswordReq, password)
+	f.Add([]byte{}, []byte{})
+
+	c := newVectorsClient(f)
+
+	f.Fuzz(func(t *testing.T, recBytes, pwd []byte) {
+		reqBytes, err := c.CreateVerifyPasswordRequest(pwd, recBytes)
+		if err != nil {
+			require.Nil(t, reqBytes)
+			return
+		}
+
+		rec := &EnrollmentRecord{}
+		require.NoError(t, proto.Unmarshal(recBytes, rec))
+		req := &VerifyPasswordRequest{}
+		require.NoError(t, proto.Unmarshal(reqBytes, req))
+		require.Equal(t, rec.Ns, req.Ns)
+		_, err = PointUnmarshal(req.C0)
+		require.NoError(t, err)
+	})
+}
+
+func FuzzClient_CheckResponseAndDecrypt(f *testing.F) {
+	f.Add(verifyPasswordResp, password)
+	f.Add(verifyBadPasswordResp, password)
+	f.Add(verifyPasswordResp, badPassword)
+	f.Add(enrollmentResponse, password)
+	f.Add([]byte{}, []byte{})
+
+	c := newVectorsClient(f)
+
+	f.Fuzz(func(t *testing.T, respBytes, pwd []byte) {
+		key, err := c.CheckResponseAndDecrypt(pwd, enrollmentRecord, respBytes)
+		if err != nil {
+			require.Nil(t, key)
+			return
+		}
+
+		// only the enrolled password can be proven right, and only with the record's key
+		require.Equal(t, password, pwd)
+		require.Equal(t, recordKey, key)
+	})
+}
+
+func FuzzUpdateRecord(f *testing.F) {
+	f.Add(enrollmentRecord, token)
+	f.Add(updatedRecord, token)
+	f.Add(enrollmentRecord, enrollmentRecord)
+	f.Add([]byte{}, []byte{})
+
+	f.Fuzz(func(t *testing.T, recBytes, tokenBytes []byte) {
+		updBytes, err := UpdateRecord(serverPublic, recBytes, tokenBytes)
+		if err != nil {
+			require.Nil(t, updBytes)
+			return
+		}
+
+		// records are only changed by a token whose proof verifies
+		require.NoError(t, VerifyUpdateToken(serverPublic, tokenBytes))
+
+		rec, upd := &EnrollmentRecord{}, &EnrollmentRecord{}
+		require.NoError(t, proto.Unmarshal(recBytes, rec))
+		require.NoError(t, proto.Unmarshal(updBytes, upd))
+		require.Equal(t, rec.Ns, upd.Ns)
+		require.Equal(t, rec.Nc, upd.Nc)
+		g, err := getGroup(Suite(upd.Suite))
+		require.NoError(t, err)
+		_, _, err = upd.validate(g)
+		require.NoError(t, err)
+	})
+}
+
+func FuzzRotateClientKeys(f *testing.F) {
+	f.Add(token)
+	f.Add(enrollmentRecord)
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, tokenBytes []byte) {
+		newPrivate, newPublic, err := RotateClientKeys(serverPublic, clientPrivate, tokenBytes)
+		if err != nil {
+			require.Nil(t, newPrivate)
+			require.Nil(t, newPublic)
+			return
+		}
+
+		// keys are only rotated by a token whose proof verifies
+		require.NoError(t, VerifyUpdateToken(serverPublic, tokenBytes))
+		_, err = NewClient(newPublic, newPrivate)
+		require.NoError(t, err)
+	})
+}
+
+func TestClient_ChangePassword(t *testing.T) {
+	s, err := NewServer(getServerKeypair())
+	require.NoError(t, err)
+	c := newVectorsClient(t)
+	newPassword := []byte("new password")
+
+	enrollment, err := s.GetEnrollment()
+	require.NoError(t, err)
+	rec, recordKey, err := c.EnrollAccount(pwd, enrollment)
+	require.NoError(t, err)
+
+	dataKey, err := GenerateDataKey()
+	require.NoError(t, err)
+	wrappedKey, err := WrapKey(dataKey, recordKey)
+	require.NoError(t, err)
+
+	verify := func(password, rec []byte) []byte {
+		req, err := c.CreateVerifyPasswordRequest(password, rec)
+		require.NoError(t, err)
+		resp, err := s.VerifyPassword(req)
+		require.NoError(t, err)
+		return resp
+	}
+
+	// the old password must be proven right
+	enrollment, err = s.GetEnrollment()
+	require.NoError(t, err)
+	newRec, newKey, newWrappedKey, err := c.ChangePassword(newPassword, newPassword, rec, verify(newPassword, rec), enrollment, wrappedKey)
+	require.Equal(t, ErrWrongPassword, err)
+	require.Nil(t, newRec)
+	require.Nil(t, newKey)
+	require.Nil(t, newWrappedKey)
+
+	newRec, newKey, newWrappedKey, err = c.ChangePassword(pwd, newPassword, rec, verify(pwd, rec), enrollment, wrappedKey)
+	require.NoError(t, err)
+	require.NotEqual(t, recordKey, newKey)
+
+	keyDec, err := c.CheckResponseAndDecrypt(newPassword, newRec, verify(newPassword, newRec))
+	require.NoError(t, err)
+	require.Equal(t, newKey, keyDec)
+	_, err = c.CheckResponseAndDecrypt(pwd, newRec, verify(pwd, newRec))
+	require.Equal(t, ErrWrongPassword, err)
+
+	// the data key survives the password change
+	unwrapped, err := UnwrapKey(newWrappedKey, newKey)
+	require.NoError(t, err)
+	require.Equal(t, dataKey, unwrapped)
+
+	// without a wrapped key only the record is replaced
+	enrollment, err = s.GetEnrollment()
+	require.NoError(t, err)
+	rec, recordKey, newWrappedKey, err = c.ChangePassword(newPassword, pwd, newRec, verify(newPassword, newRec), enrollment, nil)
+	require.NoError(t, err)
+	require.Nil(t, newWrappedKey)
+	keyDec, err = c.CheckResponseAndDecrypt(pwd, rec, verify(pwd, rec))
+	require.NoError(t, err)
+	require.Equal(t, recordKey, keyDec)
+
+	// a key wrapped with another record key is rejected before anything is enrolled
+	_, _, _, err = c.ChangePassword(pwd, newPassword, rec, verify(pwd, rec), enrollment, wrappedKey)
+	require.Error(t, err)
+
+	_, _, _, err = c.ChangePassword(pwd, newPassword, rec, verify(pwd, rec), []byte{0x01}, nil)
+	require.Equal(t, ErrInvalidResponse, err)
+
+	// only the password wrapper of a bundle is rewrapped
+	recoveryKey, err := GenerateDataKey()
+	require.NoError(t, err)
+	bundle, err := WrapDataKey(dataKey, map[string][]byte{PasswordWrapper: recordKey, "recovery": recoveryKey})
+	require.NoError(t, err)
+
+	enrollment, err = s.GetEnrollment()
+	require.NoError(t, err)
+	_, newKey, newBundle, err := c.ChangePassword(pwd, newPassword, rec, verify(pwd, rec), enrollment, bundle)
+	require.NoError(t, err)
+
+	unwrapped, err = UnwrapDataKey(newBundle, PasswordWrapper, newKey)
+	require.NoError(t, err)
+	require.Equal(t, dataKey, unwrapped)
+	_, err = UnwrapDataKey(newBundle, PasswordWrapper, recordKey)
+	require.Error(t, err)
+	unwrapped, err = UnwrapDataKey(newBundle, "recovery", recoveryKey)
+	require.NoError(t, err)
+	require.Equal(t, dataKey, unwrapped)
+}
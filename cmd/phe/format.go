@@ -0,0 +1,230 @@
+/*
+ * Copyright (C) 2015-2019 Virgil Security Inc.
+ *
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ *     (1) Redistributions of source code must retain the above copyright
+ *     notice, this list of conditions and the following disclaimer.
+ *
+ *     (2) Redistributions in binary form must reproduce the above copyright
+ *     notice, this list of conditions and the following disclaimer in
+ *     the documentation and/or other materials provided with the
+ *     distribution.
+ *
+ *     (3) Neither the name of the copyright holder nor the names of its
+ *     contributors may be used to endorse or promote products derived from
+ *     this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ''AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+ * IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ *
+ * Lead Maintainer: Virgil Security Inc. <support@virgilsecurity.com>
+ */
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// maxRecordLen limits the length of a single value in a raw record stream
+const maxRecordLen = 64 * 1024
+
+// format is the encoding of keys, tokens and records on input & output
+type format int
+
+const (
+	formatBase64 format = iota
+	formatHex
+	formatRaw
+)
+
+func parseFormat(s string) (format, error) {
+	switch s {
+	case "base64":
+		return formatBase64, nil
+	case "hex":
+		return formatHex, nil
+	case "raw":
+		return formatRaw, nil
+	}
+	return 0, errors.Errorf("unknown format %q, must be one of hex, base64, raw", s)
+}
+
+// encode encodes a single value, text formats end with a new line
+func (f format) encode(b []byte) []byte {
+	switch f {
+	case formatHex:
+		return []byte(hex.EncodeToString(b) + "\n")
+	case formatBase64:
+		return []byte(base64.StdEncoding.EncodeToString(b) + "\n")
+	}
+	return b
+}
+
+// decode decodes a single value, surrounding whitespace is ignored for text formats
+func (f format) decode(b []byte) ([]byte, error) {
+	switch f {
+	case formatHex:
+		res, err := hex.DecodeString(string(bytes.TrimSpace(b)))
+		return res, errors.Wrap(err, "invalid hex")
+	case formatBase64:
+		res, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(b)))
+		return res, errors.Wrap(err, "invalid base64")
+	}
+	return b, nil
+}
+
+// readValue reads a value from a file, "-" is the standard input
+func readValue(path string, f format, stdin io.Reader) ([]byte, error) {
+	if path == "" {
+		return nil, errors.New("missing input file")
+	}
+
+	var (
+		b   []byte
+		err error
+	)
+	if path == "-" {
+		b, err = ioutil.ReadAll(stdin)
+	} else {
+		b, err = ioutil.ReadFile(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := f.decode(b)
+	return res, errors.Wrap(err, path)
+}
+
+// writeValue writes a value to a file readable only by its owner, "-" is the standard output
+func writeValue(path string, f format, b []byte, stdout io.Writer) error {
+	if path == "-" {
+		_, err := stdout.Write(f.encode(b))
+		return err
+	}
+	return ioutil.WriteFile(path, f.encode(b), 0600)
+}
+
+// recordReader reads a stream of records: one per line for text formats and
+// prefixed with their varint encoded length for the raw format
+type recordReader struct {
+	f format
+	r *bufio.Reader
+}
+
+func newRecordReader(r io.Reader, f format) *recordReader {
+	return &recordReader{
+		f: f,
+		r: bufio.NewReader(r),
+	}
+}
+
+// next returns the next record or io.EOF at the end of the stream
+func (rr *recordReader) next() ([]byte, error) {
+	if rr.f == formatRaw {
+		n, err := binary.ReadUvarint(rr.r)
+		if err != nil {
+			if err == io.EOF {
+				return nil, io.EOF
+			}
+			return nil, errors.Wrap(err, "invalid record length")
+		}
+
+		if n > maxRecordLen {
+			return nil, errors.New("record is too long")
+		}
+
+		rec := make([]byte, n)
+		if _, err = io.ReadFull(rr.r, rec); err != nil {
+			return nil, errors.Wrap(err, "truncated record")
+		}
+		return rec, nil
+	}
+
+	for {
+		line, err := rr.r.ReadBytes('\n')
+		if len(bytes.TrimSpace(line)) > 0 {
+			return rr.f.decode(line)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+type recordWriter struct {
+	f format
+	w *bufio.Writer
+}
+
+func newRecordWriter(w io.Writer, f format) *recordWriter {
+	return &recordWriter{
+		f: f,
+		w: bufio.NewWriter(w),
+	}
+}
+
+func (rw *recordWriter) write(rec []byte) error {
+	if rw.f == formatRaw {
+		var buf [binary.MaxVarintLen64]byte
+		n := binary.PutUvarint(buf[:], uint64(len(rec)))
+		if _, err := rw.w.Write(buf[:n]); err != nil {
+			return err
+		}
+	}
+
+	_, err := rw.w.Write(rw.f.encode(rec))
+	return err
+}
+
+func (rw *recordWriter) flush() error {
+	return rw.w.Flush()
+}
+
+// openInput opens a file for reading, "-" is the standard input
+func openInput(path string, stdin io.Reader) (io.ReadCloser, error) {
+	if path == "-" {
+		return ioutil.NopCloser(stdin), nil
+	}
+	return os.Open(path)
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// createOutput creates a file for writing, "-" is the standard output
+func createOutput(path string, stdout io.Writer) (io.WriteCloser, error) {
+	if path == "-" {
+		return nopWriteCloser{stdout}, nil
+	}
+	return os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+}
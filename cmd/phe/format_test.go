@@ -0,0 +1,101 @@
+/*
+ * Copyright (C) 2015-2019 Virgil Security Inc.
+ *
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ *     (1) Redistributions of source code must retain the above copyright
+ *     notice, this list of conditions and the following disclaimer.
+ *
+ *     (2) Redistributions in binary form must reproduce the above copyright
+ *     notice, this list of conditions and the following disclaimer in
+ *     the documentation and/or other materials provided with the
+ *     distribution.
+ *
+ *     (3) Neither the name of the copyright holder nor the names of its
+ *     contributors may be used to endorse or promote products derived from
+ *     this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ''AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+ * IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ *
+ * Lead Maintainer: Virgil Security Inc. <support@virgilsecurity.com>
+ */
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFormat_Roundtrip(t *testing.T) {
+	value := []byte{0x00, 0x01, 0xfe, 0xff, '\n'}
+
+	for _, name := range []string{"hex", "base64", "raw"} {
+		f, err := parseFormat(name)
+		require.NoError(t, err)
+
+		decoded, err := f.decode(f.encode(value))
+		require.NoError(t, err)
+		require.Equal(t, value, decoded, name)
+	}
+
+	_, err := parseFormat("json")
+	require.Error(t, err)
+
+	_, err = formatHex.decode([]byte("xyz"))
+	require.Error(t, err)
+}
+
+func TestRecordStream(t *testing.T) {
+	records := [][]byte{{0x01}, {}, bytes.Repeat([]byte{0x02}, 300)}
+
+	for _, f := range []format{formatHex, formatBase64, formatRaw} {
+		var buf bytes.Buffer
+		w := newRecordWriter(&buf, f)
+		for _, rec := range records {
+			require.NoError(t, w.write(rec))
+		}
+		require.NoError(t, w.flush())
+
+		r := newRecordReader(&buf, f)
+		for _, rec := range records {
+			if f != formatRaw && len(rec) == 0 {
+				// empty lines are skipped in text streams
+				continue
+			}
+			got, err := r.next()
+			require.NoError(t, err)
+			require.Equal(t, rec, got)
+		}
+		_, err := r.next()
+		require.Equal(t, io.EOF, err)
+	}
+}
+
+func TestRecordStream_Truncated(t *testing.T) {
+	r := newRecordReader(bytes.NewReader([]byte{0x05, 0x01}), formatRaw)
+	_, err := r.next()
+	require.Error(t, err)
+	require.NotEqual(t, io.EOF, err)
+
+	r = newRecordReader(bytes.NewReader([]byte{0xff, 0xff, 0xff, 0x7f}), formatRaw)
+	_, err = r.next()
+	require.Error(t, err)
+}
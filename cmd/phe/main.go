@@ -0,0 +1,511 @@
+/*
+ * Copyright (C) 2015-2019 Virgil Security Inc.
+ *
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ *     (1) Redistributions of source code must retain the above copyright
+ *     notice, this list of conditions and the following disclaimer.
+ *
+ *     (2) Redistributions in binary form must reproduce the above copyright
+ *     notice, this list of conditions and the following disclaimer in
+ *     the documentation and/or other materials provided with the
+ *     distribution.
+ *
+ *     (3) Neither the name of the copyright holder nor the names of its
+ *     contributors may be used to endorse or promote products derived from
+ *     this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ''AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+ * IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ *
+ * Lead Maintainer: Virgil Security Inc. <support@virgilsecurity.com>
+ */
+
+// Command phe manages PHE keys and records:
+//
+//	phe keygen-server   generates a server keypair
+//	phe keygen-client   generates a client private key
+//	phe pubkey          extracts the public key from a server keypair
+//	phe rotate          rotates a server keypair and issues an update token
+//	phe rotate-client   applies an update token to the client's keys
+//	phe update-records  applies an update token to a stream of records
+//	phe enroll          enrolls a password locally, for testing
+//	phe verify          verifies a password locally, for testing
+//
+// Keys, tokens and records can be encoded as hex, base64 or raw protobuf, see phe <command> -h
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+
+	"github.com/VirgilSecurity/virgil-phe-go"
+	"github.com/pkg/errors"
+)
+
+type env struct {
+	stdin  io.Reader
+	stdout io.Writer
+	stderr io.Writer
+}
+
+type command struct {
+	usage string
+	run   func(e *env, args []string) error
+}
+
+var commands = map[string]command{
+	"keygen-server":  {"generates a server keypair", keygenServer},
+	"keygen-client":  {"generates a client private key", keygenClient},
+	"pubkey":         {"extracts the public key from a server keypair", pubkey},
+	"rotate":         {"rotates a server keypair and issues an update token", rotate},
+	"rotate-client":  {"applies an update token to the client's keys", rotateClient},
+	"update-records": {"applies an update token to a stream of records", updateRecords},
+	"enroll":         {"enrolls a password locally, for testing", enroll},
+	"verify":         {"verifies a password locally, for testing", verify},
+}
+
+func main() {
+	if err := run(os.Args[1:], &env{os.Stdin, os.Stdout, os.Stderr}); err != nil {
+		if err != flag.ErrHelp {
+			fmt.Fprintln(os.Stderr, "phe:", err)
+		}
+		os.Exit(1)
+	}
+}
+
+func run(args []string, e *env) error {
+	if len(args) == 0 {
+		usage(e.stderr)
+		return flag.ErrHelp
+	}
+
+	cmd, ok := commands[args[0]]
+	if !ok {
+		usage(e.stderr)
+		return errors.Errorf("unknown command %q", args[0])
+	}
+
+	return cmd.run(e, args[1:])
+}
+
+func usage(w io.Writer) {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintln(w, "usage: phe <command> [flags]")
+	fmt.Fprintln(w, "commands:")
+	for _, name := range names {
+		fmt.Fprintf(w, "  %-16s %s\n", name, commands[name].usage)
+	}
+}
+
+// cmdFlags are the flags of a command, every command accepts -in-format and -out-format
+type cmdFlags struct {
+	*flag.FlagSet
+	inFormat  string
+	outFormat string
+	in        format
+	out       format
+}
+
+func newFlags(e *env, name string) *cmdFlags {
+	f := &cmdFlags{
+		FlagSet: flag.NewFlagSet("phe "+name, flag.ContinueOnError),
+	}
+	f.SetOutput(e.stderr)
+	f.StringVar(&f.inFormat, "in-format", "base64", "encoding of inputs: hex, base64 or raw")
+	f.StringVar(&f.outFormat, "out-format", "base64", "encoding of outputs: hex, base64 or raw")
+	return f
+}
+
+func (f *cmdFlags) parse(args []string) (err error) {
+	if err = f.Parse(args); err != nil {
+		return
+	}
+
+	if f.NArg() > 0 {
+		return errors.Errorf("unexpected argument %q", f.Arg(0))
+	}
+
+	if f.in, err = parseFormat(f.inFormat); err != nil {
+		return
+	}
+	f.out, err = parseFormat(f.outFormat)
+	return
+}
+
+func keygenServer(e *env, args []string) error {
+	f := newFlags(e, "keygen-server")
+	out := f.String("out", "-", "server keypair output file")
+	curve := f.String("curve", "p256", "elliptic curve: p256 or p384")
+	protocol := f.Int("protocol", 3, "protocol version: 3 for RFC 9380 hash_to_curve with the strengthened failure proof, 2 for RFC 9380 with the original failure proof, 1 for the legacy hash to curve mapping of existing deployments")
+	if err := f.parse(args); err != nil {
+		return err
+	}
+
+	suite, err := parseSuite(*curve)
+	if err != nil {
+		return err
+	}
+
+	if *protocol < 1 || *protocol > 3 {
+		return fmt.Errorf("unknown protocol version %d", *protocol)
+	}
+
+	kp, err := phe.GenerateServerKeypair(phe.WithSuite(suite), phe.WithProtocol(phe.Protocol(*protocol-1)))
+	if err != nil {
+		return err
+	}
+
+	return writeValue(*out, f.out, kp, e.stdout)
+}
+
+func keygenClient(e *env, args []string) error {
+	f := newFlags(e, "keygen-client")
+	out := f.String("out", "-", "client private key output file")
+	curve := f.String("curve", "p256", "elliptic curve: p256 or p384, must match the server keypair")
+	if err := f.parse(args); err != nil {
+		return err
+	}
+
+	suite, err := parseSuite(*curve)
+	if err != nil {
+		return err
+	}
+
+	key, err := phe.GenerateClientKey(phe.WithSuite(suite))
+	if err != nil {
+		return err
+	}
+
+	return writeValue(*out, f.out, key, e.stdout)
+}
+
+func parseSuite(name string) (phe.Suite, error) {
+	switch name {
+	case "p256":
+		return phe.SuiteP256, nil
+	case "p384":
+		return phe.SuiteP384, nil
+	}
+	return 0, fmt.Errorf("unknown curve %q", name)
+}
+
+func pubkey(e *env, args []string) error {
+	f := newFlags(e, "pubkey")
+	keypair := f.String("keypair", "-", "server keypair file")
+	out := f.String("out", "-", "server public key output file")
+	if err := f.parse(args); err != nil {
+		return err
+	}
+
+	kp, err := readValue(*keypair, f.in, e.stdin)
+	if err != nil {
+		return err
+	}
+
+	pub, err := phe.GetPublicKey(kp)
+	if err != nil {
+		return err
+	}
+
+	return writeValue(*out, f.out, pub, e.stdout)
+}
+
+func rotate(e *env, args []string) error {
+	f := newFlags(e, "rotate")
+	keypair := f.String("keypair", "", "server keypair file")
+	keypairOut := f.String("keypair-out", "", "new server keypair output file")
+	tokenOut := f.String("token-out", "-", "update token output file")
+	if err := f.parse(args); err != nil {
+		return err
+	}
+
+	if *keypairOut == "" {
+		return errors.New("-keypair-out is required")
+	}
+
+	kp, err := readValue(*keypair, f.in, e.stdin)
+	if err != nil {
+		return err
+	}
+
+	token, newKp, err := phe.Rotate(kp)
+	if err != nil {
+		return err
+	}
+
+	// the new keypair goes first, a token without its keypair would be useless
+	if err = writeValue(*keypairOut, f.out, newKp, e.stdout); err != nil {
+		return err
+	}
+	return writeValue(*tokenOut, f.out, token, e.stdout)
+}
+
+func rotateClient(e *env, args []string) error {
+	f := newFlags(e, "rotate-client")
+	serverPublic := f.String("server-public", "", "server public key file")
+	clientPrivate := f.String("client-private", "", "client private key file")
+	token := f.String("token", "", "update token file")
+	serverPublicOut := f.String("server-public-out", "", "new server public key output file")
+	clientPrivateOut := f.String("client-private-out", "", "new client private key output file")
+	if err := f.parse(args); err != nil {
+		return err
+	}
+
+	if *serverPublicOut == "" || *clientPrivateOut == "" {
+		return errors.New("-server-public-out and -client-private-out are required")
+	}
+
+	pub, err := readValue(*serverPublic, f.in, e.stdin)
+	if err != nil {
+		return err
+	}
+
+	priv, err := readValue(*clientPrivate, f.in, e.stdin)
+	if err != nil {
+		return err
+	}
+
+	tokenBytes, err := readValue(*token, f.in, e.stdin)
+	if err != nil {
+		return err
+	}
+
+	newPriv, newPub, err := phe.RotateClientKeys(pub, priv, tokenBytes)
+	if err != nil {
+		return err
+	}
+
+	if err = writeValue(*clientPrivateOut, f.out, newPriv, e.stdout); err != nil {
+		return err
+	}
+	return writeValue(*serverPublicOut, f.out, newPub, e.stdout)
+}
+
+func updateRecords(e *env, args []string) error {
+	f := newFlags(e, "update-records")
+	serverPublic := f.String("server-public", "", "server public key file the token was issued for")
+	token := f.String("token", "", "update token file")
+	in := f.String("in", "-", "records input file, one record per line or varint length-delimited for the raw format")
+	out := f.String("out", "-", "updated records output file")
+	if err := f.parse(args); err != nil {
+		return err
+	}
+
+	if *serverPublic == "" {
+		return errors.New("-server-public is required")
+	}
+
+	pub, err := readValue(*serverPublic, f.in, e.stdin)
+	if err != nil {
+		return err
+	}
+
+	tokenBytes, err := readValue(*token, f.in, e.stdin)
+	if err != nil {
+		return err
+	}
+
+	// a forged token would corrupt every record, so it's checked before anything is written
+	if err = phe.VerifyUpdateToken(pub, tokenBytes); err != nil {
+		return err
+	}
+
+	r, err := openInput(*in, e.stdin)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	w, err := createOutput(*out, e.stdout)
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+
+	rr, rw := newRecordReader(r, f.in), newRecordWriter(w, f.out)
+
+	n := 0
+	for {
+		rec, err := rr.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return errors.Wrapf(err, "record %d", n+1)
+		}
+
+		// the token is verified once above instead of for every record
+		updated, err := phe.UpdateRecordUnverified(rec, tokenBytes)
+		if err != nil {
+			return errors.Wrapf(err, "record %d", n+1)
+		}
+
+		if err = rw.write(updated); err != nil {
+			return err
+		}
+		n++
+	}
+
+	if err = rw.flush(); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(e.stderr, "updated %d records\n", n)
+	return w.Close()
+}
+
+// passwordFlags adds the flags used to pass a password to a command
+func passwordFlags(f *cmdFlags) func(e *env) ([]byte, error) {
+	password := f.String("password", "", "password, visible to other users of the system, prefer -password-file")
+	passwordFile := f.String("password-file", "", "file containing the password, a trailing new line is ignored")
+
+	return func(e *env) ([]byte, error) {
+		switch {
+		case *password != "" && *passwordFile != "":
+			return nil, errors.New("only one of -password and -password-file can be used")
+		case *password != "":
+			return []byte(*password), nil
+		case *passwordFile == "-":
+			b, err := ioutil.ReadAll(e.stdin)
+			return bytes.TrimRight(b, "\r\n"), err
+		case *passwordFile != "":
+			b, err := ioutil.ReadFile(*passwordFile)
+			return bytes.TrimRight(b, "\r\n"), err
+		}
+		return nil, errors.New("-password or -password-file is required")
+	}
+}
+
+// localClient creates a server and a client from local keys, used to test enrollment & verification
+func localClient(e *env, f *cmdFlags, keypair, clientPrivate string) (*phe.Server, *phe.Client, error) {
+	kp, err := readValue(keypair, f.in, e.stdin)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	s, err := phe.NewServer(kp)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	priv, err := readValue(clientPrivate, f.in, e.stdin)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	c, err := phe.NewClient(s.GetPublicKey(), priv)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return s, c, nil
+}
+
+func enroll(e *env, args []string) error {
+	f := newFlags(e, "enroll")
+	keypair := f.String("keypair", "", "server keypair file")
+	clientPrivate := f.String("client-private", "", "client private key file")
+	out := f.String("out", "-", "enrollment record output file")
+	keyOut := f.String("key-out", "", "optional encryption key output file")
+	password := passwordFlags(f)
+	if err := f.parse(args); err != nil {
+		return err
+	}
+
+	pwd, err := password(e)
+	if err != nil {
+		return err
+	}
+
+	s, c, err := localClient(e, f, *keypair, *clientPrivate)
+	if err != nil {
+		return err
+	}
+
+	enrollment, err := s.GetEnrollment()
+	if err != nil {
+		return err
+	}
+
+	rec, key, err := c.EnrollAccount(pwd, enrollment)
+	if err != nil {
+		return err
+	}
+
+	if err = writeValue(*out, f.out, rec, e.stdout); err != nil {
+		return err
+	}
+
+	if *keyOut != "" {
+		return writeValue(*keyOut, f.out, key, e.stdout)
+	}
+	return nil
+}
+
+func verify(e *env, args []string) error {
+	f := newFlags(e, "verify")
+	keypair := f.String("keypair", "", "server keypair file")
+	clientPrivate := f.String("client-private", "", "client private key file")
+	record := f.String("record", "", "enrollment record file")
+	out := f.String("out", "-", "encryption key output file")
+	password := passwordFlags(f)
+	if err := f.parse(args); err != nil {
+		return err
+	}
+
+	pwd, err := password(e)
+	if err != nil {
+		return err
+	}
+
+	s, c, err := localClient(e, f, *keypair, *clientPrivate)
+	if err != nil {
+		return err
+	}
+
+	rec, err := readValue(*record, f.in, e.stdin)
+	if err != nil {
+		return err
+	}
+
+	req, err := c.CreateVerifyPasswordRequest(pwd, rec)
+	if err != nil {
+		return err
+	}
+
+	resp, err := s.VerifyPassword(req)
+	if err != nil {
+		return err
+	}
+
+	key, err := c.CheckResponseAndDecrypt(pwd, rec, resp)
+	if err != nil {
+		return err
+	}
+
+	return writeValue(*out, f.out, key, e.stdout)
+}
@@ -0,0 +1,231 @@
+/*
+ * Copyright (C) 2015-2019 Virgil Security Inc.
+ *
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ *     (1) Redistributions of source code must retain the above copyright
+ *     notice, this list of conditions and the following disclaimer.
+ *
+ *     (2) Redistributions in binary form must reproduce the above copyright
+ *     notice, this list of conditions and the following disclaimer in
+ *     the documentation and/or other materials provided with the
+ *     distribution.
+ *
+ *     (3) Neither the name of the copyright holder nor the names of its
+ *     contributors may be used to endorse or promote products derived from
+ *     this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ''AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+ * IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ *
+ * Lead Maintainer: Virgil Security Inc. <support@virgilsecurity.com>
+ */
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/VirgilSecurity/virgil-phe-go"
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/require"
+)
+
+type testEnv struct {
+	t   *testing.T
+	dir string
+}
+
+func (te *testEnv) path(name string) string {
+	return filepath.Join(te.dir, name)
+}
+
+func (te *testEnv) run(stdin string, args ...string) (string, error) {
+	var stdout, stderr bytes.Buffer
+	err := run(args, &env{strings.NewReader(stdin), &stdout, &stderr})
+	return stdout.String(), err
+}
+
+func (te *testEnv) mustRun(args ...string) string {
+	out, err := te.run("", args...)
+	require.NoError(te.t, err, strings.Join(args, " "))
+	return out
+}
+
+func TestCLI_Full(t *testing.T) {
+	for _, format := range []string{"hex", "base64", "raw"} {
+		te := &testEnv{t: t, dir: t.TempDir()}
+		ff := []string{"-in-format", format, "-out-format", format}
+		cmd := func(name string, args ...string) []string {
+			return append(append([]string{name}, ff...), args...)
+		}
+
+		te.mustRun(cmd("keygen-server", "-out", te.path("kp"))...)
+		te.mustRun(cmd("keygen-client", "-out", te.path("client"))...)
+		te.mustRun(cmd("pubkey", "-keypair", te.path("kp"), "-out", te.path("pub"))...)
+
+		for _, pwd := range []string{"one", "two", "three"} {
+			te.mustRun(cmd("enroll", "-keypair", te.path("kp"), "-client-private", te.path("client"),
+				"-password", pwd, "-out", te.path("rec-"+pwd), "-key-out", te.path("key-"+pwd))...)
+		}
+
+		key := te.mustRun(cmd("verify", "-keypair", te.path("kp"), "-client-private", te.path("client"),
+			"-password", "one", "-record", te.path("rec-one"))...)
+		expected, err := ioutil.ReadFile(te.path("key-one"))
+		require.NoError(t, err)
+		require.Equal(t, string(expected), key)
+
+		_, err = te.run("", cmd("verify", "-keypair", te.path("kp"), "-client-private", te.path("client"),
+			"-password", "two", "-record", te.path("rec-one"))...)
+		require.EqualError(t, err, "wrong password")
+
+		// rotate everything
+		te.mustRun(cmd("rotate", "-keypair", te.path("kp"), "-keypair-out", te.path("kp2"), "-token-out", te.path("token"))...)
+		te.mustRun(cmd("rotate-client", "-server-public", te.path("pub"), "-client-private", te.path("client"),
+			"-token", te.path("token"), "-server-public-out", te.path("pub2"), "-client-private-out", te.path("client2"))...)
+
+		pub2 := te.mustRun(cmd("pubkey", "-keypair", te.path("kp2"))...)
+		expected, err = ioutil.ReadFile(te.path("pub2"))
+		require.NoError(t, err)
+		require.Equal(t, string(expected), pub2)
+
+		// records are streamed in the same format they are stored in
+		var stream bytes.Buffer
+		for _, pwd := range []string{"one", "two", "three"} {
+			rec, err := ioutil.ReadFile(te.path("rec-" + pwd))
+			require.NoError(t, err)
+			if format == "raw" {
+				w := newRecordWriter(&stream, formatRaw)
+				require.NoError(t, w.write(rec))
+				require.NoError(t, w.flush())
+			} else {
+				stream.Write(rec)
+			}
+		}
+		require.NoError(t, ioutil.WriteFile(te.path("records"), stream.Bytes(), 0600))
+
+		// a token is only accepted for the public key it was issued for
+		_, err = te.run("", cmd("update-records", "-token", te.path("token"), "-in", te.path("records"), "-out", te.path("records2"))...)
+		require.EqualError(t, err, "-server-public is required")
+		_, err = te.run("", cmd("update-records", "-server-public", te.path("pub2"), "-token", te.path("token"),
+			"-in", te.path("records"), "-out", te.path("records2"))...)
+		require.Error(t, err)
+
+		te.mustRun(cmd("update-records", "-server-public", te.path("pub"), "-token", te.path("token"),
+			"-in", te.path("records"), "-out", te.path("records2"))...)
+
+		updated, err := ioutil.ReadFile(te.path("records2"))
+		require.NoError(t, err)
+		f, err := parseFormat(format)
+		require.NoError(t, err)
+		r := newRecordReader(bytes.NewReader(updated), f)
+
+		for _, pwd := range []string{"one", "two", "three"} {
+			rec, err := r.next()
+			require.NoError(t, err)
+			require.NoError(t, writeValue(te.path("upd-"+pwd), f, rec, nil))
+
+			key := te.mustRun(cmd("verify", "-keypair", te.path("kp2"), "-client-private", te.path("client2"),
+				"-password", pwd, "-record", te.path("upd-"+pwd))...)
+			expected, err := ioutil.ReadFile(te.path("key-" + pwd))
+			require.NoError(t, err)
+			require.Equal(t, string(expected), key)
+		}
+	}
+}
+
+func TestCLI_Stdin(t *testing.T) {
+	te := &testEnv{t: t, dir: t.TempDir()}
+
+	kp := te.mustRun("keygen-server")
+	pub, err := te.run(kp, "pubkey")
+	require.NoError(t, err)
+	require.NotEmpty(t, pub)
+
+	te.mustRun("keygen-client", "-out", te.path("client"))
+	require.NoError(t, ioutil.WriteFile(te.path("kp"), []byte(kp), 0600))
+
+	rec, err := te.run("secret\n", "enroll", "-keypair", te.path("kp"), "-client-private", te.path("client"), "-password-file", "-")
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(te.path("rec"), []byte(rec), 0600))
+
+	_, err = te.run("secret\n", "verify", "-keypair", te.path("kp"), "-client-private", te.path("client"),
+		"-record", te.path("rec"), "-password-file", "-")
+	require.NoError(t, err)
+}
+
+func TestCLI_DefaultProtocol(t *testing.T) {
+	te := &testEnv{t: t, dir: t.TempDir()}
+
+	te.mustRun("keygen-server", "-out-format", "raw", "-out", te.path("kp"))
+	b, err := ioutil.ReadFile(te.path("kp"))
+	require.NoError(t, err)
+
+	// older protocols are only used when asked for
+	kp := &phe.Keypair{}
+	require.NoError(t, proto.Unmarshal(b, kp))
+	require.Equal(t, uint32(phe.ProtocolV3), kp.Protocol)
+}
+
+func TestCLI_P384ProtocolV2(t *testing.T) {
+	te := &testEnv{t: t, dir: t.TempDir()}
+
+	te.mustRun("keygen-server", "-curve", "p384", "-protocol", "2", "-out", te.path("kp"))
+	te.mustRun("keygen-client", "-curve", "p384", "-out", te.path("client"))
+	te.mustRun("enroll", "-keypair", te.path("kp"), "-client-private", te.path("client"),
+		"-password", "secret", "-out", te.path("rec"), "-key-out", te.path("key"))
+
+	key := te.mustRun("verify", "-keypair", te.path("kp"), "-client-private", te.path("client"),
+		"-password", "secret", "-record", te.path("rec"))
+	expected, err := ioutil.ReadFile(te.path("key"))
+	require.NoError(t, err)
+	require.Equal(t, string(expected), key)
+}
+
+func TestCLI_Errors(t *testing.T) {
+	te := &testEnv{t: t, dir: t.TempDir()}
+
+	_, err := te.run("")
+	require.Error(t, err)
+
+	_, err = te.run("", "unknown")
+	require.Error(t, err)
+
+	_, err = te.run("", "keygen-server", "-out-format", "json")
+	require.Error(t, err)
+
+	_, err = te.run("", "keygen-server", "-curve", "p521")
+	require.Error(t, err)
+
+	_, err = te.run("", "keygen-server", "-protocol", "4")
+	require.Error(t, err)
+
+	_, err = te.run("", "keygen-server", "-protocol", "0")
+	require.Error(t, err)
+
+	_, err = te.run("", "rotate", "-keypair", te.path("kp"))
+	require.Error(t, err)
+
+	_, err = te.run("", "enroll", "-keypair", te.path("kp"), "-client-private", te.path("client"))
+	require.Error(t, err)
+
+	_, err = te.run("", "pubkey", "extra")
+	require.Error(t, err)
+}
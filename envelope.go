@@ -0,0 +1,215 @@
+/*
+ * Copyright (C) 2015-2019 Virgil Security Inc.
+ *
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ *     (1) Redistributions of source code must retain the above copyright
+ *     notice, this list of conditions and the following disclaimer.
+ *
+ *     (2) Redistributions in binary form must reproduce the above copyright
+ *     notice, this list of conditions and the following disclaimer in
+ *     the documentation and/or other materials provided with the
+ *     distribution.
+ *
+ *     (3) Neither the name of the copyright holder nor the names of its
+ *     contributors may be used to endorse or promote products derived from
+ *     this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ''AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+ * IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ *
+ * Lead Maintainer: Virgil Security Inc. <support@virgilsecurity.com>
+ */
+package phe
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"io"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// Envelope is a self-describing ciphertext:
+// magic (4 bytes) || version (1 byte) || algorithm (1 byte) || key ID length (1 byte) || key ID || salt (32 bytes) || ciphertext || tag.
+// Everything before the ciphertext is authenticated as additional data
+const (
+	envelopeVersion  = 1
+	envelopeFixedLen = 4 + 1 + 1 + 1
+	// MaxKeyIDLen is the maximum length of an envelope key ID
+	MaxKeyIDLen = 255
+)
+
+var envelopeMagic = []byte{0x56, 0x50, 0x48, 0x45} //VPHE
+
+// Algorithm identifies the AEAD used to encrypt an envelope. Encrypt, EncryptWithAD and EncryptWithContext produce
+// envelopes as well when an algorithm is selected with WithAlgorithm
+type Algorithm uint8
+
+const (
+	// AlgorithmAES256GCM is AES-256 in GCM mode, the algorithm used by Encrypt
+	AlgorithmAES256GCM Algorithm = 1
+	// AlgorithmChaCha20Poly1305 is ChaCha20-Poly1305 as defined in RFC 8439, it's fast without AES hardware support
+	AlgorithmChaCha20Poly1305 Algorithm = 2
+	// AlgorithmXChaCha20Poly1305 is ChaCha20-Poly1305 with a 24 byte nonce
+	AlgorithmXChaCha20Poly1305 Algorithm = 3
+)
+
+// newCipher creates the AEAD instance for a 32 byte key
+func (a Algorithm) newCipher(key []byte) (cipher.AEAD, error) {
+	switch a {
+	case AlgorithmAES256GCM:
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		return cipher.NewGCM(block)
+	case AlgorithmChaCha20Poly1305:
+		return chacha20poly1305.New(key)
+	case AlgorithmXChaCha20Poly1305:
+		return chacha20poly1305.NewX(key)
+	default:
+		return nil, errors.New("unsupported algorithm")
+	}
+}
+
+// nonceSize returns the nonce length of the algorithm or 0 if it's not supported
+func (a Algorithm) nonceSize() int {
+	switch a {
+	case AlgorithmAES256GCM, AlgorithmChaCha20Poly1305:
+		return symNonceLen
+	case AlgorithmXChaCha20Poly1305:
+		return chacha20poly1305.NonceSizeX
+	default:
+		return 0
+	}
+}
+
+// EnvelopeHeader describes an envelope
+type EnvelopeHeader struct {
+	Version   uint8
+	Algorithm Algorithm
+	// KeyID is the key identifier the envelope was created with, it may be empty
+	KeyID []byte
+}
+
+// EncryptEnvelope encrypts data like Encrypt but produces an envelope which carries the format version,
+// algorithm and an optional key ID, for example the ID of the record the key belongs to. The key ID isn't secret.
+// AES-256-GCM is used unless another algorithm is selected by WithAlgorithm. Envelopes are decrypted by Decrypt
+func EncryptEnvelope(data, key, keyID []byte, opts ...Option) ([]byte, error) {
+	o := applyOptions(opts)
+	return sealEnvelope(o.rand(), o.algorithm, data, key, keyID, encryptEnvelope, nil)
+}
+
+// sealEnvelope encrypts data into an envelope using info as HKDF info. The header and ad are authenticated
+func sealEnvelope(random io.Reader, alg Algorithm, data, key, keyID, info, ad []byte) ([]byte, error) {
+	if alg == 0 {
+		alg = AlgorithmAES256GCM
+	}
+
+	if alg.nonceSize() == 0 {
+		return nil, errors.New("unsupported algorithm")
+	}
+
+	if len(key) != symKeyLen {
+		return nil, errors.New("key must be exactly 32 bytes")
+	}
+
+	if len(keyID) > MaxKeyIDLen {
+		return nil, errors.New("key ID is too long")
+	}
+
+	header := make([]byte, 0, envelopeFixedLen+len(keyID)+symSaltLen)
+	header = append(header, envelopeMagic...)
+	header = append(header, envelopeVersion, byte(alg), byte(len(keyID)))
+	header = append(header, keyID...)
+
+	salt := make([]byte, symSaltLen)
+	if err := randRead(random, salt); err != nil {
+		return nil, err
+	}
+	header = append(header, salt...)
+
+	aead, nonce, err := newAEAD(alg, key, salt, info)
+	if err != nil {
+		return nil, err
+	}
+
+	ct := make([]byte, len(header), len(header)+len(data)+aead.Overhead())
+	copy(ct, header)
+	return aead.Seal(ct, nonce, data, envelopeAD(header, ad)), nil
+}
+
+// ParseEnvelope returns the header of an envelope without decrypting it
+func ParseEnvelope(ciphertext []byte) (*EnvelopeHeader, error) {
+	header, _, err := parseEnvelope(ciphertext)
+	return header, err
+}
+
+// parseEnvelope returns the header and its length
+func parseEnvelope(ciphertext []byte) (*EnvelopeHeader, int, error) {
+	if !isEnvelope(ciphertext) {
+		return nil, 0, errors.New("not an envelope")
+	}
+
+	if len(ciphertext) < envelopeFixedLen {
+		return nil, 0, errors.New("invalid envelope length")
+	}
+
+	version, alg, keyIDLen := ciphertext[4], Algorithm(ciphertext[5]), int(ciphertext[6])
+	if version != envelopeVersion {
+		return nil, 0, errors.New("unsupported envelope version")
+	}
+
+	headerLen := envelopeFixedLen + keyIDLen + symSaltLen
+	if len(ciphertext) < headerLen+symTagLen {
+		return nil, 0, errors.New("invalid envelope length")
+	}
+
+	return &EnvelopeHeader{
+		Version:   version,
+		Algorithm: alg,
+		KeyID:     append([]byte{}, ciphertext[envelopeFixedLen:envelopeFixedLen+keyIDLen]...),
+	}, headerLen, nil
+}
+
+func isEnvelope(ciphertext []byte) bool {
+	return bytes.HasPrefix(ciphertext, envelopeMagic)
+}
+
+func openEnvelope(ciphertext, key, info, ad []byte) ([]byte, error) {
+	header, headerLen, err := parseEnvelope(ciphertext)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, nonce, err := newAEAD(header.Algorithm, key, ciphertext[headerLen-symSaltLen:headerLen], info)
+	if err != nil {
+		return nil, err
+	}
+
+	return aead.Open(make([]byte, 0), nonce, ciphertext[headerLen:], envelopeAD(ciphertext[:headerLen], ad))
+}
+
+// envelopeAD returns the additional data of an envelope, its header followed by the caller's additional data
+func envelopeAD(header, ad []byte) []byte {
+	if len(ad) == 0 {
+		return header
+	}
+	return append(append(make([]byte, 0, len(header)+len(ad)), header...), ad...)
+}
@@ -0,0 +1,164 @@
+/*
+ * Copyright (C) 2015-2019 Virgil Security Inc.
+ *
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ *     (1) Redistributions of source code must retain the above copyright
+ *     notice, this list of conditions and the following disclaimer.
+ *
+ *     (2) Redistributions in binary form must reproduce the above copyright
+ *     notice, this list of conditions and the following disclaimer in
+ *     the documentation and/or other materials provided with the
+ *     distribution.
+ *
+ *     (3) Neither the name of the copyright holder nor the names of its
+ *     contributors may be used to endorse or promote products derived from
+ *     this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ''AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+ * IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ *
+ * Lead Maintainer: Virgil Security Inc. <support@virgilsecurity.com>
+ */
+package phe
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestEnvelope(t *testing.T) {
+	key := make([]byte, symKeyLen)
+	require.NoError(t, randRead(rand.Reader, key))
+	data := []byte("secret data")
+
+	for _, keyID := range [][]byte{nil, []byte("record 42"), bytes.Repeat([]byte{1}, MaxKeyIDLen)} {
+		ct, err := EncryptEnvelope(data, key, keyID)
+		require.NoError(t, err)
+		require.Len(t, ct, envelopeFixedLen+len(keyID)+symSaltLen+len(data)+symTagLen)
+
+		header, err := ParseEnvelope(ct)
+		require.NoError(t, err)
+		require.Equal(t, uint8(envelopeVersion), header.Version)
+		require.Equal(t, AlgorithmAES256GCM, header.Algorithm)
+		require.Equal(t, len(keyID), len(header.KeyID))
+		require.True(t, bytes.Equal(keyID, header.KeyID))
+
+		pt, err := Decrypt(ct, key)
+		require.NoError(t, err)
+		require.Equal(t, data, pt)
+	}
+
+	_, err := EncryptEnvelope(data, key, make([]byte, MaxKeyIDLen+1))
+	require.Error(t, err)
+
+	_, err = EncryptEnvelope(data, key[1:], nil)
+	require.Error(t, err)
+}
+
+func TestEnvelope_Algorithms(t *testing.T) {
+	key := make([]byte, symKeyLen)
+	require.NoError(t, randRead(rand.Reader, key))
+	data := []byte("secret data")
+
+	for _, alg := range []Algorithm{AlgorithmAES256GCM, AlgorithmChaCha20Poly1305, AlgorithmXChaCha20Poly1305} {
+		ct, err := EncryptEnvelope(data, key, []byte("record 42"), WithAlgorithm(alg))
+		require.NoError(t, err)
+
+		header, err := ParseEnvelope(ct)
+		require.NoError(t, err)
+		require.Equal(t, alg, header.Algorithm)
+
+		pt, err := Decrypt(ct, key)
+		require.NoError(t, err)
+		require.Equal(t, data, pt)
+
+		// the algorithm is authenticated
+		for _, other := range []Algorithm{AlgorithmAES256GCM, AlgorithmChaCha20Poly1305, AlgorithmXChaCha20Poly1305} {
+			if other == alg {
+				continue
+			}
+			tampered := append([]byte{}, ct...)
+			tampered[5] = byte(other)
+			_, err = Decrypt(tampered, key)
+			require.Error(t, err)
+		}
+	}
+
+	_, err := EncryptEnvelope(data, key, nil, WithAlgorithm(Algorithm(42)))
+	require.EqualError(t, err, "unsupported algorithm")
+}
+
+func TestEnvelope_Tampering(t *testing.T) {
+	key := make([]byte, symKeyLen)
+	require.NoError(t, randRead(rand.Reader, key))
+
+	ct, err := EncryptEnvelope([]byte("secret data"), key, []byte("record 42"))
+	require.NoError(t, err)
+
+	// the header is authenticated
+	for _, i := range []int{envelopeFixedLen, envelopeFixedLen + 9, len(ct) - 1} {
+		tampered := append([]byte{}, ct...)
+		tampered[i] ^= 1
+		_, err = Decrypt(tampered, key)
+		require.Error(t, err)
+	}
+
+	tampered := append([]byte{}, ct...)
+	tampered[4] = envelopeVersion + 1
+	_, err = Decrypt(tampered, key)
+	require.EqualError(t, err, "unsupported envelope version")
+
+	tampered = append([]byte{}, ct...)
+	tampered[5] = 0
+	_, err = Decrypt(tampered, key)
+	require.EqualError(t, err, "unsupported algorithm")
+
+	_, err = Decrypt(ct[:envelopeFixedLen+symSaltLen+symTagLen], key)
+	require.EqualError(t, err, "invalid envelope length")
+
+	_, err = ParseEnvelope(ct[:envelopeFixedLen-1])
+	require.EqualError(t, err, "invalid envelope length")
+}
+
+func TestEnvelope_Legacy(t *testing.T) {
+	key := make([]byte, symKeyLen)
+	require.NoError(t, randRead(rand.Reader, key))
+	data := []byte("secret data")
+
+	ct, err := Encrypt(data, key)
+	require.NoError(t, err)
+
+	_, err = ParseEnvelope(ct)
+	require.EqualError(t, err, "not an envelope")
+
+	pt, err := Decrypt(ct, key)
+	require.NoError(t, err)
+	require.Equal(t, data, pt)
+
+	// legacy salt which happens to start with the magic
+	salt := append(append([]byte{}, envelopeMagic...), make([]byte, symSaltLen-len(envelopeMagic))...)
+	ct, err = Encrypt(data, key, WithRandom(bytes.NewReader(salt)))
+	require.NoError(t, err)
+	require.True(t, isEnvelope(ct))
+
+	pt, err = Decrypt(ct, key)
+	require.NoError(t, err)
+	require.Equal(t, data, pt)
+}
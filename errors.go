@@ -0,0 +1,116 @@
+/*
+ * Copyright (C) 2015-2019 Virgil Security Inc.
+ *
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ *     (1) Redistributions of source code must retain the above copyright
+ *     notice, this list of conditions and the following disclaimer.
+ *
+ *     (2) Redistributions in binary form must reproduce the above copyright
+ *     notice, this list of conditions and the following disclaimer in
+ *     the documentation and/or other materials provided with the
+ *     distribution.
+ *
+ *     (3) Neither the name of the copyright holder nor the names of its
+ *     contributors may be used to endorse or promote products derived from
+ *     this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ''AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+ * IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ *
+ * Lead Maintainer: Virgil Security Inc. <support@virgilsecurity.com>
+ */
+package phe
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Errors returned by the package. They may be wrapped with details, use errors.Is to check for them
+var (
+	// ErrWrongPassword is returned by the client when the server has proven that the password is wrong
+	ErrWrongPassword = errors.New("wrong password")
+	// ErrInvalidProof is returned when a proof in a server response is missing, malformed or doesn't verify.
+	// It means the response was not produced by the owner of the server key
+	ErrInvalidProof = errors.New("invalid proof")
+	// ErrInvalidRecord is returned when an enrollment record is malformed
+	ErrInvalidRecord = errors.New("invalid record")
+	// ErrInvalidResponse is returned when a server response is malformed
+	ErrInvalidResponse = errors.New("invalid response")
+	// ErrInvalidRequest is returned when a password verify or enrollment request is malformed
+	ErrInvalidRequest = errors.New("invalid password verify request")
+	// ErrInvalidToken is returned when an update token is malformed or its proof doesn't verify
+	ErrInvalidToken = errors.New("invalid update token")
+	// ErrInvalidPoint is returned when bytes don't encode a point of the expected curve
+	ErrInvalidPoint = errors.New("invalid curve point")
+	// ErrInvalidPrivateKey is returned when a private key is malformed or out of range
+	ErrInvalidPrivateKey = errors.New("invalid private key")
+	// ErrInvalidPublicKey is returned when a public key is malformed
+	ErrInvalidPublicKey = errors.New("invalid public key")
+	// ErrInvalidKeypair is returned when a server keypair can't be parsed
+	ErrInvalidKeypair = errors.New("invalid keypair")
+	// ErrVersionMismatch is returned when a record, message or token belongs to another key version.
+	// The actual error is a *VersionMismatchError
+	ErrVersionMismatch = errors.New("key version does not match")
+	// ErrUnknownKeyVersion is returned by key rings which don't have the requested key version
+	ErrUnknownKeyVersion = errors.New("unknown key version")
+	// ErrSuiteMismatch is returned when a record, message or token belongs to another curve
+	ErrSuiteMismatch = errors.New("suite does not match")
+	// ErrProtocolMismatch is returned when a record, message or token belongs to another protocol version
+	ErrProtocolMismatch = errors.New("protocol does not match")
+	// ErrUnsupportedSuite is returned for unknown curve suites
+	ErrUnsupportedSuite = errors.New("unsupported suite")
+	// ErrUnsupportedProtocol is returned for unknown protocol versions
+	ErrUnsupportedProtocol = errors.New("unsupported protocol")
+)
+
+// VersionMismatchError describes an object which can't be processed with the current key version
+type VersionMismatchError struct {
+	// Object is what has the wrong version: "record", "request", "enrollment" or "update token"
+	Object string
+	// Version is the key version of the object
+	Version uint32
+	// Expected is the key version the object should have
+	Expected uint32
+}
+
+func (e *VersionMismatchError) Error() string {
+	return fmt.Sprintf("%s key version %d does not match expected key version %d", e.Object, e.Version, e.Expected)
+}
+
+// Is makes errors.Is(err, ErrVersionMismatch) true
+func (e *VersionMismatchError) Is(target error) bool {
+	return target == ErrVersionMismatch
+}
+
+// isInputError reports whether err is caused by a malformed request or one meant for another key, as opposed
+// to a failure of the server itself
+func isInputError(err error) bool {
+	for _, target := range []error{
+		ErrInvalidRequest,
+		ErrVersionMismatch,
+		ErrSuiteMismatch,
+		ErrProtocolMismatch,
+		ErrUnsupportedSuite,
+		ErrUnsupportedProtocol,
+	} {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
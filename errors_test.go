@@ -0,0 +1,137 @@
+/*
+ * Copyright (C) 2015-2019 Virgil Security Inc.
+ *
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ *     (1) Redistributions of source code must retain the above copyright
+ *     notice, this list of conditions and the following disclaimer.
+ *
+ *     (2) Redistributions in binary form must reproduce the above copyright
+ *     notice, this list of conditions and the following disclaimer in
+ *     the documentation and/or other materials provided with the
+ *     distribution.
+ *
+ *     (3) Neither the name of the copyright holder nor the names of its
+ *     contributors may be used to endorse or promote products derived from
+ *     this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ''AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+ * IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ *
+ * Lead Maintainer: Virgil Security Inc. <support@virgilsecurity.com>
+ */
+package phe
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/require"
+)
+
+func TestErrors(t *testing.T) {
+	serverKeypair, err := GenerateServerKeypair()
+	require.NoError(t, err)
+	pub, err := GetPublicKey(serverKeypair)
+	require.NoError(t, err)
+	c, err := NewClient(pub, generateClientKey(t))
+	require.NoError(t, err)
+
+	enrollment, err := GetEnrollment(serverKeypair)
+	require.NoError(t, err)
+	rec, _, err := c.EnrollAccount(pwd, enrollment)
+	require.NoError(t, err)
+
+	// wrong password
+	req, err := c.CreateVerifyPasswordRequest([]byte("wrong"), rec)
+	require.NoError(t, err)
+	resp, err := VerifyPassword(serverKeypair, req)
+	require.NoError(t, err)
+	_, err = c.CheckResponseAndDecrypt([]byte("wrong"), rec, resp)
+	require.True(t, errors.Is(err, ErrWrongPassword))
+
+	// tampered fail proof
+	vr := &VerifyPasswordResponse{}
+	require.NoError(t, proto.Unmarshal(resp, vr))
+	vr.GetFail().BlindA[0] ^= 1
+	tampered, err := proto.Marshal(vr)
+	require.NoError(t, err)
+	_, err = c.CheckResponseAndDecrypt([]byte("wrong"), rec, tampered)
+	require.True(t, errors.Is(err, ErrInvalidProof), err)
+
+	// missing fail proof
+	vr.Proof = nil
+	tampered, err = proto.Marshal(vr)
+	require.NoError(t, err)
+	_, err = c.CheckResponseAndDecrypt([]byte("wrong"), rec, tampered)
+	require.True(t, errors.Is(err, ErrInvalidProof), err)
+
+	// the server claims success for a wrong password
+	vr.Res = true
+	tampered, err = proto.Marshal(vr)
+	require.NoError(t, err)
+	_, err = c.CheckResponseAndDecrypt([]byte("wrong"), rec, tampered)
+	require.True(t, errors.Is(err, ErrInvalidProof), err)
+
+	// corrupted record
+	er := &EnrollmentRecord{}
+	require.NoError(t, proto.Unmarshal(rec, er))
+	er.T1 = er.T1[1:]
+	corrupted, err := proto.Marshal(er)
+	require.NoError(t, err)
+	_, err = c.CheckResponseAndDecrypt(pwd, corrupted, resp)
+	require.True(t, errors.Is(err, ErrInvalidRecord), err)
+
+	_, err = c.CreateVerifyPasswordRequest(pwd, []byte{0xff})
+	require.Equal(t, ErrInvalidRecord, err)
+
+	// record of another key version
+	er.Version = 5
+	corrupted, err = proto.Marshal(er)
+	require.NoError(t, err)
+	_, err = c.CreateVerifyPasswordRequest(pwd, corrupted)
+	require.True(t, errors.Is(err, ErrVersionMismatch))
+	var vme *VersionMismatchError
+	require.True(t, errors.As(err, &vme))
+	require.Equal(t, &VersionMismatchError{Object: "record", Version: 5, Expected: 0}, vme)
+
+	// bad token
+	token, _, err := Rotate(serverKeypair)
+	require.NoError(t, err)
+	ut := &UpdateToken{}
+	require.NoError(t, proto.Unmarshal(token, ut))
+	ut.B[0] ^= 1
+	badToken, err := proto.Marshal(ut)
+	require.NoError(t, err)
+	require.True(t, errors.Is(VerifyUpdateToken(pub, badToken), ErrInvalidToken))
+
+	ut.Proof = nil
+	badToken, err = proto.Marshal(ut)
+	require.NoError(t, err)
+	_, _, err = RotateClientKeys(pub, generateClientKey(t), badToken)
+	require.True(t, errors.Is(err, ErrInvalidToken), err)
+
+	// bad keys
+	_, err = NewClient(pub[1:], generateClientKey(t))
+	require.Equal(t, ErrInvalidPublicKey, err)
+
+	_, err = PointUnmarshal(pub[1:])
+	require.Equal(t, ErrInvalidPoint, err)
+
+	_, err = VerifyPassword(serverKeypair, []byte{0xff})
+	require.Equal(t, ErrInvalidRequest, err)
+}
@@ -0,0 +1,376 @@
+/*
+ * Copyright (C) 2015-2019 Virgil Security Inc.
+ *
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ *     (1) Redistributions of source code must retain the above copyright
+ *     notice, this list of conditions and the following disclaimer.
+ *
+ *     (2) Redistributions in binary form must reproduce the above copyright
+ *     notice, this list of conditions and the following disclaimer in
+ *     the documentation and/or other materials provided with the
+ *     distribution.
+ *
+ *     (3) Neither the name of the copyright holder nor the names of its
+ *     contributors may be used to endorse or promote products derived from
+ *     this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ''AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+ * IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ *
+ * Lead Maintainer: Virgil Security Inc. <support@virgilsecurity.com>
+ */
+
+// Package field implements constant-time arithmetic modulo an odd prime of 64, 128, ... 384 bits.
+// Elements are kept in Montgomery form in fixed-width 64-bit limbs, so the running time
+// of every operation depends only on the size of the modulus and never on the values
+package field
+
+import (
+	"errors"
+	"math/big"
+	"math/bits"
+)
+
+// MaxLimbs is the number of 64-bit limbs of the largest supported modulus
+const MaxLimbs = 6
+
+// Element is a field element in Montgomery form. Limbs are little-endian,
+// those above the field's limb count are always zero
+type Element [MaxLimbs]uint64
+
+// Field holds the parameters of arithmetic modulo P
+type Field struct {
+	P *big.Int
+
+	n       int // number of limbs in use
+	byteLen int
+	p       Element
+	pInv    uint64  // -p^(-1) mod 2^64
+	rr      Element // R^2 mod p, R = 2^(64 * n)
+	one     Element // R mod p, which is 1 in Montgomery form
+	pMinus2 []byte
+}
+
+// New creates a field modulo an odd prime p. The bit length of p must be a multiple of 64,
+// the single final subtraction of the Montgomery reduction relies on R < 2p
+func New(p *big.Int) (*Field, error) {
+	if p.Sign() <= 0 || p.Bit(0) == 0 || p.BitLen()%64 != 0 || p.BitLen() > 64*MaxLimbs {
+		return nil, errors.New("unsupported modulus")
+	}
+
+	f := &Field{
+		P:       new(big.Int).Set(p),
+		n:       (p.BitLen() + 63) / 64,
+		byteLen: (p.BitLen() + 7) / 8,
+	}
+	f.p = f.limbs(p)
+
+	// Newton's iteration doubles the number of correct low bits of the inverse each step
+	inv := uint64(1)
+	for i := 0; i < 6; i++ {
+		inv *= 2 - f.p[0]*inv
+	}
+	f.pInv = -inv
+
+	r := new(big.Int).Lsh(big.NewInt(1), uint(64*f.n))
+	f.one = f.limbs(new(big.Int).Mod(r, p))
+	f.rr = f.limbs(new(big.Int).Mod(new(big.Int).Mul(r, r), p))
+	f.pMinus2 = new(big.Int).Sub(p, big.NewInt(2)).Bytes()
+	return f, nil
+}
+
+// MustNew is like New but panics if the modulus is not supported
+func MustNew(p *big.Int) *Field {
+	f, err := New(p)
+	if err != nil {
+		panic(err)
+	}
+	return f
+}
+
+// limbs splits a non-negative number below 2^(64 * n) into limbs. It's only used for public values
+func (f *Field) limbs(v *big.Int) (res Element) {
+	buf := v.FillBytes(make([]byte, 8*f.n))
+	f.setLimbs(&res, buf)
+	return
+}
+
+// setLimbs reads 8 * n big-endian bytes into limbs
+func (f *Field) setLimbs(z *Element, buf []byte) {
+	*z = Element{}
+	for i := 0; i < f.n; i++ {
+		off := len(buf) - 8*(i+1)
+		for j := 0; j < 8; j++ {
+			z[i] |= uint64(buf[off+j]) << uint(56-8*j)
+		}
+	}
+}
+
+// ByteLen returns the length of encoded elements
+func (f *Field) ByteLen() int {
+	return f.byteLen
+}
+
+// SetBytes converts a big-endian number of at most 8 * limbs bytes to an element, reducing it modulo P
+func (f *Field) SetBytes(z *Element, b []byte) (*Element, error) {
+	if len(b) > 8*f.n {
+		return nil, errors.New("number is too long")
+	}
+
+	buf := make([]byte, 8*f.n)
+	copy(buf[len(buf)-len(b):], b)
+	f.setLimbs(z, buf)
+
+	// montMul reduces any number below R when the other factor is below p
+	return f.montMul(z, z, &f.rr), nil
+}
+
+// SetWideBytes converts a big-endian number of any length to an element, reducing it modulo P.
+// It's used to map uniformly random strings longer than the modulus to the field with a negligible bias.
+// The running time depends only on the length of b
+func (f *Field) SetWideBytes(z *Element, b []byte) (*Element, error) {
+	chunk := 8 * f.n
+	first := len(b) % chunk
+	if first == 0 && len(b) > 0 {
+		first = chunk
+	}
+	if _, err := f.SetBytes(z, b[:first]); err != nil {
+		return nil, err
+	}
+
+	// b = (hi * R + lo) * R + ..., and rr is R in Montgomery form
+	var lo Element
+	for off := first; off < len(b); off += chunk {
+		if _, err := f.SetBytes(&lo, b[off:off+chunk]); err != nil {
+			return nil, err
+		}
+		f.montMul(z, z, &f.rr)
+		f.Add(z, z, &lo)
+	}
+	return z, nil
+}
+
+// SetCanonicalBytes converts a big-endian number of exactly ByteLen bytes to an element.
+// Unlike SetBytes it doesn't reduce the number, values not below P are rejected
+func (f *Field) SetCanonicalBytes(z *Element, b []byte) (*Element, error) {
+	if len(b) != f.byteLen {
+		return nil, errors.New("invalid number length")
+	}
+
+	buf := make([]byte, 8*f.n)
+	copy(buf[len(buf)-len(b):], b)
+	var v Element
+	f.setLimbs(&v, buf)
+
+	// the subtraction borrows only if v < p
+	var borrow uint64
+	for j := 0; j < f.n; j++ {
+		_, borrow = bits.Sub64(v[j], f.p[j], borrow)
+	}
+	if borrow == 0 {
+		return nil, errors.New("number is not reduced")
+	}
+
+	*z = v
+	return f.montMul(z, z, &f.rr), nil
+}
+
+// Bytes returns the canonical big-endian encoding of an element, ByteLen bytes long
+func (f *Field) Bytes(x *Element) []byte {
+	var raw Element
+	raw[0] = 1
+	var v Element
+	f.montMul(&v, x, &raw)
+
+	res := make([]byte, f.byteLen)
+	for i := range res {
+		limb := (f.byteLen - 1 - i) / 8
+		shift := uint(8 * ((f.byteLen - 1 - i) % 8))
+		res[i] = byte(v[limb] >> shift)
+	}
+	return res
+}
+
+// Sgn0 returns the parity of the canonical value of x
+func (f *Field) Sgn0(x *Element) int {
+	var raw, v Element
+	raw[0] = 1
+	f.montMul(&v, x, &raw)
+	return int(v[0] & 1)
+}
+
+// SetOne sets z to 1
+func (f *Field) SetOne(z *Element) *Element {
+	*z = f.one
+	return z
+}
+
+// montMul sets z = x * y / R mod p using the CIOS method. x must be below R and y below p
+func (f *Field) montMul(z, x, y *Element) *Element {
+	var t [MaxLimbs + 2]uint64
+	n := f.n
+
+	for i := 0; i < n; i++ {
+		// t += x * y[i]
+		var c, cc uint64
+		for j := 0; j < n; j++ {
+			hi, lo := bits.Mul64(x[j], y[i])
+			lo, cc = bits.Add64(lo, t[j], 0)
+			hi += cc
+			lo, cc = bits.Add64(lo, c, 0)
+			hi += cc
+			t[j], c = lo, hi
+		}
+		t[n], cc = bits.Add64(t[n], c, 0)
+		t[n+1] = cc
+
+		// t = (t + m * p) / 2^64, where m makes the lowest limb zero
+		m := t[0] * f.pInv
+		hi, lo := bits.Mul64(m, f.p[0])
+		_, cc = bits.Add64(lo, t[0], 0)
+		c = hi + cc
+		for j := 1; j < n; j++ {
+			hi, lo = bits.Mul64(m, f.p[j])
+			lo, cc = bits.Add64(lo, t[j], 0)
+			hi += cc
+			lo, cc = bits.Add64(lo, c, 0)
+			hi += cc
+			t[j-1], c = lo, hi
+		}
+		t[n-1], cc = bits.Add64(t[n], c, 0)
+		t[n] = t[n+1] + cc
+	}
+
+	f.reduce(z, &t)
+	return z
+}
+
+// reduce sets z to the n + 1 limb number t, which must be below 2p, modulo p
+func (f *Field) reduce(z *Element, t *[MaxLimbs + 2]uint64) {
+	var s Element
+	var borrow uint64
+	for j := 0; j < f.n; j++ {
+		s[j], borrow = bits.Sub64(t[j], f.p[j], borrow)
+	}
+	_, borrow = bits.Sub64(t[f.n], 0, borrow)
+
+	// borrow is 1 if t < p
+	mask := -borrow
+	for j := 0; j < f.n; j++ {
+		z[j] = t[j]&mask | s[j]&^mask
+	}
+}
+
+// Mul sets z = x * y
+func (f *Field) Mul(z, x, y *Element) *Element {
+	return f.montMul(z, x, y)
+}
+
+// Square sets z = x * x
+func (f *Field) Square(z, x *Element) *Element {
+	return f.montMul(z, x, x)
+}
+
+// Add sets z = x + y
+func (f *Field) Add(z, x, y *Element) *Element {
+	var t [MaxLimbs + 2]uint64
+	var carry uint64
+	for j := 0; j < f.n; j++ {
+		t[j], carry = bits.Add64(x[j], y[j], carry)
+	}
+	t[f.n] = carry
+	f.reduce(z, &t)
+	return z
+}
+
+// Sub sets z = x - y
+func (f *Field) Sub(z, x, y *Element) *Element {
+	var borrow, carry uint64
+	var d Element
+	for j := 0; j < f.n; j++ {
+		d[j], borrow = bits.Sub64(x[j], y[j], borrow)
+	}
+
+	// add p back if the difference is negative
+	mask := -borrow
+	for j := 0; j < f.n; j++ {
+		z[j], carry = bits.Add64(d[j], f.p[j]&mask, carry)
+	}
+	return z
+}
+
+// Neg sets z = -x
+func (f *Field) Neg(z, x *Element) *Element {
+	var zero Element
+	return f.Sub(z, &zero, x)
+}
+
+// Exp sets z = x ^ e, where e is a big-endian exponent.
+// The running time depends on the length of e but not on its value
+func (f *Field) Exp(z, x *Element, e []byte) *Element {
+	var r, t Element
+	base := *x
+	f.SetOne(&r)
+
+	for _, b := range e {
+		for i := 7; i >= 0; i-- {
+			f.montMul(&r, &r, &r)
+			f.montMul(&t, &r, &base)
+			f.Select(&r, &t, &r, int(b>>uint(i))&1)
+		}
+	}
+
+	*z = r
+	return z
+}
+
+// Inv sets z = 1 / x using Fermat's little theorem. The inverse of zero is zero
+func (f *Field) Inv(z, x *Element) *Element {
+	return f.Exp(z, x, f.pMinus2)
+}
+
+// Select sets z to a if cond is 1 and to b if cond is 0
+func (f *Field) Select(z, a, b *Element, cond int) *Element {
+	mask := -uint64(cond & 1)
+	for j := 0; j < MaxLimbs; j++ {
+		z[j] = a[j]&mask | b[j]&^mask
+	}
+	return z
+}
+
+// Equal returns 1 if x and y are equal and 0 otherwise
+func (f *Field) Equal(x, y *Element) int {
+	var acc uint64
+	for j := 0; j < MaxLimbs; j++ {
+		acc |= x[j] ^ y[j]
+	}
+	return isZero(acc)
+}
+
+// IsZero returns 1 if x is zero and 0 otherwise
+func (f *Field) IsZero(x *Element) int {
+	var acc uint64
+	for j := 0; j < MaxLimbs; j++ {
+		acc |= x[j]
+	}
+	return isZero(acc)
+}
+
+func isZero(v uint64) int {
+	// the top bit of v | -v is set unless v is zero
+	return int(1 ^ (v|-v)>>63)
+}
@@ -0,0 +1,227 @@
+/*
+ * Copyright (C) 2015-2019 Virgil Security Inc.
+ *
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ *     (1) Redistributions of source code must retain the above copyright
+ *     notice, this list of conditions and the following disclaimer.
+ *
+ *     (2) Redistributions in binary form must reproduce the above copyright
+ *     notice, this list of conditions and the following disclaimer in
+ *     the documentation and/or other materials provided with the
+ *     distribution.
+ *
+ *     (3) Neither the name of the copyright holder nor the names of its
+ *     contributors may be used to endorse or promote products derived from
+ *     this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ''AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+ * IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ *
+ * Lead Maintainer: Virgil Security Inc. <support@virgilsecurity.com>
+ */
+
+package field
+
+import (
+	"crypto/elliptic"
+	"crypto/rand"
+	"math/big"
+	"testing"
+
+	"github.com/VirgilSecurity/virgil-phe-go/internal/dudect"
+	"github.com/stretchr/testify/require"
+)
+
+func testModuli() []*big.Int {
+	return []*big.Int{
+		elliptic.P256().Params().P,
+		elliptic.P256().Params().N,
+		elliptic.P384().Params().P,
+		elliptic.P384().Params().N,
+		new(big.Int).SetUint64(18446744073709551557), // 2^64 - 59
+	}
+}
+
+func randomElement(t *testing.T, f *Field) (*Element, *big.Int) {
+	v, err := rand.Int(rand.Reader, f.P)
+	require.NoError(t, err)
+	z, err := f.SetBytes(new(Element), v.Bytes())
+	require.NoError(t, err)
+	return z, v
+}
+
+func requireValue(t *testing.T, f *Field, expected *big.Int, z *Element) {
+	require.Equal(t, expected.FillBytes(make([]byte, f.ByteLen())), f.Bytes(z))
+}
+
+func TestField_Arithmetic(t *testing.T) {
+	for _, p := range testModuli() {
+		f, err := New(p)
+		require.NoError(t, err)
+
+		for i := 0; i < 200; i++ {
+			x, xv := randomElement(t, f)
+			y, yv := randomElement(t, f)
+			var z Element
+
+			requireValue(t, f, new(big.Int).Mod(new(big.Int).Add(xv, yv), p), f.Add(&z, x, y))
+			requireValue(t, f, new(big.Int).Mod(new(big.Int).Sub(xv, yv), p), f.Sub(&z, x, y))
+			requireValue(t, f, new(big.Int).Mod(new(big.Int).Neg(xv), p), f.Neg(&z, x))
+			requireValue(t, f, new(big.Int).Mod(new(big.Int).Mul(xv, yv), p), f.Mul(&z, x, y))
+			requireValue(t, f, new(big.Int).Mod(new(big.Int).Mul(xv, xv), p), f.Square(&z, x))
+			requireValue(t, f, new(big.Int).Exp(xv, yv, p), f.Exp(&z, x, yv.Bytes()))
+
+			if xv.Sign() != 0 {
+				requireValue(t, f, new(big.Int).ModInverse(xv, p), f.Inv(&z, x))
+			}
+
+			require.Equal(t, 1, f.Equal(x, x))
+			require.Equal(t, 0, f.Equal(x, f.Add(&z, x, f.SetOne(new(Element)))))
+		}
+	}
+}
+
+func TestField_SetBytes(t *testing.T) {
+	for _, p := range testModuli() {
+		f := MustNew(p)
+		size := (p.BitLen() + 63) / 64 * 8
+
+		// numbers above p are reduced
+		max := make([]byte, size)
+		for i := range max {
+			max[i] = 0xff
+		}
+		z, err := f.SetBytes(new(Element), max)
+		require.NoError(t, err)
+		requireValue(t, f, new(big.Int).Mod(new(big.Int).SetBytes(max), p), z)
+
+		z, err = f.SetBytes(new(Element), p.Bytes())
+		require.NoError(t, err)
+		require.Equal(t, 1, f.IsZero(z))
+
+		_, err = f.SetBytes(new(Element), make([]byte, size+1))
+		require.Error(t, err)
+
+		var zero Element
+		require.Equal(t, 1, f.IsZero(f.Inv(&zero, &zero)))
+	}
+}
+
+func TestField_SetWideBytes(t *testing.T) {
+	for _, p := range testModuli() {
+		f := MustNew(p)
+		size := (p.BitLen() + 63) / 64 * 8
+
+		for _, l := range []int{0, 1, size, size + 1, size + size/2, 2 * size, 2*size + 1, 5*size + 3} {
+			b := make([]byte, l)
+			_, err := rand.Read(b)
+			require.NoError(t, err)
+
+			z, err := f.SetWideBytes(new(Element), b)
+			require.NoError(t, err)
+			requireValue(t, f, new(big.Int).Mod(new(big.Int).SetBytes(b), p), z)
+
+			require.Equal(t, int(new(big.Int).Mod(new(big.Int).SetBytes(b), p).Bit(0)), f.Sgn0(z))
+		}
+	}
+}
+
+func TestField_SetCanonicalBytes(t *testing.T) {
+	for _, p := range testModuli() {
+		f := MustNew(p)
+
+		x, xv := randomElement(t, f)
+		z, err := f.SetCanonicalBytes(new(Element), xv.FillBytes(make([]byte, f.ByteLen())))
+		require.NoError(t, err)
+		require.Equal(t, 1, f.Equal(x, z))
+
+		pMinus1 := new(big.Int).Sub(p, big.NewInt(1))
+		z, err = f.SetCanonicalBytes(new(Element), pMinus1.FillBytes(make([]byte, f.ByteLen())))
+		require.NoError(t, err)
+		requireValue(t, f, pMinus1, z)
+
+		_, err = f.SetCanonicalBytes(new(Element), p.Bytes())
+		require.Error(t, err)
+		_, err = f.SetCanonicalBytes(new(Element), xv.FillBytes(make([]byte, f.ByteLen()+1)))
+		require.Error(t, err)
+	}
+}
+
+func TestField_Unsupported(t *testing.T) {
+	for _, p := range []*big.Int{
+		big.NewInt(0),
+		big.NewInt(-7),
+		big.NewInt(1),
+		big.NewInt(1024),
+		big.NewInt(2305843009213693951), // 2^61 - 1, R > 2p
+		new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 255), big.NewInt(19)),
+		new(big.Int).Lsh(big.NewInt(1), 64*MaxLimbs+1),
+	} {
+		_, err := New(p)
+		require.Error(t, err)
+	}
+}
+
+func fixedOrRandom(t *testing.T, f *Field, fixed *Element, class int) *Element {
+	if class == 0 {
+		return fixed
+	}
+	z, _ := randomElement(t, f)
+	return z
+}
+
+func TestField_ConstantTime(t *testing.T) {
+	if !dudect.Enabled() {
+		t.Skip("timing test, set " + dudect.EnvVar + "=1 to run it")
+	}
+
+	f := MustNew(elliptic.P256().Params().N)
+	var zero, one Element
+	f.SetOne(&one)
+	y, _ := randomElement(t, f)
+
+	res := dudect.Test(20000, 64, func(class int) func() {
+		x := *fixedOrRandom(t, f, &zero, class)
+		var z Element
+		return func() { f.Mul(&z, &x, y) }
+	})
+	require.True(t, res < dudect.Threshold, "Mul timing depends on the value, t = %f", res)
+
+	res = dudect.Test(4000, 1, func(class int) func() {
+		x := *fixedOrRandom(t, f, &one, class)
+		var z Element
+		return func() { f.Inv(&z, &x) }
+	})
+	require.True(t, res < dudect.Threshold, "Inv timing depends on the value, t = %f", res)
+}
+
+// TestField_DetectsLeak makes sure the timing test is able to notice the leak it is supposed to catch
+func TestField_DetectsLeak(t *testing.T) {
+	if !dudect.Enabled() {
+		t.Skip("timing test, set " + dudect.EnvVar + "=1 to run it")
+	}
+
+	p := elliptic.P256().Params().N
+	res := dudect.Test(4000, 1, func(class int) func() {
+		x := big.NewInt(1)
+		if class == 1 {
+			x, _ = rand.Int(rand.Reader, p)
+		}
+		return func() { new(big.Int).ModInverse(x, p) }
+	})
+	require.True(t, res > dudect.Threshold, "math/big ModInverse leak is not detected, t = %f", res)
+}
@@ -0,0 +1,349 @@
+/*
+ * Copyright (C) 2015-2019 Virgil Security Inc.
+ *
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ *     (1) Redistributions of source code must retain the above copyright
+ *     notice, this list of conditions and the following disclaimer.
+ *
+ *     (2) Redistributions in binary form must reproduce the above copyright
+ *     notice, this list of conditions and the following disclaimer in
+ *     the documentation and/or other materials provided with the
+ *     distribution.
+ *
+ *     (3) Neither the name of the copyright holder nor the names of its
+ *     contributors may be used to endorse or promote products derived from
+ *     this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ''AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+ * IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ *
+ * Lead Maintainer: Virgil Security Inc. <support@virgilsecurity.com>
+ */
+
+package phe
+
+import (
+	"crypto/elliptic"
+	"io"
+	"math/big"
+
+	"github.com/VirgilSecurity/virgil-phe-go/field"
+	"github.com/VirgilSecurity/virgil-phe-go/swu"
+	"github.com/golang/protobuf/proto"
+	"github.com/pkg/errors"
+)
+
+// Suite identifies the elliptic curve group the protocol runs in. Keys, records and messages carry it,
+// so data of different suites can't be mixed up in a deployment using several of them
+type Suite uint32
+
+const (
+	// SuiteP256 is NIST P-256, the default suite
+	SuiteP256 Suite = 0
+	// SuiteP384 is NIST P-384
+	SuiteP384 Suite = 1
+)
+
+// Protocol selects how passwords and nonces are mapped to curve points. Keys, records and messages carry it,
+// so records enrolled with the legacy mapping keep working after new keys switch to the standard one
+type Protocol uint32
+
+const (
+	// ProtocolV1 maps SHA-512 hashes truncated to the field size with the original Simple SWU implementation
+	ProtocolV1 Protocol = 0
+	// ProtocolV2 uses the hash_to_curve random oracle suites of RFC 9380:
+	// P256_XMD:SHA-256_SSWU_RO_ and P384_XMD:SHA-384_SSWU_RO_
+	ProtocolV2 Protocol = 1
+	// ProtocolV3 maps like ProtocolV2 and proves a wrong password with a Chaum-Pedersen style proof
+	// whose challenge covers the whole statement, see Server.proveFailureV3
+	ProtocolV3 Protocol = 2
+)
+
+// checkProtocol parses a protocol version of a message
+func checkProtocol(protocol uint32) (Protocol, error) {
+	switch p := Protocol(protocol); p {
+	case ProtocolV1, ProtocolV2, ProtocolV3:
+		return p, nil
+	}
+	return 0, ErrUnsupportedProtocol
+}
+
+// group implements scalar and element operations, encoding and hashing for one suite
+type group struct {
+	suite     Suite
+	curve     elliptic.Curve
+	gf        *swu.GF      // scalar field
+	zf        *field.Field // scalar field for secret fixed-length scalars
+	swu       *swu.SWU
+	h2c       *swu.HashToCurve
+	generator []byte // encoded base point
+	zLen      int
+	pointLen  int
+}
+
+var (
+	groupP256 = newGroup(SuiteP256, elliptic.P256(), swu.P256RO)
+	groupP384 = newGroup(SuiteP384, elliptic.P384(), swu.P384RO)
+)
+
+func newGroup(suite Suite, curve elliptic.Curve, h2c *swu.HashToCurve) *group {
+	params := curve.Params()
+	zLen := (params.N.BitLen() + 7) / 8
+
+	return &group{
+		suite:     suite,
+		curve:     curve,
+		gf:        swu.NewGF(params.N),
+		zf:        field.MustNew(params.N),
+		swu:       swu.MustNew(curve),
+		h2c:       h2c,
+		generator: elliptic.Marshal(curve, params.Gx, params.Gy),
+		zLen:      zLen,
+		pointLen:  1 + 2*((params.BitSize+7)/8),
+	}
+}
+
+// getGroup returns the group of a suite
+func getGroup(suite Suite) (*group, error) {
+	switch suite {
+	case SuiteP256:
+		return groupP256, nil
+	case SuiteP384:
+		return groupP384, nil
+	}
+	return nil, ErrUnsupportedSuite
+}
+
+// groupOfPoint returns the group whose elements are encoded with the given length
+func groupOfPoint(data []byte) (*group, error) {
+	switch len(data) {
+	case groupP256.pointLen:
+		return groupP256, nil
+	case groupP384.pointLen:
+		return groupP384, nil
+	}
+	return nil, ErrInvalidPoint
+}
+
+// checkSuite makes sure a message belongs to the group
+func (g *group) checkSuite(suite uint32) error {
+	if Suite(suite) != g.suite {
+		return ErrSuiteMismatch
+	}
+	return nil
+}
+
+// randomZ generates a random scalar from r which must be less than curve's N parameter
+func (g *group) randomZ(r io.Reader) (*big.Int, error) {
+	z, err := g.randomScalar(r)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(z), nil
+}
+
+// randomScalar is like randomZ but returns the scalar with the fixed length. Secret scalars are kept
+// in this form and computed with the constant-time scalar field, so that they never go through math/big
+func (g *group) randomScalar(r io.Reader) ([]byte, error) {
+	var e field.Element
+	for {
+		z := make([]byte, g.zLen)
+		if _, err := io.ReadFull(r, z); err != nil {
+			return nil, errors.Wrap(err, "random read failed")
+		}
+
+		// If the scalar is out of range, sample another random number.
+		if _, err := g.zf.SetCanonicalBytes(&e, z); err == nil {
+			return z, nil
+		}
+	}
+}
+
+// hashZ maps arrays of bytes to an integer less than curve's N parameter
+func (g *group) hashZ(domain []byte, data ...[]byte) *big.Int {
+	return new(big.Int).SetBytes(g.hashScalar(domain, data...))
+}
+
+// hashScalar is like hashZ but returns the scalar with the fixed length, it's used for secret scalars
+func (g *group) hashScalar(domain []byte, data ...[]byte) []byte {
+	xof := initKdf(domain, data...)
+
+	var e field.Element
+	var last []byte
+	for {
+		z := make([]byte, g.zLen)
+		if _, err := io.ReadFull(xof, z); err != nil {
+			// HKDF output is limited to 255 blocks. It would take hundreds of out of range numbers in a row to get here,
+			// which doesn't happen with the supported curves, but reducing the last one keeps the result defined
+			_, _ = g.zf.SetBytes(&e, last)
+			return g.zf.Bytes(&e)
+		}
+
+		// If the scalar is out of range, extract another number.
+		if _, err := g.zf.SetCanonicalBytes(&e, z); err == nil {
+			return z
+		}
+		last = z
+	}
+}
+
+// padZ makes all scalars equal size adding zeroes to the beginning if necessary
+func (g *group) padZ(z []byte) []byte {
+	if len(z) >= g.zLen {
+		return z
+	}
+
+	newZ := make([]byte, g.zLen)
+	copy(newZ[g.zLen-len(z):], z)
+	return newZ
+}
+
+// scalarBytes encodes a scalar with the fixed length the constant-time curve implementations expect,
+// a shorter encoding would take the variable-time path of crypto/elliptic
+func (g *group) scalarBytes(k *big.Int) ([]byte, error) {
+	if k.Sign() < 0 || k.BitLen() > 8*g.zLen {
+		return nil, errors.New("invalid scalar")
+	}
+	return k.FillBytes(make([]byte, g.zLen)), nil
+}
+
+// reduceScalar is like scalarBytes but brings numbers of any size and sign into the range with the scalar field.
+// Multiplying a point of the group by k and by k mod N gives the same result
+func (g *group) reduceScalar(k *big.Int) []byte {
+	if z, err := g.scalarBytes(k); err == nil {
+		return z
+	}
+
+	var e field.Element
+	_, _ = g.zf.SetWideBytes(&e, new(big.Int).Abs(k).Bytes())
+	if k.Sign() < 0 {
+		g.zf.Neg(&e, &e)
+	}
+	return g.zf.Bytes(&e)
+}
+
+// zMulAdd computes a * b + c modulo N. The fixed-length scalars are multiplied with the constant-time scalar field,
+// a nil c is zero
+func (g *group) zMulAdd(a, b, c []byte) []byte {
+	var x, y, z field.Element
+	_, _ = g.zf.SetBytes(&x, a)
+	_, _ = g.zf.SetBytes(&y, b)
+	_, _ = g.zf.SetBytes(&z, c)
+	g.zf.Mul(&x, &x, &y)
+	return g.zf.Bytes(g.zf.Add(&x, &x, &z))
+}
+
+// zNeg computes -a modulo N of a fixed-length scalar
+func (g *group) zNeg(a []byte) []byte {
+	var x field.Element
+	_, _ = g.zf.SetBytes(&x, a)
+	return g.zf.Bytes(g.zf.Neg(&x, &x))
+}
+
+// zInv computes 1 / a modulo N of a fixed-length scalar, the inverse of zero is zero
+func (g *group) zInv(a []byte) []byte {
+	var x field.Element
+	_, _ = g.zf.SetBytes(&x, a)
+	return g.zf.Bytes(g.zf.Inv(&x, &x))
+}
+
+// privateScalar pads a private key to the fixed length and checks that it's in the range [1, N) without math/big
+func (g *group) privateScalar(k []byte) ([]byte, error) {
+	if len(k) == 0 || len(k) > g.zLen {
+		return nil, ErrInvalidPrivateKey
+	}
+
+	z := g.padZ(k)
+	var e field.Element
+	if _, err := g.zf.SetCanonicalBytes(&e, z); err != nil || g.zf.IsZero(&e) == 1 {
+		return nil, ErrInvalidPrivateKey
+	}
+	return z, nil
+}
+
+// scalar parses a padded scalar which must be less than curve's N parameter
+func (g *group) scalar(z []byte) (*big.Int, error) {
+	if len(z) != g.zLen {
+		return nil, errors.New("invalid scalar")
+	}
+
+	res := new(big.Int).SetBytes(z)
+	if res.Cmp(g.curve.Params().N) >= 0 {
+		return nil, errors.New("invalid scalar")
+	}
+	return res, nil
+}
+
+// hashToPoint maps arrays of bytes to a valid curve point with the mapping of the protocol.
+// With ProtocolV2 and later the domain followed by "-" and the suite ID is used as hash_to_curve's domain separation tag
+// and the concatenated data as the message
+func (g *group) hashToPoint(protocol Protocol, domain []byte, data ...[]byte) (*Point, error) {
+	if protocol == ProtocolV1 {
+		hash := hash(domain, data...)
+		x, y, err := g.swu.HashToPoint(hash[:g.swu.HashLen()])
+		if err != nil {
+			return nil, err
+		}
+		return &Point{X: x, Y: y, g: g}, nil
+	}
+
+	dst := append(append(append([]byte(nil), domain...), '-'), g.h2c.ID...)
+	var msg []byte
+	for _, d := range data {
+		msg = append(msg, d...)
+	}
+
+	x, y, err := g.h2c.Hash(msg, dst)
+	if err != nil {
+		return nil, err
+	}
+	return &Point{X: x, Y: y, g: g}, nil
+}
+
+// unmarshalPoint validates & converts byte array to an element of the group
+func (g *group) unmarshalPoint(data []byte) (*Point, error) {
+	if len(data) != g.pointLen {
+		return nil, ErrInvalidPoint
+	}
+	x, y := elliptic.Unmarshal(g.curve, data)
+	if x == nil || y == nil {
+		return nil, ErrInvalidPoint
+	}
+	return &Point{X: x, Y: y, g: g}, nil
+}
+
+func (g *group) marshalKeypair(publicKey, privateKey []byte, protocol Protocol) ([]byte, error) {
+	kp := &Keypair{
+		PublicKey:  publicKey,
+		PrivateKey: privateKey,
+		Suite:      uint32(g.suite),
+		Protocol:   uint32(protocol),
+	}
+
+	return proto.Marshal(kp)
+}
+
+// base multiplies base point to a number
+func (g *group) base(k *big.Int) *Point {
+	return g.baseBytes(g.reduceScalar(k))
+}
+
+// baseBytes multiplies base point to a fixed-length scalar
+func (g *group) baseBytes(k []byte) *Point {
+	x, y := g.curve.ScalarBaseMult(g.padZ(k))
+	return &Point{X: x, Y: y, g: g}
+}
@@ -0,0 +1,493 @@
+/*
+ * Copyright (C) 2015-2019 Virgil Security Inc.
+ *
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ *     (1) Redistributions of source code must retain the above copyright
+ *     notice, this list of conditions and the following disclaimer.
+ *
+ *     (2) Redistributions in binary form must reproduce the above copyright
+ *     notice, this list of conditions and the following disclaimer in
+ *     the documentation and/or other materials provided with the
+ *     distribution.
+ *
+ *     (3) Neither the name of the copyright holder nor the names of its
+ *     contributors may be used to endorse or promote products derived from
+ *     this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ''AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+ * IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ *
+ * Lead Maintainer: Virgil Security Inc. <support@virgilsecurity.com>
+ */
+
+package phe
+
+import (
+	"crypto/rand"
+	"math/big"
+	"testing"
+
+	"github.com/VirgilSecurity/virgil-phe-go/swu"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGroup_P384(t *testing.T) {
+	serverKeypair, err := GenerateServerKeypair(WithSuite(SuiteP384))
+	require.NoError(t, err)
+	pub, err := GetPublicKey(serverKeypair)
+	require.NoError(t, err)
+	require.Len(t, pub, groupP384.pointLen)
+
+	c, err := NewClient(pub, generateClientKey(t, WithSuite(SuiteP384)))
+	require.NoError(t, err)
+
+	enrollment, err := GetEnrollment(serverKeypair)
+	require.NoError(t, err)
+	rec, key, err := c.EnrollAccount(pwd, enrollment)
+	require.NoError(t, err)
+
+	parsed := &EnrollmentRecord{}
+	require.NoError(t, proto.Unmarshal(rec, parsed))
+	require.Equal(t, uint32(SuiteP384), parsed.Suite)
+
+	req, err := c.CreateVerifyPasswordRequest(pwd, rec)
+	require.NoError(t, err)
+	resp, err := VerifyPassword(serverKeypair, req)
+	require.NoError(t, err)
+	keyDec, err := c.CheckResponseAndDecrypt(pwd, rec, resp)
+	require.NoError(t, err)
+	require.Equal(t, key, keyDec)
+
+	// wrong password is proven with a P-384 proof of fail
+	req, err = c.CreateVerifyPasswordRequest([]byte("wrong"), rec)
+	require.NoError(t, err)
+	resp, err = VerifyPassword(serverKeypair, req)
+	require.NoError(t, err)
+	keyDec, err = c.CheckResponseAndDecrypt([]byte("wrong"), rec, resp)
+	require.Equal(t, ErrWrongPassword, err)
+	require.Nil(t, keyDec)
+
+	token, newKeypair, err := Rotate(serverKeypair)
+	require.NoError(t, err)
+	require.NoError(t, c.Rotate(token))
+	rec, err = UpdateRecord(pub, rec, token)
+	require.NoError(t, err)
+
+	req, err = c.CreateVerifyPasswordRequest(pwd, rec)
+	require.NoError(t, err)
+	resp, err = VerifyPassword(newKeypair, req)
+	require.NoError(t, err)
+	keyDec, err = c.CheckResponseAndDecrypt(pwd, rec, resp)
+	require.NoError(t, err)
+	require.Equal(t, key, keyDec)
+}
+
+func TestGroup_Mismatch(t *testing.T) {
+	kp256, err := GenerateServerKeypair()
+	require.NoError(t, err)
+	kp384, err := GenerateServerKeypair(WithSuite(SuiteP384))
+	require.NoError(t, err)
+
+	pub256, err := GetPublicKey(kp256)
+	require.NoError(t, err)
+	pub384, err := GetPublicKey(kp384)
+	require.NoError(t, err)
+
+	c256, err := NewClient(pub256, generateClientKey(t))
+	require.NoError(t, err)
+	c384, err := NewClient(pub384, generateClientKey(t, WithSuite(SuiteP384)))
+	require.NoError(t, err)
+
+	// a P-384 sized key doesn't fit P-256
+	bigKey := make([]byte, groupP384.zLen)
+	bigKey[0] = 1
+	_, err = NewClient(pub256, bigKey)
+	require.EqualError(t, err, "invalid private key")
+
+	enrollment384, err := GetEnrollment(kp384)
+	require.NoError(t, err)
+	_, _, err = c256.EnrollAccount(pwd, enrollment384)
+	require.Error(t, err)
+
+	rec384, _, err := c384.EnrollAccount(pwd, enrollment384)
+	require.NoError(t, err)
+	_, err = c256.CreateVerifyPasswordRequest(pwd, rec384)
+	require.EqualError(t, err, "suite does not match")
+
+	req384, err := c384.CreateVerifyPasswordRequest(pwd, rec384)
+	require.NoError(t, err)
+	_, err = VerifyPassword(kp256, req384)
+	require.EqualError(t, err, "suite does not match")
+
+	token256, _, err := Rotate(kp256)
+	require.NoError(t, err)
+	_, err = UpdateRecord(pub256, rec384, token256)
+	require.EqualError(t, err, "suite does not match")
+	require.Error(t, c384.Rotate(token256))
+
+	// a record relabeled with another suite is rejected as well
+	rec := &EnrollmentRecord{}
+	require.NoError(t, proto.Unmarshal(rec384, rec))
+	rec.Suite = uint32(SuiteP256)
+	relabeled, err := proto.Marshal(rec)
+	require.NoError(t, err)
+	_, err = c384.CreateVerifyPasswordRequest(pwd, relabeled)
+	require.EqualError(t, err, "suite does not match")
+
+	_, err = GenerateServerKeypair(WithSuite(Suite(42)))
+	require.Error(t, err)
+}
+
+func TestGroup_Scalars(t *testing.T) {
+	for _, g := range []*group{groupP256, groupP384} {
+		n := g.curve.Params().N
+
+		// scalars which don't fit the fixed length are rejected rather than encoded with a variable length
+		_, err := g.scalarBytes(big.NewInt(-1))
+		require.Error(t, err)
+		_, err = g.scalarBytes(new(big.Int).Lsh(n, 8))
+		require.Error(t, err)
+		k, err := g.scalarBytes(big.NewInt(1))
+		require.NoError(t, err)
+		require.Len(t, k, g.zLen)
+
+		// points are multiplied by such scalars modulo N
+		require.Equal(t, g.base(big.NewInt(1)), g.base(new(big.Int).Add(new(big.Int).Lsh(n, 100), big.NewInt(1))))
+		require.Equal(t, g.base(new(big.Int).Sub(n, big.NewInt(1))), g.base(big.NewInt(-1)))
+
+		for _, bad := range [][]byte{nil, make([]byte, g.zLen), n.Bytes(), make([]byte, g.zLen+1)} {
+			_, err = g.privateScalar(bad)
+			require.Equal(t, ErrInvalidPrivateKey, err)
+		}
+		k, err = g.privateScalar([]byte{1})
+		require.NoError(t, err)
+		require.Equal(t, g.padZ([]byte{1}), k)
+
+		for i := 0; i < 20; i++ {
+			a, err := g.randomScalar(rand.Reader)
+			require.NoError(t, err)
+			b, err := g.randomScalar(rand.Reader)
+			require.NoError(t, err)
+			c, err := g.randomScalar(rand.Reader)
+			require.NoError(t, err)
+			require.Len(t, a, g.zLen)
+
+			ai, bi, ci := new(big.Int).SetBytes(a), new(big.Int).SetBytes(b), new(big.Int).SetBytes(c)
+			expected := new(big.Int).Mod(new(big.Int).Add(new(big.Int).Mul(ai, bi), ci), n)
+			require.Equal(t, g.padZ(expected.Bytes()), g.zMulAdd(a, b, c))
+			require.Equal(t, g.padZ(new(big.Int).Mod(new(big.Int).Neg(ai), n).Bytes()), g.zNeg(a))
+			require.Equal(t, g.padZ(new(big.Int).ModInverse(ai, n).Bytes()), g.zInv(a))
+		}
+	}
+}
+
+func TestGroup_PointUnmarshal(t *testing.T) {
+	for _, g := range []*group{groupP256, groupP384} {
+		p, err := g.hashToPoint(ProtocolV1, dhc0, pwd)
+		require.NoError(t, err)
+		data := p.Marshal()
+		require.Len(t, data, g.pointLen)
+
+		res, err := PointUnmarshal(data)
+		require.NoError(t, err)
+		require.True(t, p.Equal(res))
+		require.Equal(t, g, res.group())
+
+		_, err = PointUnmarshal(data[1:])
+		require.Error(t, err)
+	}
+
+	// same coordinates in different groups are different points
+	p, err := groupP256.hashToPoint(ProtocolV1, dhc0, pwd)
+	require.NoError(t, err)
+	require.False(t, p.Equal(&Point{X: p.X, Y: p.Y, g: groupP384}))
+}
+
+func TestGroup_Threshold_P384ProtocolV2(t *testing.T) {
+	keypairs, err := GenerateThresholdKeypairs(2, 3, WithSuite(SuiteP384), WithProtocol(ProtocolV2))
+	require.NoError(t, err)
+
+	pub, err := GetThresholdPublicKey(keypairs[0])
+	require.NoError(t, err)
+
+	servers := make([]*ThresholdServer, len(keypairs))
+	for i, kp := range keypairs {
+		servers[i], err = NewThresholdServer(kp)
+		require.NoError(t, err)
+	}
+
+	c, err := NewThresholdClient(pub, generateClientKey(t, WithSuite(SuiteP384)))
+	require.NoError(t, err)
+
+	var nonces [][]byte
+	for _, s := range servers[:2] {
+		n, err := s.GetEnrollmentNonce()
+		require.NoError(t, err)
+		nonces = append(nonces, n)
+	}
+	enrollReq, err := c.CreateEnrollmentRequest(nonces)
+	require.NoError(t, err)
+
+	var enrollResps [][]byte
+	for _, s := range servers[:2] {
+		r, err := s.GetEnrollment(enrollReq)
+		require.NoError(t, err)
+		enrollResps = append(enrollResps, r)
+	}
+	rec, key, err := c.EnrollAccount(pwd, enrollReq, enrollResps)
+	require.NoError(t, err)
+
+	req, err := c.CreateVerifyPasswordRequest(pwd, rec)
+	require.NoError(t, err)
+
+	var commitments [][]byte
+	for _, s := range servers[1:] {
+		cm, err := s.CommitVerifyPassword(req)
+		require.NoError(t, err)
+		commitments = append(commitments, cm)
+	}
+	req2, err := c.CombineCommitments(req, commitments)
+	require.NoError(t, err)
+
+	var resps [][]byte
+	for _, s := range servers[1:] {
+		r, err := s.VerifyPassword(req2)
+		require.NoError(t, err)
+		resps = append(resps, r)
+	}
+	keyDec, err := c.CheckResponsesAndDecrypt(pwd, rec, req2, resps)
+	require.NoError(t, err)
+	require.Equal(t, key, keyDec)
+}
+
+func TestProtocolV2(t *testing.T) {
+	// everything but the failure proof works the same way with ProtocolV3
+	for _, protocol := range []Protocol{ProtocolV2, ProtocolV3} {
+		for _, suite := range []Suite{SuiteP256, SuiteP384} {
+			testProtocol(t, protocol, suite)
+		}
+	}
+}
+
+func testProtocol(t *testing.T, protocol Protocol, suite Suite) {
+	kp, err := GenerateServerKeypair(WithSuite(suite), WithProtocol(protocol))
+	require.NoError(t, err)
+
+	keys := NewServerKeyRing()
+	require.NoError(t, keys.Add(1, kp))
+	pub, err := keys.GetPublicKey(1)
+	require.NoError(t, err)
+
+	clients := NewClientKeyRing()
+	require.NoError(t, clients.Add(1, pub, generateClientKey(t, WithSuite(suite))))
+
+	enrollment, err := keys.GetEnrollment()
+	require.NoError(t, err)
+	rec, key, err := clients.EnrollAccount(pwd, enrollment)
+	require.NoError(t, err)
+
+	parsed := &EnrollmentRecord{}
+	require.NoError(t, proto.Unmarshal(rec, parsed))
+	require.Equal(t, uint32(protocol), parsed.Protocol)
+
+	requireLogin(t, keys, clients, rec, key)
+
+	req, err := clients.CreateVerifyPasswordRequest([]byte("wrong"), rec)
+	require.NoError(t, err)
+	resp, err := keys.VerifyPassword(req)
+	require.NoError(t, err)
+	keyDec, err := clients.CheckResponseAndDecrypt([]byte("wrong"), rec, resp)
+	require.Equal(t, ErrWrongPassword, err)
+	require.Nil(t, keyDec)
+
+	// rotation keeps the protocol
+	token, newKeypair, err := keys.Rotate()
+	require.NoError(t, err)
+	newKp, err := unmarshalKeypair(newKeypair)
+	require.NoError(t, err)
+	require.Equal(t, uint32(protocol), newKp.Protocol)
+	_, _, err = clients.Rotate(token)
+	require.NoError(t, err)
+
+	rec, err = UpdateRecord(pub, rec, token)
+	require.NoError(t, err)
+	requireLogin(t, keys, clients, rec, key)
+}
+
+func TestProtocolV2_Mismatch(t *testing.T) {
+	kp1, err := GenerateServerKeypair()
+	require.NoError(t, err)
+	kp2, err := GenerateServerKeypair(WithProtocol(ProtocolV2))
+	require.NoError(t, err)
+
+	pub1, err := GetPublicKey(kp1)
+	require.NoError(t, err)
+	c, err := NewClient(pub1, generateClientKey(t))
+	require.NoError(t, err)
+
+	enrollment, err := GetEnrollment(kp1)
+	require.NoError(t, err)
+	rec1, _, err := c.EnrollAccount(pwd, enrollment)
+	require.NoError(t, err)
+
+	// a request of a legacy record is rejected by a server with the same private key but the new protocol
+	s1, err := NewServer(kp1)
+	require.NoError(t, err)
+	s1.protocol = ProtocolV2
+	req, err := c.CreateVerifyPasswordRequest(pwd, rec1)
+	require.NoError(t, err)
+	_, err = s1.VerifyPassword(req)
+	require.EqualError(t, err, "protocol does not match")
+
+	pub2, err := GetPublicKey(kp2)
+	require.NoError(t, err)
+	token2, _, err := Rotate(kp2)
+	require.NoError(t, err)
+	_, err = UpdateRecord(pub2, rec1, token2)
+	require.EqualError(t, err, "protocol does not match")
+
+	_, err = GenerateServerKeypair(WithProtocol(Protocol(7)))
+	require.Error(t, err)
+
+	rec := &EnrollmentRecord{}
+	require.NoError(t, proto.Unmarshal(rec1, rec))
+	rec.Protocol = 7
+	unknown, err := proto.Marshal(rec)
+	require.NoError(t, err)
+	_, err = c.CreateVerifyPasswordRequest(pwd, unknown)
+	require.EqualError(t, err, "unsupported protocol")
+}
+
+// TestProtocolV2_HashToCurve pins the way data is passed to hash_to_curve, other implementations have to do the same
+func TestProtocolV2_HashToCurve(t *testing.T) {
+	ns := make([]byte, pheNonceLen)
+	require.NoError(t, randRead(rand.Reader, ns))
+
+	p, err := groupP256.hashToPoint(ProtocolV2, dhc0, ns, pwd)
+	require.NoError(t, err)
+	x, y, err := swu.P256RO.Hash(append(append([]byte(nil), ns...), pwd...), []byte("VRGLPHE1-P256_XMD:SHA-256_SSWU_RO_"))
+	require.NoError(t, err)
+	require.Equal(t, x, p.X)
+	require.Equal(t, y, p.Y)
+
+	p, err = groupP384.hashToPoint(ProtocolV2, dhs1, ns)
+	require.NoError(t, err)
+	x, y, err = swu.P384RO.Hash(ns, []byte("VRGLPHE4-P384_XMD:SHA-384_SSWU_RO_"))
+	require.NoError(t, err)
+	require.Equal(t, x, p.X)
+	require.Equal(t, y, p.Y)
+}
+
+// TestProtocolV3_ForgedProofOfFail makes sure that a server can't claim that a correct password is wrong
+func TestProtocolV3_ForgedProofOfFail(t *testing.T) {
+	kp, err := GenerateServerKeypair(WithProtocol(ProtocolV3))
+	require.NoError(t, err)
+	s, err := NewServer(kp)
+	require.NoError(t, err)
+	c, err := NewClient(s.GetPublicKey(), generateClientKey(t))
+	require.NoError(t, err)
+
+	enrollment, err := s.GetEnrollment()
+	require.NoError(t, err)
+	rec, _, err := c.EnrollAccount(pwd, enrollment)
+	require.NoError(t, err)
+
+	reqBytes, err := c.CreateVerifyPasswordRequest(pwd, rec)
+	require.NoError(t, err)
+	req := &VerifyPasswordRequest{}
+	require.NoError(t, proto.Unmarshal(reqBytes, req))
+	c0, err := s.g.unmarshalPoint(req.C0)
+	require.NoError(t, err)
+	hs0, err := s.g.hashToPoint(ProtocolV3, dhs0, req.Ns)
+	require.NoError(t, err)
+
+	check := func(resp *VerifyPasswordResponse) error {
+		respBytes, err := proto.Marshal(resp)
+		require.NoError(t, err)
+		key, err := c.CheckResponseAndDecrypt(pwd, rec, respBytes)
+		require.Nil(t, key)
+		return err
+	}
+
+	// the honest witness a = r, b = -r * x gives the point at infinity for a correct password
+	scalar := func() []byte {
+		return s.g.padZ(randomZ().Bytes())
+	}
+	r := scalar()
+	c1 := c0.ScalarMult(r).Add(hs0.ScalarMult(s.g.zMulAdd(s.g.zNeg(r), s.privateKeyBytes, nil)))
+	require.True(t, c1.isInfinity())
+
+	// any other witness satisfies c1 = c0 * a + hs0 * b but not I = X * a + G * b
+	a, b := scalar(), scalar()
+	c1 = c0.ScalarMult(a).Add(hs0.ScalarMult(b))
+	proof, err := s.proveFailureV3(c0, hs0, c1, a, b)
+	require.NoError(t, err)
+	forged := &VerifyPasswordResponse{C1: c1.Marshal(), Proof: proof}
+	require.Equal(t, ErrInvalidProof, check(forged))
+
+	// b = -a * x with another key
+	b = s.g.zMulAdd(s.g.zNeg(a), scalar(), nil)
+	c1 = c0.ScalarMult(a).Add(hs0.ScalarMult(b))
+	proof, err = s.proveFailureV3(c0, hs0, c1, a, b)
+	require.NoError(t, err)
+	forged = &VerifyPasswordResponse{C1: c1.Marshal(), Proof: proof}
+	require.Equal(t, ErrInvalidProof, check(forged))
+
+	// a valid proof for a wrong password can't be replayed
+	wrongReq, err := c.CreateVerifyPasswordRequest([]byte("wrong"), rec)
+	require.NoError(t, err)
+	wrongRespBytes, err := s.VerifyPassword(wrongReq)
+	require.NoError(t, err)
+	_, err = c.CheckResponseAndDecrypt([]byte("wrong"), rec, wrongRespBytes)
+	require.Equal(t, ErrWrongPassword, err)
+	wrongResp := &VerifyPasswordResponse{}
+	require.NoError(t, proto.Unmarshal(wrongRespBytes, wrongResp))
+	require.Equal(t, ErrInvalidProof, check(wrongResp))
+
+	tamper := func(f func(p *ProofOfFail)) *VerifyPasswordResponse {
+		resp := &VerifyPasswordResponse{}
+		require.NoError(t, proto.Unmarshal(wrongRespBytes, resp))
+		f(resp.GetFail())
+		return resp
+	}
+	checkWrong := func(resp *VerifyPasswordResponse) error {
+		respBytes, err := proto.Marshal(resp)
+		require.NoError(t, err)
+		_, err = c.CheckResponseAndDecrypt([]byte("wrong"), rec, respBytes)
+		return err
+	}
+
+	require.Equal(t, ErrInvalidProof, checkWrong(tamper(func(p *ProofOfFail) {
+		p.BlindA = padZ(gf.Add(new(big.Int).SetBytes(p.BlindA), big.NewInt(1)).Bytes())
+	})))
+	require.Equal(t, ErrInvalidProof, checkWrong(tamper(func(p *ProofOfFail) {
+		p.Term1, p.Term2 = p.Term2, p.Term1
+	})))
+	require.Equal(t, ErrInvalidProof, checkWrong(tamper(func(p *ProofOfFail) {
+		p.BlindB = padZ(curve.Params().N.Bytes())
+	})))
+
+	// the legacy proof isn't accepted for ProtocolV3 records
+	s.protocol = ProtocolV1
+	_, legacy, err := s.proveFailure(c0, hs0)
+	require.NoError(t, err)
+	require.Equal(t, ErrInvalidProof, checkWrong(tamper(func(p *ProofOfFail) {
+		p.Term3, p.Term4 = legacy.Fail.Term3, legacy.Fail.Term4
+	})))
+}
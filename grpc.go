@@ -0,0 +1,313 @@
+/*
+ * Copyright (C) 2015-2019 Virgil Security Inc.
+ *
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ *     (1) Redistributions of source code must retain the above copyright
+ *     notice, this list of conditions and the following disclaimer.
+ *
+ *     (2) Redistributions in binary form must reproduce the above copyright
+ *     notice, this list of conditions and the following disclaimer in
+ *     the documentation and/or other materials provided with the
+ *     distribution.
+ *
+ *     (3) Neither the name of the copyright holder nor the names of its
+ *     contributors may be used to endorse or promote products derived from
+ *     this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ''AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+ * IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ *
+ * Lead Maintainer: Virgil Security Inc. <support@virgilsecurity.com>
+ */
+
+package phe
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/pkg/errors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// trailer keys used to pass ThrottledError details
+const (
+	retryAfterTrailer = "phe-retry-after-ms"
+	lockedTrailer     = "phe-locked"
+)
+
+// GRPCServer implements the PHE gRPC service on top of a ServerKeyRing
+type GRPCServer struct {
+	keys     *ServerKeyRing
+	onRotate func(version uint32, newServerKeypair []byte) error
+}
+
+// NewGRPCServer creates a gRPC service which serves the keys of the key ring.
+// onRotate is called with every keypair created by Rotate and must persist it, a failure cancels the rotation.
+// If onRotate is nil, Rotate is disabled. Rotate issues update tokens to whoever calls it,
+// so it must only be reachable by administrators, e.g. through an interceptor or a separate listener
+func NewGRPCServer(keys *ServerKeyRing, onRotate func(version uint32, newServerKeypair []byte) error) *GRPCServer {
+	return &GRPCServer{
+		keys:     keys,
+		onRotate: onRotate,
+	}
+}
+
+// Register registers the service with a gRPC server
+func (g *GRPCServer) Register(s *grpc.Server) {
+	RegisterPHEServer(s, g)
+}
+
+// GetEnrollment generates a new enrollment using the current key version
+func (g *GRPCServer) GetEnrollment(ctx context.Context, req *GetEnrollmentRequest) (*EnrollmentResponse, error) {
+	s, err := g.keys.get(nil)
+	if err != nil {
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	}
+
+	resp, err := s.enrollment()
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return resp, nil
+}
+
+// GetPublicKey returns the public key of the requested version or the current one
+func (g *GRPCServer) GetPublicKey(ctx context.Context, req *GetPublicKeyRequest) (*GetPublicKeyResponse, error) {
+	var version *uint32
+	if !req.Current {
+		version = &req.Version
+	}
+
+	s, err := g.keys.get(version)
+	if err != nil {
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
+
+	return &GetPublicKeyResponse{
+		PublicKey: s.GetPublicKey(),
+		Version:   s.version,
+	}, nil
+}
+
+// VerifyPassword verifies a password attempt with the key version the record was enrolled with
+func (g *GRPCServer) VerifyPassword(ctx context.Context, req *VerifyPasswordRequest) (*VerifyPasswordResponse, error) {
+	s, err := g.keys.get(&req.Version)
+	if err != nil {
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
+
+	resp, _, err := s.verify(req)
+	if err != nil {
+		if te, ok := errors.Cause(err).(*ThrottledError); ok {
+			// the trailer is best effort, the error code is what matters
+			_ = grpc.SetTrailer(ctx, metadata.Pairs(
+				retryAfterTrailer, strconv.FormatInt(int64(te.RetryAfter/time.Millisecond), 10),
+				lockedTrailer, strconv.FormatBool(te.Locked),
+			))
+			return nil, status.Error(codes.ResourceExhausted, te.Error())
+		}
+		if isInputError(err) {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	return resp, nil
+}
+
+// Rotate creates a new key version, persists it with the onRotate hook and returns the update token
+func (g *GRPCServer) Rotate(ctx context.Context, req *RotateRequest) (*UpdateToken, error) {
+	if g.onRotate == nil {
+		return nil, status.Error(codes.Unimplemented, "rotation is disabled")
+	}
+
+	tokenBytes, _, err := g.keys.rotate(g.onRotate)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	token := &UpdateToken{}
+	if err = proto.Unmarshal(tokenBytes, token); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	return token, nil
+}
+
+// GRPCClient calls a remote PHE service. Its methods take and return the same serialized messages as
+// the functions of this package, so they can be used with Client and ClientKeyRing directly
+type GRPCClient struct {
+	client PHEClient
+}
+
+// NewGRPCClient creates a client of the PHE service reachable through the connection
+func NewGRPCClient(cc *grpc.ClientConn) *GRPCClient {
+	return &GRPCClient{
+		client: NewPHEClient(cc),
+	}
+}
+
+// GetEnrollment returns a new enrollment response
+func (c *GRPCClient) GetEnrollment(ctx context.Context) ([]byte, error) {
+	resp, err := c.client.GetEnrollment(ctx, &GetEnrollmentRequest{})
+	if err != nil {
+		return nil, err
+	}
+
+	return proto.Marshal(resp)
+}
+
+// GetPublicKey returns server public key of the given version
+func (c *GRPCClient) GetPublicKey(ctx context.Context, version uint32) ([]byte, error) {
+	resp, err := c.client.GetPublicKey(ctx, &GetPublicKeyRequest{Version: version})
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.PublicKey, nil
+}
+
+// GetCurrentPublicKey returns the current server public key and its version
+func (c *GRPCClient) GetCurrentPublicKey(ctx context.Context) (publicKey []byte, version uint32, err error) {
+	resp, err := c.client.GetPublicKey(ctx, &GetPublicKeyRequest{Current: true})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return resp.PublicKey, resp.Version, nil
+}
+
+// VerifyPassword sends a request created by Client.CreateVerifyPasswordRequest and returns the server's response.
+// A throttled attempt is returned as *ThrottledError
+func (c *GRPCClient) VerifyPassword(ctx context.Context, reqBytes []byte) ([]byte, error) {
+	req := &VerifyPasswordRequest{}
+	if err := proto.Unmarshal(reqBytes, req); err != nil {
+		return nil, ErrInvalidRequest
+	}
+
+	resp, err := c.verifyPassword(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	return proto.Marshal(resp)
+}
+
+func (c *GRPCClient) verifyPassword(ctx context.Context, req *VerifyPasswordRequest) (*VerifyPasswordResponse, error) {
+	var trailer metadata.MD
+	resp, err := c.client.VerifyPassword(ctx, req, grpc.Trailer(&trailer))
+	if status.Code(err) == codes.ResourceExhausted {
+		return nil, throttledFromTrailer(trailer)
+	}
+	return resp, err
+}
+
+func throttledFromTrailer(md metadata.MD) *ThrottledError {
+	te := &ThrottledError{}
+	if v := md.Get(retryAfterTrailer); len(v) > 0 {
+		if ms, err := strconv.ParseInt(v[0], 10, 64); err == nil {
+			te.RetryAfter = time.Duration(ms) * time.Millisecond
+		}
+	}
+	if v := md.Get(lockedTrailer); len(v) > 0 {
+		te.Locked, _ = strconv.ParseBool(v[0])
+	}
+	return te
+}
+
+// Rotate asks the server to rotate its key and returns the update token
+func (c *GRPCClient) Rotate(ctx context.Context) ([]byte, error) {
+	token, err := c.client.Rotate(ctx, &RotateRequest{})
+	if err != nil {
+		return nil, err
+	}
+
+	return proto.Marshal(token)
+}
+
+// EnrollAccount requests a new enrollment from the server and uses it to create an Enrollment Record
+func (c *GRPCClient) EnrollAccount(ctx context.Context, client *Client, password []byte) (rec []byte, key []byte, err error) {
+	resp, err := c.client.GetEnrollment(ctx, &GetEnrollmentRequest{})
+	if err != nil {
+		return
+	}
+
+	return client.enrollAccount(password, resp)
+}
+
+// CheckPassword verifies the password against the record with the server and returns the data encryption key on success.
+// ErrWrongPassword is returned if the server has proven that the password is wrong
+func (c *GRPCClient) CheckPassword(ctx context.Context, client *Client, password []byte, recBytes []byte) (key []byte, err error) {
+	rec := &EnrollmentRecord{}
+	if err = proto.Unmarshal(recBytes, rec); err != nil {
+		return nil, ErrInvalidRecord
+	}
+
+	reqBytes, err := client.createVerifyPasswordRequest(password, rec)
+	if err != nil {
+		return
+	}
+
+	req := &VerifyPasswordRequest{}
+	if err = proto.Unmarshal(reqBytes, req); err != nil {
+		return nil, ErrInvalidRequest
+	}
+
+	resp, err := c.verifyPassword(ctx, req)
+	if err != nil {
+		return
+	}
+
+	return client.checkResponseAndDecrypt(password, rec, resp)
+}
+
+// ChangePassword verifies the old password with the server, requests a new enrollment and enrolls the new password,
+// see Client.ChangePassword. The caller must replace the record and the wrapped key together
+func (c *GRPCClient) ChangePassword(ctx context.Context, client *Client, oldPassword, newPassword, recBytes, wrappedKey []byte) (newRec, newKey, newWrappedKey []byte, err error) {
+	rec := &EnrollmentRecord{}
+	if err = proto.Unmarshal(recBytes, rec); err != nil {
+		return nil, nil, nil, ErrInvalidRecord
+	}
+
+	reqBytes, err := client.createVerifyPasswordRequest(oldPassword, rec)
+	if err != nil {
+		return
+	}
+
+	req := &VerifyPasswordRequest{}
+	if err = proto.Unmarshal(reqBytes, req); err != nil {
+		return nil, nil, nil, ErrInvalidRequest
+	}
+
+	resp, err := c.verifyPassword(ctx, req)
+	if err != nil {
+		return
+	}
+
+	enrollment, err := c.client.GetEnrollment(ctx, &GetEnrollmentRequest{})
+	if err != nil {
+		return
+	}
+
+	return changePassword(client, client, oldPassword, newPassword, rec, resp, enrollment, wrappedKey)
+}
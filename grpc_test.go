@@ -0,0 +1,241 @@
+/*
+ * Copyright (C) 2015-2019 Virgil Security Inc.
+ *
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ *     (1) Redistributions of source code must retain the above copyright
+ *     notice, this list of conditions and the following disclaimer.
+ *
+ *     (2) Redistributions in binary form must reproduce the above copyright
+ *     notice, this list of conditions and the following disclaimer in
+ *     the documentation and/or other materials provided with the
+ *     distribution.
+ *
+ *     (3) Neither the name of the copyright holder nor the names of its
+ *     contributors may be used to endorse or promote products derived from
+ *     this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ''AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+ * IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ *
+ * Lead Maintainer: Virgil Security Inc. <support@virgilsecurity.com>
+ */
+
+package phe
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+func startGRPC(t *testing.T, srv *GRPCServer) *GRPCClient {
+	lis := bufconn.Listen(1 << 20)
+	s := grpc.NewServer()
+	srv.Register(s)
+	go func() {
+		_ = s.Serve(lis)
+	}()
+	t.Cleanup(s.Stop)
+
+	cc, err := grpc.NewClient("passthrough:///bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return lis.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = cc.Close()
+	})
+
+	return NewGRPCClient(cc)
+}
+
+func TestGRPC_Full(t *testing.T) {
+	ctx := context.Background()
+
+	serverKeypair, err := GenerateServerKeypair()
+	require.NoError(t, err)
+	keys := NewServerKeyRing()
+	require.NoError(t, keys.Add(0, serverKeypair))
+
+	persisted := make(map[uint32][]byte)
+	remote := startGRPC(t, NewGRPCServer(keys, func(version uint32, kp []byte) error {
+		persisted[version] = kp
+		return nil
+	}))
+
+	pub, version, err := remote.GetCurrentPublicKey(ctx)
+	require.NoError(t, err)
+	require.Equal(t, uint32(0), version)
+
+	c, err := NewClient(pub, generateClientKey(t))
+	require.NoError(t, err)
+
+	rec, key, err := remote.EnrollAccount(ctx, c, pwd)
+	require.NoError(t, err)
+
+	keyDec, err := remote.CheckPassword(ctx, c, pwd, rec)
+	require.NoError(t, err)
+	require.Equal(t, key, keyDec)
+
+	keyDec, err = remote.CheckPassword(ctx, c, []byte("Password1"), rec)
+	require.Equal(t, ErrWrongPassword, err)
+	require.Nil(t, keyDec)
+
+	// serialized messages work with the package functions as well
+	req, err := c.CreateVerifyPasswordRequest(pwd, rec)
+	require.NoError(t, err)
+	resp, err := remote.VerifyPassword(ctx, req)
+	require.NoError(t, err)
+	keyDec, err = c.CheckResponseAndDecrypt(pwd, rec, resp)
+	require.NoError(t, err)
+	require.Equal(t, key, keyDec)
+
+	token, err := remote.Rotate(ctx)
+	require.NoError(t, err)
+	require.Contains(t, persisted, uint32(1))
+	require.NoError(t, c.Rotate(token))
+
+	newPub, err := remote.GetPublicKey(ctx, 1)
+	require.NoError(t, err)
+	persistedPub, err := GetPublicKey(persisted[1])
+	require.NoError(t, err)
+	require.Equal(t, persistedPub, newPub)
+
+	rec, err = UpdateRecord(pub, rec, token)
+	require.NoError(t, err)
+	keyDec, err = remote.CheckPassword(ctx, c, pwd, rec)
+	require.NoError(t, err)
+	require.Equal(t, key, keyDec)
+
+	dataKey, err := GenerateDataKey()
+	require.NoError(t, err)
+	wrappedKey, err := WrapKey(dataKey, key)
+	require.NoError(t, err)
+	_, _, _, err = remote.ChangePassword(ctx, c, []byte("Password1"), []byte("Password2"), rec, wrappedKey)
+	require.Equal(t, ErrWrongPassword, err)
+	rec, key, wrappedKey, err = remote.ChangePassword(ctx, c, pwd, []byte("Password2"), rec, wrappedKey)
+	require.NoError(t, err)
+	keyDec, err = remote.CheckPassword(ctx, c, []byte("Password2"), rec)
+	require.NoError(t, err)
+	require.Equal(t, key, keyDec)
+	unwrapped, err := UnwrapKey(wrappedKey, key)
+	require.NoError(t, err)
+	require.Equal(t, dataKey, unwrapped)
+
+	_, err = remote.GetPublicKey(ctx, 2)
+	require.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func TestGRPC_Throttled(t *testing.T) {
+	ctx := context.Background()
+
+	serverKeypair, err := GenerateServerKeypair()
+	require.NoError(t, err)
+	keys := NewServerKeyRing(WithRateLimiter(NewMemoryRateLimiter(RateLimitPolicy{LockoutAfter: 1})))
+	require.NoError(t, keys.Add(0, serverKeypair))
+	remote := startGRPC(t, NewGRPCServer(keys, nil))
+
+	pub, err := remote.GetPublicKey(ctx, 0)
+	require.NoError(t, err)
+	c, err := NewClient(pub, generateClientKey(t))
+	require.NoError(t, err)
+
+	rec, _, err := remote.EnrollAccount(ctx, c, pwd)
+	require.NoError(t, err)
+
+	_, err = remote.CheckPassword(ctx, c, []byte("Password1"), rec)
+	require.Equal(t, ErrWrongPassword, err)
+
+	_, err = remote.CheckPassword(ctx, c, pwd, rec)
+	require.Equal(t, &ThrottledError{Locked: true}, err)
+
+	// rotation is disabled without a persistence hook
+	_, err = remote.Rotate(ctx)
+	require.Equal(t, codes.Unimplemented, status.Code(err))
+}
+
+func TestGRPC_ThrottledRetryAfter(t *testing.T) {
+	ctx := context.Background()
+
+	serverKeypair, err := GenerateServerKeypair()
+	require.NoError(t, err)
+	keys := NewServerKeyRing(WithRateLimiter(NewMemoryRateLimiter(RateLimitPolicy{BaseDelay: time.Hour})))
+	require.NoError(t, keys.Add(0, serverKeypair))
+	remote := startGRPC(t, NewGRPCServer(keys, nil))
+
+	pub, err := remote.GetPublicKey(ctx, 0)
+	require.NoError(t, err)
+	c, err := NewClient(pub, generateClientKey(t))
+	require.NoError(t, err)
+
+	rec, _, err := remote.EnrollAccount(ctx, c, pwd)
+	require.NoError(t, err)
+
+	_, err = remote.CheckPassword(ctx, c, []byte("Password1"), rec)
+	require.Equal(t, ErrWrongPassword, err)
+
+	_, err = remote.CheckPassword(ctx, c, pwd, rec)
+	te, ok := err.(*ThrottledError)
+	require.True(t, ok)
+	require.False(t, te.Locked)
+	require.True(t, te.RetryAfter > 59*time.Minute)
+}
+
+func TestGRPC_Errors(t *testing.T) {
+	ctx := context.Background()
+
+	serverKeypair, err := GenerateServerKeypair()
+	require.NoError(t, err)
+	keys := NewServerKeyRing(WithRateLimiter(NewRateLimiter(DefaultRateLimitPolicy, failingRateLimitStore{})))
+	require.NoError(t, keys.Add(0, serverKeypair))
+	remote := startGRPC(t, NewGRPCServer(keys, nil))
+
+	pub, err := remote.GetPublicKey(ctx, 0)
+	require.NoError(t, err)
+	c, err := NewClient(pub, generateClientKey(t))
+	require.NoError(t, err)
+
+	// malformed requests are the caller's fault
+	reqBytes, err := proto.Marshal(&VerifyPasswordRequest{Ns: []byte{1}})
+	require.NoError(t, err)
+	_, err = remote.VerifyPassword(ctx, reqBytes)
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	_, err = remote.VerifyPassword(ctx, []byte{0x01, 0x02})
+	require.Equal(t, ErrInvalidRequest, err)
+	_, err = remote.CheckPassword(ctx, c, pwd, []byte{0x01, 0x02})
+	require.Equal(t, ErrInvalidRecord, err)
+
+	rec, _, err := remote.EnrollAccount(ctx, c, pwd)
+	require.NoError(t, err)
+
+	// a failing rate limit store is the server's fault
+	req, err := c.CreateVerifyPasswordRequest(pwd, rec)
+	require.NoError(t, err)
+	_, err = remote.VerifyPassword(ctx, req)
+	require.Equal(t, codes.Internal, status.Code(err))
+}
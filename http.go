@@ -0,0 +1,282 @@
+/*
+ * Copyright (C) 2015-2019 Virgil Security Inc.
+ *
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ *     (1) Redistributions of source code must retain the above copyright
+ *     notice, this list of conditions and the following disclaimer.
+ *
+ *     (2) Redistributions in binary form must reproduce the above copyright
+ *     notice, this list of conditions and the following disclaimer in
+ *     the documentation and/or other materials provided with the
+ *     distribution.
+ *
+ *     (3) Neither the name of the copyright holder nor the names of its
+ *     contributors may be used to endorse or promote products derived from
+ *     this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ''AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+ * IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ *
+ * Lead Maintainer: Virgil Security Inc. <support@virgilsecurity.com>
+ */
+
+package phe
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/pkg/errors"
+)
+
+// DefaultMaxRequestSize limits the size of HTTP request bodies if no other limit is given
+const DefaultMaxRequestSize = 64 * 1024
+
+// HTTP error codes returned in the "code" field of an error response
+const (
+	HTTPErrorInvalidRequest   = "invalid_request"
+	HTTPErrorRequestTooLarge  = "request_too_large"
+	HTTPErrorMethodNotAllowed = "method_not_allowed"
+	HTTPErrorNotFound         = "not_found"
+	HTTPErrorUnknownVersion   = "unknown_version"
+	HTTPErrorThrottled        = "throttled"
+	HTTPErrorInternal         = "internal_error"
+)
+
+// HTTPEnrollmentResponse is returned by POST /enrollment
+type HTTPEnrollmentResponse struct {
+	// EnrollmentResponse is a base64 encoded EnrollmentResponse message
+	EnrollmentResponse string `json:"enrollment_response"`
+}
+
+// HTTPVerifyPasswordRequest is the body of POST /verify-password
+type HTTPVerifyPasswordRequest struct {
+	// VerifyPasswordRequest is a base64 encoded VerifyPasswordRequest message
+	VerifyPasswordRequest string `json:"verify_password_request"`
+}
+
+// HTTPVerifyPasswordResponse is returned by POST /verify-password
+type HTTPVerifyPasswordResponse struct {
+	// VerifyPasswordResponse is a base64 encoded VerifyPasswordResponse message
+	VerifyPasswordResponse string `json:"verify_password_response"`
+}
+
+// HTTPPublicKeyResponse is returned by GET /public-key
+type HTTPPublicKeyResponse struct {
+	// PublicKey is the base64 encoded server public key
+	PublicKey string `json:"public_key"`
+	Version   uint32 `json:"version"`
+}
+
+// HTTPError is the body of every error response
+type HTTPError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	// RetryAfterMs is set for throttled attempts which can be retried
+	RetryAfterMs int64 `json:"retry_after_ms,omitempty"`
+	// Locked is set for throttled attempts of a locked record
+	Locked bool `json:"locked,omitempty"`
+
+	status int
+}
+
+func (e *HTTPError) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+// HTTPHandler exposes the server operations of a ServerKeyRing as JSON endpoints:
+//
+//	POST /enrollment       returns HTTPEnrollmentResponse
+//	POST /verify-password  takes HTTPVerifyPasswordRequest, returns HTTPVerifyPasswordResponse
+//	GET  /public-key       returns HTTPPublicKeyResponse of the current key or of the ?version= given
+//
+// Binary values use standard base64 encoding. Failures are returned as HTTPError with a matching status code.
+// To mount the handler under a prefix use http.StripPrefix
+type HTTPHandler struct {
+	keys           *ServerKeyRing
+	maxRequestSize int64
+}
+
+// NewHTTPHandler creates a handler serving the keys of the key ring. Request bodies larger than
+// maxRequestSize bytes are rejected, 0 means DefaultMaxRequestSize
+func NewHTTPHandler(keys *ServerKeyRing, maxRequestSize int64) *HTTPHandler {
+	if maxRequestSize <= 0 {
+		maxRequestSize = DefaultMaxRequestSize
+	}
+
+	return &HTTPHandler{
+		keys:           keys,
+		maxRequestSize: maxRequestSize,
+	}
+}
+
+// ServeHTTP implements http.Handler
+func (h *HTTPHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var (
+		resp interface{}
+		err  *HTTPError
+	)
+
+	switch r.URL.Path {
+	case "/enrollment":
+		if err = checkMethod(r, http.MethodPost); err == nil {
+			resp, err = h.enrollment()
+		}
+	case "/verify-password":
+		if err = checkMethod(r, http.MethodPost); err == nil {
+			resp, err = h.verifyPassword(w, r)
+		}
+	case "/public-key":
+		if err = checkMethod(r, http.MethodGet); err == nil {
+			resp, err = h.publicKey(r)
+		}
+	default:
+		err = httpError(http.StatusNotFound, HTTPErrorNotFound, "unknown endpoint")
+	}
+
+	if err != nil {
+		if err.status == http.StatusMethodNotAllowed {
+			w.Header().Set("Allow", err.Message)
+		}
+		if err.RetryAfterMs > 0 {
+			w.Header().Set("Retry-After", strconv.FormatInt((err.RetryAfterMs+999)/1000, 10))
+		}
+		writeJSON(w, err.status, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func checkMethod(r *http.Request, method string) *HTTPError {
+	if r.Method != method {
+		return httpError(http.StatusMethodNotAllowed, HTTPErrorMethodNotAllowed, method)
+	}
+	return nil
+}
+
+func httpError(status int, code, message string) *HTTPError {
+	return &HTTPError{
+		Code:    code,
+		Message: message,
+		status:  status,
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	// the status is already sent, nothing can be done about a failed write
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func (h *HTTPHandler) enrollment() (interface{}, *HTTPError) {
+	s, err := h.keys.get(nil)
+	if err != nil {
+		return nil, httpError(http.StatusInternalServerError, HTTPErrorInternal, err.Error())
+	}
+
+	resp, err := s.enrollment()
+	if err != nil {
+		return nil, httpError(http.StatusInternalServerError, HTTPErrorInternal, err.Error())
+	}
+
+	enrollment, err := proto.Marshal(resp)
+	if err != nil {
+		return nil, httpError(http.StatusInternalServerError, HTTPErrorInternal, err.Error())
+	}
+
+	return &HTTPEnrollmentResponse{
+		EnrollmentResponse: base64.StdEncoding.EncodeToString(enrollment),
+	}, nil
+}
+
+func (h *HTTPHandler) verifyPassword(w http.ResponseWriter, r *http.Request) (interface{}, *HTTPError) {
+	body := &HTTPVerifyPasswordRequest{}
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, h.maxRequestSize))
+	if err := dec.Decode(body); err != nil {
+		if _, ok := err.(*http.MaxBytesError); ok {
+			return nil, httpError(http.StatusRequestEntityTooLarge, HTTPErrorRequestTooLarge, "request is too large")
+		}
+		return nil, httpError(http.StatusBadRequest, HTTPErrorInvalidRequest, "invalid JSON")
+	}
+
+	reqBytes, err := base64.StdEncoding.DecodeString(body.VerifyPasswordRequest)
+	if err != nil {
+		return nil, httpError(http.StatusBadRequest, HTTPErrorInvalidRequest, "invalid base64")
+	}
+
+	req := &VerifyPasswordRequest{}
+	if err = proto.Unmarshal(reqBytes, req); err != nil {
+		return nil, httpError(http.StatusBadRequest, HTTPErrorInvalidRequest, "invalid verify password request")
+	}
+
+	s, err := h.keys.get(&req.Version)
+	if err != nil {
+		return nil, httpError(http.StatusNotFound, HTTPErrorUnknownVersion, err.Error())
+	}
+
+	resp, _, err := s.verify(req)
+	if err != nil {
+		if te, ok := errors.Cause(err).(*ThrottledError); ok {
+			e := httpError(http.StatusTooManyRequests, HTTPErrorThrottled, te.Error())
+			e.RetryAfterMs = int64((te.RetryAfter + time.Millisecond - 1) / time.Millisecond)
+			e.Locked = te.Locked
+			return nil, e
+		}
+		if isInputError(err) {
+			return nil, httpError(http.StatusBadRequest, HTTPErrorInvalidRequest, err.Error())
+		}
+		return nil, httpError(http.StatusInternalServerError, HTTPErrorInternal, err.Error())
+	}
+
+	respBytes, err := proto.Marshal(resp)
+	if err != nil {
+		return nil, httpError(http.StatusInternalServerError, HTTPErrorInternal, err.Error())
+	}
+
+	return &HTTPVerifyPasswordResponse{
+		VerifyPasswordResponse: base64.StdEncoding.EncodeToString(respBytes),
+	}, nil
+}
+
+func (h *HTTPHandler) publicKey(r *http.Request) (interface{}, *HTTPError) {
+	var version *uint32
+	if v := r.URL.Query().Get("version"); v != "" {
+		n, err := strconv.ParseUint(v, 10, 32)
+		if err != nil {
+			return nil, httpError(http.StatusBadRequest, HTTPErrorInvalidRequest, "invalid version")
+		}
+		v32 := uint32(n)
+		version = &v32
+	}
+
+	s, err := h.keys.get(version)
+	if err != nil {
+		return nil, httpError(http.StatusNotFound, HTTPErrorUnknownVersion, err.Error())
+	}
+
+	return &HTTPPublicKeyResponse{
+		PublicKey: base64.StdEncoding.EncodeToString(s.GetPublicKey()),
+		Version:   s.version,
+	}, nil
+}
@@ -0,0 +1,212 @@
+/*
+ * Copyright (C) 2015-2019 Virgil Security Inc.
+ *
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ *     (1) Redistributions of source code must retain the above copyright
+ *     notice, this list of conditions and the following disclaimer.
+ *
+ *     (2) Redistributions in binary form must reproduce the above copyright
+ *     notice, this list of conditions and the following disclaimer in
+ *     the documentation and/or other materials provided with the
+ *     distribution.
+ *
+ *     (3) Neither the name of the copyright holder nor the names of its
+ *     contributors may be used to endorse or promote products derived from
+ *     this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ''AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+ * IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ *
+ * Lead Maintainer: Virgil Security Inc. <support@virgilsecurity.com>
+ */
+
+package phe
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func startHTTP(t *testing.T, keys *ServerKeyRing) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.Handle("/phe/", http.StripPrefix("/phe", NewHTTPHandler(keys, 1024)))
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func doJSON(t *testing.T, method, url string, body interface{}, status int, resp interface{}) {
+	var reqBody bytes.Buffer
+	if body != nil {
+		require.NoError(t, json.NewEncoder(&reqBody).Encode(body))
+	}
+
+	req, err := http.NewRequest(method, url, &reqBody)
+	require.NoError(t, err)
+	r, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer r.Body.Close()
+
+	require.Equal(t, status, r.StatusCode)
+	require.Equal(t, "application/json", r.Header.Get("Content-Type"))
+	require.NoError(t, json.NewDecoder(r.Body).Decode(resp))
+}
+
+func decodeBase64(t *testing.T, s string) []byte {
+	b, err := base64.StdEncoding.DecodeString(s)
+	require.NoError(t, err)
+	return b
+}
+
+func TestHTTP_Full(t *testing.T) {
+	serverKeypair, err := GenerateServerKeypair()
+	require.NoError(t, err)
+	keys := NewServerKeyRing()
+	require.NoError(t, keys.Add(3, serverKeypair))
+	srv := startHTTP(t, keys)
+
+	pubResp := &HTTPPublicKeyResponse{}
+	doJSON(t, http.MethodGet, srv.URL+"/phe/public-key", nil, http.StatusOK, pubResp)
+	require.Equal(t, uint32(3), pubResp.Version)
+
+	clients := NewClientKeyRing()
+	require.NoError(t, clients.Add(pubResp.Version, decodeBase64(t, pubResp.PublicKey), generateClientKey(t)))
+
+	enrollResp := &HTTPEnrollmentResponse{}
+	doJSON(t, http.MethodPost, srv.URL+"/phe/enrollment", nil, http.StatusOK, enrollResp)
+	rec, key, err := clients.EnrollAccount(pwd, decodeBase64(t, enrollResp.EnrollmentResponse))
+	require.NoError(t, err)
+
+	req, err := clients.CreateVerifyPasswordRequest(pwd, rec)
+	require.NoError(t, err)
+
+	verifyResp := &HTTPVerifyPasswordResponse{}
+	doJSON(t, http.MethodPost, srv.URL+"/phe/verify-password", &HTTPVerifyPasswordRequest{
+		VerifyPasswordRequest: base64.StdEncoding.EncodeToString(req),
+	}, http.StatusOK, verifyResp)
+
+	keyDec, err := clients.CheckResponseAndDecrypt(pwd, rec, decodeBase64(t, verifyResp.VerifyPasswordResponse))
+	require.NoError(t, err)
+	require.Equal(t, key, keyDec)
+
+	// explicit version
+	doJSON(t, http.MethodGet, srv.URL+"/phe/public-key?version=3", nil, http.StatusOK, pubResp)
+
+	httpErr := &HTTPError{}
+	doJSON(t, http.MethodGet, srv.URL+"/phe/public-key?version=2", nil, http.StatusNotFound, httpErr)
+	require.Equal(t, HTTPErrorUnknownVersion, httpErr.Code)
+}
+
+func TestHTTP_Errors(t *testing.T) {
+	serverKeypair, err := GenerateServerKeypair()
+	require.NoError(t, err)
+	keys := NewServerKeyRing()
+	require.NoError(t, keys.Add(0, serverKeypair))
+	srv := startHTTP(t, keys)
+
+	cases := []struct {
+		method string
+		path   string
+		body   interface{}
+		status int
+		code   string
+	}{
+		{http.MethodGet, "/phe/enrollment", nil, http.StatusMethodNotAllowed, HTTPErrorMethodNotAllowed},
+		{http.MethodPost, "/phe/unknown", nil, http.StatusNotFound, HTTPErrorNotFound},
+		{http.MethodGet, "/phe/public-key?version=x", nil, http.StatusBadRequest, HTTPErrorInvalidRequest},
+		{http.MethodPost, "/phe/verify-password", "not an object", http.StatusBadRequest, HTTPErrorInvalidRequest},
+		{http.MethodPost, "/phe/verify-password", &HTTPVerifyPasswordRequest{VerifyPasswordRequest: "!"}, http.StatusBadRequest, HTTPErrorInvalidRequest},
+		{http.MethodPost, "/phe/verify-password", &HTTPVerifyPasswordRequest{VerifyPasswordRequest: "AAAA"}, http.StatusBadRequest, HTTPErrorInvalidRequest},
+		{http.MethodPost, "/phe/verify-password", &HTTPVerifyPasswordRequest{VerifyPasswordRequest: strings.Repeat("A", 2048)}, http.StatusRequestEntityTooLarge, HTTPErrorRequestTooLarge},
+	}
+
+	for _, c := range cases {
+		httpErr := &HTTPError{}
+		doJSON(t, c.method, srv.URL+c.path, c.body, c.status, httpErr)
+		require.Equal(t, c.code, httpErr.Code, c.path)
+		require.NotEmpty(t, httpErr.Message)
+	}
+}
+
+func TestHTTP_Throttled(t *testing.T) {
+	serverKeypair, err := GenerateServerKeypair()
+	require.NoError(t, err)
+	keys := NewServerKeyRing(WithRateLimiter(NewMemoryRateLimiter(RateLimitPolicy{BaseDelay: 90 * time.Second})))
+	require.NoError(t, keys.Add(0, serverKeypair))
+	srv := startHTTP(t, keys)
+
+	pub, err := keys.GetPublicKey(0)
+	require.NoError(t, err)
+	c, err := NewClient(pub, generateClientKey(t))
+	require.NoError(t, err)
+
+	enrollment, err := keys.GetEnrollment()
+	require.NoError(t, err)
+	rec, _, err := c.EnrollAccount(pwd, enrollment)
+	require.NoError(t, err)
+	req, err := c.CreateVerifyPasswordRequest(pwd, rec)
+	require.NoError(t, err)
+	body := &HTTPVerifyPasswordRequest{VerifyPasswordRequest: base64.StdEncoding.EncodeToString(req)}
+
+	doJSON(t, http.MethodPost, srv.URL+"/phe/verify-password", body, http.StatusOK, &HTTPVerifyPasswordResponse{})
+
+	// the successful attempt reset the state, start a failed one
+	badReq, err := c.CreateVerifyPasswordRequest([]byte("Password1"), rec)
+	require.NoError(t, err)
+	badBody := &HTTPVerifyPasswordRequest{VerifyPasswordRequest: base64.StdEncoding.EncodeToString(badReq)}
+	doJSON(t, http.MethodPost, srv.URL+"/phe/verify-password", badBody, http.StatusOK, &HTTPVerifyPasswordResponse{})
+
+	httpErr := &HTTPError{}
+	doJSON(t, http.MethodPost, srv.URL+"/phe/verify-password", body, http.StatusTooManyRequests, httpErr)
+	require.Equal(t, HTTPErrorThrottled, httpErr.Code)
+	require.False(t, httpErr.Locked)
+	require.True(t, httpErr.RetryAfterMs > 80000)
+}
+
+func TestHTTP_InternalError(t *testing.T) {
+	serverKeypair, err := GenerateServerKeypair()
+	require.NoError(t, err)
+	keys := NewServerKeyRing(WithRateLimiter(NewRateLimiter(DefaultRateLimitPolicy, failingRateLimitStore{})))
+	require.NoError(t, keys.Add(0, serverKeypair))
+	srv := startHTTP(t, keys)
+
+	pub, err := keys.GetPublicKey(0)
+	require.NoError(t, err)
+	c, err := NewClient(pub, generateClientKey(t))
+	require.NoError(t, err)
+
+	enrollment, err := keys.GetEnrollment()
+	require.NoError(t, err)
+	rec, _, err := c.EnrollAccount(pwd, enrollment)
+	require.NoError(t, err)
+	req, err := c.CreateVerifyPasswordRequest(pwd, rec)
+	require.NoError(t, err)
+
+	// a failing rate limit store is the server's fault
+	httpErr := &HTTPError{}
+	body := &HTTPVerifyPasswordRequest{VerifyPasswordRequest: base64.StdEncoding.EncodeToString(req)}
+	doJSON(t, http.MethodPost, srv.URL+"/phe/verify-password", body, http.StatusInternalServerError, httpErr)
+	require.Equal(t, HTTPErrorInternal, httpErr.Code)
+}
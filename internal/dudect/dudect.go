@@ -0,0 +1,124 @@
+/*
+ * Copyright (C) 2015-2019 Virgil Security Inc.
+ *
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ *     (1) Redistributions of source code must retain the above copyright
+ *     notice, this list of conditions and the following disclaimer.
+ *
+ *     (2) Redistributions in binary form must reproduce the above copyright
+ *     notice, this list of conditions and the following disclaimer in
+ *     the documentation and/or other materials provided with the
+ *     distribution.
+ *
+ *     (3) Neither the name of the copyright holder nor the names of its
+ *     contributors may be used to endorse or promote products derived from
+ *     this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ''AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+ * IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ *
+ * Lead Maintainer: Virgil Security Inc. <support@virgilsecurity.com>
+ */
+
+// Package dudect is a leakage detector in the spirit of dudect (Reparaz, Balasch, Verbauwhede, "Dude, is my code constant time?").
+// An operation is timed on two classes of secret inputs, one fixed and one random, in random order.
+// Welch's t-test then tells whether the two timing distributions differ
+package dudect
+
+import (
+	"math"
+	"math/rand"
+	"os"
+	"sort"
+	"time"
+)
+
+// Threshold is the t statistic above which timings are considered to depend on the input class
+const Threshold = 10
+
+// EnvVar is the environment variable which enables timing tests when set to 1.
+// They are slow and sensitive to machine load, so they don't run as part of the regular tests
+const EnvVar = "PHE_DUDECT"
+
+// Enabled reports whether timing tests were requested with EnvVar
+func Enabled() bool {
+	return os.Getenv(EnvVar) == "1"
+}
+
+// Test times batch calls of the function returned by setup for each of samples measurements,
+// choosing class 0 or 1 at random each time. All inputs are prepared by setup before the measurements start.
+// It returns the largest absolute t statistic over several croppings of the slowest measurements,
+// which removes interrupts and other noise unrelated to the inputs
+func Test(samples, batch int, setup func(class int) func()) float64 {
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+	classes := make([]int, samples)
+	ops := make([]func(), samples)
+	times := make([]float64, samples)
+
+	for i := range ops {
+		classes[i] = rnd.Intn(2)
+		ops[i] = setup(classes[i])
+	}
+
+	for i, op := range ops {
+		start := time.Now()
+		for j := 0; j < batch; j++ {
+			op()
+		}
+		times[i] = float64(time.Since(start))
+	}
+
+	sorted := append([]float64(nil), times...)
+	sort.Float64s(sorted)
+
+	var res float64
+	for _, pct := range []float64{0.5, 0.75, 0.9, 0.99} {
+		cutoff := sorted[int(pct*float64(len(sorted)-1))]
+		if t := math.Abs(welch(classes, times, cutoff)); t > res {
+			res = t
+		}
+	}
+	return res
+}
+
+// welch computes Welch's t statistic of the two classes using measurements not above the cutoff
+func welch(classes []int, times []float64, cutoff float64) float64 {
+	var n, mean, m2 [2]float64
+	for i, t := range times {
+		if t > cutoff {
+			continue
+		}
+
+		// Welford's online mean and variance
+		c := classes[i]
+		n[c]++
+		delta := t - mean[c]
+		mean[c] += delta / n[c]
+		m2[c] += delta * (t - mean[c])
+	}
+
+	if n[0] < 2 || n[1] < 2 {
+		return 0
+	}
+
+	v0, v1 := m2[0]/(n[0]-1), m2[1]/(n[1]-1)
+	se := math.Sqrt(v0/n[0] + v1/n[1])
+	if se == 0 {
+		return 0
+	}
+	return (mean[0] - mean[1]) / se
+}
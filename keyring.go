@@ -0,0 +1,421 @@
+/*
+ * Copyright (C) 2015-2019 Virgil Security Inc.
+ *
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ *     (1) Redistributions of source code must retain the above copyright
+ *     notice, this list of conditions and the following disclaimer.
+ *
+ *     (2) Redistributions in binary form must reproduce the above copyright
+ *     notice, this list of conditions and the following disclaimer in
+ *     the documentation and/or other materials provided with the
+ *     distribution.
+ *
+ *     (3) Neither the name of the copyright holder nor the names of its
+ *     contributors may be used to endorse or promote products derived from
+ *     this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ''AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+ * IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ *
+ * Lead Maintainer: Virgil Security Inc. <support@virgilsecurity.com>
+ */
+
+package phe
+
+import (
+	"sync"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/pkg/errors"
+)
+
+// ServerKeyRing keeps numbered server keypairs so that records enrolled under older keys
+// can still be verified while they are being updated after a rotation.
+// New enrollments always use the current (highest) version. ServerKeyRing is safe for concurrent use
+type ServerKeyRing struct {
+	mu      sync.RWMutex
+	current uint32
+	servers map[uint32]*Server
+	opts    []Option
+}
+
+// NewServerKeyRing creates an empty server key ring. The options are applied to every key version,
+// so a rate limiter keeps counting attempts of a record after its key has been rotated
+func NewServerKeyRing(opts ...Option) *ServerKeyRing {
+	return &ServerKeyRing{
+		servers: make(map[uint32]*Server),
+		opts:    opts,
+	}
+}
+
+// Add registers a server keypair under the given version. Version 0 is used for keys created before versioning
+func (r *ServerKeyRing) Add(version uint32, serverKeypair []byte) error {
+	s, err := newServer(serverKeypair, version, r.opts...)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.add(s)
+}
+
+func (r *ServerKeyRing) add(s *Server) error {
+	if _, ok := r.servers[s.version]; ok {
+		return errors.New("key version already exists")
+	}
+
+	if len(r.servers) == 0 || s.version > r.current {
+		r.current = s.version
+	}
+	r.servers[s.version] = s
+	return nil
+}
+
+// Remove deletes a key version which is no longer used by any record. The current version cannot be removed
+func (r *ServerKeyRing) Remove(version uint32) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.servers[version]; !ok {
+		return ErrUnknownKeyVersion
+	}
+
+	if version == r.current {
+		return errors.New("current key version cannot be removed")
+	}
+
+	delete(r.servers, version)
+	return nil
+}
+
+// CurrentVersion returns the version used for new enrollments
+func (r *ServerKeyRing) CurrentVersion() uint32 {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.current
+}
+
+// GetEnrollment generates a new enrollment using the current key version
+func (r *ServerKeyRing) GetEnrollment() ([]byte, error) {
+	s, err := r.get(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.GetEnrollment()
+}
+
+// GetPublicKey returns server public key of the given version
+func (r *ServerKeyRing) GetPublicKey(version uint32) ([]byte, error) {
+	s, err := r.get(&version)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.GetPublicKey(), nil
+}
+
+// VerifyPassword checks password attempt with the key version the record was enrolled with
+func (r *ServerKeyRing) VerifyPassword(reqBytes []byte) (response []byte, err error) {
+	response, _, err = r.VerifyPasswordExtended(reqBytes)
+	return
+}
+
+// VerifyPasswordExtended checks password attempt with the key version the record was enrolled with
+// and returns an object containing verify result & salt used for verification
+func (r *ServerKeyRing) VerifyPasswordExtended(reqBytes []byte) (response []byte, state *VerifyPasswordResult, err error) {
+	req := &VerifyPasswordRequest{}
+	if err = proto.Unmarshal(reqBytes, req); err != nil {
+		return nil, nil, ErrInvalidRequest
+	}
+
+	s, err := r.get(&req.Version)
+	if err != nil {
+		return
+	}
+
+	return s.verifyPassword(req)
+}
+
+// Rotate creates the next key version, makes it current and issues an update token which moves
+// clients and records to it. The new keypair must be persisted by the caller
+func (r *ServerKeyRing) Rotate() (token []byte, newServerKeypair []byte, err error) {
+	return r.rotate(nil)
+}
+
+// rotate calls persist with the new keypair before it's made current, a persist error cancels the rotation
+func (r *ServerKeyRing) rotate(persist func(version uint32, newServerKeypair []byte) error) (token []byte, newServerKeypair []byte, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	cur, ok := r.servers[r.current]
+	if !ok {
+		return nil, nil, errors.New("key ring is empty")
+	}
+
+	version := r.current + 1
+	token, newServerKeypair, err = cur.rotate(version)
+	if err != nil {
+		return
+	}
+
+	s, err := newServer(newServerKeypair, version, r.opts...)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if persist != nil {
+		if err = persist(version, newServerKeypair); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if err = r.add(s); err != nil {
+		return nil, nil, err
+	}
+	return
+}
+
+// get returns server of the given version or the current one if version is nil
+func (r *ServerKeyRing) get(version *uint32) (*Server, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if len(r.servers) == 0 {
+		return nil, errors.New("key ring is empty")
+	}
+
+	v := r.current
+	if version != nil {
+		v = *version
+	}
+
+	s, ok := r.servers[v]
+	if !ok {
+		return nil, ErrUnknownKeyVersion
+	}
+	return s, nil
+}
+
+// ClientKeyRing keeps numbered client keys together with the matching server public keys
+// and dispatches records to the key version they were enrolled or updated with.
+// ClientKeyRing is safe for concurrent use
+type ClientKeyRing struct {
+	mu      sync.RWMutex
+	current uint32
+	clients map[uint32]*Client
+	opts    []Option
+}
+
+// NewClientKeyRing creates an empty client key ring. The options are applied to every key version
+func NewClientKeyRing(opts ...Option) *ClientKeyRing {
+	return &ClientKeyRing{
+		clients: make(map[uint32]*Client),
+		opts:    opts,
+	}
+}
+
+// Add registers client's private key and server's public key under the given version.
+// Version 0 is used for keys created before versioning
+func (r *ClientKeyRing) Add(version uint32, serverPublicKey []byte, clientPrivateKey []byte) error {
+	c, err := NewClient(serverPublicKey, clientPrivateKey, r.opts...)
+	if err != nil {
+		return err
+	}
+	c.version = version
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.add(c)
+}
+
+func (r *ClientKeyRing) add(c *Client) error {
+	if _, ok := r.clients[c.version]; ok {
+		return errors.New("key version already exists")
+	}
+
+	if len(r.clients) == 0 || c.version > r.current {
+		r.current = c.version
+	}
+	r.clients[c.version] = c
+	return nil
+}
+
+// Remove deletes a key version which is no longer used by any record. The current version cannot be removed
+func (r *ClientKeyRing) Remove(version uint32) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.clients[version]; !ok {
+		return ErrUnknownKeyVersion
+	}
+
+	if version == r.current {
+		return errors.New("current key version cannot be removed")
+	}
+
+	delete(r.clients, version)
+	return nil
+}
+
+// CurrentVersion returns the newest key version
+func (r *ClientKeyRing) CurrentVersion() uint32 {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.current
+}
+
+// EnrollAccount creates a new Enrollment Record with the key version of the Enrollment Response
+func (r *ClientKeyRing) EnrollAccount(password []byte, respBytes []byte) (rec []byte, key []byte, err error) {
+	resp := &EnrollmentResponse{}
+	if err = proto.Unmarshal(respBytes, resp); err != nil {
+		return nil, nil, ErrInvalidResponse
+	}
+
+	c, err := r.get(resp.Version)
+	if err != nil {
+		return
+	}
+
+	return c.enrollAccount(password, resp)
+}
+
+// CreateVerifyPasswordRequest creates a password verification request with the key version of the record
+func (r *ClientKeyRing) CreateVerifyPasswordRequest(password []byte, recBytes []byte) (req []byte, err error) {
+	rec := &EnrollmentRecord{}
+	if err = proto.Unmarshal(recBytes, rec); err != nil {
+		return nil, ErrInvalidRecord
+	}
+
+	c, err := r.get(rec.Version)
+	if err != nil {
+		return
+	}
+
+	return c.createVerifyPasswordRequest(password, rec)
+}
+
+// CheckResponseAndDecrypt verifies server's answer with the key version of the record and extracts data encryption key on success.
+// ErrWrongPassword is returned if the server has proven that the password is wrong
+func (r *ClientKeyRing) CheckResponseAndDecrypt(password []byte, recBytes []byte, respBytes []byte) (key []byte, err error) {
+	rec := &EnrollmentRecord{}
+	if err = proto.Unmarshal(recBytes, rec); err != nil {
+		return nil, ErrInvalidRecord
+	}
+
+	resp := &VerifyPasswordResponse{}
+	if err = proto.Unmarshal(respBytes, resp); err != nil {
+		return nil, ErrInvalidResponse
+	}
+
+	c, err := r.get(rec.Version)
+	if err != nil {
+		return
+	}
+
+	return c.checkResponseAndDecrypt(password, rec, resp)
+}
+
+// ChangePassword is like Client.ChangePassword, the old password is verified with the key version of the record
+// and the new one is enrolled with the key version of the Enrollment Response
+func (r *ClientKeyRing) ChangePassword(oldPassword, newPassword, recBytes, verifyResp, enrollment, wrappedKey []byte) (newRec, newKey, newWrappedKey []byte, err error) {
+	rec := &EnrollmentRecord{}
+	if err = proto.Unmarshal(recBytes, rec); err != nil {
+		return nil, nil, nil, ErrInvalidRecord
+	}
+
+	resp := &VerifyPasswordResponse{}
+	if err = proto.Unmarshal(verifyResp, resp); err != nil {
+		return nil, nil, nil, ErrInvalidResponse
+	}
+
+	enrollResp := &EnrollmentResponse{}
+	if err = proto.Unmarshal(enrollment, enrollResp); err != nil {
+		return nil, nil, nil, ErrInvalidResponse
+	}
+
+	old, err := r.get(rec.Version)
+	if err != nil {
+		return
+	}
+
+	cur, err := r.get(enrollResp.Version)
+	if err != nil {
+		return
+	}
+
+	return changePassword(old, cur, oldPassword, newPassword, rec, resp, enrollResp, wrappedKey)
+}
+
+// RecoverAccount is like Client.RecoverAccount, the new password is enrolled with the key version of the Enrollment Response
+func (r *ClientKeyRing) RecoverAccount(newPassword, enrollment, dataKey, wrappedKey []byte) (rec, recordKey, newWrappedKey []byte, err error) {
+	enrollResp := &EnrollmentResponse{}
+	if err = proto.Unmarshal(enrollment, enrollResp); err != nil {
+		return nil, nil, nil, ErrInvalidResponse
+	}
+
+	c, err := r.get(enrollResp.Version)
+	if err != nil {
+		return
+	}
+
+	return c.RecoverAccount(newPassword, enrollment, dataKey, wrappedKey)
+}
+
+// Rotate derives the key version issued by the update token from the current one and makes it current.
+// Returned keys must be persisted by the caller
+func (r *ClientKeyRing) Rotate(tokenBytes []byte) (newClientPrivate, newServerPublic []byte, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	cur, ok := r.clients[r.current]
+	if !ok {
+		return nil, nil, errors.New("key ring is empty")
+	}
+
+	c, err := NewClient(cur.serverPublicKeyBytes, cur.clientPrivateKeyBytes, r.opts...)
+	if err != nil {
+		return
+	}
+	c.version = cur.version
+
+	if err = c.Rotate(tokenBytes); err != nil {
+		return
+	}
+
+	if c.version == cur.version {
+		return nil, nil, errors.New("unversioned update token cannot be applied to a key ring")
+	}
+
+	if err = r.add(c); err != nil {
+		return nil, nil, err
+	}
+
+	return c.clientPrivateKeyBytes, c.serverPublicKeyBytes, nil
+}
+
+func (r *ClientKeyRing) get(version uint32) (*Client, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	c, ok := r.clients[version]
+	if !ok {
+		return nil, ErrUnknownKeyVersion
+	}
+	return c, nil
+}
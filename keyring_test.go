@@ -0,0 +1,243 @@
+/*
+ * Copyright (C) 2015-2019 Virgil Security Inc.
+ *
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ *     (1) Redistributions of source code must retain the above copyright
+ *     notice, this list of conditions and the following disclaimer.
+ *
+ *     (2) Redistributions in binary form must reproduce the above copyright
+ *     notice, this list of conditions and the following disclaimer in
+ *     the documentation and/or other materials provided with the
+ *     distribution.
+ *
+ *     (3) Neither the name of the copyright holder nor the names of its
+ *     contributors may be used to endorse or promote products derived from
+ *     this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ''AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+ * IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ *
+ * Lead Maintainer: Virgil Security Inc. <support@virgilsecurity.com>
+ */
+
+package phe
+
+import (
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeyRing_Rotation(t *testing.T) {
+	serverKeypair, err := GenerateServerKeypair()
+	require.NoError(t, err)
+	clientKey := generateClientKey(t)
+
+	servers := NewServerKeyRing()
+	require.NoError(t, servers.Add(1, serverKeypair))
+	pub, err := servers.GetPublicKey(1)
+	require.NoError(t, err)
+
+	clients := NewClientKeyRing()
+	require.NoError(t, clients.Add(1, pub, clientKey))
+
+	enrollment, err := servers.GetEnrollment()
+	require.NoError(t, err)
+	oldRec, oldKey, err := clients.EnrollAccount(pwd, enrollment)
+	require.NoError(t, err)
+	requireRecordVersion(t, oldRec, 1)
+
+	token, newKeypair, err := servers.Rotate()
+	require.NoError(t, err)
+	require.Equal(t, uint32(2), servers.CurrentVersion())
+	require.NotEmpty(t, newKeypair)
+
+	newPriv, newPub, err := clients.Rotate(token)
+	require.NoError(t, err)
+	require.Equal(t, uint32(2), clients.CurrentVersion())
+	serverPub, err := servers.GetPublicKey(2)
+	require.NoError(t, err)
+	require.Equal(t, serverPub, newPub)
+	require.NotEqual(t, clientKey, newPriv)
+
+	// new enrollments use the new key
+	enrollment, err = servers.GetEnrollment()
+	require.NoError(t, err)
+	newRec, newKey, err := clients.EnrollAccount(pwd, enrollment)
+	require.NoError(t, err)
+	requireRecordVersion(t, newRec, 2)
+	requireLogin(t, servers, clients, newRec, newKey)
+
+	// records which are not updated yet still work
+	requireLogin(t, servers, clients, oldRec, oldKey)
+
+	updRec, err := UpdateRecord(pub, oldRec, token)
+	require.NoError(t, err)
+	requireRecordVersion(t, updRec, 2)
+	requireLogin(t, servers, clients, updRec, oldKey)
+
+	// repeated update is a no-op
+	updRec2, err := UpdateRecord(pub, updRec, token)
+	require.NoError(t, err)
+	require.Equal(t, updRec, updRec2)
+
+	// a password change moves a record which is not updated yet to the new key
+	changeReq, err := clients.CreateVerifyPasswordRequest(pwd, oldRec)
+	require.NoError(t, err)
+	changeResp, err := servers.VerifyPassword(changeReq)
+	require.NoError(t, err)
+	enrollment, err = servers.GetEnrollment()
+	require.NoError(t, err)
+	changedRec, changedKey, _, err := clients.ChangePassword(pwd, pwd, oldRec, changeResp, enrollment, nil)
+	require.NoError(t, err)
+	requireRecordVersion(t, changedRec, 2)
+	requireLogin(t, servers, clients, changedRec, changedKey)
+
+	dataKey, err := GenerateDataKey()
+	require.NoError(t, err)
+	recoveredRec, recoveredKey, wrappedKey, err := clients.RecoverAccount(pwd, enrollment, dataKey, nil)
+	require.NoError(t, err)
+	requireRecordVersion(t, recoveredRec, 2)
+	requireLogin(t, servers, clients, recoveredRec, recoveredKey)
+	unwrapped, err := UnwrapKey(wrappedKey, recoveredKey)
+	require.NoError(t, err)
+	require.Equal(t, dataKey, unwrapped)
+
+	// after all records are updated the old version can be removed
+	require.NoError(t, servers.Remove(1))
+	require.NoError(t, clients.Remove(1))
+	require.Error(t, servers.Remove(2))
+
+	req, err := clients.CreateVerifyPasswordRequest(pwd, updRec)
+	require.NoError(t, err)
+	_, err = clients.CreateVerifyPasswordRequest(pwd, oldRec)
+	require.Error(t, err)
+
+	oldReq := &VerifyPasswordRequest{}
+	require.NoError(t, proto.Unmarshal(req, oldReq))
+	oldReq.Version = 1
+	oldReqBytes, err := proto.Marshal(oldReq)
+	require.NoError(t, err)
+	_, err = servers.VerifyPassword(oldReqBytes)
+	require.Error(t, err)
+}
+
+func TestKeyRing_VersionMismatch(t *testing.T) {
+	serverKeypair, err := GenerateServerKeypair()
+	require.NoError(t, err)
+
+	servers := NewServerKeyRing()
+	require.NoError(t, servers.Add(0, serverKeypair))
+	require.Error(t, servers.Add(0, serverKeypair))
+
+	token, _, err := servers.Rotate()
+	require.NoError(t, err)
+
+	pub, err := GetPublicKey(serverKeypair)
+	require.NoError(t, err)
+	c, err := NewClient(pub, generateClientKey(t))
+	require.NoError(t, err)
+
+	// an unversioned client can't use enrollment of version 1
+	enrollment, err := servers.GetEnrollment()
+	require.NoError(t, err)
+	_, _, err = c.EnrollAccount(pwd, enrollment)
+	require.Error(t, err)
+
+	// plain server refuses requests for another key version
+	s, err := NewServer(serverKeypair)
+	require.NoError(t, err)
+	enrollment, err = s.GetEnrollment()
+	require.NoError(t, err)
+	rec, _, err := c.EnrollAccount(pwd, enrollment)
+	require.NoError(t, err)
+
+	updRec, err := UpdateRecord(pub, rec, token)
+	require.NoError(t, err)
+	require.NoError(t, c.Rotate(token))
+	req, err := c.CreateVerifyPasswordRequest(pwd, updRec)
+	require.NoError(t, err)
+	_, err = s.VerifyPassword(req)
+	require.Error(t, err)
+
+	// token can't be applied twice to client keys
+	require.Error(t, c.Rotate(token))
+}
+
+func TestKeyRing_Malformed(t *testing.T) {
+	serverKeypair, err := GenerateServerKeypair()
+	require.NoError(t, err)
+	servers := NewServerKeyRing()
+	require.NoError(t, servers.Add(0, serverKeypair))
+	pub, err := servers.GetPublicKey(0)
+	require.NoError(t, err)
+	clients := NewClientKeyRing()
+	require.NoError(t, clients.Add(0, pub, generateClientKey(t)))
+
+	enrollment, err := servers.GetEnrollment()
+	require.NoError(t, err)
+	rec, _, err := clients.EnrollAccount(pwd, enrollment)
+	require.NoError(t, err)
+	req, err := clients.CreateVerifyPasswordRequest(pwd, rec)
+	require.NoError(t, err)
+	resp, err := servers.VerifyPassword(req)
+	require.NoError(t, err)
+
+	bad := []byte{0x01, 0x02}
+
+	_, _, err = servers.VerifyPasswordExtended(bad)
+	require.Equal(t, ErrInvalidRequest, err)
+
+	_, _, err = clients.EnrollAccount(pwd, bad)
+	require.Equal(t, ErrInvalidResponse, err)
+
+	_, err = clients.CreateVerifyPasswordRequest(pwd, bad)
+	require.Equal(t, ErrInvalidRecord, err)
+
+	_, err = clients.CheckResponseAndDecrypt(pwd, bad, resp)
+	require.Equal(t, ErrInvalidRecord, err)
+	_, err = clients.CheckResponseAndDecrypt(pwd, rec, bad)
+	require.Equal(t, ErrInvalidResponse, err)
+
+	_, _, _, err = clients.ChangePassword(pwd, pwd, bad, resp, enrollment, nil)
+	require.Equal(t, ErrInvalidRecord, err)
+	_, _, _, err = clients.ChangePassword(pwd, pwd, rec, bad, enrollment, nil)
+	require.Equal(t, ErrInvalidResponse, err)
+	_, _, _, err = clients.ChangePassword(pwd, pwd, rec, resp, bad, nil)
+	require.Equal(t, ErrInvalidResponse, err)
+
+	_, _, _, err = clients.RecoverAccount(pwd, bad, make([]byte, dataKeyLen), nil)
+	require.Equal(t, ErrInvalidResponse, err)
+}
+
+func requireRecordVersion(t *testing.T, recBytes []byte, version uint32) {
+	rec := &EnrollmentRecord{}
+	require.NoError(t, proto.Unmarshal(recBytes, rec))
+	require.Equal(t, version, rec.Version)
+}
+
+func requireLogin(t *testing.T, servers *ServerKeyRing, clients *ClientKeyRing, rec, key []byte) {
+	req, err := clients.CreateVerifyPasswordRequest(pwd, rec)
+	require.NoError(t, err)
+	resp, res, err := servers.VerifyPasswordExtended(req)
+	require.NoError(t, err)
+	require.True(t, res.Res)
+	keyDec, err := clients.CheckResponseAndDecrypt(pwd, rec, resp)
+	require.NoError(t, err)
+	require.Equal(t, key, keyDec)
+}
@@ -0,0 +1,336 @@
+/*
+ * Copyright (C) 2015-2019 Virgil Security Inc.
+ *
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ *     (1) Redistributions of source code must retain the above copyright
+ *     notice, this list of conditions and the following disclaimer.
+ *
+ *     (2) Redistributions in binary form must reproduce the above copyright
+ *     notice, this list of conditions and the following disclaimer in
+ *     the documentation and/or other materials provided with the
+ *     distribution.
+ *
+ *     (3) Neither the name of the copyright holder nor the names of its
+ *     contributors may be used to endorse or promote products derived from
+ *     this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ''AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+ * IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ *
+ * Lead Maintainer: Virgil Security Inc. <support@virgilsecurity.com>
+ */
+package phe
+
+import (
+	"bytes"
+	"io"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// A data key wrapped by several wrapping keys is encoded as
+// magic (4 bytes) || version (1 byte) || wrapper count (1 byte) || wrappers sorted by ID,
+// each wrapper is ID length (1 byte) || ID || data key wrapped like WrapKey does with the ID as additional data
+const (
+	dataKeyLen         = 32
+	wrappedKeyLen      = symSaltLen + dataKeyLen + symTagLen
+	wrappedKeysVersion = 1
+	wrappedKeysHdrLen  = 4 + 1 + 1
+	// MaxWrapperIDLen is the maximum length of a wrapper ID
+	MaxWrapperIDLen = 255
+	// MaxWrappers is the maximum number of wrappers of a data key
+	MaxWrappers = 255
+	// PasswordWrapper is the ID of the wrapper which uses the key of the user's enrollment record.
+	// ChangePassword rewraps it with the key of the new record
+	PasswordWrapper = "password"
+)
+
+var wrappedKeysMagic = []byte{0x56, 0x50, 0x48, 0x4b} //VPHK
+
+type keyWrapper struct {
+	id         string
+	wrappedKey []byte
+}
+
+// GenerateDataKey creates a random 32 byte data encryption key. The key of an enrollment record changes
+// whenever the account is enrolled again, so user data should rather be encrypted with a data key
+// which is stored wrapped by WrapKey next to the record and outlives password changes
+func GenerateDataKey(opts ...Option) ([]byte, error) {
+	key := make([]byte, dataKeyLen)
+	if err := randRead(applyOptions(opts).rand(), key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// WrapKey encrypts a data encryption key with the key returned by EnrollAccount or CheckResponseAndDecrypt.
+// WithRandom replaces the source of the salt
+func WrapKey(dataKey, recordKey []byte, opts ...Option) ([]byte, error) {
+	if len(dataKey) != dataKeyLen {
+		return nil, errors.New("data key must be exactly 32 bytes")
+	}
+	return seal(applyOptions(opts).rand(), dataKey, recordKey, keyWrap, nil)
+}
+
+// UnwrapKey decrypts a data encryption key wrapped by WrapKey with the same record key
+func UnwrapKey(wrappedKey, recordKey []byte) ([]byte, error) {
+	dataKey, err := open(wrappedKey, recordKey, keyWrap, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(dataKey) != dataKeyLen {
+		return nil, errors.New("invalid data key length")
+	}
+	return dataKey, nil
+}
+
+// WrapDataKey wraps the data key with each of the wrapping keys, which are 32 byte keys mapped by their IDs.
+// Usually the key returned by EnrollAccount is used under PasswordWrapper and a recovery key kept offline under
+// another ID. Any of the wrapping keys unwraps the data key with UnwrapDataKey. WithRandom replaces the source of the salts
+func WrapDataKey(dataKey []byte, wrappingKeys map[string][]byte, opts ...Option) ([]byte, error) {
+	if len(dataKey) != dataKeyLen {
+		return nil, errors.New("data key must be exactly 32 bytes")
+	}
+
+	if len(wrappingKeys) == 0 {
+		return nil, errors.New("no wrapping keys")
+	}
+
+	random := applyOptions(opts).rand()
+	var wrappers []keyWrapper
+	for id := range wrappingKeys {
+		if err := checkWrapperID(id); err != nil {
+			return nil, err
+		}
+		wrappers = append(wrappers, keyWrapper{id: id})
+	}
+
+	sort.Slice(wrappers, func(i, j int) bool {
+		return wrappers[i].id < wrappers[j].id
+	})
+
+	for i := range wrappers {
+		wrapped, err := wrapWithID(random, dataKey, wrappers[i].id, wrappingKeys[wrappers[i].id])
+		if err != nil {
+			return nil, err
+		}
+		wrappers[i].wrappedKey = wrapped
+	}
+
+	return marshalWrappedKeys(wrappers)
+}
+
+// UnwrapDataKey decrypts a data key wrapped by WrapDataKey with the wrapping key of the given ID
+func UnwrapDataKey(wrapped []byte, id string, wrappingKey []byte) ([]byte, error) {
+	wrappers, err := parseWrappedKeys(wrapped)
+	if err != nil {
+		return nil, err
+	}
+
+	w := findWrapper(wrappers, id)
+	if w == nil {
+		return nil, errors.New("wrapper not found")
+	}
+
+	return unwrapWithID(w.wrappedKey, id, wrappingKey)
+}
+
+// DataKeyWrappers returns the IDs of the wrappers of a data key wrapped by WrapDataKey
+func DataKeyWrappers(wrapped []byte) ([]string, error) {
+	wrappers, err := parseWrappedKeys(wrapped)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, len(wrappers))
+	for i, w := range wrappers {
+		ids[i] = w.id
+	}
+	return ids, nil
+}
+
+// AddDataKeyWrapper unwraps the data key with an existing wrapper and wraps it with another key under newID,
+// replacing the wrapper of that ID if there is one. Other wrappers aren't changed
+func AddDataKeyWrapper(wrapped []byte, id string, wrappingKey []byte, newID string, newWrappingKey []byte, opts ...Option) ([]byte, error) {
+	dataKey, err := UnwrapDataKey(wrapped, id, wrappingKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return setWrapper(applyOptions(opts).rand(), wrapped, dataKey, newID, newWrappingKey)
+}
+
+// RewrapDataKey replaces the wrapping key of a wrapper, for example the record key after the password has been changed.
+// Other wrappers aren't changed
+func RewrapDataKey(wrapped []byte, id string, oldKey, newKey []byte, opts ...Option) ([]byte, error) {
+	return AddDataKeyWrapper(wrapped, id, oldKey, id, newKey, opts...)
+}
+
+// RemoveDataKeyWrapper removes a wrapper, for example a revoked recovery key. The last wrapper can't be removed
+func RemoveDataKeyWrapper(wrapped []byte, id string) ([]byte, error) {
+	wrappers, err := parseWrappedKeys(wrapped)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, w := range wrappers {
+		if w.id != id {
+			continue
+		}
+		if len(wrappers) == 1 {
+			return nil, errors.New("the last wrapper can't be removed")
+		}
+		return marshalWrappedKeys(append(wrappers[:i:i], wrappers[i+1:]...))
+	}
+	return nil, errors.New("wrapper not found")
+}
+
+// unwrapPasswordKey unwraps a data key wrapped either by WrapKey or by WrapDataKey under PasswordWrapper
+func unwrapPasswordKey(wrapped, recordKey []byte) ([]byte, error) {
+	if len(wrapped) == wrappedKeyLen {
+		return UnwrapKey(wrapped, recordKey)
+	}
+	return UnwrapDataKey(wrapped, PasswordWrapper, recordKey)
+}
+
+// rewrapPasswordKey wraps the data key unwrapped by unwrapPasswordKey with a new record key in the same format
+func rewrapPasswordKey(random io.Reader, wrapped, dataKey, recordKey []byte) ([]byte, error) {
+	if len(wrapped) == wrappedKeyLen {
+		return WrapKey(dataKey, recordKey, WithRandom(random))
+	}
+	return setWrapper(random, wrapped, dataKey, PasswordWrapper, recordKey)
+}
+
+func setWrapper(random io.Reader, wrapped, dataKey []byte, id string, wrappingKey []byte) ([]byte, error) {
+	if err := checkWrapperID(id); err != nil {
+		return nil, err
+	}
+
+	wrappers, err := parseWrappedKeys(wrapped)
+	if err != nil {
+		return nil, err
+	}
+
+	newWrapped, err := wrapWithID(random, dataKey, id, wrappingKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if w := findWrapper(wrappers, id); w != nil {
+		w.wrappedKey = newWrapped
+		return marshalWrappedKeys(wrappers)
+	}
+
+	wrappers = append(wrappers, keyWrapper{id: id, wrappedKey: newWrapped})
+	sort.Slice(wrappers, func(i, j int) bool {
+		return wrappers[i].id < wrappers[j].id
+	})
+	return marshalWrappedKeys(wrappers)
+}
+
+func checkWrapperID(id string) error {
+	if len(id) == 0 || len(id) > MaxWrapperIDLen {
+		return errors.New("invalid wrapper ID")
+	}
+	return nil
+}
+
+func findWrapper(wrappers []keyWrapper, id string) *keyWrapper {
+	for i := range wrappers {
+		if wrappers[i].id == id {
+			return &wrappers[i]
+		}
+	}
+	return nil
+}
+
+// wrapWithID wraps the data key like WrapKey and binds it to the wrapper ID, so that wrappers can't be swapped
+func wrapWithID(random io.Reader, dataKey []byte, id string, wrappingKey []byte) ([]byte, error) {
+	return seal(random, dataKey, wrappingKey, keyWrap, []byte(id))
+}
+
+func unwrapWithID(wrappedKey []byte, id string, wrappingKey []byte) ([]byte, error) {
+	dataKey, err := open(wrappedKey, wrappingKey, keyWrap, []byte(id))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(dataKey) != dataKeyLen {
+		return nil, errors.New("invalid data key length")
+	}
+	return dataKey, nil
+}
+
+func marshalWrappedKeys(wrappers []keyWrapper) ([]byte, error) {
+	if len(wrappers) > MaxWrappers {
+		return nil, errors.New("too many wrappers")
+	}
+
+	res := make([]byte, 0, wrappedKeysHdrLen+len(wrappers)*(1+wrappedKeyLen))
+	res = append(res, wrappedKeysMagic...)
+	res = append(res, wrappedKeysVersion, byte(len(wrappers)))
+	for _, w := range wrappers {
+		res = append(res, byte(len(w.id)))
+		res = append(res, w.id...)
+		res = append(res, w.wrappedKey...)
+	}
+	return res, nil
+}
+
+func parseWrappedKeys(wrapped []byte) ([]keyWrapper, error) {
+	if len(wrapped) < wrappedKeysHdrLen || !bytes.HasPrefix(wrapped, wrappedKeysMagic) {
+		return nil, errors.New("invalid wrapped data key")
+	}
+
+	if wrapped[4] != wrappedKeysVersion {
+		return nil, errors.New("unsupported wrapped data key version")
+	}
+
+	count := int(wrapped[5])
+	if count == 0 {
+		return nil, errors.New("invalid wrapped data key")
+	}
+
+	wrappers := make([]keyWrapper, count)
+	rest := wrapped[wrappedKeysHdrLen:]
+	for i := range wrappers {
+		if len(rest) < 1 {
+			return nil, errors.New("invalid wrapped data key length")
+		}
+
+		idLen := int(rest[0])
+		if idLen == 0 || len(rest) < 1+idLen+wrappedKeyLen {
+			return nil, errors.New("invalid wrapped data key length")
+		}
+
+		wrappers[i] = keyWrapper{
+			id:         string(rest[1 : 1+idLen]),
+			wrappedKey: rest[1+idLen : 1+idLen+wrappedKeyLen],
+		}
+		if i > 0 && wrappers[i-1].id >= wrappers[i].id {
+			return nil, errors.New("invalid wrapper order")
+		}
+		rest = rest[1+idLen+wrappedKeyLen:]
+	}
+
+	if len(rest) != 0 {
+		return nil, errors.New("invalid wrapped data key length")
+	}
+	return wrappers, nil
+}
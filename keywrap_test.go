@@ -0,0 +1,219 @@
+/*
+ * Copyright (C) 2015-2019 Virgil Security Inc.
+ *
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ *     (1) Redistributions of source code must retain the above copyright
+ *     notice, this list of conditions and the following disclaimer.
+ *
+ *     (2) Redistributions in binary form must reproduce the above copyright
+ *     notice, this list of conditions and the following disclaimer in
+ *     the documentation and/or other materials provided with the
+ *     distribution.
+ *
+ *     (3) Neither the name of the copyright holder nor the names of its
+ *     contributors may be used to endorse or promote products derived from
+ *     this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ''AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+ * IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ *
+ * Lead Maintainer: Virgil Security Inc. <support@virgilsecurity.com>
+ */
+package phe
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWrapKey(t *testing.T) {
+	dataKey, err := GenerateDataKey()
+	require.NoError(t, err)
+	require.Len(t, dataKey, dataKeyLen)
+
+	recordKey, err := GenerateDataKey()
+	require.NoError(t, err)
+
+	wrapped, err := WrapKey(dataKey, recordKey)
+	require.NoError(t, err)
+
+	unwrapped, err := UnwrapKey(wrapped, recordKey)
+	require.NoError(t, err)
+	require.Equal(t, dataKey, unwrapped)
+
+	otherKey, err := GenerateDataKey()
+	require.NoError(t, err)
+	_, err = UnwrapKey(wrapped, otherKey)
+	require.Error(t, err)
+
+	wrapped[len(wrapped)-1] ^= 1
+	_, err = UnwrapKey(wrapped, recordKey)
+	require.Error(t, err)
+
+	// a wrapped key isn't an ordinary ciphertext and vice versa
+	ct, err := Encrypt(dataKey, recordKey)
+	require.NoError(t, err)
+	_, err = UnwrapKey(ct, recordKey)
+	require.Error(t, err)
+
+	wrapped, err = WrapKey(dataKey, recordKey, WithRandom(bytes.NewReader(make([]byte, symSaltLen))))
+	require.NoError(t, err)
+	_, err = Decrypt(wrapped, recordKey)
+	require.Error(t, err)
+
+	_, err = WrapKey(dataKey[1:], recordKey)
+	require.EqualError(t, err, "data key must be exactly 32 bytes")
+	_, err = WrapKey(dataKey, recordKey[1:])
+	require.Error(t, err)
+}
+
+func TestWrapDataKey(t *testing.T) {
+	dataKey, err := GenerateDataKey()
+	require.NoError(t, err)
+	recordKey, err := GenerateDataKey()
+	require.NoError(t, err)
+	recoveryKey, err := GenerateDataKey()
+	require.NoError(t, err)
+
+	wrapped, err := WrapDataKey(dataKey, map[string][]byte{PasswordWrapper: recordKey, "recovery": recoveryKey})
+	require.NoError(t, err)
+
+	ids, err := DataKeyWrappers(wrapped)
+	require.NoError(t, err)
+	require.Equal(t, []string{PasswordWrapper, "recovery"}, ids)
+
+	for id, key := range map[string][]byte{PasswordWrapper: recordKey, "recovery": recoveryKey} {
+		unwrapped, err := UnwrapDataKey(wrapped, id, key)
+		require.NoError(t, err)
+		require.Equal(t, dataKey, unwrapped)
+	}
+
+	// a wrapper only opens with its own key and ID
+	_, err = UnwrapDataKey(wrapped, PasswordWrapper, recoveryKey)
+	require.Error(t, err)
+	_, err = UnwrapDataKey(wrapped, "other", recordKey)
+	require.EqualError(t, err, "wrapper not found")
+
+	wrappers, err := parseWrappedKeys(wrapped)
+	require.NoError(t, err)
+	swapped, err := marshalWrappedKeys([]keyWrapper{
+		{id: PasswordWrapper, wrappedKey: wrappers[1].wrappedKey},
+		{id: "recovery", wrappedKey: wrappers[0].wrappedKey},
+	})
+	require.NoError(t, err)
+	_, err = UnwrapDataKey(swapped, "recovery", recordKey)
+	require.Error(t, err)
+	_, err = UnwrapDataKey(swapped, PasswordWrapper, recoveryKey)
+	require.Error(t, err)
+
+	// rewrapping keeps the other wrappers
+	newRecordKey, err := GenerateDataKey()
+	require.NoError(t, err)
+	rewrapped, err := RewrapDataKey(wrapped, PasswordWrapper, recordKey, newRecordKey)
+	require.NoError(t, err)
+	_, err = UnwrapDataKey(rewrapped, PasswordWrapper, recordKey)
+	require.Error(t, err)
+	unwrapped, err := UnwrapDataKey(rewrapped, PasswordWrapper, newRecordKey)
+	require.NoError(t, err)
+	require.Equal(t, dataKey, unwrapped)
+	unwrapped, err = UnwrapDataKey(rewrapped, "recovery", recoveryKey)
+	require.NoError(t, err)
+	require.Equal(t, dataKey, unwrapped)
+
+	_, err = RewrapDataKey(wrapped, PasswordWrapper, recoveryKey, newRecordKey)
+	require.Error(t, err)
+
+	// adding and removing wrappers
+	adminKey, err := GenerateDataKey()
+	require.NoError(t, err)
+	added, err := AddDataKeyWrapper(rewrapped, "recovery", recoveryKey, "admin", adminKey)
+	require.NoError(t, err)
+	ids, err = DataKeyWrappers(added)
+	require.NoError(t, err)
+	require.Equal(t, []string{"admin", PasswordWrapper, "recovery"}, ids)
+	unwrapped, err = UnwrapDataKey(added, "admin", adminKey)
+	require.NoError(t, err)
+	require.Equal(t, dataKey, unwrapped)
+
+	removed, err := RemoveDataKeyWrapper(added, "recovery")
+	require.NoError(t, err)
+	ids, err = DataKeyWrappers(removed)
+	require.NoError(t, err)
+	require.Equal(t, []string{"admin", PasswordWrapper}, ids)
+	_, err = UnwrapDataKey(removed, "recovery", recoveryKey)
+	require.Error(t, err)
+
+	removed, err = RemoveDataKeyWrapper(removed, "admin")
+	require.NoError(t, err)
+	_, err = RemoveDataKeyWrapper(removed, PasswordWrapper)
+	require.EqualError(t, err, "the last wrapper can't be removed")
+	_, err = RemoveDataKeyWrapper(removed, "admin")
+	require.EqualError(t, err, "wrapper not found")
+
+	// the legacy and the bundle formats are told apart by length
+	single, err := WrapKey(dataKey, recordKey)
+	require.NoError(t, err)
+	unwrapped, err = unwrapPasswordKey(single, recordKey)
+	require.NoError(t, err)
+	require.Equal(t, dataKey, unwrapped)
+	unwrapped, err = unwrapPasswordKey(wrapped, recordKey)
+	require.NoError(t, err)
+	require.Equal(t, dataKey, unwrapped)
+
+	_, err = WrapDataKey(dataKey, nil)
+	require.EqualError(t, err, "no wrapping keys")
+	_, err = WrapDataKey(dataKey, map[string][]byte{"": recordKey})
+	require.EqualError(t, err, "invalid wrapper ID")
+	_, err = WrapDataKey(dataKey[1:], map[string][]byte{PasswordWrapper: recordKey})
+	require.Error(t, err)
+}
+
+func TestWrapDataKey_Parse(t *testing.T) {
+	dataKey, err := GenerateDataKey()
+	require.NoError(t, err)
+	wrapped, err := WrapDataKey(dataKey, map[string][]byte{"a": dataKey, "b": dataKey})
+	require.NoError(t, err)
+
+	_, err = DataKeyWrappers(wrapped)
+	require.NoError(t, err)
+
+	for i := 0; i < len(wrapped); i++ {
+		_, err = DataKeyWrappers(wrapped[:i])
+		require.Error(t, err)
+	}
+
+	_, err = DataKeyWrappers(append(wrapped[:len(wrapped):len(wrapped)], 0))
+	require.Error(t, err)
+
+	bad := append([]byte{}, wrapped...)
+	bad[4] = 2
+	_, err = DataKeyWrappers(bad)
+	require.EqualError(t, err, "unsupported wrapped data key version")
+
+	bad = append([]byte{}, wrapped...)
+	bad[0] = 0
+	_, err = DataKeyWrappers(bad)
+	require.Error(t, err)
+
+	// duplicate and unsorted IDs are rejected
+	bad = append([]byte{}, wrapped...)
+	bad[wrappedKeysHdrLen+1+1+wrappedKeyLen+1] = 'a'
+	_, err = DataKeyWrappers(bad)
+	require.EqualError(t, err, "invalid wrapper order")
+}
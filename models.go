@@ -42,42 +42,61 @@ import (
 	"github.com/pkg/errors"
 )
 
-func (m *EnrollmentRecord) validate() (t0, t1 *Point, err error) {
+func (m *EnrollmentRecord) validate(g *group) (t0, t1 *Point, err error) {
 
 	if m == nil ||
 		len(m.Nc) != pheNonceLen || len(m.Ns) != pheNonceLen {
-		err = errors.New("invalid record")
+		err = ErrInvalidRecord
 		return
 	}
 
-	if t0, err = PointUnmarshal(m.T0); err != nil {
+	if err = g.checkSuite(m.Suite); err != nil {
 		return
 	}
 
-	t1, err = PointUnmarshal(m.T1)
+	return validateRecordPoints(g, m.T0, m.T1)
+}
+
+func validateRecordPoints(g *group, t0b, t1b []byte) (t0, t1 *Point, err error) {
+	if t0, err = g.unmarshalPoint(t0b); err != nil {
+		return nil, nil, errors.WithMessage(ErrInvalidRecord, "invalid t0")
+	}
+
+	if t1, err = g.unmarshalPoint(t1b); err != nil {
+		return nil, nil, errors.WithMessage(ErrInvalidRecord, "invalid t1")
+	}
 	return
 }
 
-func (m *ProofOfSuccess) validate() (term1, term2, term3 *Point, blindX *big.Int, err error) {
+// unmarshalProofPoint parses a proof term
+func (g *group) unmarshalProofPoint(data []byte) (*Point, error) {
+	p, err := g.unmarshalPoint(data)
+	if err != nil {
+		return nil, ErrInvalidProof
+	}
+	return p, nil
+}
+
+func (m *ProofOfSuccess) validate(g *group) (term1, term2, term3 *Point, blindX *big.Int, err error) {
 	if m == nil {
-		err = errors.New("invalid proof")
+		err = ErrInvalidProof
 		return
 	}
 
-	if term1, err = PointUnmarshal(m.Term1); err != nil {
+	if term1, err = g.unmarshalProofPoint(m.Term1); err != nil {
 		return
 	}
 
-	if term2, err = PointUnmarshal(m.Term2); err != nil {
+	if term2, err = g.unmarshalProofPoint(m.Term2); err != nil {
 		return
 	}
 
-	if term3, err = PointUnmarshal(m.Term3); err != nil {
+	if term3, err = g.unmarshalProofPoint(m.Term3); err != nil {
 		return
 	}
 
-	if len(m.BlindX) != zLen {
-		err = errors.New("invalid proof")
+	if len(m.BlindX) != g.zLen {
+		err = ErrInvalidProof
 		return
 	}
 	blindX = new(big.Int).SetBytes(m.BlindX)
@@ -85,35 +104,35 @@ func (m *ProofOfSuccess) validate() (term1, term2, term3 *Point, blindX *big.Int
 	return
 }
 
-func (m *ProofOfFail) validate() (term1, term2, term3, term4 *Point, blindA, blindB *big.Int, err error) {
+func (m *ProofOfFail) validate(g *group) (term1, term2, term3, term4 *Point, blindA, blindB *big.Int, err error) {
 	if m == nil {
-		err = errors.New("invalid proof")
+		err = ErrInvalidProof
 		return
 	}
 
-	if term1, err = PointUnmarshal(m.Term1); err != nil {
+	if term1, err = g.unmarshalProofPoint(m.Term1); err != nil {
 		return
 	}
 
-	if term2, err = PointUnmarshal(m.Term2); err != nil {
+	if term2, err = g.unmarshalProofPoint(m.Term2); err != nil {
 		return
 	}
 
-	if term3, err = PointUnmarshal(m.Term3); err != nil {
+	if term3, err = g.unmarshalProofPoint(m.Term3); err != nil {
 		return
 	}
 
-	if term4, err = PointUnmarshal(m.Term4); err != nil {
+	if term4, err = g.unmarshalProofPoint(m.Term4); err != nil {
 		return
 	}
 
-	if len(m.BlindA) != zLen {
-		err = errors.New("invalid proof")
+	if len(m.BlindA) != g.zLen {
+		err = ErrInvalidProof
 		return
 	}
 
-	if len(m.BlindB) != zLen {
-		err = errors.New("invalid proof")
+	if len(m.BlindB) != g.zLen {
+		err = ErrInvalidProof
 		return
 	}
 
@@ -123,19 +142,73 @@ func (m *ProofOfFail) validate() (term1, term2, term3, term4 *Point, blindA, bli
 	return
 }
 
-func (m *UpdateToken) validate() (a, b *big.Int, err error) {
+// validateV3 parses the failure proof of ProtocolV3 which has only two terms
+func (m *ProofOfFail) validateV3(g *group) (term1, term2 *Point, blindA, blindB *big.Int, err error) {
+	if m == nil || len(m.Term3) != 0 || len(m.Term4) != 0 {
+		err = ErrInvalidProof
+		return
+	}
+
+	if term1, err = g.unmarshalProofPoint(m.Term1); err != nil {
+		return
+	}
+
+	if term2, err = g.unmarshalProofPoint(m.Term2); err != nil {
+		return
+	}
+
+	if blindA, err = g.scalar(m.BlindA); err != nil {
+		return nil, nil, nil, nil, ErrInvalidProof
+	}
+
+	if blindB, err = g.scalar(m.BlindB); err != nil {
+		return nil, nil, nil, nil, ErrInvalidProof
+	}
+
+	return
+}
+
+// validate parses the proof of an update token. A missing or malformed proof is reported as ErrInvalidToken,
+// the error returned when the proof doesn't verify
+func (m *ProofOfRotation) validate(g *group) (term *Point, blindX *big.Int, err error) {
 	if m == nil {
-		return nil, nil, errors.New("invalid token")
+		err = errors.WithMessage(ErrInvalidToken, "update token has no proof")
+		return
 	}
-	if len(m.A) != zLen {
-		return nil, nil, errors.New("invalid update token")
+
+	if term, err = g.unmarshalPoint(m.Term); err != nil {
+		return nil, nil, errors.WithMessage(ErrInvalidToken, "invalid proof term")
+	}
+
+	if len(m.BlindX) != g.zLen {
+		return nil, nil, errors.WithMessage(ErrInvalidToken, "invalid proof blind")
+	}
+	blindX = new(big.Int).SetBytes(m.BlindX)
+
+	return
+}
+
+func (m *UpdateToken) validate(g *group) (a, b *big.Int, err error) {
+	if m == nil {
+		return nil, nil, ErrInvalidToken
+	}
+	if err = g.checkSuite(m.Suite); err != nil {
+		return
 	}
-	if len(m.B) != zLen {
-		return nil, nil, errors.New("invalid update token")
+	if len(m.A) != g.zLen {
+		return nil, nil, ErrInvalidToken
+	}
+	if len(m.B) != g.zLen {
+		return nil, nil, ErrInvalidToken
 	}
 
 	a = new(big.Int).SetBytes(m.A)
 	b = new(big.Int).SetBytes(m.B)
+
+	// a = 0 would make all records independent of the password
+	if a.Sign() == 0 || a.Cmp(g.curve.Params().N) >= 0 || b.Cmp(g.curve.Params().N) >= 0 {
+		return nil, nil, ErrInvalidToken
+	}
 	return
 }
 
@@ -144,3 +217,88 @@ type VerifyPasswordResult struct {
 	Res  bool
 	Salt []byte
 }
+
+func (m *ThresholdPublicKey) validate() (g *group, shares []*Point, err error) {
+	if m == nil || m.Threshold == 0 || int(m.Threshold) > len(m.Shares) || len(m.Shares) > maxThresholdServers {
+		return nil, nil, errors.WithMessage(ErrInvalidPublicKey, "invalid threshold public key")
+	}
+
+	if g, err = getGroup(Suite(m.Suite)); err != nil {
+		return
+	}
+
+	shares = make([]*Point, len(m.Shares))
+	for i, s := range m.Shares {
+		if shares[i], err = g.unmarshalPoint(s); err != nil {
+			return nil, nil, errors.WithMessage(ErrInvalidPublicKey, "invalid threshold public key share")
+		}
+	}
+	return
+}
+
+func (m *ThresholdEnrollmentRecord) validate(g *group) (t0, t1 *Point, err error) {
+
+	if m == nil ||
+		len(m.Nc) != pheNonceLen || len(m.Ns) != pheNonceLen || len(m.Check) != thresholdCheckLen {
+		err = ErrInvalidRecord
+		return
+	}
+
+	if err = g.checkSuite(m.Suite); err != nil {
+		return
+	}
+
+	return validateRecordPoints(g, m.T0, m.T1)
+}
+
+func (m *ProofOfCommitment) validate(g *group) (term1, term2, term3 *Point, blindR, blindX *big.Int, err error) {
+	if m == nil {
+		err = ErrInvalidProof
+		return
+	}
+
+	if term1, err = g.unmarshalProofPoint(m.Term1); err != nil {
+		return
+	}
+
+	if term2, err = g.unmarshalProofPoint(m.Term2); err != nil {
+		return
+	}
+
+	if term3, err = g.unmarshalProofPoint(m.Term3); err != nil {
+		return
+	}
+
+	if len(m.BlindR) != g.zLen || len(m.BlindX) != g.zLen {
+		err = ErrInvalidProof
+		return
+	}
+
+	blindR = new(big.Int).SetBytes(m.BlindR)
+	blindX = new(big.Int).SetBytes(m.BlindX)
+
+	return
+}
+
+func (m *ProofOfEquality) validate(g *group) (term1, term2 *Point, blindX *big.Int, err error) {
+	if m == nil {
+		err = ErrInvalidProof
+		return
+	}
+
+	if term1, err = g.unmarshalProofPoint(m.Term1); err != nil {
+		return
+	}
+
+	if term2, err = g.unmarshalProofPoint(m.Term2); err != nil {
+		return
+	}
+
+	if len(m.BlindX) != g.zLen {
+		err = ErrInvalidProof
+		return
+	}
+	blindX = new(big.Int).SetBytes(m.BlindX)
+
+	return
+}
@@ -0,0 +1,108 @@
+/*
+ * Copyright (C) 2015-2019 Virgil Security Inc.
+ *
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ *     (1) Redistributions of source code must retain the above copyright
+ *     notice, this list of conditions and the following disclaimer.
+ *
+ *     (2) Redistributions in binary form must reproduce the above copyright
+ *     notice, this list of conditions and the following disclaimer in
+ *     the documentation and/or other materials provided with the
+ *     distribution.
+ *
+ *     (3) Neither the name of the copyright holder nor the names of its
+ *     contributors may be used to endorse or promote products derived from
+ *     this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ''AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+ * IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ *
+ * Lead Maintainer: Virgil Security Inc. <support@virgilsecurity.com>
+ */
+
+package phe
+
+import (
+	"crypto/rand"
+	"io"
+)
+
+// Option configures optional behaviour of the protocol parties
+type Option func(*options)
+
+type options struct {
+	rateLimiter RateLimiter
+	suite       Suite
+	protocol    Protocol
+	algorithm   Algorithm
+	random      io.Reader
+}
+
+// WithRateLimiter makes the server consult the rate limiter before verifying each password attempt
+func WithRateLimiter(limiter RateLimiter) Option {
+	return func(o *options) {
+		o.rateLimiter = limiter
+	}
+}
+
+// WithSuite selects the curve of generated keys, P-256 is used by default
+func WithSuite(suite Suite) Option {
+	return func(o *options) {
+		o.suite = suite
+	}
+}
+
+// WithProtocol selects the protocol version of generated server keys, ProtocolV1 is used by default.
+// Records are enrolled with the protocol version of the server key
+func WithProtocol(protocol Protocol) Option {
+	return func(o *options) {
+		o.protocol = protocol
+	}
+}
+
+// WithAlgorithm selects the AEAD used by EncryptEnvelope, AlgorithmAES256GCM is used by default.
+// It also makes Encrypt, EncryptWithAD and EncryptWithContext produce envelopes instead of the legacy format.
+// The algorithm is recorded in the envelope, so Decrypt, DecryptWithAD and DecryptWithContext don't need it
+func WithAlgorithm(alg Algorithm) Option {
+	return func(o *options) {
+		o.algorithm = alg
+	}
+}
+
+// WithRandom replaces crypto/rand as the source of randomness for keys, nonces, salts and proofs.
+// The reader must be cryptographically secure. A deterministic reader is only meant for reproducible tests
+func WithRandom(r io.Reader) Option {
+	return func(o *options) {
+		o.random = r
+	}
+}
+
+func applyOptions(opts []Option) *options {
+	o := &options{}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// rand returns the configured source of randomness or crypto/rand
+func (o *options) rand() io.Reader {
+	if o.random == nil {
+		return rand.Reader
+	}
+	return o.random
+}
@@ -4,8 +4,12 @@
 package phe
 
 import (
+	context "context"
 	fmt "fmt"
 	proto "github.com/golang/protobuf/proto"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
 	math "math"
 )
 
@@ -23,6 +27,8 @@ const _ = proto.ProtoPackageIsVersion3 // please upgrade the proto package
 type Keypair struct {
 	PublicKey            []byte   `protobuf:"bytes,1,opt,name=public_key,json=publicKey,proto3" json:"public_key,omitempty"`
 	PrivateKey           []byte   `protobuf:"bytes,2,opt,name=private_key,json=privateKey,proto3" json:"private_key,omitempty"`
+	Suite                uint32   `protobuf:"varint,3,opt,name=suite,proto3" json:"suite,omitempty"`
+	Protocol             uint32   `protobuf:"varint,4,opt,name=protocol,proto3" json:"protocol,omitempty"`
 	XXX_NoUnkeyedLiteral struct{} `json:"-"`
 	XXX_unrecognized     []byte   `json:"-"`
 	XXX_sizecache        int32    `json:"-"`
@@ -67,11 +73,28 @@ func (m *Keypair) GetPrivateKey() []byte {
 	return nil
 }
 
+func (m *Keypair) GetSuite() uint32 {
+	if m != nil {
+		return m.Suite
+	}
+	return 0
+}
+
+func (m *Keypair) GetProtocol() uint32 {
+	if m != nil {
+		return m.Protocol
+	}
+	return 0
+}
+
 type EnrollmentRecord struct {
 	Ns                   []byte   `protobuf:"bytes,1,opt,name=ns,proto3" json:"ns,omitempty"`
 	Nc                   []byte   `protobuf:"bytes,2,opt,name=nc,proto3" json:"nc,omitempty"`
 	T0                   []byte   `protobuf:"bytes,3,opt,name=t0,proto3" json:"t0,omitempty"`
 	T1                   []byte   `protobuf:"bytes,4,opt,name=t1,proto3" json:"t1,omitempty"`
+	Version              uint32   `protobuf:"varint,5,opt,name=version,proto3" json:"version,omitempty"`
+	Suite                uint32   `protobuf:"varint,6,opt,name=suite,proto3" json:"suite,omitempty"`
+	Protocol             uint32   `protobuf:"varint,7,opt,name=protocol,proto3" json:"protocol,omitempty"`
 	XXX_NoUnkeyedLiteral struct{} `json:"-"`
 	XXX_unrecognized     []byte   `json:"-"`
 	XXX_sizecache        int32    `json:"-"`
@@ -130,6 +153,27 @@ func (m *EnrollmentRecord) GetT1() []byte {
 	return nil
 }
 
+func (m *EnrollmentRecord) GetVersion() uint32 {
+	if m != nil {
+		return m.Version
+	}
+	return 0
+}
+
+func (m *EnrollmentRecord) GetSuite() uint32 {
+	if m != nil {
+		return m.Suite
+	}
+	return 0
+}
+
+func (m *EnrollmentRecord) GetProtocol() uint32 {
+	if m != nil {
+		return m.Protocol
+	}
+	return 0
+}
+
 type ProofOfSuccess struct {
 	Term1                []byte   `protobuf:"bytes,1,opt,name=term1,proto3" json:"term1,omitempty"`
 	Term2                []byte   `protobuf:"bytes,2,opt,name=term2,proto3" json:"term2,omitempty"`
@@ -272,19 +316,70 @@ func (m *ProofOfFail) GetBlindB() []byte {
 	return nil
 }
 
-type UpdateToken struct {
-	A                    []byte   `protobuf:"bytes,1,opt,name=a,proto3" json:"a,omitempty"`
-	B                    []byte   `protobuf:"bytes,2,opt,name=b,proto3" json:"b,omitempty"`
+type ProofOfRotation struct {
+	Term                 []byte   `protobuf:"bytes,1,opt,name=term,proto3" json:"term,omitempty"`
+	BlindX               []byte   `protobuf:"bytes,2,opt,name=blind_x,json=blindX,proto3" json:"blind_x,omitempty"`
 	XXX_NoUnkeyedLiteral struct{} `json:"-"`
 	XXX_unrecognized     []byte   `json:"-"`
 	XXX_sizecache        int32    `json:"-"`
 }
 
+func (m *ProofOfRotation) Reset()         { *m = ProofOfRotation{} }
+func (m *ProofOfRotation) String() string { return proto.CompactTextString(m) }
+func (*ProofOfRotation) ProtoMessage()    {}
+func (*ProofOfRotation) Descriptor() ([]byte, []int) {
+	return fileDescriptor_36f30d920d9c0b48, []int{4}
+}
+
+func (m *ProofOfRotation) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_ProofOfRotation.Unmarshal(m, b)
+}
+func (m *ProofOfRotation) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_ProofOfRotation.Marshal(b, m, deterministic)
+}
+func (m *ProofOfRotation) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_ProofOfRotation.Merge(m, src)
+}
+func (m *ProofOfRotation) XXX_Size() int {
+	return xxx_messageInfo_ProofOfRotation.Size(m)
+}
+func (m *ProofOfRotation) XXX_DiscardUnknown() {
+	xxx_messageInfo_ProofOfRotation.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_ProofOfRotation proto.InternalMessageInfo
+
+func (m *ProofOfRotation) GetTerm() []byte {
+	if m != nil {
+		return m.Term
+	}
+	return nil
+}
+
+func (m *ProofOfRotation) GetBlindX() []byte {
+	if m != nil {
+		return m.BlindX
+	}
+	return nil
+}
+
+type UpdateToken struct {
+	A                    []byte           `protobuf:"bytes,1,opt,name=a,proto3" json:"a,omitempty"`
+	B                    []byte           `protobuf:"bytes,2,opt,name=b,proto3" json:"b,omitempty"`
+	Version              uint32           `protobuf:"varint,3,opt,name=version,proto3" json:"version,omitempty"`
+	Proof                *ProofOfRotation `protobuf:"bytes,4,opt,name=proof,proto3" json:"proof,omitempty"`
+	Suite                uint32           `protobuf:"varint,5,opt,name=suite,proto3" json:"suite,omitempty"`
+	Protocol             uint32           `protobuf:"varint,6,opt,name=protocol,proto3" json:"protocol,omitempty"`
+	XXX_NoUnkeyedLiteral struct{}         `json:"-"`
+	XXX_unrecognized     []byte           `json:"-"`
+	XXX_sizecache        int32            `json:"-"`
+}
+
 func (m *UpdateToken) Reset()         { *m = UpdateToken{} }
 func (m *UpdateToken) String() string { return proto.CompactTextString(m) }
 func (*UpdateToken) ProtoMessage()    {}
 func (*UpdateToken) Descriptor() ([]byte, []int) {
-	return fileDescriptor_36f30d920d9c0b48, []int{4}
+	return fileDescriptor_36f30d920d9c0b48, []int{5}
 }
 
 func (m *UpdateToken) XXX_Unmarshal(b []byte) error {
@@ -319,11 +414,42 @@ func (m *UpdateToken) GetB() []byte {
 	return nil
 }
 
+func (m *UpdateToken) GetVersion() uint32 {
+	if m != nil {
+		return m.Version
+	}
+	return 0
+}
+
+func (m *UpdateToken) GetProof() *ProofOfRotation {
+	if m != nil {
+		return m.Proof
+	}
+	return nil
+}
+
+func (m *UpdateToken) GetSuite() uint32 {
+	if m != nil {
+		return m.Suite
+	}
+	return 0
+}
+
+func (m *UpdateToken) GetProtocol() uint32 {
+	if m != nil {
+		return m.Protocol
+	}
+	return 0
+}
+
 type EnrollmentResponse struct {
 	Ns                   []byte          `protobuf:"bytes,1,opt,name=ns,proto3" json:"ns,omitempty"`
 	C0                   []byte          `protobuf:"bytes,2,opt,name=c0,proto3" json:"c0,omitempty"`
 	C1                   []byte          `protobuf:"bytes,3,opt,name=c1,proto3" json:"c1,omitempty"`
 	Proof                *ProofOfSuccess `protobuf:"bytes,4,opt,name=proof,proto3" json:"proof,omitempty"`
+	Version              uint32          `protobuf:"varint,5,opt,name=version,proto3" json:"version,omitempty"`
+	Suite                uint32          `protobuf:"varint,6,opt,name=suite,proto3" json:"suite,omitempty"`
+	Protocol             uint32          `protobuf:"varint,7,opt,name=protocol,proto3" json:"protocol,omitempty"`
 	XXX_NoUnkeyedLiteral struct{}        `json:"-"`
 	XXX_unrecognized     []byte          `json:"-"`
 	XXX_sizecache        int32           `json:"-"`
@@ -333,7 +459,7 @@ func (m *EnrollmentResponse) Reset()         { *m = EnrollmentResponse{} }
 func (m *EnrollmentResponse) String() string { return proto.CompactTextString(m) }
 func (*EnrollmentResponse) ProtoMessage()    {}
 func (*EnrollmentResponse) Descriptor() ([]byte, []int) {
-	return fileDescriptor_36f30d920d9c0b48, []int{5}
+	return fileDescriptor_36f30d920d9c0b48, []int{6}
 }
 
 func (m *EnrollmentResponse) XXX_Unmarshal(b []byte) error {
@@ -382,9 +508,33 @@ func (m *EnrollmentResponse) GetProof() *ProofOfSuccess {
 	return nil
 }
 
+func (m *EnrollmentResponse) GetVersion() uint32 {
+	if m != nil {
+		return m.Version
+	}
+	return 0
+}
+
+func (m *EnrollmentResponse) GetSuite() uint32 {
+	if m != nil {
+		return m.Suite
+	}
+	return 0
+}
+
+func (m *EnrollmentResponse) GetProtocol() uint32 {
+	if m != nil {
+		return m.Protocol
+	}
+	return 0
+}
+
 type VerifyPasswordRequest struct {
 	Ns                   []byte   `protobuf:"bytes,1,opt,name=ns,proto3" json:"ns,omitempty"`
 	C0                   []byte   `protobuf:"bytes,2,opt,name=c0,proto3" json:"c0,omitempty"`
+	Version              uint32   `protobuf:"varint,3,opt,name=version,proto3" json:"version,omitempty"`
+	Suite                uint32   `protobuf:"varint,4,opt,name=suite,proto3" json:"suite,omitempty"`
+	Protocol             uint32   `protobuf:"varint,5,opt,name=protocol,proto3" json:"protocol,omitempty"`
 	XXX_NoUnkeyedLiteral struct{} `json:"-"`
 	XXX_unrecognized     []byte   `json:"-"`
 	XXX_sizecache        int32    `json:"-"`
@@ -394,7 +544,7 @@ func (m *VerifyPasswordRequest) Reset()         { *m = VerifyPasswordRequest{} }
 func (m *VerifyPasswordRequest) String() string { return proto.CompactTextString(m) }
 func (*VerifyPasswordRequest) ProtoMessage()    {}
 func (*VerifyPasswordRequest) Descriptor() ([]byte, []int) {
-	return fileDescriptor_36f30d920d9c0b48, []int{6}
+	return fileDescriptor_36f30d920d9c0b48, []int{7}
 }
 
 func (m *VerifyPasswordRequest) XXX_Unmarshal(b []byte) error {
@@ -429,6 +579,27 @@ func (m *VerifyPasswordRequest) GetC0() []byte {
 	return nil
 }
 
+func (m *VerifyPasswordRequest) GetVersion() uint32 {
+	if m != nil {
+		return m.Version
+	}
+	return 0
+}
+
+func (m *VerifyPasswordRequest) GetSuite() uint32 {
+	if m != nil {
+		return m.Suite
+	}
+	return 0
+}
+
+func (m *VerifyPasswordRequest) GetProtocol() uint32 {
+	if m != nil {
+		return m.Protocol
+	}
+	return 0
+}
+
 type VerifyPasswordResponse struct {
 	Res bool   `protobuf:"varint,1,opt,name=res,proto3" json:"res,omitempty"`
 	C1  []byte `protobuf:"bytes,2,opt,name=c1,proto3" json:"c1,omitempty"`
@@ -445,7 +616,7 @@ func (m *VerifyPasswordResponse) Reset()         { *m = VerifyPasswordResponse{}
 func (m *VerifyPasswordResponse) String() string { return proto.CompactTextString(m) }
 func (*VerifyPasswordResponse) ProtoMessage()    {}
 func (*VerifyPasswordResponse) Descriptor() ([]byte, []int) {
-	return fileDescriptor_36f30d920d9c0b48, []int{7}
+	return fileDescriptor_36f30d920d9c0b48, []int{8}
 }
 
 func (m *VerifyPasswordResponse) XXX_Unmarshal(b []byte) error {
@@ -525,45 +696,1134 @@ func (*VerifyPasswordResponse) XXX_OneofWrappers() []interface{} {
 	}
 }
 
-func init() {
-	proto.RegisterType((*Keypair)(nil), "phe.Keypair")
-	proto.RegisterType((*EnrollmentRecord)(nil), "phe.EnrollmentRecord")
-	proto.RegisterType((*ProofOfSuccess)(nil), "phe.ProofOfSuccess")
-	proto.RegisterType((*ProofOfFail)(nil), "phe.ProofOfFail")
-	proto.RegisterType((*UpdateToken)(nil), "phe.UpdateToken")
-	proto.RegisterType((*EnrollmentResponse)(nil), "phe.EnrollmentResponse")
-	proto.RegisterType((*VerifyPasswordRequest)(nil), "phe.VerifyPasswordRequest")
-	proto.RegisterType((*VerifyPasswordResponse)(nil), "phe.VerifyPasswordResponse")
+type ThresholdPublicKey struct {
+	Threshold            uint32   `protobuf:"varint,1,opt,name=threshold,proto3" json:"threshold,omitempty"`
+	Shares               [][]byte `protobuf:"bytes,2,rep,name=shares,proto3" json:"shares,omitempty"`
+	Suite                uint32   `protobuf:"varint,3,opt,name=suite,proto3" json:"suite,omitempty"`
+	Protocol             uint32   `protobuf:"varint,4,opt,name=protocol,proto3" json:"protocol,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
 }
 
-func init() { proto.RegisterFile("phe.proto", fileDescriptor_36f30d920d9c0b48) }
+func (m *ThresholdPublicKey) Reset()         { *m = ThresholdPublicKey{} }
+func (m *ThresholdPublicKey) String() string { return proto.CompactTextString(m) }
+func (*ThresholdPublicKey) ProtoMessage()    {}
+func (*ThresholdPublicKey) Descriptor() ([]byte, []int) {
+	return fileDescriptor_36f30d920d9c0b48, []int{9}
+}
 
-var fileDescriptor_36f30d920d9c0b48 = []byte{
-	// 409 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0xac, 0x93, 0x4f, 0x6f, 0x13, 0x31,
-	0x10, 0xc5, 0xbb, 0x9b, 0x26, 0xa1, 0x93, 0xaa, 0x8a, 0xcc, 0xbf, 0xbd, 0x20, 0x90, 0x0f, 0x88,
-	0x5e, 0x4a, 0xb6, 0x45, 0xe2, 0x4c, 0x25, 0x50, 0x51, 0x0e, 0x54, 0xe6, 0x8f, 0xb8, 0x55, 0x5e,
-	0x67, 0xa2, 0xae, 0xb2, 0xb5, 0x8d, 0xed, 0x00, 0xfb, 0x49, 0xb8, 0xf0, 0x61, 0xd1, 0xda, 0xb3,
-	0x74, 0x41, 0x91, 0xb8, 0x70, 0xcb, 0x9b, 0xf1, 0xcc, 0xfb, 0xd9, 0x2f, 0x0b, 0x07, 0xf6, 0x1a,
-	0x4f, 0xac, 0x33, 0xc1, 0xb0, 0x91, 0xbd, 0x46, 0xfe, 0x16, 0xa6, 0x4b, 0x6c, 0xad, 0xac, 0x1d,
-	0x7b, 0x04, 0x60, 0xb7, 0x55, 0x53, 0xab, 0xab, 0x0d, 0xb6, 0x45, 0xf6, 0x24, 0x7b, 0x76, 0x28,
-	0x0e, 0x52, 0x65, 0x89, 0x2d, 0x7b, 0x0c, 0x33, 0xeb, 0xea, 0xaf, 0x32, 0x60, 0xec, 0xe7, 0xb1,
-	0x0f, 0x54, 0x5a, 0x62, 0xcb, 0x05, 0xcc, 0x5f, 0x6b, 0x67, 0x9a, 0xe6, 0x06, 0x75, 0x10, 0xa8,
-	0x8c, 0x5b, 0xb1, 0x23, 0xc8, 0xb5, 0xa7, 0x5d, 0xb9, 0xf6, 0x51, 0x2b, 0x9a, 0xcd, 0xb5, 0xea,
-	0x74, 0x58, 0x14, 0xa3, 0xa4, 0xc3, 0x22, 0xea, 0xb2, 0xd8, 0x27, 0x5d, 0xf2, 0x0d, 0x1c, 0x5d,
-	0x3a, 0x63, 0xd6, 0xef, 0xd6, 0xef, 0xb7, 0x4a, 0xa1, 0xf7, 0xec, 0x1e, 0x8c, 0x03, 0xba, 0x9b,
-	0x92, 0x96, 0x26, 0xd1, 0x57, 0x4f, 0x69, 0x75, 0x12, 0x7d, 0xf5, 0x8c, 0x0c, 0x92, 0x60, 0x0f,
-	0x61, 0x5a, 0x35, 0xb5, 0x5e, 0x5d, 0x7d, 0x27, 0xa3, 0x49, 0x94, 0x9f, 0xf9, 0x8f, 0x0c, 0x66,
-	0xe4, 0xf6, 0x46, 0xd6, 0xcd, 0x7f, 0xb0, 0xa2, 0xea, 0x0b, 0x32, 0x4a, 0xe2, 0x16, 0x40, 0x16,
-	0xe3, 0x01, 0xc0, 0xab, 0xdb, 0x46, 0x55, 0x4c, 0x06, 0x8d, 0x73, 0x7e, 0x0c, 0xb3, 0x8f, 0x76,
-	0x25, 0x03, 0x7e, 0x30, 0x1b, 0xd4, 0xec, 0x10, 0x32, 0x49, 0x50, 0x99, 0xec, 0x54, 0x45, 0x30,
-	0x59, 0xc5, 0x0d, 0xb0, 0x61, 0x0a, 0xde, 0x1a, 0xed, 0x71, 0x57, 0x0e, 0x6a, 0xd1, 0xe7, 0xa0,
-	0xe2, 0xbb, 0xab, 0xb2, 0xcf, 0x41, 0x95, 0xec, 0x18, 0xc6, 0xb6, 0x7b, 0x89, 0x08, 0x3e, 0x3b,
-	0xbd, 0x7b, 0xd2, 0xfd, 0x6d, 0xfe, 0x4c, 0x42, 0xa4, 0x13, 0xfc, 0x25, 0xdc, 0xff, 0x84, 0xae,
-	0x5e, 0xb7, 0x97, 0xd2, 0xfb, 0x6f, 0xc6, 0xad, 0x04, 0x7e, 0xd9, 0xa2, 0x0f, 0xff, 0xf2, 0xe4,
-	0x3f, 0x33, 0x78, 0xf0, 0xf7, 0x24, 0xe1, 0xce, 0x61, 0xe4, 0x30, 0xcd, 0xde, 0x11, 0xdd, 0x4f,
-	0x02, 0xcc, 0x7f, 0x03, 0x3e, 0x87, 0xa9, 0x4f, 0x1c, 0x91, 0x7a, 0x37, 0xe2, 0xc5, 0x9e, 0xe8,
-	0x4f, 0xb1, 0xa7, 0xb0, 0xbf, 0x96, 0x75, 0x43, 0x17, 0x9a, 0x0f, 0x4f, 0x77, 0x61, 0x5f, 0xec,
-	0x89, 0xd8, 0x3f, 0x9f, 0xd2, 0xcd, 0xab, 0x49, 0xfc, 0x4a, 0xce, 0x7e, 0x05, 0x00, 0x00, 0xff,
-	0xff, 0xbb, 0x6c, 0x7f, 0xb0, 0x32, 0x03, 0x00, 0x00,
+func (m *ThresholdPublicKey) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_ThresholdPublicKey.Unmarshal(m, b)
+}
+func (m *ThresholdPublicKey) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_ThresholdPublicKey.Marshal(b, m, deterministic)
+}
+func (m *ThresholdPublicKey) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_ThresholdPublicKey.Merge(m, src)
+}
+func (m *ThresholdPublicKey) XXX_Size() int {
+	return xxx_messageInfo_ThresholdPublicKey.Size(m)
+}
+func (m *ThresholdPublicKey) XXX_DiscardUnknown() {
+	xxx_messageInfo_ThresholdPublicKey.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_ThresholdPublicKey proto.InternalMessageInfo
+
+func (m *ThresholdPublicKey) GetThreshold() uint32 {
+	if m != nil {
+		return m.Threshold
+	}
+	return 0
+}
+
+func (m *ThresholdPublicKey) GetShares() [][]byte {
+	if m != nil {
+		return m.Shares
+	}
+	return nil
+}
+
+func (m *ThresholdPublicKey) GetSuite() uint32 {
+	if m != nil {
+		return m.Suite
+	}
+	return 0
+}
+
+func (m *ThresholdPublicKey) GetProtocol() uint32 {
+	if m != nil {
+		return m.Protocol
+	}
+	return 0
+}
+
+type ThresholdKeypair struct {
+	Index                uint32              `protobuf:"varint,1,opt,name=index,proto3" json:"index,omitempty"`
+	PrivateKey           []byte              `protobuf:"bytes,2,opt,name=private_key,json=privateKey,proto3" json:"private_key,omitempty"`
+	PublicKey            *ThresholdPublicKey `protobuf:"bytes,3,opt,name=public_key,json=publicKey,proto3" json:"public_key,omitempty"`
+	XXX_NoUnkeyedLiteral struct{}            `json:"-"`
+	XXX_unrecognized     []byte              `json:"-"`
+	XXX_sizecache        int32               `json:"-"`
+}
+
+func (m *ThresholdKeypair) Reset()         { *m = ThresholdKeypair{} }
+func (m *ThresholdKeypair) String() string { return proto.CompactTextString(m) }
+func (*ThresholdKeypair) ProtoMessage()    {}
+func (*ThresholdKeypair) Descriptor() ([]byte, []int) {
+	return fileDescriptor_36f30d920d9c0b48, []int{10}
+}
+
+func (m *ThresholdKeypair) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_ThresholdKeypair.Unmarshal(m, b)
+}
+func (m *ThresholdKeypair) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_ThresholdKeypair.Marshal(b, m, deterministic)
+}
+func (m *ThresholdKeypair) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_ThresholdKeypair.Merge(m, src)
+}
+func (m *ThresholdKeypair) XXX_Size() int {
+	return xxx_messageInfo_ThresholdKeypair.Size(m)
+}
+func (m *ThresholdKeypair) XXX_DiscardUnknown() {
+	xxx_messageInfo_ThresholdKeypair.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_ThresholdKeypair proto.InternalMessageInfo
+
+func (m *ThresholdKeypair) GetIndex() uint32 {
+	if m != nil {
+		return m.Index
+	}
+	return 0
+}
+
+func (m *ThresholdKeypair) GetPrivateKey() []byte {
+	if m != nil {
+		return m.PrivateKey
+	}
+	return nil
+}
+
+func (m *ThresholdKeypair) GetPublicKey() *ThresholdPublicKey {
+	if m != nil {
+		return m.PublicKey
+	}
+	return nil
+}
+
+type ThresholdNonce struct {
+	Index                uint32   `protobuf:"varint,1,opt,name=index,proto3" json:"index,omitempty"`
+	Nonce                []byte   `protobuf:"bytes,2,opt,name=nonce,proto3" json:"nonce,omitempty"`
+	Timestamp            uint64   `protobuf:"varint,3,opt,name=timestamp,proto3" json:"timestamp,omitempty"`
+	Tag                  []byte   `protobuf:"bytes,4,opt,name=tag,proto3" json:"tag,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *ThresholdNonce) Reset()         { *m = ThresholdNonce{} }
+func (m *ThresholdNonce) String() string { return proto.CompactTextString(m) }
+func (*ThresholdNonce) ProtoMessage()    {}
+func (*ThresholdNonce) Descriptor() ([]byte, []int) {
+	return fileDescriptor_36f30d920d9c0b48, []int{11}
+}
+
+func (m *ThresholdNonce) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_ThresholdNonce.Unmarshal(m, b)
+}
+func (m *ThresholdNonce) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_ThresholdNonce.Marshal(b, m, deterministic)
+}
+func (m *ThresholdNonce) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_ThresholdNonce.Merge(m, src)
+}
+func (m *ThresholdNonce) XXX_Size() int {
+	return xxx_messageInfo_ThresholdNonce.Size(m)
+}
+func (m *ThresholdNonce) XXX_DiscardUnknown() {
+	xxx_messageInfo_ThresholdNonce.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_ThresholdNonce proto.InternalMessageInfo
+
+func (m *ThresholdNonce) GetIndex() uint32 {
+	if m != nil {
+		return m.Index
+	}
+	return 0
+}
+
+func (m *ThresholdNonce) GetNonce() []byte {
+	if m != nil {
+		return m.Nonce
+	}
+	return nil
+}
+
+func (m *ThresholdNonce) GetTimestamp() uint64 {
+	if m != nil {
+		return m.Timestamp
+	}
+	return 0
+}
+
+func (m *ThresholdNonce) GetTag() []byte {
+	if m != nil {
+		return m.Tag
+	}
+	return nil
+}
+
+type ThresholdEnrollmentRequest struct {
+	Nonces               []*ThresholdNonce `protobuf:"bytes,1,rep,name=nonces,proto3" json:"nonces,omitempty"`
+	XXX_NoUnkeyedLiteral struct{}          `json:"-"`
+	XXX_unrecognized     []byte            `json:"-"`
+	XXX_sizecache        int32             `json:"-"`
+}
+
+func (m *ThresholdEnrollmentRequest) Reset()         { *m = ThresholdEnrollmentRequest{} }
+func (m *ThresholdEnrollmentRequest) String() string { return proto.CompactTextString(m) }
+func (*ThresholdEnrollmentRequest) ProtoMessage()    {}
+func (*ThresholdEnrollmentRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_36f30d920d9c0b48, []int{12}
+}
+
+func (m *ThresholdEnrollmentRequest) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_ThresholdEnrollmentRequest.Unmarshal(m, b)
+}
+func (m *ThresholdEnrollmentRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_ThresholdEnrollmentRequest.Marshal(b, m, deterministic)
+}
+func (m *ThresholdEnrollmentRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_ThresholdEnrollmentRequest.Merge(m, src)
+}
+func (m *ThresholdEnrollmentRequest) XXX_Size() int {
+	return xxx_messageInfo_ThresholdEnrollmentRequest.Size(m)
+}
+func (m *ThresholdEnrollmentRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_ThresholdEnrollmentRequest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_ThresholdEnrollmentRequest proto.InternalMessageInfo
+
+func (m *ThresholdEnrollmentRequest) GetNonces() []*ThresholdNonce {
+	if m != nil {
+		return m.Nonces
+	}
+	return nil
+}
+
+type ThresholdEnrollmentResponse struct {
+	Index                uint32          `protobuf:"varint,1,opt,name=index,proto3" json:"index,omitempty"`
+	Ns                   []byte          `protobuf:"bytes,2,opt,name=ns,proto3" json:"ns,omitempty"`
+	C0                   []byte          `protobuf:"bytes,3,opt,name=c0,proto3" json:"c0,omitempty"`
+	C1                   []byte          `protobuf:"bytes,4,opt,name=c1,proto3" json:"c1,omitempty"`
+	Proof                *ProofOfSuccess `protobuf:"bytes,5,opt,name=proof,proto3" json:"proof,omitempty"`
+	XXX_NoUnkeyedLiteral struct{}        `json:"-"`
+	XXX_unrecognized     []byte          `json:"-"`
+	XXX_sizecache        int32           `json:"-"`
+}
+
+func (m *ThresholdEnrollmentResponse) Reset()         { *m = ThresholdEnrollmentResponse{} }
+func (m *ThresholdEnrollmentResponse) String() string { return proto.CompactTextString(m) }
+func (*ThresholdEnrollmentResponse) ProtoMessage()    {}
+func (*ThresholdEnrollmentResponse) Descriptor() ([]byte, []int) {
+	return fileDescriptor_36f30d920d9c0b48, []int{13}
+}
+
+func (m *ThresholdEnrollmentResponse) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_ThresholdEnrollmentResponse.Unmarshal(m, b)
+}
+func (m *ThresholdEnrollmentResponse) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_ThresholdEnrollmentResponse.Marshal(b, m, deterministic)
+}
+func (m *ThresholdEnrollmentResponse) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_ThresholdEnrollmentResponse.Merge(m, src)
+}
+func (m *ThresholdEnrollmentResponse) XXX_Size() int {
+	return xxx_messageInfo_ThresholdEnrollmentResponse.Size(m)
+}
+func (m *ThresholdEnrollmentResponse) XXX_DiscardUnknown() {
+	xxx_messageInfo_ThresholdEnrollmentResponse.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_ThresholdEnrollmentResponse proto.InternalMessageInfo
+
+func (m *ThresholdEnrollmentResponse) GetIndex() uint32 {
+	if m != nil {
+		return m.Index
+	}
+	return 0
+}
+
+func (m *ThresholdEnrollmentResponse) GetNs() []byte {
+	if m != nil {
+		return m.Ns
+	}
+	return nil
+}
+
+func (m *ThresholdEnrollmentResponse) GetC0() []byte {
+	if m != nil {
+		return m.C0
+	}
+	return nil
+}
+
+func (m *ThresholdEnrollmentResponse) GetC1() []byte {
+	if m != nil {
+		return m.C1
+	}
+	return nil
+}
+
+func (m *ThresholdEnrollmentResponse) GetProof() *ProofOfSuccess {
+	if m != nil {
+		return m.Proof
+	}
+	return nil
+}
+
+type ThresholdEnrollmentRecord struct {
+	Ns                   []byte   `protobuf:"bytes,1,opt,name=ns,proto3" json:"ns,omitempty"`
+	Nc                   []byte   `protobuf:"bytes,2,opt,name=nc,proto3" json:"nc,omitempty"`
+	T0                   []byte   `protobuf:"bytes,3,opt,name=t0,proto3" json:"t0,omitempty"`
+	T1                   []byte   `protobuf:"bytes,4,opt,name=t1,proto3" json:"t1,omitempty"`
+	Check                []byte   `protobuf:"bytes,5,opt,name=check,proto3" json:"check,omitempty"`
+	Suite                uint32   `protobuf:"varint,6,opt,name=suite,proto3" json:"suite,omitempty"`
+	Protocol             uint32   `protobuf:"varint,7,opt,name=protocol,proto3" json:"protocol,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *ThresholdEnrollmentRecord) Reset()         { *m = ThresholdEnrollmentRecord{} }
+func (m *ThresholdEnrollmentRecord) String() string { return proto.CompactTextString(m) }
+func (*ThresholdEnrollmentRecord) ProtoMessage()    {}
+func (*ThresholdEnrollmentRecord) Descriptor() ([]byte, []int) {
+	return fileDescriptor_36f30d920d9c0b48, []int{14}
+}
+
+func (m *ThresholdEnrollmentRecord) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_ThresholdEnrollmentRecord.Unmarshal(m, b)
+}
+func (m *ThresholdEnrollmentRecord) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_ThresholdEnrollmentRecord.Marshal(b, m, deterministic)
+}
+func (m *ThresholdEnrollmentRecord) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_ThresholdEnrollmentRecord.Merge(m, src)
+}
+func (m *ThresholdEnrollmentRecord) XXX_Size() int {
+	return xxx_messageInfo_ThresholdEnrollmentRecord.Size(m)
+}
+func (m *ThresholdEnrollmentRecord) XXX_DiscardUnknown() {
+	xxx_messageInfo_ThresholdEnrollmentRecord.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_ThresholdEnrollmentRecord proto.InternalMessageInfo
+
+func (m *ThresholdEnrollmentRecord) GetNs() []byte {
+	if m != nil {
+		return m.Ns
+	}
+	return nil
+}
+
+func (m *ThresholdEnrollmentRecord) GetNc() []byte {
+	if m != nil {
+		return m.Nc
+	}
+	return nil
+}
+
+func (m *ThresholdEnrollmentRecord) GetT0() []byte {
+	if m != nil {
+		return m.T0
+	}
+	return nil
+}
+
+func (m *ThresholdEnrollmentRecord) GetT1() []byte {
+	if m != nil {
+		return m.T1
+	}
+	return nil
+}
+
+func (m *ThresholdEnrollmentRecord) GetCheck() []byte {
+	if m != nil {
+		return m.Check
+	}
+	return nil
+}
+
+func (m *ThresholdEnrollmentRecord) GetSuite() uint32 {
+	if m != nil {
+		return m.Suite
+	}
+	return 0
+}
+
+func (m *ThresholdEnrollmentRecord) GetProtocol() uint32 {
+	if m != nil {
+		return m.Protocol
+	}
+	return 0
+}
+
+type ProofOfCommitment struct {
+	Term1                []byte   `protobuf:"bytes,1,opt,name=term1,proto3" json:"term1,omitempty"`
+	Term2                []byte   `protobuf:"bytes,2,opt,name=term2,proto3" json:"term2,omitempty"`
+	Term3                []byte   `protobuf:"bytes,3,opt,name=term3,proto3" json:"term3,omitempty"`
+	BlindR               []byte   `protobuf:"bytes,4,opt,name=blind_r,json=blindR,proto3" json:"blind_r,omitempty"`
+	BlindX               []byte   `protobuf:"bytes,5,opt,name=blind_x,json=blindX,proto3" json:"blind_x,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *ProofOfCommitment) Reset()         { *m = ProofOfCommitment{} }
+func (m *ProofOfCommitment) String() string { return proto.CompactTextString(m) }
+func (*ProofOfCommitment) ProtoMessage()    {}
+func (*ProofOfCommitment) Descriptor() ([]byte, []int) {
+	return fileDescriptor_36f30d920d9c0b48, []int{15}
+}
+
+func (m *ProofOfCommitment) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_ProofOfCommitment.Unmarshal(m, b)
+}
+func (m *ProofOfCommitment) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_ProofOfCommitment.Marshal(b, m, deterministic)
+}
+func (m *ProofOfCommitment) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_ProofOfCommitment.Merge(m, src)
+}
+func (m *ProofOfCommitment) XXX_Size() int {
+	return xxx_messageInfo_ProofOfCommitment.Size(m)
+}
+func (m *ProofOfCommitment) XXX_DiscardUnknown() {
+	xxx_messageInfo_ProofOfCommitment.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_ProofOfCommitment proto.InternalMessageInfo
+
+func (m *ProofOfCommitment) GetTerm1() []byte {
+	if m != nil {
+		return m.Term1
+	}
+	return nil
+}
+
+func (m *ProofOfCommitment) GetTerm2() []byte {
+	if m != nil {
+		return m.Term2
+	}
+	return nil
+}
+
+func (m *ProofOfCommitment) GetTerm3() []byte {
+	if m != nil {
+		return m.Term3
+	}
+	return nil
+}
+
+func (m *ProofOfCommitment) GetBlindR() []byte {
+	if m != nil {
+		return m.BlindR
+	}
+	return nil
+}
+
+func (m *ProofOfCommitment) GetBlindX() []byte {
+	if m != nil {
+		return m.BlindX
+	}
+	return nil
+}
+
+type ThresholdCommitment struct {
+	Index                uint32             `protobuf:"varint,1,opt,name=index,proto3" json:"index,omitempty"`
+	Nonce                []byte             `protobuf:"bytes,2,opt,name=nonce,proto3" json:"nonce,omitempty"`
+	A                    []byte             `protobuf:"bytes,3,opt,name=a,proto3" json:"a,omitempty"`
+	B                    []byte             `protobuf:"bytes,4,opt,name=b,proto3" json:"b,omitempty"`
+	Proof                *ProofOfCommitment `protobuf:"bytes,5,opt,name=proof,proto3" json:"proof,omitempty"`
+	XXX_NoUnkeyedLiteral struct{}           `json:"-"`
+	XXX_unrecognized     []byte             `json:"-"`
+	XXX_sizecache        int32              `json:"-"`
+}
+
+func (m *ThresholdCommitment) Reset()         { *m = ThresholdCommitment{} }
+func (m *ThresholdCommitment) String() string { return proto.CompactTextString(m) }
+func (*ThresholdCommitment) ProtoMessage()    {}
+func (*ThresholdCommitment) Descriptor() ([]byte, []int) {
+	return fileDescriptor_36f30d920d9c0b48, []int{16}
+}
+
+func (m *ThresholdCommitment) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_ThresholdCommitment.Unmarshal(m, b)
+}
+func (m *ThresholdCommitment) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_ThresholdCommitment.Marshal(b, m, deterministic)
+}
+func (m *ThresholdCommitment) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_ThresholdCommitment.Merge(m, src)
+}
+func (m *ThresholdCommitment) XXX_Size() int {
+	return xxx_messageInfo_ThresholdCommitment.Size(m)
+}
+func (m *ThresholdCommitment) XXX_DiscardUnknown() {
+	xxx_messageInfo_ThresholdCommitment.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_ThresholdCommitment proto.InternalMessageInfo
+
+func (m *ThresholdCommitment) GetIndex() uint32 {
+	if m != nil {
+		return m.Index
+	}
+	return 0
+}
+
+func (m *ThresholdCommitment) GetNonce() []byte {
+	if m != nil {
+		return m.Nonce
+	}
+	return nil
+}
+
+func (m *ThresholdCommitment) GetA() []byte {
+	if m != nil {
+		return m.A
+	}
+	return nil
+}
+
+func (m *ThresholdCommitment) GetB() []byte {
+	if m != nil {
+		return m.B
+	}
+	return nil
+}
+
+func (m *ThresholdCommitment) GetProof() *ProofOfCommitment {
+	if m != nil {
+		return m.Proof
+	}
+	return nil
+}
+
+type ThresholdVerifyPasswordRequest struct {
+	Ns                   []byte                 `protobuf:"bytes,1,opt,name=ns,proto3" json:"ns,omitempty"`
+	C0                   []byte                 `protobuf:"bytes,2,opt,name=c0,proto3" json:"c0,omitempty"`
+	Commitments          []*ThresholdCommitment `protobuf:"bytes,3,rep,name=commitments,proto3" json:"commitments,omitempty"`
+	XXX_NoUnkeyedLiteral struct{}               `json:"-"`
+	XXX_unrecognized     []byte                 `json:"-"`
+	XXX_sizecache        int32                  `json:"-"`
+}
+
+func (m *ThresholdVerifyPasswordRequest) Reset()         { *m = ThresholdVerifyPasswordRequest{} }
+func (m *ThresholdVerifyPasswordRequest) String() string { return proto.CompactTextString(m) }
+func (*ThresholdVerifyPasswordRequest) ProtoMessage()    {}
+func (*ThresholdVerifyPasswordRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_36f30d920d9c0b48, []int{17}
+}
+
+func (m *ThresholdVerifyPasswordRequest) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_ThresholdVerifyPasswordRequest.Unmarshal(m, b)
+}
+func (m *ThresholdVerifyPasswordRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_ThresholdVerifyPasswordRequest.Marshal(b, m, deterministic)
+}
+func (m *ThresholdVerifyPasswordRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_ThresholdVerifyPasswordRequest.Merge(m, src)
+}
+func (m *ThresholdVerifyPasswordRequest) XXX_Size() int {
+	return xxx_messageInfo_ThresholdVerifyPasswordRequest.Size(m)
+}
+func (m *ThresholdVerifyPasswordRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_ThresholdVerifyPasswordRequest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_ThresholdVerifyPasswordRequest proto.InternalMessageInfo
+
+func (m *ThresholdVerifyPasswordRequest) GetNs() []byte {
+	if m != nil {
+		return m.Ns
+	}
+	return nil
+}
+
+func (m *ThresholdVerifyPasswordRequest) GetC0() []byte {
+	if m != nil {
+		return m.C0
+	}
+	return nil
+}
+
+func (m *ThresholdVerifyPasswordRequest) GetCommitments() []*ThresholdCommitment {
+	if m != nil {
+		return m.Commitments
+	}
+	return nil
+}
+
+type ProofOfEquality struct {
+	Term1                []byte   `protobuf:"bytes,1,opt,name=term1,proto3" json:"term1,omitempty"`
+	Term2                []byte   `protobuf:"bytes,2,opt,name=term2,proto3" json:"term2,omitempty"`
+	BlindX               []byte   `protobuf:"bytes,3,opt,name=blind_x,json=blindX,proto3" json:"blind_x,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *ProofOfEquality) Reset()         { *m = ProofOfEquality{} }
+func (m *ProofOfEquality) String() string { return proto.CompactTextString(m) }
+func (*ProofOfEquality) ProtoMessage()    {}
+func (*ProofOfEquality) Descriptor() ([]byte, []int) {
+	return fileDescriptor_36f30d920d9c0b48, []int{18}
+}
+
+func (m *ProofOfEquality) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_ProofOfEquality.Unmarshal(m, b)
+}
+func (m *ProofOfEquality) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_ProofOfEquality.Marshal(b, m, deterministic)
+}
+func (m *ProofOfEquality) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_ProofOfEquality.Merge(m, src)
+}
+func (m *ProofOfEquality) XXX_Size() int {
+	return xxx_messageInfo_ProofOfEquality.Size(m)
+}
+func (m *ProofOfEquality) XXX_DiscardUnknown() {
+	xxx_messageInfo_ProofOfEquality.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_ProofOfEquality proto.InternalMessageInfo
+
+func (m *ProofOfEquality) GetTerm1() []byte {
+	if m != nil {
+		return m.Term1
+	}
+	return nil
+}
+
+func (m *ProofOfEquality) GetTerm2() []byte {
+	if m != nil {
+		return m.Term2
+	}
+	return nil
+}
+
+func (m *ProofOfEquality) GetBlindX() []byte {
+	if m != nil {
+		return m.BlindX
+	}
+	return nil
+}
+
+type ThresholdVerifyPasswordResponse struct {
+	Index                uint32           `protobuf:"varint,1,opt,name=index,proto3" json:"index,omitempty"`
+	V                    []byte           `protobuf:"bytes,2,opt,name=v,proto3" json:"v,omitempty"`
+	Proof                *ProofOfEquality `protobuf:"bytes,3,opt,name=proof,proto3" json:"proof,omitempty"`
+	XXX_NoUnkeyedLiteral struct{}         `json:"-"`
+	XXX_unrecognized     []byte           `json:"-"`
+	XXX_sizecache        int32            `json:"-"`
+}
+
+func (m *ThresholdVerifyPasswordResponse) Reset()         { *m = ThresholdVerifyPasswordResponse{} }
+func (m *ThresholdVerifyPasswordResponse) String() string { return proto.CompactTextString(m) }
+func (*ThresholdVerifyPasswordResponse) ProtoMessage()    {}
+func (*ThresholdVerifyPasswordResponse) Descriptor() ([]byte, []int) {
+	return fileDescriptor_36f30d920d9c0b48, []int{19}
+}
+
+func (m *ThresholdVerifyPasswordResponse) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_ThresholdVerifyPasswordResponse.Unmarshal(m, b)
+}
+func (m *ThresholdVerifyPasswordResponse) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_ThresholdVerifyPasswordResponse.Marshal(b, m, deterministic)
+}
+func (m *ThresholdVerifyPasswordResponse) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_ThresholdVerifyPasswordResponse.Merge(m, src)
+}
+func (m *ThresholdVerifyPasswordResponse) XXX_Size() int {
+	return xxx_messageInfo_ThresholdVerifyPasswordResponse.Size(m)
+}
+func (m *ThresholdVerifyPasswordResponse) XXX_DiscardUnknown() {
+	xxx_messageInfo_ThresholdVerifyPasswordResponse.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_ThresholdVerifyPasswordResponse proto.InternalMessageInfo
+
+func (m *ThresholdVerifyPasswordResponse) GetIndex() uint32 {
+	if m != nil {
+		return m.Index
+	}
+	return 0
+}
+
+func (m *ThresholdVerifyPasswordResponse) GetV() []byte {
+	if m != nil {
+		return m.V
+	}
+	return nil
+}
+
+func (m *ThresholdVerifyPasswordResponse) GetProof() *ProofOfEquality {
+	if m != nil {
+		return m.Proof
+	}
+	return nil
+}
+
+type GetEnrollmentRequest struct {
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *GetEnrollmentRequest) Reset()         { *m = GetEnrollmentRequest{} }
+func (m *GetEnrollmentRequest) String() string { return proto.CompactTextString(m) }
+func (*GetEnrollmentRequest) ProtoMessage()    {}
+func (*GetEnrollmentRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_36f30d920d9c0b48, []int{20}
+}
+
+func (m *GetEnrollmentRequest) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_GetEnrollmentRequest.Unmarshal(m, b)
+}
+func (m *GetEnrollmentRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_GetEnrollmentRequest.Marshal(b, m, deterministic)
+}
+func (m *GetEnrollmentRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_GetEnrollmentRequest.Merge(m, src)
+}
+func (m *GetEnrollmentRequest) XXX_Size() int {
+	return xxx_messageInfo_GetEnrollmentRequest.Size(m)
+}
+func (m *GetEnrollmentRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_GetEnrollmentRequest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_GetEnrollmentRequest proto.InternalMessageInfo
+
+type GetPublicKeyRequest struct {
+	Version              uint32   `protobuf:"varint,1,opt,name=version,proto3" json:"version,omitempty"`
+	Current              bool     `protobuf:"varint,2,opt,name=current,proto3" json:"current,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *GetPublicKeyRequest) Reset()         { *m = GetPublicKeyRequest{} }
+func (m *GetPublicKeyRequest) String() string { return proto.CompactTextString(m) }
+func (*GetPublicKeyRequest) ProtoMessage()    {}
+func (*GetPublicKeyRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_36f30d920d9c0b48, []int{21}
+}
+
+func (m *GetPublicKeyRequest) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_GetPublicKeyRequest.Unmarshal(m, b)
+}
+func (m *GetPublicKeyRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_GetPublicKeyRequest.Marshal(b, m, deterministic)
+}
+func (m *GetPublicKeyRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_GetPublicKeyRequest.Merge(m, src)
+}
+func (m *GetPublicKeyRequest) XXX_Size() int {
+	return xxx_messageInfo_GetPublicKeyRequest.Size(m)
+}
+func (m *GetPublicKeyRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_GetPublicKeyRequest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_GetPublicKeyRequest proto.InternalMessageInfo
+
+func (m *GetPublicKeyRequest) GetVersion() uint32 {
+	if m != nil {
+		return m.Version
+	}
+	return 0
+}
+
+func (m *GetPublicKeyRequest) GetCurrent() bool {
+	if m != nil {
+		return m.Current
+	}
+	return false
+}
+
+type GetPublicKeyResponse struct {
+	PublicKey            []byte   `protobuf:"bytes,1,opt,name=public_key,json=publicKey,proto3" json:"public_key,omitempty"`
+	Version              uint32   `protobuf:"varint,2,opt,name=version,proto3" json:"version,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *GetPublicKeyResponse) Reset()         { *m = GetPublicKeyResponse{} }
+func (m *GetPublicKeyResponse) String() string { return proto.CompactTextString(m) }
+func (*GetPublicKeyResponse) ProtoMessage()    {}
+func (*GetPublicKeyResponse) Descriptor() ([]byte, []int) {
+	return fileDescriptor_36f30d920d9c0b48, []int{22}
+}
+
+func (m *GetPublicKeyResponse) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_GetPublicKeyResponse.Unmarshal(m, b)
+}
+func (m *GetPublicKeyResponse) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_GetPublicKeyResponse.Marshal(b, m, deterministic)
+}
+func (m *GetPublicKeyResponse) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_GetPublicKeyResponse.Merge(m, src)
+}
+func (m *GetPublicKeyResponse) XXX_Size() int {
+	return xxx_messageInfo_GetPublicKeyResponse.Size(m)
+}
+func (m *GetPublicKeyResponse) XXX_DiscardUnknown() {
+	xxx_messageInfo_GetPublicKeyResponse.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_GetPublicKeyResponse proto.InternalMessageInfo
+
+func (m *GetPublicKeyResponse) GetPublicKey() []byte {
+	if m != nil {
+		return m.PublicKey
+	}
+	return nil
+}
+
+func (m *GetPublicKeyResponse) GetVersion() uint32 {
+	if m != nil {
+		return m.Version
+	}
+	return 0
+}
+
+type RotateRequest struct {
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *RotateRequest) Reset()         { *m = RotateRequest{} }
+func (m *RotateRequest) String() string { return proto.CompactTextString(m) }
+func (*RotateRequest) ProtoMessage()    {}
+func (*RotateRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_36f30d920d9c0b48, []int{23}
+}
+
+func (m *RotateRequest) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_RotateRequest.Unmarshal(m, b)
+}
+func (m *RotateRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_RotateRequest.Marshal(b, m, deterministic)
+}
+func (m *RotateRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_RotateRequest.Merge(m, src)
+}
+func (m *RotateRequest) XXX_Size() int {
+	return xxx_messageInfo_RotateRequest.Size(m)
+}
+func (m *RotateRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_RotateRequest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_RotateRequest proto.InternalMessageInfo
+
+func init() {
+	proto.RegisterType((*Keypair)(nil), "phe.Keypair")
+	proto.RegisterType((*EnrollmentRecord)(nil), "phe.EnrollmentRecord")
+	proto.RegisterType((*ProofOfSuccess)(nil), "phe.ProofOfSuccess")
+	proto.RegisterType((*ProofOfFail)(nil), "phe.ProofOfFail")
+	proto.RegisterType((*ProofOfRotation)(nil), "phe.ProofOfRotation")
+	proto.RegisterType((*UpdateToken)(nil), "phe.UpdateToken")
+	proto.RegisterType((*EnrollmentResponse)(nil), "phe.EnrollmentResponse")
+	proto.RegisterType((*VerifyPasswordRequest)(nil), "phe.VerifyPasswordRequest")
+	proto.RegisterType((*VerifyPasswordResponse)(nil), "phe.VerifyPasswordResponse")
+	proto.RegisterType((*ThresholdPublicKey)(nil), "phe.ThresholdPublicKey")
+	proto.RegisterType((*ThresholdKeypair)(nil), "phe.ThresholdKeypair")
+	proto.RegisterType((*ThresholdNonce)(nil), "phe.ThresholdNonce")
+	proto.RegisterType((*ThresholdEnrollmentRequest)(nil), "phe.ThresholdEnrollmentRequest")
+	proto.RegisterType((*ThresholdEnrollmentResponse)(nil), "phe.ThresholdEnrollmentResponse")
+	proto.RegisterType((*ThresholdEnrollmentRecord)(nil), "phe.ThresholdEnrollmentRecord")
+	proto.RegisterType((*ProofOfCommitment)(nil), "phe.ProofOfCommitment")
+	proto.RegisterType((*ThresholdCommitment)(nil), "phe.ThresholdCommitment")
+	proto.RegisterType((*ThresholdVerifyPasswordRequest)(nil), "phe.ThresholdVerifyPasswordRequest")
+	proto.RegisterType((*ProofOfEquality)(nil), "phe.ProofOfEquality")
+	proto.RegisterType((*ThresholdVerifyPasswordResponse)(nil), "phe.ThresholdVerifyPasswordResponse")
+	proto.RegisterType((*GetEnrollmentRequest)(nil), "phe.GetEnrollmentRequest")
+	proto.RegisterType((*GetPublicKeyRequest)(nil), "phe.GetPublicKeyRequest")
+	proto.RegisterType((*GetPublicKeyResponse)(nil), "phe.GetPublicKeyResponse")
+	proto.RegisterType((*RotateRequest)(nil), "phe.RotateRequest")
+}
+
+func init() { proto.RegisterFile("phe.proto", fileDescriptor_36f30d920d9c0b48) }
+
+var fileDescriptor_36f30d920d9c0b48 = []byte{
+	// 979 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0xac, 0x56, 0xdf, 0x6f, 0xe3, 0x44,
+	0x10, 0xbe, 0xb5, 0xe3, 0xa4, 0x9d, 0xa4, 0xbd, 0xb2, 0x0d, 0x3d, 0x37, 0x07, 0x5c, 0xe5, 0x07,
+	0x74, 0xfc, 0x50, 0x69, 0x7a, 0x88, 0x07, 0x1e, 0x90, 0xb8, 0xaa, 0x5c, 0xab, 0x93, 0xb8, 0xca,
+	0x1c, 0x27, 0xde, 0x4e, 0x8e, 0xb3, 0x25, 0x56, 0x1d, 0xdb, 0xb5, 0x37, 0xe5, 0x22, 0x78, 0x41,
+	0x3c, 0x20, 0x81, 0xc4, 0x2b, 0x2f, 0x08, 0x09, 0xf1, 0x67, 0xf0, 0xcf, 0xa1, 0xdd, 0x1d, 0xdb,
+	0xbb, 0xa9, 0x43, 0xb9, 0x2a, 0x6f, 0xf9, 0x76, 0x27, 0x33, 0xdf, 0xcc, 0x7c, 0x3b, 0x63, 0x58,
+	0xcf, 0x26, 0x6c, 0x3f, 0xcb, 0x53, 0x9e, 0x52, 0x3b, 0x9b, 0x30, 0xef, 0x7b, 0xe8, 0x3c, 0x65,
+	0xf3, 0x2c, 0x88, 0x72, 0xfa, 0x36, 0x40, 0x36, 0x1b, 0xc5, 0x51, 0xf8, 0xf2, 0x82, 0xcd, 0x5d,
+	0xb2, 0x47, 0x1e, 0xf6, 0xfc, 0x75, 0x75, 0xf2, 0x94, 0xcd, 0xe9, 0x03, 0xe8, 0x66, 0x79, 0x74,
+	0x15, 0x70, 0x26, 0xef, 0x2d, 0x79, 0x0f, 0x78, 0x24, 0x0c, 0xfa, 0xe0, 0x14, 0xb3, 0x88, 0x33,
+	0xd7, 0xde, 0x23, 0x0f, 0x37, 0x7c, 0x05, 0xe8, 0x00, 0xd6, 0x64, 0xb8, 0x30, 0x8d, 0xdd, 0x96,
+	0xbc, 0xa8, 0xb0, 0xf7, 0x27, 0x81, 0xad, 0xe3, 0x24, 0x4f, 0xe3, 0x78, 0xca, 0x12, 0xee, 0xb3,
+	0x30, 0xcd, 0xc7, 0x74, 0x13, 0xac, 0xa4, 0xc0, 0xf0, 0x56, 0x52, 0x48, 0x1c, 0x62, 0x38, 0x2b,
+	0x09, 0x05, 0xe6, 0x07, 0x32, 0x46, 0xcf, 0xb7, 0xf8, 0x81, 0xc4, 0x43, 0xb7, 0x85, 0x78, 0x48,
+	0x5d, 0xe8, 0x5c, 0xb1, 0xbc, 0x88, 0xd2, 0xc4, 0x75, 0x64, 0xbc, 0x12, 0xd6, 0x04, 0xdb, 0xcb,
+	0x08, 0x76, 0x16, 0x08, 0x5e, 0xc0, 0xe6, 0x59, 0x9e, 0xa6, 0xe7, 0xcf, 0xce, 0xbf, 0x9a, 0x85,
+	0x21, 0x2b, 0x0a, 0xe1, 0x83, 0xb3, 0x7c, 0x3a, 0x44, 0x82, 0x0a, 0x94, 0xa7, 0x87, 0x48, 0x53,
+	0x81, 0xf2, 0xf4, 0x11, 0x92, 0x55, 0x80, 0xde, 0x83, 0xce, 0x28, 0x8e, 0x92, 0xf1, 0xcb, 0x57,
+	0x48, 0xba, 0x2d, 0xe1, 0x37, 0xde, 0xef, 0x04, 0xba, 0x18, 0xed, 0x8b, 0x20, 0x8a, 0x57, 0x10,
+	0x0a, 0x4f, 0x3f, 0xc6, 0x40, 0x0a, 0xd4, 0x04, 0x02, 0xd7, 0xd1, 0x08, 0x7c, 0x5e, 0x5f, 0x8c,
+	0xdc, 0xb6, 0x76, 0xf1, 0xd8, 0xfb, 0x0c, 0xee, 0x22, 0x31, 0x3f, 0xe5, 0x01, 0x17, 0xb5, 0xa4,
+	0xd0, 0x12, 0xde, 0x90, 0x9b, 0xfc, 0xad, 0x67, 0x66, 0x19, 0x99, 0xfd, 0x45, 0xa0, 0xfb, 0x75,
+	0x36, 0x0e, 0x38, 0x7b, 0x9e, 0x5e, 0xb0, 0x84, 0xf6, 0x80, 0x04, 0xf8, 0x4f, 0x12, 0x08, 0x34,
+	0xc2, 0x3f, 0x90, 0x91, 0xde, 0x3e, 0xdb, 0x6c, 0xdf, 0xfb, 0xe0, 0x64, 0x82, 0x85, 0xcc, 0xa6,
+	0x7b, 0xd8, 0xdf, 0x17, 0x52, 0x5e, 0xe0, 0xe5, 0x2b, 0x93, 0xba, 0xd5, 0xce, 0xb2, 0x56, 0xb7,
+	0x17, 0x5a, 0xfd, 0x0f, 0x01, 0xaa, 0x6b, 0xb1, 0xc8, 0xd2, 0xa4, 0x60, 0x4d, 0x6a, 0x0c, 0x0f,
+	0x4a, 0x35, 0x86, 0x52, 0x7d, 0xe1, 0xb0, 0x54, 0x63, 0x38, 0xa4, 0xef, 0x99, 0x24, 0xb7, 0x75,
+	0x92, 0xa8, 0xa1, 0x92, 0xe3, 0x2a, 0x85, 0xfa, 0x13, 0x81, 0x37, 0x5f, 0xb0, 0x3c, 0x3a, 0x9f,
+	0x9f, 0x05, 0x45, 0xf1, 0x5d, 0x9a, 0x8f, 0x7d, 0x76, 0x39, 0x63, 0x05, 0xbf, 0x31, 0x81, 0xe5,
+	0xf5, 0xae, 0x58, 0xb4, 0x96, 0xb1, 0x70, 0x16, 0x58, 0xfc, 0x41, 0x60, 0x67, 0x91, 0x05, 0xd6,
+	0x71, 0x0b, 0xec, 0x9c, 0x29, 0x1e, 0x6b, 0xbe, 0xf8, 0x89, 0x95, 0xb3, 0xaa, 0xca, 0x7d, 0x04,
+	0x9d, 0x42, 0x15, 0xc8, 0xb5, 0x97, 0xd6, 0xee, 0xe4, 0x8e, 0x5f, 0x5a, 0xd1, 0x77, 0xa1, 0x75,
+	0x1e, 0x44, 0x31, 0x56, 0x7a, 0x4b, 0xb7, 0x16, 0xef, 0xe7, 0xe4, 0x8e, 0x2f, 0xef, 0x1f, 0x77,
+	0xb0, 0x25, 0xde, 0x0f, 0x40, 0x9f, 0x4f, 0x72, 0x56, 0x4c, 0xd2, 0x78, 0x7c, 0x56, 0xcd, 0xb5,
+	0xb7, 0x60, 0x9d, 0x97, 0xa7, 0x92, 0xdf, 0x86, 0x5f, 0x1f, 0xd0, 0x1d, 0x68, 0x17, 0x93, 0x40,
+	0x50, 0xb7, 0xf6, 0x6c, 0x21, 0x69, 0x85, 0x6e, 0x31, 0xec, 0x7e, 0x24, 0xb0, 0x55, 0x85, 0x2f,
+	0x67, 0x6e, 0x1f, 0x9c, 0x28, 0x19, 0xb3, 0x57, 0x18, 0x58, 0x81, 0x9b, 0x47, 0xed, 0x27, 0xc6,
+	0xa8, 0x56, 0xe5, 0xba, 0x27, 0x0b, 0x70, 0x3d, 0x41, 0x6d, 0x86, 0x7b, 0x31, 0x6c, 0x56, 0x06,
+	0x5f, 0xa6, 0x49, 0xc8, 0x96, 0x10, 0xe8, 0x83, 0x93, 0x88, 0xeb, 0x72, 0xc8, 0x48, 0x20, 0x2b,
+	0x15, 0x4d, 0x59, 0xc1, 0x83, 0x69, 0x26, 0x83, 0xb6, 0xfc, 0xfa, 0x40, 0x74, 0x98, 0x07, 0xdf,
+	0xe2, 0xa8, 0x11, 0x3f, 0xbd, 0x53, 0x18, 0x54, 0xd1, 0xf4, 0xa7, 0xa5, 0x84, 0xf9, 0x01, 0xb4,
+	0xa5, 0x5b, 0x21, 0x0a, 0xbb, 0x6a, 0xb7, 0x49, 0xcf, 0x47, 0x13, 0xef, 0x37, 0x02, 0xf7, 0x1b,
+	0x7d, 0xa1, 0xbc, 0x9a, 0xd3, 0x50, 0xda, 0xb7, 0x16, 0xb4, 0x6f, 0x2f, 0x3c, 0xde, 0xd6, 0xf5,
+	0xc7, 0xeb, 0xdc, 0xf4, 0x78, 0xbd, 0xbf, 0x09, 0xec, 0x36, 0x12, 0x5a, 0xc9, 0x0e, 0xeb, 0x83,
+	0x13, 0x4e, 0x58, 0x78, 0x81, 0x03, 0x5a, 0x81, 0x5b, 0x8c, 0x85, 0x9f, 0x09, 0xbc, 0x81, 0xfc,
+	0x8f, 0xd2, 0xe9, 0x34, 0xe2, 0x82, 0xe3, 0x2a, 0x77, 0x58, 0x6e, 0xec, 0x30, 0x5f, 0x5f, 0x01,
+	0x8e, 0xb1, 0x02, 0x7e, 0x25, 0xb0, 0x5d, 0xd5, 0xcb, 0xe4, 0xf2, 0xbf, 0xf5, 0x27, 0xd7, 0x86,
+	0x6d, 0xac, 0x8d, 0x56, 0xb9, 0x36, 0x3e, 0x34, 0x5b, 0xb7, 0xa3, 0xb7, 0xae, 0x0e, 0xe7, 0x57,
+	0x93, 0xe0, 0x9d, 0x8a, 0xcc, 0xed, 0xc6, 0xe6, 0xa7, 0xd0, 0x0d, 0x2b, 0xb7, 0x62, 0x62, 0x09,
+	0x09, 0xbb, 0xa6, 0x84, 0xb5, 0xb8, 0xba, 0xb1, 0xf7, 0xa2, 0x5a, 0xa7, 0xc7, 0x97, 0xb3, 0x20,
+	0x8e, 0xf8, 0xfc, 0xb5, 0x5a, 0xa2, 0xd5, 0xd8, 0x36, 0x6a, 0x7c, 0x09, 0x0f, 0x96, 0x66, 0xf5,
+	0x9f, 0xef, 0xa4, 0x07, 0xe4, 0x0a, 0x63, 0x90, 0xab, 0x7a, 0xcf, 0xda, 0xd7, 0xf7, 0x6c, 0x49,
+	0xb8, 0x2c, 0xe4, 0x0e, 0xf4, 0x9f, 0x30, 0x7e, 0xed, 0x71, 0x7b, 0xa7, 0xb0, 0xfd, 0x84, 0xf1,
+	0x7a, 0x06, 0x61, 0x55, 0xb5, 0x65, 0x43, 0xcc, 0x65, 0xe3, 0x42, 0x27, 0x9c, 0xe5, 0x39, 0x4b,
+	0xb8, 0x24, 0xb2, 0xe6, 0x97, 0xd0, 0x7b, 0x06, 0x7d, 0xd3, 0x15, 0xa6, 0x72, 0xc3, 0xe7, 0xaa,
+	0x16, 0xca, 0x32, 0x42, 0x79, 0x77, 0x61, 0x43, 0x7e, 0x2e, 0x30, 0x64, 0x75, 0xf8, 0x8b, 0x05,
+	0xf6, 0xd9, 0xc9, 0x31, 0x3d, 0x82, 0x0d, 0x23, 0x19, 0xba, 0x2b, 0x53, 0x6f, 0x4a, 0x70, 0xa0,
+	0xa6, 0x6d, 0xc3, 0x24, 0x3a, 0x82, 0x9e, 0x4e, 0x97, 0xba, 0xa5, 0x8f, 0xc5, 0x62, 0x0c, 0x76,
+	0x1b, 0x6e, 0xd0, 0xc9, 0x29, 0x6c, 0x9a, 0x0d, 0xa4, 0x03, 0x69, 0xdc, 0xa8, 0xd5, 0xc1, 0xfd,
+	0xc6, 0x3b, 0x74, 0xb5, 0x0f, 0x6d, 0x95, 0x2d, 0xa5, 0xd2, 0xcc, 0x48, 0x7d, 0xa0, 0xb6, 0xa6,
+	0xf6, 0x6d, 0x36, 0x6a, 0xcb, 0xe1, 0xf1, 0xe8, 0xdf, 0x01, 0x00, 0x06, 0xeb, 0xb0, 0x95, 0x29,
+	0x0c, 0x00, 0x00,
+}
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ context.Context
+var _ grpc.ClientConn
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+const _ = grpc.SupportPackageIsVersion4
+
+// PHEClient is the client API for PHE service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://godoc.org/google.golang.org/grpc#ClientConn.NewStream.
+type PHEClient interface {
+	// GetEnrollment generates a new enrollment using the current key version
+	GetEnrollment(ctx context.Context, in *GetEnrollmentRequest, opts ...grpc.CallOption) (*EnrollmentResponse, error)
+	// GetPublicKey returns the public key of the requested version or the current one
+	GetPublicKey(ctx context.Context, in *GetPublicKeyRequest, opts ...grpc.CallOption) (*GetPublicKeyResponse, error)
+	// VerifyPassword verifies a password attempt and returns a proof of the result
+	VerifyPassword(ctx context.Context, in *VerifyPasswordRequest, opts ...grpc.CallOption) (*VerifyPasswordResponse, error)
+	// Rotate creates a new key version and returns the update token for the clients
+	Rotate(ctx context.Context, in *RotateRequest, opts ...grpc.CallOption) (*UpdateToken, error)
+}
+
+type pHEClient struct {
+	cc *grpc.ClientConn
+}
+
+func NewPHEClient(cc *grpc.ClientConn) PHEClient {
+	return &pHEClient{cc}
+}
+
+func (c *pHEClient) GetEnrollment(ctx context.Context, in *GetEnrollmentRequest, opts ...grpc.CallOption) (*EnrollmentResponse, error) {
+	out := new(EnrollmentResponse)
+	err := c.cc.Invoke(ctx, "/phe.PHE/GetEnrollment", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *pHEClient) GetPublicKey(ctx context.Context, in *GetPublicKeyRequest, opts ...grpc.CallOption) (*GetPublicKeyResponse, error) {
+	out := new(GetPublicKeyResponse)
+	err := c.cc.Invoke(ctx, "/phe.PHE/GetPublicKey", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *pHEClient) VerifyPassword(ctx context.Context, in *VerifyPasswordRequest, opts ...grpc.CallOption) (*VerifyPasswordResponse, error) {
+	out := new(VerifyPasswordResponse)
+	err := c.cc.Invoke(ctx, "/phe.PHE/VerifyPassword", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *pHEClient) Rotate(ctx context.Context, in *RotateRequest, opts ...grpc.CallOption) (*UpdateToken, error) {
+	out := new(UpdateToken)
+	err := c.cc.Invoke(ctx, "/phe.PHE/Rotate", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// PHEServer is the server API for PHE service.
+type PHEServer interface {
+	// GetEnrollment generates a new enrollment using the current key version
+	GetEnrollment(context.Context, *GetEnrollmentRequest) (*EnrollmentResponse, error)
+	// GetPublicKey returns the public key of the requested version or the current one
+	GetPublicKey(context.Context, *GetPublicKeyRequest) (*GetPublicKeyResponse, error)
+	// VerifyPassword verifies a password attempt and returns a proof of the result
+	VerifyPassword(context.Context, *VerifyPasswordRequest) (*VerifyPasswordResponse, error)
+	// Rotate creates a new key version and returns the update token for the clients
+	Rotate(context.Context, *RotateRequest) (*UpdateToken, error)
+}
+
+// UnimplementedPHEServer can be embedded to have forward compatible implementations.
+type UnimplementedPHEServer struct {
+}
+
+func (*UnimplementedPHEServer) GetEnrollment(ctx context.Context, req *GetEnrollmentRequest) (*EnrollmentResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetEnrollment not implemented")
+}
+func (*UnimplementedPHEServer) GetPublicKey(ctx context.Context, req *GetPublicKeyRequest) (*GetPublicKeyResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetPublicKey not implemented")
+}
+func (*UnimplementedPHEServer) VerifyPassword(ctx context.Context, req *VerifyPasswordRequest) (*VerifyPasswordResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method VerifyPassword not implemented")
+}
+func (*UnimplementedPHEServer) Rotate(ctx context.Context, req *RotateRequest) (*UpdateToken, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Rotate not implemented")
+}
+
+func RegisterPHEServer(s *grpc.Server, srv PHEServer) {
+	s.RegisterService(&_PHE_serviceDesc, srv)
+}
+
+func _PHE_GetEnrollment_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetEnrollmentRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(PHEServer).GetEnrollment(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/phe.PHE/GetEnrollment",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(PHEServer).GetEnrollment(ctx, req.(*GetEnrollmentRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _PHE_GetPublicKey_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetPublicKeyRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(PHEServer).GetPublicKey(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/phe.PHE/GetPublicKey",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(PHEServer).GetPublicKey(ctx, req.(*GetPublicKeyRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _PHE_VerifyPassword_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(VerifyPasswordRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(PHEServer).VerifyPassword(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/phe.PHE/VerifyPassword",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(PHEServer).VerifyPassword(ctx, req.(*VerifyPasswordRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _PHE_Rotate_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RotateRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(PHEServer).Rotate(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/phe.PHE/Rotate",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(PHEServer).Rotate(ctx, req.(*RotateRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+var _PHE_serviceDesc = grpc.ServiceDesc{
+	ServiceName: "phe.PHE",
+	HandlerType: (*PHEServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "GetEnrollment",
+			Handler:    _PHE_GetEnrollment_Handler,
+		},
+		{
+			MethodName: "GetPublicKey",
+			Handler:    _PHE_GetPublicKey_Handler,
+		},
+		{
+			MethodName: "VerifyPassword",
+			Handler:    _PHE_VerifyPassword_Handler,
+		},
+		{
+			MethodName: "Rotate",
+			Handler:    _PHE_Rotate_Handler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "phe.proto",
 }
@@ -38,8 +38,13 @@ package phe
 
 import (
 	"crypto/elliptic"
+	"crypto/rand"
+	"errors"
+	"math/big"
 	"testing"
 
+	"github.com/VirgilSecurity/virgil-phe-go/internal/drbg"
+	"github.com/golang/protobuf/proto"
 	"github.com/stretchr/testify/require"
 )
 
@@ -50,8 +55,8 @@ var (
 func BenchmarkAddP256(b *testing.B) {
 	b.ResetTimer()
 	p256 := elliptic.P256()
-	_, x, y, _ := elliptic.GenerateKey(p256, randReader)
-	_, x1, y1, _ := elliptic.GenerateKey(p256, randReader)
+	_, x, y, _ := elliptic.GenerateKey(p256, rand.Reader)
+	_, x1, y1, _ := elliptic.GenerateKey(p256, rand.Reader)
 
 	b.ReportAllocs()
 	b.StartTimer()
@@ -102,7 +107,7 @@ func Test_PHE(t *testing.T) {
 	newPub, err := GetPublicKey(newPrivate)
 	require.NoError(t, err)
 	require.Equal(t, c.serverPublicKeyBytes, newPub)
-	rec1, err := UpdateRecord(rec, token)
+	rec1, err := UpdateRecord(pub, rec, token)
 	require.NoError(t, err)
 	//Check password request
 	req, err = c.CreateVerifyPasswordRequest(pwd, rec1)
@@ -146,24 +151,21 @@ func Test_PHE_InvalidPassword(t *testing.T) {
 	require.False(t, result.Res)
 	//validate response & decrypt M
 	keyDec, err := c.CheckResponseAndDecrypt([]byte("Password1"), rec, resp)
-	require.Nil(t, err)
+	require.Equal(t, ErrWrongPassword, err)
 	// decrypted m must be nil
 	require.Nil(t, keyDec)
 }
 
 func BenchmarkServer_GetEnrollment(b *testing.B) {
-	MockRandom()
 	serverKeypair, err := GenerateServerKeypair()
 	require.NoError(b, err)
 	b.ReportAllocs()
 	for i := 0; i < b.N; i++ {
-		MockRandom()
 		GetEnrollment(serverKeypair)
 	}
 }
 
 func BenchmarkClient_EnrollAccount(b *testing.B) {
-	MockRandom()
 	serverKeypair, err := GenerateServerKeypair()
 	require.NoError(b, err)
 	pub, err := GetPublicKey(serverKeypair)
@@ -178,14 +180,12 @@ func BenchmarkClient_EnrollAccount(b *testing.B) {
 	b.ResetTimer()
 
 	for i := 0; i < b.N; i++ {
-		MockRandom()
 		_, _, err := c.EnrollAccount(pwd, enrollment)
 		require.NoError(b, err)
 	}
 }
 
 func BenchmarkClient_CreateVerifyPasswordRequest(b *testing.B) {
-	MockRandom()
 	serverKeypair, err := GenerateServerKeypair()
 	require.NoError(b, err)
 	pub, err := GetPublicKey(serverKeypair)
@@ -211,7 +211,6 @@ func BenchmarkClient_CreateVerifyPasswordRequest(b *testing.B) {
 }
 
 func BenchmarkVerifyDecrypt(b *testing.B) {
-	MockRandom()
 	serverKeypair, err := GenerateServerKeypair()
 	require.NoError(b, err)
 	pub, err := GetPublicKey(serverKeypair)
@@ -244,11 +243,9 @@ func BenchmarkVerifyDecrypt(b *testing.B) {
 		// decrypted m must be the same as original
 		require.Equal(b, key, keyDec)
 	}
-	EndMock()
 }
 
 func BenchmarkLoginFlow(b *testing.B) {
-	MockRandom()
 	serverKeypair, err := GenerateServerKeypair()
 	require.NoError(b, err)
 	pub, err := GetPublicKey(serverKeypair)
@@ -268,7 +265,6 @@ func BenchmarkLoginFlow(b *testing.B) {
 	b.ResetTimer()
 
 	for i := 0; i < b.N; i++ {
-		MockRandom()
 		//Check password request
 		req, err := c.CreateVerifyPasswordRequest(pwd, rec)
 		require.NoError(b, err)
@@ -282,3 +278,179 @@ func BenchmarkLoginFlow(b *testing.B) {
 		require.Equal(b, key, keyDec)
 	}
 }
+
+func Test_PHE_InvalidUpdateToken(t *testing.T) {
+	serverKeypair, err := GenerateServerKeypair()
+	require.NoError(t, err)
+	otherKeypair, err := GenerateServerKeypair()
+	require.NoError(t, err)
+	pub, err := GetPublicKey(serverKeypair)
+	require.NoError(t, err)
+	clientKey := generateClientKey(t)
+	c, err := NewClient(pub, clientKey)
+	require.NoError(t, err)
+
+	token, _, err := Rotate(serverKeypair)
+	require.NoError(t, err)
+	require.NoError(t, VerifyUpdateToken(pub, token))
+
+	// token issued for another server key
+	otherToken, _, err := Rotate(otherKeypair)
+	require.NoError(t, err)
+	require.Error(t, VerifyUpdateToken(pub, otherToken))
+	require.Error(t, c.Rotate(otherToken))
+	require.Equal(t, pub, c.serverPublicKeyBytes)
+	require.Equal(t, clientKey, c.clientPrivateKeyBytes)
+
+	// records aren't touched by a token issued for another server key
+	enrollment, err := GetEnrollment(serverKeypair)
+	require.NoError(t, err)
+	rec, _, err := c.EnrollAccount(pwd, enrollment)
+	require.NoError(t, err)
+	_, err = UpdateRecord(pub, rec, otherToken)
+	require.True(t, errors.Is(err, ErrInvalidToken), "%v", err)
+	_, err = UpdateRecord(pub, rec, token)
+	require.NoError(t, err)
+
+	tamper := func(f func(tkn *UpdateToken)) []byte {
+		tkn := &UpdateToken{}
+		require.NoError(t, proto.Unmarshal(token, tkn))
+		f(tkn)
+		res, err := proto.Marshal(tkn)
+		require.NoError(t, err)
+		return res
+	}
+
+	// modified b
+	badToken := tamper(func(tkn *UpdateToken) {
+		tkn.B = padZ(gf.Add(new(big.Int).SetBytes(tkn.B), big.NewInt(1)).Bytes())
+	})
+	require.Error(t, VerifyUpdateToken(pub, badToken))
+	_, _, err = RotateClientKeys(pub, clientKey, badToken)
+	require.Error(t, err)
+
+	_, err = UpdateRecord(pub, rec, badToken)
+	require.True(t, errors.Is(err, ErrInvalidToken), "%v", err)
+
+	// a missing, malformed or wrong proof is reported the same way
+	for _, f := range []func(tkn *UpdateToken){
+		func(tkn *UpdateToken) { tkn.Proof = nil },
+		func(tkn *UpdateToken) { tkn.Proof.Term = tkn.Proof.Term[1:] },
+		func(tkn *UpdateToken) { tkn.Proof.BlindX = tkn.Proof.BlindX[1:] },
+		func(tkn *UpdateToken) { tkn.Proof.BlindX[0] ^= 1 },
+	} {
+		badToken = tamper(f)
+		require.True(t, errors.Is(c.Rotate(badToken), ErrInvalidToken))
+		require.True(t, errors.Is(VerifyUpdateToken(pub, badToken), ErrInvalidToken))
+		_, err = UpdateRecord(pub, rec, badToken)
+		require.True(t, errors.Is(err, ErrInvalidToken), "%v", err)
+	}
+
+	// a = 0 would make records independent of the password
+	badToken = tamper(func(tkn *UpdateToken) {
+		tkn.A = make([]byte, zLen)
+	})
+	require.Error(t, c.Rotate(badToken))
+	_, err = UpdateRecord(pub, enrollmentRecord, badToken)
+	require.Error(t, err)
+
+	require.NoError(t, c.Rotate(token))
+}
+
+func Test_PHE_InfinityPoints(t *testing.T) {
+	serverKeypair, err := GenerateServerKeypair()
+	require.NoError(t, err)
+	pub, err := GetPublicKey(serverKeypair)
+	require.NoError(t, err)
+	c, err := NewClient(pub, generateClientKey(t))
+	require.NoError(t, err)
+
+	enrollment, err := GetEnrollment(serverKeypair)
+	require.NoError(t, err)
+	recBytes, _, err := c.EnrollAccount(pwd, enrollment)
+	require.NoError(t, err)
+
+	rec := &EnrollmentRecord{}
+	require.NoError(t, proto.Unmarshal(recBytes, rec))
+	protocol, err := checkProtocol(rec.Protocol)
+	require.NoError(t, err)
+
+	// t0 = hc0 * y makes c0 the point at infinity
+	hc0, err := c.g.hashToPoint(protocol, dhc0, rec.Nc, pwd)
+	require.NoError(t, err)
+	rec.T0 = hc0.ScalarMult(c.clientPrivateKey).Marshal()
+	badRec, err := proto.Marshal(rec)
+	require.NoError(t, err)
+
+	_, err = c.CreateVerifyPasswordRequest(pwd, badRec)
+	require.True(t, errors.Is(err, ErrInvalidRecord))
+	_, err = c.CheckResponseAndDecrypt(pwd, badRec, verifyPasswordResp)
+	require.Error(t, err)
+
+	// a = 1, b = -1 turns t0 = hs0 into the point at infinity
+	require.NoError(t, proto.Unmarshal(recBytes, rec))
+	hs0, err := c.g.hashToPoint(protocol, dhs0, rec.Ns)
+	require.NoError(t, err)
+	rec.T0 = hs0.Marshal()
+	badRec, err = proto.Marshal(rec)
+	require.NoError(t, err)
+
+	// the token is issued by the owner of the server key, so its proof verifies
+	s, err := NewServer(serverKeypair)
+	require.NoError(t, err)
+	a, b := big.NewInt(1), new(big.Int).Sub(c.g.curve.Params().N, big.NewInt(1))
+	newPrivate := s.g.zMulAdd(s.privateKeyBytes, padZ(a.Bytes()), padZ(b.Bytes()))
+	proof, err := s.proveRotation(newPrivate, s.g.baseBytes(newPrivate), padZ(a.Bytes()), padZ(b.Bytes()))
+	require.NoError(t, err)
+	tkn := &UpdateToken{
+		Version:  rec.Version + 1,
+		A:        padZ(a.Bytes()),
+		B:        padZ(b.Bytes()),
+		Proof:    proof,
+		Suite:    rec.Suite,
+		Protocol: rec.Protocol,
+	}
+	badToken, err := proto.Marshal(tkn)
+	require.NoError(t, err)
+	require.NoError(t, VerifyUpdateToken(pub, badToken))
+	_, err = UpdateRecord(pub, badRec, badToken)
+	require.True(t, errors.Is(err, ErrInvalidToken), "%v", err)
+}
+
+// Test_PHE_Deterministic runs the whole protocol twice with the same seeded randomness,
+// which is how stable test vectors are produced
+func Test_PHE_Deterministic(t *testing.T) {
+	run := func(seed string) (out [][]byte) {
+		random := WithRandom(drbg.New([]byte(seed)))
+
+		serverKeypair, err := GenerateServerKeypair(random)
+		require.NoError(t, err)
+		s, err := NewServer(serverKeypair, random)
+		require.NoError(t, err)
+		c, err := NewClient(s.GetPublicKey(), generateClientKey(t, random), random)
+		require.NoError(t, err)
+
+		enrollment, err := s.GetEnrollment()
+		require.NoError(t, err)
+		rec, key, err := c.EnrollAccount(pwd, enrollment)
+		require.NoError(t, err)
+		req, err := c.CreateVerifyPasswordRequest(pwd, rec)
+		require.NoError(t, err)
+		resp, err := s.VerifyPassword(req)
+		require.NoError(t, err)
+		token, newKeypair, err := s.Rotate()
+		require.NoError(t, err)
+		ct, err := Encrypt(pwd, key, random)
+		require.NoError(t, err)
+
+		return [][]byte{serverKeypair, enrollment, rec, key, req, resp, token, newKeypair, ct}
+	}
+
+	first := run("seed")
+	require.Equal(t, first, run("seed"))
+
+	other := run("another seed")
+	for i := range first {
+		require.NotEqual(t, first[i], other[i])
+	}
+}
@@ -39,89 +39,90 @@ package phe
 import (
 	"crypto/elliptic"
 	"math/big"
-
-	"github.com/pkg/errors"
 )
 
 // Point represents an elliptic curve point
 type Point struct {
 	X, Y *big.Int
+	g    *group // nil means P-256
 }
 
-var (
-	pn   = curve.Params().P
-	zero = big.NewInt(0)
-)
-
-// PointUnmarshal validates & converts byte array to an elliptic curve point object
+// PointUnmarshal validates & converts byte array to an elliptic curve point object.
+// The curve is detected by the length of the encoding
 func PointUnmarshal(data []byte) (*Point, error) {
-	if len(data) != 65 {
-		return nil, errors.New("Invalid curve point")
+	g, err := groupOfPoint(data)
+	if err != nil {
+		return nil, err
 	}
-	x, y := elliptic.Unmarshal(curve, data)
-	if x == nil || y == nil {
-		return nil, errors.New("Invalid curve point")
+	return g.unmarshalPoint(data)
+}
+
+func (p *Point) group() *group {
+	if p.g == nil {
+		return groupP256
 	}
-	return &Point{
-		X: x,
-		Y: y,
-	}, nil
+	return p.g
 }
 
 // Add adds two points
 func (p *Point) Add(a *Point) *Point {
-	x, y := curve.Add(p.X, p.Y, a.X, a.Y)
-	return &Point{x, y}
+	x, y := p.group().curve.Add(p.X, p.Y, a.X, a.Y)
+	return &Point{x, y, p.g}
 }
 
 // Neg inverts point's Y coordinate
 func (p *Point) Neg() *Point {
-	t := new(Point)
+	t := &Point{g: p.g}
 	t.X = p.X
-	t.Y = new(big.Int).Sub(pn, p.Y)
+	t.Y = new(big.Int).Sub(p.group().curve.Params().P, p.Y)
 	return t
 }
 
 // ScalarMult multiplies point to a number
 func (p *Point) ScalarMult(b []byte) *Point {
-	x, y := curve.ScalarMult(p.X, p.Y, b)
+	x, y := p.group().curve.ScalarMult(p.X, p.Y, p.group().padZ(b))
 
-	return &Point{x, y}
+	return &Point{x, y, p.g}
 }
 
 // ScalarMultInt multiplies point to a number
 func (p *Point) ScalarMultInt(b *big.Int) *Point {
-	x, y := curve.ScalarMult(p.X, p.Y, b.Bytes())
+	x, y := p.group().curve.ScalarMult(p.X, p.Y, p.group().reduceScalar(b))
 
-	return &Point{x, y}
+	return &Point{x, y, p.g}
 }
 
-// ScalarBaseMult multiplies base point to a number
+// ScalarBaseMult multiplies base point of the receiver's curve to a number
 func (p *Point) ScalarBaseMult(b []byte) *Point {
-	x, y := curve.ScalarBaseMult(b)
+	x, y := p.group().curve.ScalarBaseMult(p.group().padZ(b))
 
-	return &Point{x, y}
+	return &Point{x, y, p.g}
 }
 
-// ScalarBaseMultInt multiplies base point to a number
+// ScalarBaseMultInt multiplies base point of the receiver's curve to a number
 func (p *Point) ScalarBaseMultInt(b *big.Int) *Point {
-	x, y := curve.ScalarBaseMult(b.Bytes())
+	x, y := p.group().curve.ScalarBaseMult(p.group().reduceScalar(b))
 
-	return &Point{x, y}
+	return &Point{x, y, p.g}
 }
 
-// Marshal converts point to an array of bytes
+// Marshal converts point to an array of bytes.
+// The point at infinity has no encoding, nil is returned for it
 func (p *Point) Marshal() []byte {
-
-	if p.X.Cmp(zero) != 0 &&
-		p.Y.Cmp(zero) != 0 {
-		return elliptic.Marshal(curve, p.X, p.Y)
+	if p.isInfinity() {
+		return nil
 	}
-	panic("zero point")
+	return elliptic.Marshal(p.group().curve, p.X, p.Y)
+}
+
+// isInfinity checks whether the point is the point at infinity, which has no encoding
+func (p *Point) isInfinity() bool {
+	return p.X.Sign() == 0 && p.Y.Sign() == 0
 }
 
 // Equal checks two points for equality
 func (p *Point) Equal(other *Point) bool {
-	return p.X.Cmp(other.X) == 0 &&
+	return p.group() == other.group() &&
+		p.X.Cmp(other.X) == 0 &&
 		p.Y.Cmp(other.Y) == 0
 }
@@ -37,6 +37,7 @@
 package phe
 
 import (
+	"crypto/rand"
 	"testing"
 
 	"github.com/VirgilSecurity/virgil-phe-go/swu"
@@ -64,9 +65,14 @@ func TestPoint_Add_Neg(t *testing.T) {
 
 func MakePoint() *Point {
 	b := make([]byte, swu.PointHashLen)
-	randRead(b)
-	x, y := swu.HashToPoint(b)
-	return &Point{x, y}
+	if err := randRead(rand.Reader, b); err != nil {
+		panic(err)
+	}
+	x, y, err := swu.HashToPoint(b)
+	if err != nil {
+		panic(err)
+	}
+	return &Point{X: x, Y: y}
 }
 
 func TestPointUnmarshal(t *testing.T) {
@@ -78,3 +84,32 @@ func TestPointUnmarshal(t *testing.T) {
 	assert.NoError(t, err)
 	assert.True(t, p2.Equal(p1))
 }
+
+func TestPoint_MarshalInfinity(t *testing.T) {
+	p := MakePoint()
+	inf := p.Add(p.Neg())
+	assert.True(t, inf.isInfinity())
+	assert.Nil(t, inf.Marshal())
+
+	_, err := PointUnmarshal(inf.Marshal())
+	assert.Error(t, err)
+}
+
+func FuzzPointUnmarshal(f *testing.F) {
+	f.Add(serverPublic)
+	f.Add(rotatedServerPub)
+	f.Add(MakePoint().Marshal())
+	f.Add([]byte{0x04})
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		p, err := PointUnmarshal(data)
+		if err != nil {
+			assert.Nil(t, p)
+			return
+		}
+
+		assert.Equal(t, data, p.Marshal())
+		assert.True(t, p.group().curve.IsOnCurve(p.X, p.Y))
+	})
+}
@@ -38,8 +38,6 @@ package phe
 
 import (
 	"bytes"
-	"crypto/rand"
-	"io"
 )
 
 var randBytes = []byte{
@@ -73,27 +71,8 @@ var randBytes = []byte{
 	0xf8, 0x77, 0xe1, 0x59, 0x65, 0x89, 0x16, 0xa2,
 }
 
-func MockRandom() {
-
-	/*buf := make([]byte, 96)
-	rand.Read(buf)
-
-	for i := 0; i < len(buf); i++ {
-		fmt.Printf("0x%02x, ", buf[i])
-		if (i+1)%8 == 0 {
-			fmt.Println()
-		}
-	}
-	fmt.Println()*/
-
-	r, ok := randReader.(*bytes.Reader) //reuse reader if possible
-	if ok {
-		r.Seek(0, io.SeekStart)
-	} else {
-		randReader = bytes.NewReader(randBytes)
-	}
-}
-
-func EndMock() {
-	randReader = rand.Reader
+// mockRandom makes the party read the fixed random bytes the test vectors were created with.
+// Each call starts from the beginning of randBytes
+func mockRandom() Option {
+	return WithRandom(bytes.NewReader(randBytes))
 }
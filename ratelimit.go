@@ -0,0 +1,357 @@
+/*
+ * Copyright (C) 2015-2019 Virgil Security Inc.
+ *
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ *     (1) Redistributions of source code must retain the above copyright
+ *     notice, this list of conditions and the following disclaimer.
+ *
+ *     (2) Redistributions in binary form must reproduce the above copyright
+ *     notice, this list of conditions and the following disclaimer in
+ *     the documentation and/or other materials provided with the
+ *     distribution.
+ *
+ *     (3) Neither the name of the copyright holder nor the names of its
+ *     contributors may be used to endorse or promote products derived from
+ *     this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ''AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+ * IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ *
+ * Lead Maintainer: Virgil Security Inc. <support@virgilsecurity.com>
+ */
+
+package phe
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// RateLimiter decides whether a password attempt may be verified. Attempts are keyed on the record's server nonce.
+// Implementations must be safe for concurrent use
+type RateLimiter interface {
+	// Allow registers a new attempt and returns *ThrottledError if it must be rejected.
+	// Any other error also makes the server reject the attempt
+	Allow(ns []byte) error
+	// Report is called with the result of every allowed attempt
+	Report(ns []byte, success bool) error
+}
+
+// ThrottledError is returned instead of a verification response when a record has too many failed attempts
+type ThrottledError struct {
+	// RetryAfter is how long the caller has to wait before the next attempt. It is zero if the record is locked
+	RetryAfter time.Duration
+	// Locked means that no more attempts are allowed until the record is unlocked
+	Locked bool
+}
+
+func (e *ThrottledError) Error() string {
+	if e.Locked {
+		return "too many failed attempts, record is locked"
+	}
+	return fmt.Sprintf("too many failed attempts, retry after %v", e.RetryAfter)
+}
+
+// RateLimitPolicy configures PolicyRateLimiter. Zero fields disable the corresponding limit
+type RateLimitPolicy struct {
+	// At most MaxAttempts failed attempts are allowed within a sliding Window
+	Window      time.Duration
+	MaxAttempts int
+	// After n consecutive failed attempts the next one is delayed for BaseDelay * 2^(n-1), but no longer than MaxDelay
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	// The record is locked after LockoutAfter consecutive failed attempts
+	LockoutAfter int
+	// The state of a record which isn't locked is kept for at least Retention after its last attempt, even if
+	// the window and the delay have passed, so that consecutive failures separated by long pauses still lead to a lockout.
+	// Stores may forget a state after its Expires time
+	Retention time.Duration
+}
+
+// DefaultRateLimitPolicy allows 10 failed attempts per hour, delays attempts up to 5 minutes and locks records after 100 failures in a row.
+// Failures are forgotten after a day without attempts
+var DefaultRateLimitPolicy = RateLimitPolicy{
+	Window:       time.Hour,
+	MaxAttempts:  10,
+	BaseDelay:    time.Second,
+	MaxDelay:     5 * time.Minute,
+	LockoutAfter: 100,
+	Retention:    24 * time.Hour,
+}
+
+// RateLimitState is the rate limiting state of a single record
+type RateLimitState struct {
+	// Failures are the times of failed attempts within the policy window
+	Failures []time.Time
+	// Consecutive is the number of failed attempts since the last successful one
+	Consecutive int
+	// NextAttempt is the earliest time of the next attempt
+	NextAttempt time.Time
+	// Locked is set once the record reaches the lockout limit
+	Locked bool
+	// Expires is the time after which the state no longer restricts attempts and may be forgotten.
+	// It is zero for locked records, which are kept until they are unlocked
+	Expires time.Time
+}
+
+// RateLimitStore keeps the state of records for PolicyRateLimiter, e.g. in a database shared by several servers
+type RateLimitStore interface {
+	// Update atomically applies fn to the state of the record, starting from a zero state if there is none.
+	// The state must not be saved if fn returns an error
+	Update(ns []byte, fn func(state *RateLimitState) error) error
+	// Delete forgets the state of the record
+	Delete(ns []byte) error
+}
+
+// PolicyRateLimiter applies a RateLimitPolicy to the states kept in a RateLimitStore.
+// Each attempt is counted as failed until it's reported as successful, so concurrent or
+// interrupted attempts can't bypass the limits
+type PolicyRateLimiter struct {
+	policy RateLimitPolicy
+	store  RateLimitStore
+	now    func() time.Time
+}
+
+// NewRateLimiter creates a rate limiter which keeps record states in the given store
+func NewRateLimiter(policy RateLimitPolicy, store RateLimitStore) *PolicyRateLimiter {
+	return &PolicyRateLimiter{
+		policy: policy,
+		store:  store,
+		now:    time.Now,
+	}
+}
+
+// NewMemoryRateLimiter creates a rate limiter which keeps record states in memory
+func NewMemoryRateLimiter(policy RateLimitPolicy) *PolicyRateLimiter {
+	return NewRateLimiter(policy, NewMemoryRateLimitStore())
+}
+
+// Allow registers a new attempt unless it violates the policy
+func (l *PolicyRateLimiter) Allow(ns []byte) error {
+	if len(ns) == 0 {
+		return errors.New("invalid record nonce")
+	}
+
+	now := l.now()
+	p := l.policy
+
+	return l.store.Update(ns, func(state *RateLimitState) error {
+		if state.Locked {
+			return &ThrottledError{Locked: true}
+		}
+
+		if wait := state.NextAttempt.Sub(now); wait > 0 {
+			return &ThrottledError{RetryAfter: wait}
+		}
+
+		if p.Window > 0 {
+			i := 0
+			for i < len(state.Failures) && now.Sub(state.Failures[i]) >= p.Window {
+				i++
+			}
+			state.Failures = state.Failures[i:]
+
+			if p.MaxAttempts > 0 && len(state.Failures) >= p.MaxAttempts {
+				return &ThrottledError{RetryAfter: state.Failures[0].Add(p.Window).Sub(now)}
+			}
+
+			state.Failures = append(state.Failures, now)
+		}
+
+		state.Consecutive++
+
+		if p.LockoutAfter > 0 && state.Consecutive >= p.LockoutAfter {
+			state.Locked = true
+		}
+
+		if p.BaseDelay > 0 {
+			state.NextAttempt = now.Add(backoff(p.BaseDelay, p.MaxDelay, state.Consecutive))
+		}
+
+		state.Expires = p.expires(state, now)
+		return nil
+	})
+}
+
+// expires returns the time after which the state of a record is equivalent to no state at all
+func (p RateLimitPolicy) expires(state *RateLimitState, now time.Time) time.Time {
+	if state.Locked {
+		return time.Time{}
+	}
+
+	expires := now.Add(p.Retention)
+	if state.NextAttempt.After(expires) {
+		expires = state.NextAttempt
+	}
+	if n := len(state.Failures); n > 0 {
+		if end := state.Failures[n-1].Add(p.Window); end.After(expires) {
+			expires = end
+		}
+	}
+	return expires
+}
+
+// backoff calculates base * 2^(n-1) limited by max
+func backoff(base, max time.Duration, n int) time.Duration {
+	delay := base
+	for i := 1; i < n; i++ {
+		if max > 0 && delay >= max {
+			break
+		}
+		// stop doubling before the duration overflows
+		if delay > time.Duration(1<<62) {
+			break
+		}
+		delay *= 2
+	}
+
+	if max > 0 && delay > max {
+		delay = max
+	}
+	return delay
+}
+
+// Report resets the state of the record after a successful attempt. Failed attempts were already counted by Allow
+func (l *PolicyRateLimiter) Report(ns []byte, success bool) error {
+	if !success {
+		return nil
+	}
+	return l.store.Delete(ns)
+}
+
+// Unlock resets the state of a locked record, e.g. after the user has been verified by other means
+func (l *PolicyRateLimiter) Unlock(ns []byte) error {
+	return l.store.Delete(ns)
+}
+
+// DefaultMemoryRateLimitStoreSize is the number of records NewMemoryRateLimitStore keeps states of
+const DefaultMemoryRateLimitStoreSize = 1 << 20
+
+// minSweepSize is the number of states below which MemoryRateLimitStore doesn't look for expired ones
+const minSweepSize = 1024
+
+// evictFraction is the part of a full MemoryRateLimitStore which is evicted at once
+const evictFraction = 16
+
+// MemoryRateLimitStore is a RateLimitStore which keeps states in memory of a single process.
+// Record nonces are chosen by clients, so expired states are swept whenever the number of states has doubled
+// since the last sweep. When the store is full, the unlocked states which expire soonest are evicted to make room,
+// locked states are kept until their records are unlocked. If only locked states are left, attempts of new records
+// are limited by fn but their states aren't saved, so a flood of nonces can't lock out other records
+type MemoryRateLimitStore struct {
+	mu         sync.Mutex
+	states     map[string]*RateLimitState
+	maxEntries int
+	nextSweep  int
+	now        func() time.Time
+}
+
+// NewMemoryRateLimitStore creates an empty in-memory store for up to DefaultMemoryRateLimitStoreSize records
+func NewMemoryRateLimitStore() *MemoryRateLimitStore {
+	return NewMemoryRateLimitStoreSize(DefaultMemoryRateLimitStoreSize)
+}
+
+// NewMemoryRateLimitStoreSize creates an empty in-memory store for up to maxEntries records
+func NewMemoryRateLimitStoreSize(maxEntries int) *MemoryRateLimitStore {
+	return &MemoryRateLimitStore{
+		states:     make(map[string]*RateLimitState),
+		maxEntries: maxEntries,
+		nextSweep:  minSweepSize,
+		now:        time.Now,
+	}
+}
+
+// Update atomically applies fn to a copy of the record's state and saves it if fn succeeds
+func (m *MemoryRateLimitStore) Update(ns []byte, fn func(state *RateLimitState) error) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	state := &RateLimitState{}
+	old, ok := m.states[string(ns)]
+	if ok {
+		*state = *old
+		state.Failures = append([]time.Time(nil), old.Failures...)
+	} else if len(m.states) >= m.nextSweep || len(m.states) >= m.maxEntries {
+		m.sweep()
+		if len(m.states) >= m.maxEntries {
+			// evict a batch at once, so that a full store isn't scanned for every new record
+			m.evict(m.maxEntries - m.maxEntries/evictFraction - 1)
+		}
+	}
+
+	if err := fn(state); err != nil {
+		return err
+	}
+
+	if ok || len(m.states) < m.maxEntries {
+		m.states[string(ns)] = state
+	}
+	return nil
+}
+
+// sweep removes expired states
+func (m *MemoryRateLimitStore) sweep() {
+	now := m.now()
+	for ns, state := range m.states {
+		if !state.Expires.IsZero() && !now.Before(state.Expires) {
+			delete(m.states, ns)
+		}
+	}
+
+	m.nextSweep = 2 * len(m.states)
+	if m.nextSweep < minSweepSize {
+		m.nextSweep = minSweepSize
+	}
+}
+
+// evict removes the unlocked states which expire soonest until at most target states are left
+func (m *MemoryRateLimitStore) evict(target int) {
+	type entry struct {
+		ns      string
+		expires time.Time
+	}
+
+	var entries []entry
+	for ns, state := range m.states {
+		if !state.Expires.IsZero() {
+			entries = append(entries, entry{ns, state.Expires})
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].expires.Before(entries[j].expires)
+	})
+
+	for _, e := range entries {
+		if len(m.states) <= target {
+			break
+		}
+		delete(m.states, e.ns)
+	}
+}
+
+// Delete forgets the state of the record
+func (m *MemoryRateLimitStore) Delete(ns []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.states, string(ns))
+	return nil
+}
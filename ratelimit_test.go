@@ -0,0 +1,259 @@
+/*
+ * Copyright (C) 2015-2019 Virgil Security Inc.
+ *
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ *     (1) Redistributions of source code must retain the above copyright
+ *     notice, this list of conditions and the following disclaimer.
+ *
+ *     (2) Redistributions in binary form must reproduce the above copyright
+ *     notice, this list of conditions and the following disclaimer in
+ *     the documentation and/or other materials provided with the
+ *     distribution.
+ *
+ *     (3) Neither the name of the copyright holder nor the names of its
+ *     contributors may be used to endorse or promote products derived from
+ *     this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ''AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+ * IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ *
+ * Lead Maintainer: Virgil Security Inc. <support@virgilsecurity.com>
+ */
+
+package phe
+
+import (
+	"crypto/rand"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeClock struct {
+	t time.Time
+}
+
+func (c *fakeClock) now() time.Time {
+	return c.t
+}
+
+// failingRateLimitStore fails like an unreachable database
+type failingRateLimitStore struct{}
+
+func (failingRateLimitStore) Update(ns []byte, fn func(state *RateLimitState) error) error {
+	return errors.New("rate limit store is unavailable")
+}
+
+func (failingRateLimitStore) Delete(ns []byte) error {
+	return errors.New("rate limit store is unavailable")
+}
+
+func newTestRateLimiter(policy RateLimitPolicy) (*PolicyRateLimiter, *fakeClock) {
+	clock := &fakeClock{t: time.Unix(1500000000, 0)}
+	l := NewMemoryRateLimiter(policy)
+	l.now = clock.now
+	l.store.(*MemoryRateLimitStore).now = clock.now
+	return l, clock
+}
+
+func requireThrottled(t *testing.T, err error, retryAfter time.Duration, locked bool) {
+	require.Error(t, err)
+	te, ok := err.(*ThrottledError)
+	require.True(t, ok, "%v is not a ThrottledError", err)
+	require.Equal(t, retryAfter, te.RetryAfter)
+	require.Equal(t, locked, te.Locked)
+}
+
+func TestRateLimiter_Window(t *testing.T) {
+	l, clock := newTestRateLimiter(RateLimitPolicy{Window: time.Minute, MaxAttempts: 3})
+	ns := []byte("record")
+
+	for i := 0; i < 3; i++ {
+		require.NoError(t, l.Allow(ns))
+		clock.t = clock.t.Add(10 * time.Second)
+	}
+
+	requireThrottled(t, l.Allow(ns), 30*time.Second, false)
+
+	// other records are not affected
+	require.NoError(t, l.Allow([]byte("other")))
+
+	// the first attempt leaves the window
+	clock.t = clock.t.Add(30 * time.Second)
+	require.NoError(t, l.Allow(ns))
+	requireThrottled(t, l.Allow(ns), 10*time.Second, false)
+}
+
+func TestRateLimiter_Backoff(t *testing.T) {
+	l, clock := newTestRateLimiter(RateLimitPolicy{BaseDelay: time.Second, MaxDelay: 4 * time.Second})
+	ns := []byte("record")
+
+	for _, delay := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 4 * time.Second} {
+		require.NoError(t, l.Allow(ns))
+		requireThrottled(t, l.Allow(ns), delay, false)
+		clock.t = clock.t.Add(delay)
+	}
+
+	// success resets the backoff
+	require.NoError(t, l.Allow(ns))
+	require.NoError(t, l.Report(ns, true))
+	require.NoError(t, l.Allow(ns))
+	requireThrottled(t, l.Allow(ns), time.Second, false)
+}
+
+func TestRateLimiter_Lockout(t *testing.T) {
+	l, clock := newTestRateLimiter(RateLimitPolicy{LockoutAfter: 2})
+	ns := []byte("record")
+
+	require.NoError(t, l.Allow(ns))
+	require.NoError(t, l.Report(ns, false))
+	require.NoError(t, l.Allow(ns))
+	require.NoError(t, l.Report(ns, false))
+
+	clock.t = clock.t.Add(24 * time.Hour)
+	requireThrottled(t, l.Allow(ns), 0, true)
+
+	require.NoError(t, l.Unlock(ns))
+	require.NoError(t, l.Allow(ns))
+}
+
+func TestRateLimiter_Expires(t *testing.T) {
+	l, clock := newTestRateLimiter(RateLimitPolicy{Window: time.Minute, MaxAttempts: 3, BaseDelay: time.Second, MaxDelay: 2 * time.Hour, Retention: time.Hour})
+	store := l.store.(*MemoryRateLimitStore)
+	ns := []byte("record")
+	start := clock.t
+
+	state := func() *RateLimitState {
+		return store.states[string(ns)]
+	}
+
+	// retention outlasts the window and the delay
+	require.NoError(t, l.Allow(ns))
+	require.Equal(t, start.Add(time.Hour), state().Expires)
+
+	// a delay longer than retention keeps the state until the next attempt is allowed
+	state().Consecutive = 20
+	clock.t = clock.t.Add(time.Minute)
+	require.NoError(t, l.Allow(ns))
+	require.Equal(t, clock.t.Add(2*time.Hour), state().Expires)
+
+	// locked records never expire
+	l.policy.LockoutAfter = 1
+	l.policy.BaseDelay = 0
+	clock.t = clock.t.Add(3 * time.Hour)
+	require.NoError(t, l.Allow(ns))
+	require.True(t, state().Locked)
+	require.True(t, state().Expires.IsZero())
+
+	clock.t = clock.t.Add(1000 * time.Hour)
+	store.sweep()
+	requireThrottled(t, l.Allow(ns), 0, true)
+}
+
+func TestMemoryRateLimitStore_Bounded(t *testing.T) {
+	l, clock := newTestRateLimiter(DefaultRateLimitPolicy)
+	store := l.store.(*MemoryRateLimitStore)
+
+	// random nonces of unknown records are forgotten once their states expire
+	ns := make([]byte, 32)
+	for i := 0; i < 20*minSweepSize; i++ {
+		require.NoError(t, randRead(rand.Reader, ns))
+		require.NoError(t, l.Allow(ns))
+		require.True(t, len(store.states) <= minSweepSize)
+		clock.t = clock.t.Add(time.Hour)
+	}
+
+	// the store doesn't grow beyond its size while no state expires,
+	// the states which expire soonest make room for new records
+	l, clock = newTestRateLimiter(DefaultRateLimitPolicy)
+	store = NewMemoryRateLimitStoreSize(10)
+	store.now = clock.now
+	l.store = store
+
+	for i := 0; i < 10; i++ {
+		require.NoError(t, l.Allow([]byte{byte(i)}))
+		clock.t = clock.t.Add(time.Minute)
+	}
+	require.NoError(t, l.Allow([]byte{10}))
+	require.Len(t, store.states, 10)
+	require.NotContains(t, store.states, string([]byte{0}))
+	require.Contains(t, store.states, string([]byte{10}))
+
+	// locked states are never evicted, new records are still allowed when only locked states are left
+	l, clock = newTestRateLimiter(RateLimitPolicy{LockoutAfter: 1})
+	store = NewMemoryRateLimitStoreSize(10)
+	store.now = clock.now
+	l.store = store
+
+	for i := 0; i < 10; i++ {
+		require.NoError(t, l.Allow([]byte{byte(i)}))
+	}
+	for i := 10; i < 20; i++ {
+		require.NoError(t, l.Allow([]byte{byte(i)}))
+	}
+	require.Len(t, store.states, 10)
+	require.Equal(t, &ThrottledError{Locked: true}, l.Allow([]byte{0}))
+}
+
+func TestBackoff_Overflow(t *testing.T) {
+	require.True(t, backoff(time.Second, 0, 1000) > 0)
+	require.Equal(t, time.Minute, backoff(time.Second, time.Minute, 1000))
+}
+
+func TestServer_RateLimiter(t *testing.T) {
+	serverKeypair, err := GenerateServerKeypair()
+	require.NoError(t, err)
+
+	l, _ := newTestRateLimiter(RateLimitPolicy{Window: time.Hour, MaxAttempts: 2})
+	s, err := NewServer(serverKeypair, WithRateLimiter(l))
+	require.NoError(t, err)
+
+	c, err := NewClient(s.GetPublicKey(), generateClientKey(t))
+	require.NoError(t, err)
+
+	enrollment, err := s.GetEnrollment()
+	require.NoError(t, err)
+	rec, key, err := c.EnrollAccount(pwd, enrollment)
+	require.NoError(t, err)
+
+	badReq, err := c.CreateVerifyPasswordRequest([]byte("Password1"), rec)
+	require.NoError(t, err)
+	goodReq, err := c.CreateVerifyPasswordRequest(pwd, rec)
+	require.NoError(t, err)
+
+	// a successful attempt resets the counter
+	_, err = s.VerifyPassword(badReq)
+	require.NoError(t, err)
+	resp, err := s.VerifyPassword(goodReq)
+	require.NoError(t, err)
+	keyDec, err := c.CheckResponseAndDecrypt(pwd, rec, resp)
+	require.NoError(t, err)
+	require.Equal(t, key, keyDec)
+
+	_, err = s.VerifyPassword(badReq)
+	require.NoError(t, err)
+	_, state, err := s.VerifyPasswordExtended(badReq)
+	require.NoError(t, err)
+	require.False(t, state.Res)
+
+	resp, state, err = s.VerifyPasswordExtended(goodReq)
+	requireThrottled(t, err, time.Hour, false)
+	require.Nil(t, resp)
+	require.Nil(t, state)
+}
@@ -0,0 +1,420 @@
+/*
+ * Copyright (C) 2015-2019 Virgil Security Inc.
+ *
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ *     (1) Redistributions of source code must retain the above copyright
+ *     notice, this list of conditions and the following disclaimer.
+ *
+ *     (2) Redistributions in binary form must reproduce the above copyright
+ *     notice, this list of conditions and the following disclaimer in
+ *     the documentation and/or other materials provided with the
+ *     distribution.
+ *
+ *     (3) Neither the name of the copyright holder nor the names of its
+ *     contributors may be used to endorse or promote products derived from
+ *     this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ''AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+ * IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ *
+ * Lead Maintainer: Virgil Security Inc. <support@virgilsecurity.com>
+ */
+
+package phe
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// An escrowed data key is encrypted with ECIES to a recovery public key:
+// magic (4 bytes) || version (1 byte) || suite (1 byte) || account ID length (1 byte) || account ID || ephemeral public key ||
+// salt (32 bytes) || wrapped data key || tag. Everything before the salt is authenticated as additional data.
+//
+// A recovery artifact is signed with a key derived from the recovery private key:
+// magic (4 bytes) || version (1 byte) || suite (1 byte) || time (8 bytes, unix seconds) || SHA-256 of the escrowed key ||
+// account ID length (1 byte) || account ID || reason length (2 bytes) || reason || signature commitment || signature scalar
+const (
+	escrowVersion     = 1
+	escrowFixedLen    = 4 + 1 + 1 + 1
+	artifactVersion   = 1
+	artifactFixedLen  = 4 + 1 + 1 + 8 + sha256.Size + 1
+	maxRecoveryReason = 0xffff
+	// MaxAccountIDLen is the maximum length of the account ID of an escrowed key
+	MaxAccountIDLen = 255
+)
+
+var (
+	escrowMagic   = []byte{0x56, 0x50, 0x48, 0x52} //VPHR
+	artifactMagic = []byte{0x56, 0x50, 0x48, 0x41} //VPHA
+)
+
+// RecoveryArtifact is the signed statement RecoverDataKey produces every time an escrowed key is decrypted.
+// Only the holder of the recovery private key can create it, so auditors can check recoveries with the key
+// returned by RecoveryVerificationKey
+type RecoveryArtifact struct {
+	Time time.Time
+	// AccountID is the account ID the key was escrowed with
+	AccountID []byte
+	// Reason is the justification given by the administrator
+	Reason string
+	// EscrowDigest is the SHA-256 hash of the escrowed key which was decrypted
+	EscrowDigest []byte
+}
+
+// Covers checks whether the artifact was produced by decrypting the escrowed key
+func (a *RecoveryArtifact) Covers(escrowedKey []byte) bool {
+	digest := sha256.Sum256(escrowedKey)
+	return bytes.Equal(a.EscrowDigest, digest[:])
+}
+
+// GenerateRecoveryKeypair creates the keypair administrators keep offline to recover data keys of users
+// who have forgotten their passwords. It is encoded like a server keypair but must never be used as one.
+// WithSuite selects the curve
+func GenerateRecoveryKeypair(opts ...Option) ([]byte, error) {
+	o := applyOptions(opts)
+	g, err := getGroup(o.suite)
+	if err != nil {
+		return nil, err
+	}
+
+	privateKey, err := g.randomScalar(o.rand())
+	if err != nil {
+		return nil, err
+	}
+	publicKey := g.baseBytes(privateKey)
+
+	return g.marshalKeypair(publicKey.Marshal(), privateKey, ProtocolV1)
+}
+
+// RecoveryPublicKey returns the public key of a recovery keypair which clients escrow data keys to
+func RecoveryPublicKey(recoveryKeypair []byte) ([]byte, error) {
+	_, pub, _, err := parseRecoveryKeypair(recoveryKeypair)
+	if err != nil {
+		return nil, err
+	}
+	return pub.Marshal(), nil
+}
+
+// RecoveryVerificationKey returns the public key recovery artifacts are verified with. Artifacts are signed with
+// a key derived from the recovery private key rather than the key which decrypts escrowed keys, so it differs
+// from RecoveryPublicKey
+func RecoveryVerificationKey(recoveryKeypair []byte) ([]byte, error) {
+	g, _, privateKey, err := parseRecoveryKeypair(recoveryKeypair)
+	if err != nil {
+		return nil, err
+	}
+
+	signingKey, err := recoverySigningKey(g, privateKey)
+	if err != nil {
+		return nil, err
+	}
+	return g.baseBytes(signingKey).Marshal(), nil
+}
+
+// EscrowDataKey encrypts a data key to the recovery public key, so that it can be recovered without the password.
+// It is stored alongside the key wrapped by WrapKey or WrapDataKey and outlives password changes like the data key does.
+// The account ID isn't secret, it binds the escrowed key to the account and is recorded in recovery artifacts.
+// WithRandom replaces the source of the ephemeral key and the salt
+func EscrowDataKey(dataKey, recoveryPublicKey, accountID []byte, opts ...Option) ([]byte, error) {
+	if len(dataKey) != dataKeyLen {
+		return nil, errors.New("data key must be exactly 32 bytes")
+	}
+
+	if len(accountID) > MaxAccountIDLen {
+		return nil, errors.New("account ID is too long")
+	}
+
+	pub, err := PointUnmarshal(recoveryPublicKey)
+	if err != nil {
+		return nil, ErrInvalidPublicKey
+	}
+	g := pub.group()
+	random := applyOptions(opts).rand()
+
+	e, err := g.randomScalar(random)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = g.privateScalar(e); err != nil {
+		return nil, errors.New("invalid ephemeral key")
+	}
+	ephemeral := g.baseBytes(e).Marshal()
+
+	header := make([]byte, 0, escrowFixedLen+len(accountID)+len(ephemeral))
+	header = append(header, escrowMagic...)
+	header = append(header, escrowVersion, byte(g.suite), byte(len(accountID)))
+	header = append(header, accountID...)
+	header = append(header, ephemeral...)
+
+	key, err := escrowKey(ephemeral, recoveryPublicKey, pub.ScalarMult(e))
+	if err != nil {
+		return nil, err
+	}
+
+	wrapped, err := seal(random, dataKey, key, recoveryEscrow, header)
+	if err != nil {
+		return nil, err
+	}
+	return append(header, wrapped...), nil
+}
+
+// RecoverDataKey decrypts an escrowed data key with the recovery keypair and returns it together with
+// a recovery artifact, which should be kept in the audit log. The reason must not be empty.
+// The signature nonce is derived from the signing key and the artifact, WithRandom replaces the source of
+// the random bytes mixed into it
+func RecoverDataKey(escrowedKey, recoveryKeypair []byte, reason string, opts ...Option) (dataKey, artifact []byte, err error) {
+	return recoverDataKey(escrowedKey, recoveryKeypair, reason, time.Now(), applyOptions(opts).rand())
+}
+
+func recoverDataKey(escrowedKey, recoveryKeypair []byte, reason string, now time.Time, random io.Reader) (dataKey, artifact []byte, err error) {
+	if len(reason) == 0 || len(reason) > maxRecoveryReason {
+		return nil, nil, errors.New("invalid recovery reason")
+	}
+
+	g, pub, privateKey, err := parseRecoveryKeypair(recoveryKeypair)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	suite, accountID, ephemeral, headerLen, err := parseEscrowedKey(escrowedKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err = g.checkSuite(uint32(suite)); err != nil {
+		return nil, nil, err
+	}
+
+	e, err := g.unmarshalPoint(ephemeral)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	key, err := escrowKey(ephemeral, pub.Marshal(), e.ScalarMult(privateKey))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	dataKey, err = open(escrowedKey[headerLen:], key, recoveryEscrow, escrowedKey[:headerLen])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if len(dataKey) != dataKeyLen {
+		return nil, nil, errors.New("invalid data key length")
+	}
+
+	digest := sha256.Sum256(escrowedKey)
+	body := make([]byte, 0, artifactFixedLen+len(accountID)+2+len(reason)+g.pointLen+g.zLen)
+	body = append(body, artifactMagic...)
+	body = append(body, artifactVersion, byte(g.suite))
+	body = appendUint64(body, uint64(now.Unix()))
+	body = append(body, digest[:]...)
+	body = append(body, byte(len(accountID)))
+	body = append(body, accountID...)
+	body = append(body, byte(len(reason)>>8), byte(len(reason)))
+	body = append(body, reason...)
+
+	signingKey, err := recoverySigningKey(g, privateKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Schnorr signature: R = k * G, s = k + H(X, R, body) * x.
+	// Like in RFC 6979 k is derived from the key and the message, the random bytes are only mixed in,
+	// so a broken or replayed random source can't make two different artifacts share a nonce
+	extra := make([]byte, symSaltLen)
+	if err = randRead(random, extra); err != nil {
+		return nil, nil, err
+	}
+	k := g.hashScalar(recoveryNonce, signingKey, extra, body)
+	if _, err = g.privateScalar(k); err != nil {
+		return nil, nil, errors.New("invalid signature nonce")
+	}
+	r := g.baseBytes(k)
+	challenge := g.hashZ(recoveryAudit, g.baseBytes(signingKey).Marshal(), r.Marshal(), body)
+	s := g.zMulAdd(g.padZ(challenge.Bytes()), signingKey, k)
+
+	artifact = append(body, r.Marshal()...)
+	artifact = append(artifact, s...)
+	return dataKey, artifact, nil
+}
+
+// VerifyRecoveryArtifact checks the signature of a recovery artifact with the key returned by RecoveryVerificationKey
+// and parses it
+func VerifyRecoveryArtifact(artifact, verificationKey []byte) (*RecoveryArtifact, error) {
+	pub, err := PointUnmarshal(verificationKey)
+	if err != nil {
+		return nil, ErrInvalidPublicKey
+	}
+	g := pub.group()
+
+	if len(artifact) < artifactFixedLen+2 || !bytes.HasPrefix(artifact, artifactMagic) {
+		return nil, errors.New("invalid recovery artifact")
+	}
+
+	if artifact[4] != artifactVersion {
+		return nil, errors.New("unsupported recovery artifact version")
+	}
+
+	if err = g.checkSuite(uint32(artifact[5])); err != nil {
+		return nil, err
+	}
+
+	idLen := int(artifact[artifactFixedLen-1])
+	if len(artifact) < artifactFixedLen+idLen+2 {
+		return nil, errors.New("invalid recovery artifact length")
+	}
+
+	reasonStart := artifactFixedLen + idLen + 2
+	reasonLen := int(artifact[reasonStart-2])<<8 | int(artifact[reasonStart-1])
+	bodyLen := reasonStart + reasonLen
+	if reasonLen == 0 || len(artifact) != bodyLen+g.pointLen+g.zLen {
+		return nil, errors.New("invalid recovery artifact length")
+	}
+
+	body := artifact[:bodyLen]
+	rBytes := artifact[bodyLen : bodyLen+g.pointLen]
+	r, err := g.unmarshalPoint(rBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := g.scalar(artifact[bodyLen+g.pointLen:])
+	if err != nil {
+		return nil, err
+	}
+
+	challenge := g.hashZ(recoveryAudit, pub.Marshal(), rBytes, body)
+	if !g.base(s).Equal(r.Add(pub.ScalarMultInt(challenge))) {
+		return nil, errors.New("invalid recovery artifact signature")
+	}
+
+	const timeOffset = 4 + 1 + 1
+	return &RecoveryArtifact{
+		Time:         time.Unix(int64(binary.BigEndian.Uint64(artifact[timeOffset:])), 0),
+		EscrowDigest: append([]byte{}, artifact[timeOffset+8:timeOffset+8+sha256.Size]...),
+		AccountID:    append([]byte{}, artifact[artifactFixedLen:artifactFixedLen+idLen]...),
+		Reason:       string(artifact[reasonStart:bodyLen]),
+	}, nil
+}
+
+// RecoverAccount enrolls the account again with a new password after its data key has been recovered by RecoverDataKey.
+// enrollment is a fresh Enrollment Response. If wrappedKey is not nil, it is the key wrapped by WrapKey or WrapDataKey
+// which was stored before, the password wrapper is replaced and the other wrappers are kept, otherwise the data key is
+// wrapped by WrapKey. The escrowed key stays valid, because the data key doesn't change
+func (c *Client) RecoverAccount(newPassword, enrollment, dataKey, wrappedKey []byte) (rec, recordKey, newWrappedKey []byte, err error) {
+	if len(dataKey) != dataKeyLen {
+		return nil, nil, nil, errors.New("data key must be exactly 32 bytes")
+	}
+
+	rec, recordKey, err = c.EnrollAccount(newPassword, enrollment)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	if wrappedKey == nil {
+		newWrappedKey, err = WrapKey(dataKey, recordKey, WithRandom(c.random))
+	} else {
+		newWrappedKey, err = rewrapPasswordKey(c.random, wrappedKey, dataKey, recordKey)
+	}
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return rec, recordKey, newWrappedKey, nil
+}
+
+// recoverySigningKey derives the key recovery artifacts are signed with, so that the key which decrypts escrowed keys
+// is never used in signatures
+func recoverySigningKey(g *group, privateKey []byte) ([]byte, error) {
+	return g.privateScalar(g.hashScalar(recoverySigning, privateKey))
+}
+
+func parseRecoveryKeypair(recoveryKeypair []byte) (*group, *Point, []byte, error) {
+	kp, err := unmarshalKeypair(recoveryKeypair)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	g, err := getGroup(Suite(kp.Suite))
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	if len(kp.PrivateKey) != g.zLen {
+		return nil, nil, nil, ErrInvalidPrivateKey
+	}
+	privateKey, err := g.privateScalar(kp.PrivateKey)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	pub, err := g.unmarshalPoint(kp.PublicKey)
+	if err != nil || !pub.Equal(g.baseBytes(privateKey)) {
+		return nil, nil, nil, ErrInvalidPublicKey
+	}
+	return g, pub, privateKey, nil
+}
+
+// parseEscrowedKey returns the header fields of an escrowed key and the header length
+func parseEscrowedKey(escrowedKey []byte) (suite Suite, accountID, ephemeral []byte, headerLen int, err error) {
+	if len(escrowedKey) < escrowFixedLen || !bytes.HasPrefix(escrowedKey, escrowMagic) {
+		return 0, nil, nil, 0, errors.New("invalid escrowed key")
+	}
+
+	if escrowedKey[4] != escrowVersion {
+		return 0, nil, nil, 0, errors.New("unsupported escrowed key version")
+	}
+
+	g, err := getGroup(Suite(escrowedKey[5]))
+	if err != nil {
+		return 0, nil, nil, 0, err
+	}
+
+	idLen := int(escrowedKey[6])
+	headerLen = escrowFixedLen + idLen + g.pointLen
+	if len(escrowedKey) != headerLen+wrappedKeyLen {
+		return 0, nil, nil, 0, errors.New("invalid escrowed key length")
+	}
+
+	return g.suite, escrowedKey[escrowFixedLen : escrowFixedLen+idLen], escrowedKey[escrowFixedLen+idLen : headerLen], headerLen, nil
+}
+
+// escrowKey derives the key wrapping an escrowed data key from the ECDH shared point
+func escrowKey(ephemeral, recoveryPublicKey []byte, shared *Point) ([]byte, error) {
+	if shared.isInfinity() {
+		return nil, errors.New("invalid shared secret")
+	}
+
+	key := make([]byte, symKeyLen)
+	if _, err := io.ReadFull(initKdf(recoveryEscrow, ephemeral, recoveryPublicKey, shared.Marshal()), key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func appendUint64(b []byte, v uint64) []byte {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], v)
+	return append(b, buf[:]...)
+}
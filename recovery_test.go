@@ -0,0 +1,288 @@
+/*
+ * Copyright (C) 2015-2019 Virgil Security Inc.
+ *
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ *     (1) Redistributions of source code must retain the above copyright
+ *     notice, this list of conditions and the following disclaimer.
+ *
+ *     (2) Redistributions in binary form must reproduce the above copyright
+ *     notice, this list of conditions and the following disclaimer in
+ *     the documentation and/or other materials provided with the
+ *     distribution.
+ *
+ *     (3) Neither the name of the copyright holder nor the names of its
+ *     contributors may be used to endorse or promote products derived from
+ *     this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ''AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+ * IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ *
+ * Lead Maintainer: Virgil Security Inc. <support@virgilsecurity.com>
+ */
+
+package phe
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+	"time"
+
+	"github.com/VirgilSecurity/virgil-phe-go/internal/drbg"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecovery(t *testing.T) {
+	s, err := NewServer(getServerKeypair())
+	require.NoError(t, err)
+	c := newVectorsClient(t)
+	accountID := []byte("alice")
+
+	recoveryKeypair, err := GenerateRecoveryKeypair()
+	require.NoError(t, err)
+	recoveryPublicKey, err := RecoveryPublicKey(recoveryKeypair)
+	require.NoError(t, err)
+	verificationKey, err := RecoveryVerificationKey(recoveryKeypair)
+	require.NoError(t, err)
+
+	enrollment, err := s.GetEnrollment()
+	require.NoError(t, err)
+	_, recordKey, err := c.EnrollAccount(pwd, enrollment)
+	require.NoError(t, err)
+
+	dataKey, err := GenerateDataKey()
+	require.NoError(t, err)
+	otherKey, err := GenerateDataKey()
+	require.NoError(t, err)
+	wrappedKey, err := WrapDataKey(dataKey, map[string][]byte{PasswordWrapper: recordKey, "other": otherKey})
+	require.NoError(t, err)
+	escrowedKey, err := EscrowDataKey(dataKey, recoveryPublicKey, accountID)
+	require.NoError(t, err)
+
+	// the password is forgotten, administrators recover the data key offline
+	recovered, artifact, err := RecoverDataKey(escrowedKey, recoveryKeypair, "ticket 42")
+	require.NoError(t, err)
+	require.Equal(t, dataKey, recovered)
+
+	a, err := VerifyRecoveryArtifact(artifact, verificationKey)
+	require.NoError(t, err)
+	require.Equal(t, accountID, a.AccountID)
+	require.Equal(t, "ticket 42", a.Reason)
+	require.True(t, a.Covers(escrowedKey))
+	require.WithinDuration(t, time.Now(), a.Time, time.Minute)
+
+	// and the account is enrolled with a new password
+	newPassword := []byte("new password")
+	enrollment, err = s.GetEnrollment()
+	require.NoError(t, err)
+	rec, newRecordKey, newWrappedKey, err := c.RecoverAccount(newPassword, enrollment, recovered, wrappedKey)
+	require.NoError(t, err)
+
+	req, err := c.CreateVerifyPasswordRequest(newPassword, rec)
+	require.NoError(t, err)
+	resp, err := s.VerifyPassword(req)
+	require.NoError(t, err)
+	keyDec, err := c.CheckResponseAndDecrypt(newPassword, rec, resp)
+	require.NoError(t, err)
+	require.Equal(t, newRecordKey, keyDec)
+
+	unwrapped, err := UnwrapDataKey(newWrappedKey, PasswordWrapper, newRecordKey)
+	require.NoError(t, err)
+	require.Equal(t, dataKey, unwrapped)
+	unwrapped, err = UnwrapDataKey(newWrappedKey, "other", otherKey)
+	require.NoError(t, err)
+	require.Equal(t, dataKey, unwrapped)
+
+	// without a stored wrapped key the data key is wrapped by WrapKey
+	_, newRecordKey, newWrappedKey, err = c.RecoverAccount(newPassword, enrollment, recovered, nil)
+	require.NoError(t, err)
+	unwrapped, err = UnwrapKey(newWrappedKey, newRecordKey)
+	require.NoError(t, err)
+	require.Equal(t, dataKey, unwrapped)
+
+	_, _, _, err = c.RecoverAccount(newPassword, enrollment, recovered[1:], nil)
+	require.Error(t, err)
+}
+
+func TestRecovery_Errors(t *testing.T) {
+	recoveryKeypair, err := GenerateRecoveryKeypair()
+	require.NoError(t, err)
+	recoveryPublicKey, err := RecoveryPublicKey(recoveryKeypair)
+	require.NoError(t, err)
+	otherKeypair, err := GenerateRecoveryKeypair()
+	require.NoError(t, err)
+	verificationKey, err := RecoveryVerificationKey(recoveryKeypair)
+	require.NoError(t, err)
+	otherVerificationKey, err := RecoveryVerificationKey(otherKeypair)
+	require.NoError(t, err)
+	p384Keypair, err := GenerateRecoveryKeypair(WithSuite(SuiteP384))
+	require.NoError(t, err)
+
+	dataKey, err := GenerateDataKey()
+	require.NoError(t, err)
+	escrowedKey, err := EscrowDataKey(dataKey, recoveryPublicKey, []byte("alice"))
+	require.NoError(t, err)
+
+	_, _, err = RecoverDataKey(escrowedKey, otherKeypair, "reason")
+	require.Error(t, err)
+	_, _, err = RecoverDataKey(escrowedKey, p384Keypair, "reason")
+	require.Equal(t, ErrSuiteMismatch, err)
+	_, _, err = RecoverDataKey(escrowedKey, recoveryKeypair, "")
+	require.EqualError(t, err, "invalid recovery reason")
+	_, _, err = RecoverDataKey(escrowedKey, getServerKeypair()[1:], "reason")
+	require.Error(t, err)
+
+	// the account ID is authenticated
+	tampered := append([]byte{}, escrowedKey...)
+	tampered[escrowFixedLen] ^= 1
+	_, _, err = RecoverDataKey(tampered, recoveryKeypair, "reason")
+	require.Error(t, err)
+
+	for i := 0; i < len(escrowedKey); i++ {
+		_, _, err = RecoverDataKey(escrowedKey[:i], recoveryKeypair, "reason")
+		require.Error(t, err)
+	}
+
+	_, err = EscrowDataKey(dataKey[1:], recoveryPublicKey, nil)
+	require.Error(t, err)
+	_, err = EscrowDataKey(dataKey, recoveryPublicKey[1:], nil)
+	require.Equal(t, ErrInvalidPublicKey, err)
+	_, err = EscrowDataKey(dataKey, recoveryPublicKey, make([]byte, MaxAccountIDLen+1))
+	require.EqualError(t, err, "account ID is too long")
+
+	_, err = RecoveryVerificationKey(getServerKeypair()[1:])
+	require.Error(t, err)
+
+	// artifacts only verify with the verification key of the recovery keypair and can't be altered
+	_, artifact, err := RecoverDataKey(escrowedKey, recoveryKeypair, "reason")
+	require.NoError(t, err)
+	_, err = VerifyRecoveryArtifact(artifact, otherVerificationKey)
+	require.EqualError(t, err, "invalid recovery artifact signature")
+	_, err = VerifyRecoveryArtifact(artifact, verificationKey[1:])
+	require.Equal(t, ErrInvalidPublicKey, err)
+
+	// the escrow key isn't used for signatures
+	require.NotEqual(t, recoveryPublicKey, verificationKey)
+	_, err = VerifyRecoveryArtifact(artifact, recoveryPublicKey)
+	require.EqualError(t, err, "invalid recovery artifact signature")
+
+	for i := range artifact {
+		tampered = append([]byte{}, artifact...)
+		tampered[i] ^= 1
+		_, err = VerifyRecoveryArtifact(tampered, verificationKey)
+		require.Error(t, err)
+	}
+
+	for i := 0; i < len(artifact); i++ {
+		_, err = VerifyRecoveryArtifact(artifact[:i], verificationKey)
+		require.Error(t, err)
+	}
+}
+
+func TestRecovery_P384(t *testing.T) {
+	recoveryKeypair, err := GenerateRecoveryKeypair(WithSuite(SuiteP384))
+	require.NoError(t, err)
+	recoveryPublicKey, err := RecoveryPublicKey(recoveryKeypair)
+	require.NoError(t, err)
+
+	dataKey, err := GenerateDataKey()
+	require.NoError(t, err)
+	escrowedKey, err := EscrowDataKey(dataKey, recoveryPublicKey, nil)
+	require.NoError(t, err)
+
+	now := time.Unix(1700000000, 0)
+	recovered, artifact, err := recoverDataKey(escrowedKey, recoveryKeypair, "reason", now, rand.Reader)
+	require.NoError(t, err)
+	require.Equal(t, dataKey, recovered)
+
+	verificationKey, err := RecoveryVerificationKey(recoveryKeypair)
+	require.NoError(t, err)
+	a, err := VerifyRecoveryArtifact(artifact, verificationKey)
+	require.NoError(t, err)
+	require.True(t, now.Equal(a.Time))
+	require.Empty(t, a.AccountID)
+}
+
+func TestRecovery_Deterministic(t *testing.T) {
+	escrow := func() ([]byte, []byte) {
+		random := WithRandom(drbg.New([]byte("recovery")))
+		kp, err := GenerateRecoveryKeypair(random)
+		require.NoError(t, err)
+		pub, err := RecoveryPublicKey(kp)
+		require.NoError(t, err)
+		escrowedKey, err := EscrowDataKey(bytes.Repeat([]byte{1}, dataKeyLen), pub, []byte("id"), random)
+		require.NoError(t, err)
+		return kp, escrowedKey
+	}
+
+	kp1, escrowed1 := escrow()
+	kp2, escrowed2 := escrow()
+	require.Equal(t, kp1, kp2)
+	require.Equal(t, escrowed1, escrowed2)
+
+	// a replayed random source gives the same artifact for the same recovery, but never reuses the nonce for another one
+	now := time.Unix(1700000000, 0)
+	artifactFor := func(reason string) []byte {
+		_, artifact, err := recoverDataKey(escrowed1, kp1, reason, now, drbg.New([]byte("nonce")))
+		require.NoError(t, err)
+		return artifact
+	}
+
+	artifact1, artifact2, artifact3 := artifactFor("reason 1"), artifactFor("reason 1"), artifactFor("reason 2")
+	require.Equal(t, artifact1, artifact2)
+	nonce := func(artifact []byte) []byte {
+		return artifact[len(artifact)-groupP256.pointLen-groupP256.zLen : len(artifact)-groupP256.zLen]
+	}
+	require.NotEqual(t, nonce(artifact1), nonce(artifact3))
+
+	verificationKey, err := RecoveryVerificationKey(kp1)
+	require.NoError(t, err)
+	for _, artifact := range [][]byte{artifact1, artifact3} {
+		_, err = VerifyRecoveryArtifact(artifact, verificationKey)
+		require.NoError(t, err)
+	}
+}
+
+func FuzzRecoverDataKey(f *testing.F) {
+	recoveryKeypair, err := GenerateRecoveryKeypair(WithRandom(drbg.New([]byte("fuzz"))))
+	require.NoError(f, err)
+	recoveryPublicKey, err := RecoveryPublicKey(recoveryKeypair)
+	require.NoError(f, err)
+	verificationKey, err := RecoveryVerificationKey(recoveryKeypair)
+	require.NoError(f, err)
+	escrowedKey, err := EscrowDataKey(make([]byte, dataKeyLen), recoveryPublicKey, []byte("id"))
+	require.NoError(f, err)
+	_, artifact, err := RecoverDataKey(escrowedKey, recoveryKeypair, "reason")
+	require.NoError(f, err)
+
+	f.Add(escrowedKey, artifact)
+	f.Add([]byte{}, []byte{})
+
+	f.Fuzz(func(t *testing.T, escrowedKey, artifact []byte) {
+		if dataKey, artifact, err := RecoverDataKey(escrowedKey, recoveryKeypair, "reason"); err == nil {
+			require.Len(t, dataKey, dataKeyLen)
+			a, err := VerifyRecoveryArtifact(artifact, verificationKey)
+			require.NoError(t, err)
+			require.True(t, a.Covers(escrowedKey))
+		}
+
+		if a, err := VerifyRecoveryArtifact(artifact, verificationKey); err == nil {
+			require.NotEmpty(t, a.Reason)
+			require.Len(t, a.EscrowDigest, 32)
+		}
+	})
+}
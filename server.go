@@ -37,38 +37,100 @@
 package phe
 
 import (
+	"io"
+
 	"github.com/golang/protobuf/proto"
 	"github.com/pkg/errors"
 )
 
-// GenerateServerKeypair creates a new random Nist p-256 keypair
-func GenerateServerKeypair() ([]byte, error) {
-	privateKey := padZ(randomZ().Bytes())
-	publicKey := new(Point).ScalarBaseMult(privateKey)
+// GenerateServerKeypair creates a new random Nist p-256 keypair, WithSuite selects another curve
+// and WithRandom another source of randomness
+func GenerateServerKeypair(opts ...Option) ([]byte, error) {
+	o := applyOptions(opts)
+	g, err := getGroup(o.suite)
+	if err != nil {
+		return nil, err
+	}
+
+	protocol, err := checkProtocol(uint32(o.protocol))
+	if err != nil {
+		return nil, err
+	}
+
+	privateKey, err := g.randomScalar(o.rand())
+	if err != nil {
+		return nil, err
+	}
+	publicKey := g.baseBytes(privateKey)
+
+	return g.marshalKeypair(publicKey.Marshal(), privateKey, protocol)
 
-	return marshalKeypair(publicKey.Marshal(), privateKey)
+}
 
+// Server is the rate-limiter side of the protocol. It keeps a parsed server keypair
+// so it is not unmarshaled on every request. Server is immutable and safe for concurrent use
+type Server struct {
+	privateKeyBytes []byte
+	publicKey       *Point
+	publicKeyBytes  []byte
+	version         uint32
+	rateLimiter     RateLimiter
+	random          io.Reader
+	g               *group
+	protocol        Protocol
 }
 
-// GetEnrollment generates a new random enrollment record and a proof
-func GetEnrollment(serverKeypair []byte) ([]byte, error) {
+// NewServer creates a new server instance from the keypair produced by GenerateServerKeypair or Rotate
+func NewServer(serverKeypair []byte, opts ...Option) (*Server, error) {
+	return newServer(serverKeypair, 0, opts...)
+}
 
+func newServer(serverKeypair []byte, version uint32, opts ...Option) (*Server, error) {
 	kp, err := unmarshalKeypair(serverKeypair)
 	if err != nil {
 		return nil, err
 	}
 
-	ns := make([]byte, pheNonceLen)
-	randRead(ns)
-	hs0, hs1, c0, c1 := eval(kp, ns)
-	proof := proveSuccess(kp, hs0, hs1, c0, c1)
+	g, err := getGroup(Suite(kp.Suite))
+	if err != nil {
+		return nil, err
+	}
 
-	return proto.Marshal(&EnrollmentResponse{
-		Ns:    ns,
-		C0:    c0.Marshal(),
-		C1:    c1.Marshal(),
-		Proof: proof.Success,
-	})
+	protocol, err := checkProtocol(kp.Protocol)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(kp.PrivateKey) != g.zLen {
+		return nil, ErrInvalidPrivateKey
+	}
+
+	pub, err := g.unmarshalPoint(kp.PublicKey)
+	if err != nil {
+		return nil, ErrInvalidPublicKey
+	}
+
+	o := applyOptions(opts)
+	return &Server{
+		privateKeyBytes: kp.PrivateKey,
+		publicKey:       pub,
+		publicKeyBytes:  kp.PublicKey,
+		version:         version,
+		rateLimiter:     o.rateLimiter,
+		random:          o.rand(),
+		g:               g,
+		protocol:        protocol,
+	}, nil
+}
+
+// GetEnrollment generates a new random enrollment record and a proof
+func GetEnrollment(serverKeypair []byte, opts ...Option) ([]byte, error) {
+	s, err := NewServer(serverKeypair, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.GetEnrollment()
 }
 
 // GetPublicKey returns server public key
@@ -83,53 +145,170 @@ func GetPublicKey(serverKeypair []byte) ([]byte, error) {
 
 // VerifyPassword compares password attempt to the one server would calculate itself using its private key
 // and returns a zero knowledge proof of ether success or failure
-func VerifyPassword(serverKeypair []byte, reqBytes []byte) (response []byte, err error) {
+func VerifyPassword(serverKeypair []byte, reqBytes []byte, opts ...Option) (response []byte, err error) {
 
-	response, _, err = VerifyPasswordExtended(serverKeypair, reqBytes)
+	response, _, err = VerifyPasswordExtended(serverKeypair, reqBytes, opts...)
 	return
 }
 
 // VerifyPasswordExtended compares password attempt to the one server would calculate itself using its private key
 // and returns a zero knowledge proof of ether success or failure
 // and an object containing verify result & salt used for verification
-func VerifyPasswordExtended(serverKeypair []byte, reqBytes []byte) (response []byte, state *VerifyPasswordResult, err error) {
+func VerifyPasswordExtended(serverKeypair []byte, reqBytes []byte, opts ...Option) (response []byte, state *VerifyPasswordResult, err error) {
+	s, err := NewServer(serverKeypair, opts...)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return s.VerifyPasswordExtended(reqBytes)
+}
+
+//Rotate updates server's private and public keys and issues an update token for use on client's side
+func Rotate(serverKeypair []byte, opts ...Option) (token []byte, newServerKeypair []byte, err error) {
+	s, err := NewServer(serverKeypair, opts...)
+	if err != nil {
+		return
+	}
+
+	return s.Rotate()
+}
+
+// GetEnrollment generates a new random enrollment record and a proof
+func (s *Server) GetEnrollment() ([]byte, error) {
+	resp, err := s.enrollment()
+	if err != nil {
+		return nil, err
+	}
+	return proto.Marshal(resp)
+}
+
+func (s *Server) enrollment() (*EnrollmentResponse, error) {
+
+	ns := make([]byte, pheNonceLen)
+	if err := randRead(s.random, ns); err != nil {
+		return nil, err
+	}
+
+	hs0, hs1, c0, c1, err := s.eval(ns)
+	if err != nil {
+		return nil, err
+	}
+
+	proof, err := s.proveSuccess(hs0, hs1, c0, c1)
+	if err != nil {
+		return nil, err
+	}
+
+	return &EnrollmentResponse{
+		Ns:       ns,
+		C0:       c0.Marshal(),
+		C1:       c1.Marshal(),
+		Proof:    proof.Success,
+		Version:  s.version,
+		Suite:    uint32(s.g.suite),
+		Protocol: uint32(s.protocol),
+	}, nil
+}
+
+// GetPublicKey returns server public key
+func (s *Server) GetPublicKey() []byte {
+	return s.publicKeyBytes
+}
+
+// VerifyPassword compares password attempt to the one server would calculate itself using its private key
+// and returns a zero knowledge proof of ether success or failure
+func (s *Server) VerifyPassword(reqBytes []byte) (response []byte, err error) {
+
+	response, _, err = s.VerifyPasswordExtended(reqBytes)
+	return
+}
+
+// VerifyPasswordExtended compares password attempt to the one server would calculate itself using its private key
+// and returns a zero knowledge proof of ether success or failure
+// and an object containing verify result & salt used for verification.
+// If the server has a rate limiter, a throttled attempt is rejected with *ThrottledError
+func (s *Server) VerifyPasswordExtended(reqBytes []byte) (response []byte, state *VerifyPasswordResult, err error) {
 	req := &VerifyPasswordRequest{}
 	if err = proto.Unmarshal(reqBytes, req); err != nil {
-		return
+		return nil, nil, ErrInvalidRequest
 	}
 
-	kp, err := unmarshalKeypair(serverKeypair)
+	return s.verifyPassword(req)
+}
+
+func (s *Server) verifyPassword(req *VerifyPasswordRequest) (response []byte, state *VerifyPasswordResult, err error) {
+	resp, state, err := s.verify(req)
 	if err != nil {
 		return nil, nil, err
 	}
 
+	response, err = proto.Marshal(resp)
+	return
+}
+
+func (s *Server) verify(req *VerifyPasswordRequest) (response *VerifyPasswordResponse, state *VerifyPasswordResult, err error) {
 	if req == nil || len(req.Ns) != pheNonceLen {
-		err = errors.New("Invalid password verify request")
+		err = ErrInvalidRequest
+		return
+	}
+
+	if req.Version != s.version {
+		err = &VersionMismatchError{Object: "request", Version: req.Version, Expected: s.version}
+		return
+	}
+
+	if err = s.g.checkSuite(req.Suite); err != nil {
+		return
+	}
+
+	if Protocol(req.Protocol) != s.protocol {
+		err = ErrProtocolMismatch
 		return
 	}
 
 	ns := req.Ns
 
-	c0, err := PointUnmarshal(req.C0)
+	c0, err := s.g.unmarshalPoint(req.C0)
+	if err != nil {
+		return nil, nil, ErrInvalidRequest
+	}
+
+	if s.rateLimiter != nil {
+		if err = s.rateLimiter.Allow(ns); err != nil {
+			return
+		}
+		defer func() {
+			if err == nil {
+				err = s.rateLimiter.Report(ns, state.Res)
+			}
+		}()
+	}
+
+	hs0, err := s.g.hashToPoint(s.protocol, dhs0, ns)
 	if err != nil {
 		return
 	}
 
-	hs0 := hashToPoint(dhs0, ns)
-	hs1 := hashToPoint(dhs1, ns)
+	hs1, err := s.g.hashToPoint(s.protocol, dhs1, ns)
+	if err != nil {
+		return
+	}
 
-	if hs0.ScalarMult(kp.PrivateKey).Equal(c0) {
+	if hs0.ScalarMult(s.privateKeyBytes).Equal(c0) {
 		//password is ok
 
-		c1 := hs1.ScalarMult(kp.PrivateKey)
+		c1 := hs1.ScalarMult(s.privateKeyBytes)
+
+		var proof *VerifyPasswordResponse_Success
+		if proof, err = s.proveSuccess(hs0, hs1, c0, c1); err != nil {
+			return
+		}
 
-		resp := &VerifyPasswordResponse{
+		response = &VerifyPasswordResponse{
 			Res:   true,
 			C1:    c1.Marshal(),
-			Proof: proveSuccess(kp, hs0, hs1, c0, c1),
+			Proof: proof,
 		}
-
-		response, err = proto.Marshal(resp)
 		state = &VerifyPasswordResult{
 			Res:  true,
 			Salt: req.Ns,
@@ -139,16 +318,16 @@ func VerifyPasswordExtended(serverKeypair []byte, reqBytes []byte) (response []b
 
 	//password is invalid
 
-	c1, proof, err := proveFailure(kp, c0, hs0)
+	c1, proof, err := s.proveFailure(c0, hs0)
 	if err != nil {
 		return
 	}
 
-	response, err = proto.Marshal(&VerifyPasswordResponse{
+	response = &VerifyPasswordResponse{
 		Res:   false,
 		C1:    c1.Marshal(),
 		Proof: proof,
-	})
+	}
 	state = &VerifyPasswordResult{
 		Res:  false,
 		Salt: req.Ns,
@@ -156,51 +335,130 @@ func VerifyPasswordExtended(serverKeypair []byte, reqBytes []byte) (response []b
 	return
 }
 
-func eval(kp *Keypair, ns []byte) (hs0, hs1, c0, c1 *Point) {
-	hs0 = hashToPoint(dhs0, ns)
-	hs1 = hashToPoint(dhs1, ns)
+// Rotate generates new server's private and public keys and issues an update token for use on client's side
+// Server itself is not modified, a new instance must be created from the new keypair
+func (s *Server) Rotate() (token []byte, newServerKeypair []byte, err error) {
+	return s.rotate(0)
+}
+
+// rotate issues an update token which moves records to the given key version
+func (s *Server) rotate(version uint32) (token []byte, newServerKeypair []byte, err error) {
+
+	aBytes, err := s.g.randomScalar(s.random)
+	if err != nil {
+		return
+	}
+
+	bBytes, err := s.g.randomScalar(s.random)
+	if err != nil {
+		return
+	}
+
+	newPrivate := s.g.zMulAdd(s.privateKeyBytes, aBytes, bBytes)
+	newPublic := s.g.baseBytes(newPrivate)
+
+	newServerKeypair, err = s.g.marshalKeypair(newPublic.Marshal(), newPrivate, s.protocol)
+	if err != nil {
+		return
+	}
+
+	proof, err := s.proveRotation(newPrivate, newPublic, aBytes, bBytes)
+	if err != nil {
+		return
+	}
+
+	token, err = proto.Marshal(&UpdateToken{
+		A:        aBytes,
+		B:        bBytes,
+		Version:  version,
+		Proof:    proof,
+		Suite:    uint32(s.g.suite),
+		Protocol: uint32(s.protocol),
+	})
 
-	c0 = hs0.ScalarMult(kp.PrivateKey)
-	c1 = hs1.ScalarMult(kp.PrivateKey)
 	return
 }
 
-func proveSuccess(kp *Keypair, hs0, hs1, c0, c1 *Point) *VerifyPasswordResponse_Success {
-	blindX := randomZ()
+// proveRotation proves the knowledge of the new private key whose public key
+// the client derives from the old one with the update token: newX = X * a + G * b
+func (s *Server) proveRotation(newPrivate []byte, newPublic *Point, a, b []byte) (*ProofOfRotation, error) {
+	blindX, err := s.g.randomScalar(s.random)
+	if err != nil {
+		return nil, err
+	}
 
-	term1 := hs0.ScalarMult(blindX.Bytes())
-	term2 := hs1.ScalarMult(blindX.Bytes())
-	term3 := new(Point).ScalarBaseMult(blindX.Bytes())
+	term := s.g.baseBytes(blindX)
+
+	//challenge = group.hash((self.X, newX, self.G, a, b, term), target_type=ZR)
+
+	challenge := s.g.hashZ(proofRotation, s.publicKeyBytes, newPublic.Marshal(), s.g.generator, a, b, term.Marshal())
+	return &ProofOfRotation{
+		Term:   term.Marshal(),
+		BlindX: s.g.zMulAdd(newPrivate, s.g.padZ(challenge.Bytes()), blindX),
+	}, nil
+}
+
+func (s *Server) eval(ns []byte) (hs0, hs1, c0, c1 *Point, err error) {
+	if hs0, err = s.g.hashToPoint(s.protocol, dhs0, ns); err != nil {
+		return
+	}
+
+	if hs1, err = s.g.hashToPoint(s.protocol, dhs1, ns); err != nil {
+		return
+	}
+
+	c0 = hs0.ScalarMult(s.privateKeyBytes)
+	c1 = hs1.ScalarMult(s.privateKeyBytes)
+	return
+}
+
+func (s *Server) proveSuccess(hs0, hs1, c0, c1 *Point) (*VerifyPasswordResponse_Success, error) {
+	blindX, err := s.g.randomScalar(s.random)
+	if err != nil {
+		return nil, err
+	}
+
+	term1 := hs0.ScalarMult(blindX)
+	term2 := hs1.ScalarMult(blindX)
+	term3 := s.g.baseBytes(blindX)
 
 	//challenge = group.hash((self.X, self.G, c0, c1, term1, term2, term3), target_type=ZR)
 
-	challenge := hashZ(proofOk, kp.PublicKey, curveG, c0.Marshal(), c1.Marshal(), term1.Marshal(), term2.Marshal(), term3.Marshal())
-	res := gf.Add(blindX, gf.MulBytes(kp.PrivateKey, challenge))
+	challenge := s.g.hashZ(proofOk, s.publicKeyBytes, s.g.generator, c0.Marshal(), c1.Marshal(), term1.Marshal(), term2.Marshal(), term3.Marshal())
 
 	return &VerifyPasswordResponse_Success{
 		Success: &ProofOfSuccess{
 			Term1:  term1.Marshal(),
 			Term2:  term2.Marshal(),
 			Term3:  term3.Marshal(),
-			BlindX: padZ(res.Bytes()),
+			BlindX: s.g.zMulAdd(s.privateKeyBytes, s.g.padZ(challenge.Bytes()), blindX),
 		},
-	}
+	}, nil
 }
 
-func proveFailure(kp *Keypair, c0, hs0 *Point) (c1 *Point, proof *VerifyPasswordResponse_Fail, err error) {
-	r := randomZ()
-	minusR := gf.Neg(r)
-	minusRX := gf.MulBytes(kp.PrivateKey, minusR)
+func (s *Server) proveFailure(c0, hs0 *Point) (c1 *Point, proof *VerifyPasswordResponse_Fail, err error) {
+	r, err := s.g.randomScalar(s.random)
+	if err != nil {
+		return
+	}
+	minusRX := s.g.zMulAdd(s.privateKeyBytes, s.g.zNeg(r), nil)
 
-	c1 = c0.ScalarMult(r.Bytes()).Add(hs0.ScalarMult(minusRX.Bytes()))
+	c1 = c0.ScalarMult(r).Add(hs0.ScalarMult(minusRX))
 
 	a := r
 	b := minusRX
 
-	blindA := randomZ().Bytes()
-	blindB := randomZ().Bytes()
+	if s.protocol >= ProtocolV3 {
+		proof, err = s.proveFailureV3(c0, hs0, c1, a, b)
+		return
+	}
+
+	blindA, err := s.g.randomScalar(s.random)
+	if err != nil {
+		return
+	}
 
-	publicKey, err := PointUnmarshal(kp.PublicKey)
+	blindB, err := s.g.randomScalar(s.random)
 	if err != nil {
 		return
 	}
@@ -213,43 +471,55 @@ func proveFailure(kp *Keypair, c0, hs0 *Point) (c1 *Point, proof *VerifyPassword
 
 	term1 := c0.ScalarMult(blindA)
 	term2 := hs0.ScalarMult(blindB)
-	term3 := publicKey.ScalarMult(blindA)
-	term4 := new(Point).ScalarBaseMult(blindB)
+	term3 := s.publicKey.ScalarMult(blindA)
+	term4 := s.g.baseBytes(blindB)
 
-	challenge := hashZ(proofError, kp.PublicKey, curveG, c0.Marshal(), c1.Marshal(), term1.Marshal(), term2.Marshal(), term3.Marshal(), term4.Marshal())
+	challenge := s.g.padZ(s.g.hashZ(proofError, s.publicKeyBytes, s.g.generator, c0.Marshal(), c1.Marshal(), term1.Marshal(), term2.Marshal(), term3.Marshal(), term4.Marshal()).Bytes())
 	pof := &ProofOfFail{
 		Term1:  term1.Marshal(),
 		Term2:  term2.Marshal(),
 		Term3:  term3.Marshal(),
 		Term4:  term4.Marshal(),
-		BlindA: padZ(gf.AddBytes(blindA, gf.Mul(challenge, a)).Bytes()),
-		BlindB: padZ(gf.AddBytes(blindB, gf.Mul(challenge, b)).Bytes()),
+		BlindA: s.g.zMulAdd(challenge, a, blindA),
+		BlindB: s.g.zMulAdd(challenge, b, blindB),
 	}
 	return c1, &VerifyPasswordResponse_Fail{
 		Fail: pof,
 	}, nil
 }
 
-//Rotate updates server's private and public keys and issues an update token for use on client's side
-func Rotate(serverKeypair []byte) (token []byte, newServerKeypair []byte, err error) {
-
-	kp, err := unmarshalKeypair(serverKeypair)
+// proveFailureV3 proves the knowledge of a, b such that c1 = c0 * a + hs0 * b and I = X * a + G * b,
+// where I is the point at infinity. Since c1 isn't the point at infinity, it can only be built this way
+// if c0 != hs0 * x, that is if the password is wrong. Both relations share the blinds and the challenge,
+// which is computed over the whole statement including hs0
+func (s *Server) proveFailureV3(c0, hs0, c1 *Point, a, b []byte) (*VerifyPasswordResponse_Fail, error) {
+	blindA, err := s.g.randomScalar(s.random)
 	if err != nil {
-		return
+		return nil, err
 	}
-	a, b := randomZ(), randomZ()
-	newPrivate := padZ(gf.Add(gf.MulBytes(kp.PrivateKey, a), b).Bytes())
-	newPublic := new(Point).ScalarBaseMult(newPrivate)
 
-	newServerKeypair, err = marshalKeypair(newPublic.Marshal(), newPrivate)
+	blindB, err := s.g.randomScalar(s.random)
 	if err != nil {
-		return
+		return nil, err
 	}
 
-	token, err = proto.Marshal(&UpdateToken{
-		A: padZ(a.Bytes()),
-		B: padZ(b.Bytes()),
-	})
+	// term1 = c0 * blind_a + hs0 * blind_b
+	// term2 = X * blind_a + G * blind_b
 
-	return
+	term1 := c0.ScalarMult(blindA).Add(hs0.ScalarMult(blindB))
+	term2 := s.publicKey.ScalarMult(blindA).Add(s.g.baseBytes(blindB))
+	if term1.isInfinity() || term2.isInfinity() {
+		return nil, errors.New("degenerate proof terms")
+	}
+
+	challenge := s.g.padZ(s.g.hashZ(proofErrorV3, s.publicKeyBytes, s.g.generator, hs0.Marshal(), c0.Marshal(), c1.Marshal(), term1.Marshal(), term2.Marshal()).Bytes())
+
+	return &VerifyPasswordResponse_Fail{
+		Fail: &ProofOfFail{
+			Term1:  term1.Marshal(),
+			Term2:  term2.Marshal(),
+			BlindA: s.g.zMulAdd(challenge, a, blindA),
+			BlindB: s.g.zMulAdd(challenge, b, blindB),
+		},
+	}, nil
 }
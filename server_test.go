@@ -0,0 +1,281 @@
+/*
+ * Copyright (C) 2015-2019 Virgil Security Inc.
+ *
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ *     (1) Redistributions of source code must retain the above copyright
+ *     notice, this list of conditions and the following disclaimer.
+ *
+ *     (2) Redistributions in binary form must reproduce the above copyright
+ *     notice, this list of conditions and the following disclaimer in
+ *     the documentation and/or other materials provided with the
+ *     distribution.
+ *
+ *     (3) Neither the name of the copyright holder nor the names of its
+ *     contributors may be used to endorse or promote products derived from
+ *     this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ''AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+ * IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ *
+ * Lead Maintainer: Virgil Security Inc. <support@virgilsecurity.com>
+ */
+
+package phe
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"math/big"
+	"sync"
+	"testing"
+
+	"github.com/VirgilSecurity/virgil-phe-go/internal/dudect"
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServer_InvalidKeypair(t *testing.T) {
+	_, err := NewServer([]byte{0x01, 0x02})
+	require.Error(t, err)
+
+	kp, err := marshalKeypair(serverPublic, serverPrivate[1:])
+	require.NoError(t, err)
+	_, err = NewServer(kp)
+	require.Error(t, err)
+
+	kp, err = marshalKeypair(serverPublic[1:], serverPrivate)
+	require.NoError(t, err)
+	_, err = NewServer(kp)
+	require.Error(t, err)
+}
+
+func TestServer_Vectors(t *testing.T) {
+	s, err := NewServer(getServerKeypair(), mockRandom())
+	require.NoError(t, err)
+	require.Equal(t, serverPublic, s.GetPublicKey())
+
+	resp, err := s.GetEnrollment()
+	require.NoError(t, err)
+	require.Equal(t, enrollmentResponse, resp)
+
+	s, err = NewServer(getServerKeypair(), mockRandom())
+	require.NoError(t, err)
+	resp, err = s.VerifyPassword(verifyPasswordReq)
+	require.NoError(t, err)
+	require.Equal(t, verifyPasswordResp, resp)
+
+	s, err = NewServer(getServerKeypair(), mockRandom())
+	require.NoError(t, err)
+	resp, err = s.VerifyPassword(verifyBadPasswordReq)
+	require.NoError(t, err)
+	require.Equal(t, verifyBadPasswordResp, resp)
+}
+
+func TestServer_Concurrent(t *testing.T) {
+	serverKeypair, err := GenerateServerKeypair()
+	require.NoError(t, err)
+	s, err := NewServer(serverKeypair)
+	require.NoError(t, err)
+	c, err := NewClient(s.GetPublicKey(), generateClientKey(t))
+	require.NoError(t, err)
+
+	enrollment, err := s.GetEnrollment()
+	require.NoError(t, err)
+	rec, key, err := c.EnrollAccount(pwd, enrollment)
+	require.NoError(t, err)
+	req, err := c.CreateVerifyPasswordRequest(pwd, rec)
+	require.NoError(t, err)
+	badReq, err := c.CreateVerifyPasswordRequest([]byte("Password1"), rec)
+	require.NoError(t, err)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 16)
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if i%2 == 0 {
+				resp, res, err := s.VerifyPasswordExtended(req)
+				if err != nil {
+					errs <- err
+					return
+				}
+				if !res.Res {
+					errs <- errors.New("valid password rejected")
+					return
+				}
+				keyDec, err := c.CheckResponseAndDecrypt(pwd, rec, resp)
+				if err == nil && !bytes.Equal(key, keyDec) {
+					err = errors.New("keys don't match")
+				}
+				errs <- err
+				return
+			}
+			_, res, err := s.VerifyPasswordExtended(badReq)
+			if err == nil && res.Res {
+				err = errors.New("invalid password accepted")
+			}
+			errs <- err
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+}
+
+func TestServer_Rotate(t *testing.T) {
+	serverKeypair, err := GenerateServerKeypair()
+	require.NoError(t, err)
+	s, err := NewServer(serverKeypair)
+	require.NoError(t, err)
+
+	token, newKeypair, err := s.Rotate()
+	require.NoError(t, err)
+	require.Equal(t, serverKeypair, mustMarshalKeypair(s))
+
+	rotated, err := NewServer(newKeypair)
+	require.NoError(t, err)
+
+	newPriv, newPub, err := RotateClientKeys(s.GetPublicKey(), generateClientKey(t), token)
+	require.NoError(t, err)
+	require.NotEmpty(t, newPriv)
+	require.Equal(t, rotated.GetPublicKey(), newPub)
+}
+
+// TestServer_ConstantTime checks that the time the server spends on the private key doesn't depend on the key
+func TestServer_ConstantTime(t *testing.T) {
+	if !dudect.Enabled() {
+		t.Skip("timing test, set " + dudect.EnvVar + "=1 to run it")
+	}
+
+	ns := make([]byte, pheNonceLen)
+	require.NoError(t, randRead(rand.Reader, ns))
+
+	newTestServer := func(class int) *Server {
+		priv := big.NewInt(1)
+		if class == 1 {
+			priv = randomZ()
+		}
+		pub := groupP256.base(priv)
+		return &Server{
+			privateKeyBytes: padZ(priv.Bytes()),
+			publicKey:       pub,
+			publicKeyBytes:  pub.Marshal(),
+			random:          rand.Reader,
+			g:               groupP256,
+		}
+	}
+
+	res := dudect.Test(2000, 1, func(class int) func() {
+		s := newTestServer(class)
+		return func() {
+			hs0, hs1, c0, c1, _ := s.eval(ns)
+			_, _ = s.proveSuccess(hs0, hs1, c0, c1)
+		}
+	})
+	require.True(t, res < dudect.Threshold, "server timing depends on the private key, t = %f", res)
+}
+
+func mustMarshalKeypair(s *Server) []byte {
+	kp, err := marshalKeypair(s.publicKeyBytes, s.privateKeyBytes)
+	if err != nil {
+		panic(err)
+	}
+	return kp
+}
+
+func BenchmarkServer_VerifyPassword(b *testing.B) {
+	serverKeypair, err := GenerateServerKeypair()
+	require.NoError(b, err)
+	s, err := NewServer(serverKeypair)
+	require.NoError(b, err)
+	c, err := NewClient(s.GetPublicKey(), generateClientKey(b))
+	require.NoError(b, err)
+	enrollment, err := s.GetEnrollment()
+	require.NoError(b, err)
+	rec, _, err := c.EnrollAccount(pwd, enrollment)
+	require.NoError(b, err)
+	req, err := c.CreateVerifyPasswordRequest(pwd, rec)
+	require.NoError(b, err)
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		_, err := s.VerifyPassword(req)
+		require.NoError(b, err)
+	}
+}
+
+// FuzzServer_VerifyPassword makes sure no request can crash the server
+// and that every response the server gives carries a proof the client accepts
+func FuzzServer_VerifyPassword(f *testing.F) {
+	f.Add(verifyPasswordReq)
+	f.Add(verifyBadPasswordReq)
+	f.Add(enrollmentRecord)
+	f.Add([]byte{})
+
+	s, err := NewServer(getServerKeypair())
+	require.NoError(f, err)
+	c, err := NewClient(serverPublic, clientPrivate)
+	require.NoError(f, err)
+
+	f.Fuzz(func(t *testing.T, reqBytes []byte) {
+		respBytes, res, err := s.VerifyPasswordExtended(reqBytes)
+		if err != nil {
+			require.Nil(t, respBytes)
+			return
+		}
+
+		req, resp := &VerifyPasswordRequest{}, &VerifyPasswordResponse{}
+		require.NoError(t, proto.Unmarshal(reqBytes, req))
+		require.NoError(t, proto.Unmarshal(respBytes, resp))
+		require.Equal(t, res.Res, resp.Res)
+		require.Equal(t, req.Ns, res.Salt)
+
+		c0, err := c.g.unmarshalPoint(req.C0)
+		require.NoError(t, err)
+		c1, err := c.g.unmarshalPoint(resp.C1)
+		require.NoError(t, err)
+
+		if resp.Res {
+			require.True(t, c.validateProofOfSuccess(s.protocol, resp.GetSuccess(), req.Ns, c0, c1, req.C0, resp.C1))
+			return
+		}
+
+		hs0, err := c.g.hashToPoint(s.protocol, dhs0, req.Ns)
+		require.NoError(t, err)
+		require.NoError(t, c.validateProofOfFail(s.protocol, resp, c0, c1, hs0))
+	})
+}
+
+// FuzzNewServer makes sure a corrupted keypair is rejected with an error
+func FuzzNewServer(f *testing.F) {
+	f.Add(getServerKeypair())
+	f.Add([]byte{0x01, 0x02})
+
+	f.Fuzz(func(t *testing.T, keypair []byte) {
+		s, err := NewServer(keypair)
+		if err != nil {
+			return
+		}
+		_, err = s.GetEnrollment()
+		require.NoError(t, err)
+	})
+}
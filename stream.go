@@ -0,0 +1,464 @@
+/*
+ * Copyright (C) 2015-2019 Virgil Security Inc.
+ *
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ *     (1) Redistributions of source code must retain the above copyright
+ *     notice, this list of conditions and the following disclaimer.
+ *
+ *     (2) Redistributions in binary form must reproduce the above copyright
+ *     notice, this list of conditions and the following disclaimer in
+ *     the documentation and/or other materials provided with the
+ *     distribution.
+ *
+ *     (3) Neither the name of the copyright holder nor the names of its
+ *     contributors may be used to endorse or promote products derived from
+ *     this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ''AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+ * IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ *
+ * Lead Maintainer: Virgil Security Inc. <support@virgilsecurity.com>
+ */
+package phe
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha512"
+	"encoding/binary"
+	"io"
+	"math"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/hkdf"
+)
+
+// Streams are encrypted in chunks, each chunk is sealed by AES-GCM separately.
+// The stream starts with a header: version byte, chunk size (uint32 big endian) and 32 byte salt.
+// The per-stream key and 7 byte nonce prefix are derived from the master key and salt by HKDF.
+// The nonce of every chunk is nonce prefix || chunk index (uint32 big endian) || final flag,
+// and the header is authenticated as additional data of each chunk.
+// So chunks can't be reordered, and the stream can't be truncated or extended without decryption failure
+const (
+	streamVersion        = 1
+	streamHeaderLen      = 1 + 4 + symSaltLen
+	streamNoncePrefixLen = symNonceLen - 5
+)
+
+const (
+	// DefaultStreamChunkSize is the chunk size used by NewStreamWriter if none is specified
+	DefaultStreamChunkSize = 64 * 1024
+	// MaxStreamChunkSize is the largest supported chunk size
+	MaxStreamChunkSize = 16 * 1024 * 1024
+)
+
+type streamCipher struct {
+	aead        cipher.AEAD
+	header      []byte
+	noncePrefix []byte
+	chunkSize   int
+}
+
+func newStreamCipher(key, header []byte) (*streamCipher, error) {
+	if len(key) != symKeyLen {
+		return nil, errors.New("key must be exactly 32 bytes")
+	}
+
+	if len(header) != streamHeaderLen || header[0] != streamVersion {
+		return nil, errors.New("invalid stream header")
+	}
+
+	chunkSize := binary.BigEndian.Uint32(header[1:5])
+	if chunkSize == 0 || chunkSize > MaxStreamChunkSize {
+		return nil, errors.New("invalid stream chunk size")
+	}
+
+	kdf := hkdf.New(sha512.New, key, header[5:], encryptStream)
+	keyNonce := make([]byte, symKeyLen+streamNoncePrefixLen)
+	if _, err := io.ReadFull(kdf, keyNonce); err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(keyNonce[:symKeyLen])
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return &streamCipher{
+		aead:        aead,
+		header:      header,
+		noncePrefix: keyNonce[symKeyLen:],
+		chunkSize:   int(chunkSize),
+	}, nil
+}
+
+func (c *streamCipher) nonce(index uint64, final bool) ([]byte, error) {
+	if index > math.MaxUint32 {
+		return nil, errors.New("stream is too long")
+	}
+	nonce := make([]byte, symNonceLen)
+	copy(nonce, c.noncePrefix)
+	binary.BigEndian.PutUint32(nonce[streamNoncePrefixLen:], uint32(index))
+	if final {
+		nonce[symNonceLen-1] = 1
+	}
+	return nonce, nil
+}
+
+func (c *streamCipher) seal(dst, chunk []byte, index uint64, final bool) ([]byte, error) {
+	nonce, err := c.nonce(index, final)
+	if err != nil {
+		return nil, err
+	}
+	return c.aead.Seal(dst, nonce, chunk, c.header), nil
+}
+
+func (c *streamCipher) open(dst, chunk []byte, index uint64, final bool) ([]byte, error) {
+	nonce, err := c.nonce(index, final)
+	if err != nil {
+		return nil, err
+	}
+	res, err := c.aead.Open(dst, nonce, chunk, c.header)
+	if err != nil {
+		return nil, errors.Wrapf(err, "chunk %d", index)
+	}
+	return res, nil
+}
+
+type streamWriter struct {
+	w      io.Writer
+	c      *streamCipher
+	buf    []byte
+	ct     []byte
+	index  uint64
+	err    error
+	closed bool
+}
+
+// NewStreamWriter returns a writer which encrypts everything written to it with the key and writes the result to w.
+// key is 32 bytes, for example the one returned by EnrollAccount or CheckResponseAndDecrypt.
+// chunkSize is the size of plaintext chunks, DefaultStreamChunkSize is used if it's zero.
+// Close must be called to write the final chunk, it doesn't close w. WithRandom replaces the source of the salt
+func NewStreamWriter(w io.Writer, key []byte, chunkSize int, opts ...Option) (io.WriteCloser, error) {
+	if chunkSize == 0 {
+		chunkSize = DefaultStreamChunkSize
+	}
+	if chunkSize < 0 || chunkSize > MaxStreamChunkSize {
+		return nil, errors.New("invalid stream chunk size")
+	}
+
+	header := make([]byte, streamHeaderLen)
+	header[0] = streamVersion
+	binary.BigEndian.PutUint32(header[1:5], uint32(chunkSize))
+	if err := randRead(applyOptions(opts).rand(), header[5:]); err != nil {
+		return nil, err
+	}
+
+	c, err := newStreamCipher(key, header)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err = w.Write(header); err != nil {
+		return nil, err
+	}
+
+	return &streamWriter{
+		w:   w,
+		c:   c,
+		buf: make([]byte, 0, chunkSize),
+		ct:  make([]byte, 0, chunkSize+symTagLen),
+	}, nil
+}
+
+func (s *streamWriter) Write(p []byte) (n int, err error) {
+	if s.closed {
+		return 0, errors.New("write to closed stream")
+	}
+	if s.err != nil {
+		return 0, s.err
+	}
+
+	for len(p) > 0 {
+		// the buffered chunk is written only when there's more data, because the last chunk must be marked as final
+		if len(s.buf) == s.c.chunkSize {
+			if s.err = s.flush(false); s.err != nil {
+				return n, s.err
+			}
+		}
+
+		l := copy(s.buf[len(s.buf):cap(s.buf)], p)
+		s.buf = s.buf[:len(s.buf)+l]
+		p = p[l:]
+		n += l
+	}
+	return n, nil
+}
+
+func (s *streamWriter) flush(final bool) error {
+	ct, err := s.c.seal(s.ct[:0], s.buf, s.index, final)
+	if err != nil {
+		return err
+	}
+	if _, err = s.w.Write(ct); err != nil {
+		return err
+	}
+	s.buf = s.buf[:0]
+	s.index++
+	return nil
+}
+
+// Close writes the final chunk
+func (s *streamWriter) Close() error {
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	if s.err != nil {
+		return s.err
+	}
+	s.err = s.flush(true)
+	return s.err
+}
+
+type streamReader struct {
+	r     io.Reader
+	key   []byte
+	c     *streamCipher
+	buf   []byte
+	n     int
+	pt    []byte
+	out   []byte
+	index uint64
+	done  bool
+	err   error
+}
+
+// NewStreamReader returns a reader which decrypts the stream written by NewStreamWriter.
+// Data is returned only after the chunk it belongs to has been authenticated.
+// Read returns io.EOF only after the final chunk, a truncated stream results in an error
+func NewStreamReader(r io.Reader, key []byte) io.Reader {
+	return &streamReader{r: r, key: key}
+}
+
+func (s *streamReader) Read(p []byte) (int, error) {
+	for len(s.out) == 0 {
+		if s.err != nil {
+			return 0, s.err
+		}
+		if s.done {
+			return 0, io.EOF
+		}
+		s.err = s.next()
+	}
+
+	n := copy(p, s.out)
+	s.out = s.out[n:]
+	return n, nil
+}
+
+func (s *streamReader) next() error {
+	if s.c == nil {
+		header := make([]byte, streamHeaderLen)
+		if _, err := io.ReadFull(s.r, header); err != nil {
+			return errors.New("invalid stream header")
+		}
+		c, err := newStreamCipher(s.key, header)
+		if err != nil {
+			return err
+		}
+		s.c = c
+		// one more byte to find out whether the chunk is the last one
+		s.buf = make([]byte, c.chunkSize+symTagLen+1)
+		s.pt = make([]byte, 0, c.chunkSize)
+	}
+
+	l, err := io.ReadFull(s.r, s.buf[s.n:])
+	s.n += l
+	final := false
+	switch err {
+	case nil:
+	case io.EOF, io.ErrUnexpectedEOF:
+		final = true
+	default:
+		return err
+	}
+
+	chunkLen := s.n
+	if !final {
+		chunkLen--
+	}
+	if chunkLen < symTagLen {
+		return errors.New("invalid stream length")
+	}
+
+	s.out, err = s.c.open(s.pt[:0], s.buf[:chunkLen], s.index, final)
+	if err != nil {
+		return err
+	}
+
+	s.index++
+	s.n = copy(s.buf, s.buf[chunkLen:s.n])
+	s.done = final
+	return nil
+}
+
+// StreamReaderAt gives random access to the plaintext of the stream written by NewStreamWriter.
+// Only chunks covering the requested range are read and decrypted
+type StreamReaderAt struct {
+	r      io.ReaderAt
+	c      *streamCipher
+	chunks uint64
+	ctSize int64
+	size   int64
+}
+
+// NewStreamReaderAt reads the header of the stream which is size bytes long
+func NewStreamReaderAt(r io.ReaderAt, size int64, key []byte) (*StreamReaderAt, error) {
+	header := make([]byte, streamHeaderLen)
+	if size < streamHeaderLen {
+		return nil, errors.New("invalid stream header")
+	}
+	if err := readFullAt(r, header, 0); err != nil {
+		return nil, errors.Wrap(err, "invalid stream header")
+	}
+
+	c, err := newStreamCipher(key, header)
+	if err != nil {
+		return nil, err
+	}
+
+	body := uint64(size - streamHeaderLen)
+	ctChunk := uint64(c.chunkSize + symTagLen)
+	chunks := (body + ctChunk - 1) / ctChunk
+	if chunks == 0 || body-(chunks-1)*ctChunk < symTagLen {
+		return nil, errors.New("invalid stream length")
+	}
+
+	return &StreamReaderAt{
+		r:      r,
+		c:      c,
+		chunks: chunks,
+		ctSize: size,
+		size:   int64(body - chunks*symTagLen),
+	}, nil
+}
+
+// Size returns the length of the plaintext
+func (s *StreamReaderAt) Size() int64 {
+	return s.size
+}
+
+// ChunkSize returns the size of plaintext chunks
+func (s *StreamReaderAt) ChunkSize() int {
+	return s.c.chunkSize
+}
+
+// Chunks returns the number of chunks in the stream
+func (s *StreamReaderAt) Chunks() int {
+	return int(s.chunks)
+}
+
+// DecryptChunks decrypts count chunks starting with the chunk first
+func (s *StreamReaderAt) DecryptChunks(first, count int) ([]byte, error) {
+	if first < 0 || count < 0 || uint64(first)+uint64(count) > s.chunks {
+		return nil, errors.New("chunk range is out of bounds")
+	}
+
+	if count == 0 {
+		return []byte{}, nil
+	}
+
+	ctChunk := int64(s.c.chunkSize + symTagLen)
+	start := streamHeaderLen + int64(first)*ctChunk
+	end := streamHeaderLen + int64(first+count)*ctChunk
+	if end > s.ctSize {
+		end = s.ctSize
+	}
+
+	ct := make([]byte, end-start)
+	if err := readFullAt(s.r, ct, start); err != nil {
+		return nil, err
+	}
+
+	pt := make([]byte, 0, len(ct))
+	for i := 0; i < count; i++ {
+		l := int(ctChunk)
+		if l > len(ct) {
+			l = len(ct)
+		}
+		index := uint64(first + i)
+		var err error
+		pt, err = s.c.open(pt, ct[:l], index, index == s.chunks-1)
+		if err != nil {
+			return nil, err
+		}
+		ct = ct[l:]
+	}
+	return pt, nil
+}
+
+// readFullAt reads exactly len(p) bytes at off. io.ReaderAt may return io.EOF along with the last bytes,
+// and a short read is io.ErrUnexpectedEOF even if the reader doesn't report an error
+func readFullAt(r io.ReaderAt, p []byte, off int64) error {
+	n, err := r.ReadAt(p, off)
+	if n == len(p) {
+		return nil
+	}
+	if err == nil || err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// ReadAt implements io.ReaderAt for the plaintext
+func (s *StreamReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	if off >= s.size {
+		return 0, io.EOF
+	}
+
+	end := off + int64(len(p))
+	if end > s.size {
+		end = s.size
+	}
+
+	cs := int64(s.c.chunkSize)
+	first := off / cs
+	last := (end + cs - 1) / cs
+	if last == first {
+		last++
+	}
+
+	pt, err := s.DecryptChunks(int(first), int(last-first))
+	if err != nil {
+		return 0, err
+	}
+
+	n := copy(p, pt[off-first*cs:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
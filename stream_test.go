@@ -0,0 +1,262 @@
+/*
+ * Copyright (C) 2015-2019 Virgil Security Inc.
+ *
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ *     (1) Redistributions of source code must retain the above copyright
+ *     notice, this list of conditions and the following disclaimer.
+ *
+ *     (2) Redistributions in binary form must reproduce the above copyright
+ *     notice, this list of conditions and the following disclaimer in
+ *     the documentation and/or other materials provided with the
+ *     distribution.
+ *
+ *     (3) Neither the name of the copyright holder nor the names of its
+ *     contributors may be used to endorse or promote products derived from
+ *     this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ''AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+ * IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ *
+ * Lead Maintainer: Virgil Security Inc. <support@virgilsecurity.com>
+ */
+package phe
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func sealStream(t *testing.T, data, key []byte, chunkSize int) []byte {
+	var buf bytes.Buffer
+	w, err := NewStreamWriter(&buf, key, chunkSize)
+	require.NoError(t, err)
+
+	// write in odd pieces to cross chunk boundaries
+	for p := data; len(p) > 0; {
+		l := 7
+		if l > len(p) {
+			l = len(p)
+		}
+		n, err := w.Write(p[:l])
+		require.NoError(t, err)
+		require.Equal(t, l, n)
+		p = p[l:]
+	}
+	require.NoError(t, w.Close())
+	return buf.Bytes()
+}
+
+func TestStream(t *testing.T) {
+	key := make([]byte, symKeyLen)
+	require.NoError(t, randRead(rand.Reader, key))
+
+	const chunkSize = 32
+	for _, size := range []int{0, 1, chunkSize - 1, chunkSize, chunkSize + 1, 3 * chunkSize, 3*chunkSize + 5} {
+		data := make([]byte, size)
+		require.NoError(t, randRead(rand.Reader, data))
+
+		ct := sealStream(t, data, key, chunkSize)
+		chunks := (size + chunkSize - 1) / chunkSize
+		if chunks == 0 {
+			chunks = 1
+		}
+		require.Len(t, ct, streamHeaderLen+size+chunks*symTagLen)
+
+		pt, err := ioutil.ReadAll(NewStreamReader(bytes.NewReader(ct), key))
+		require.NoError(t, err)
+		require.Equal(t, data, pt)
+
+		ra, err := NewStreamReaderAt(bytes.NewReader(ct), int64(len(ct)), key)
+		require.NoError(t, err)
+		require.Equal(t, int64(size), ra.Size())
+		require.Equal(t, chunks, ra.Chunks())
+		require.Equal(t, chunkSize, ra.ChunkSize())
+
+		pt, err = ioutil.ReadAll(io.NewSectionReader(ra, 0, ra.Size()))
+		require.NoError(t, err)
+		require.Equal(t, data, pt)
+
+		for off := 0; off < size; off += 5 {
+			for _, l := range []int{1, 10, chunkSize, 2*chunkSize + 3} {
+				p := make([]byte, l)
+				n, err := ra.ReadAt(p, int64(off))
+				end := off + l
+				if end > size {
+					end = size
+					require.Equal(t, io.EOF, err)
+				} else {
+					require.NoError(t, err)
+				}
+				require.Equal(t, data[off:end], p[:n])
+			}
+		}
+	}
+}
+
+func TestStream_DefaultChunkSize(t *testing.T) {
+	key := make([]byte, symKeyLen)
+	require.NoError(t, randRead(rand.Reader, key))
+
+	data := make([]byte, 2*DefaultStreamChunkSize+100)
+	require.NoError(t, randRead(rand.Reader, data))
+
+	var buf bytes.Buffer
+	w, err := NewStreamWriter(&buf, key, 0)
+	require.NoError(t, err)
+	_, err = w.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+
+	_, err = w.Write(data)
+	require.Error(t, err)
+
+	ct := buf.Bytes()
+	ra, err := NewStreamReaderAt(bytes.NewReader(ct), int64(len(ct)), key)
+	require.NoError(t, err)
+	require.Equal(t, 3, ra.Chunks())
+
+	pt, err := ra.DecryptChunks(1, 2)
+	require.NoError(t, err)
+	require.Equal(t, data[DefaultStreamChunkSize:], pt)
+
+	_, err = ra.DecryptChunks(2, 2)
+	require.Error(t, err)
+}
+
+func TestStream_Tampering(t *testing.T) {
+	key := make([]byte, symKeyLen)
+	require.NoError(t, randRead(rand.Reader, key))
+
+	const chunkSize = 16
+	const ctChunk = chunkSize + symTagLen
+	data := make([]byte, 4*chunkSize+3)
+	require.NoError(t, randRead(rand.Reader, data))
+	ct := sealStream(t, data, key, chunkSize)
+	body := ct[streamHeaderLen:]
+
+	chunk := func(i int) []byte {
+		end := (i + 1) * ctChunk
+		if end > len(body) {
+			end = len(body)
+		}
+		return body[i*ctChunk : end]
+	}
+	join := func(parts ...[]byte) []byte {
+		return bytes.Join(append([][]byte{ct[:streamHeaderLen]}, parts...), nil)
+	}
+
+	flipped := append([]byte{}, ct...)
+	flipped[streamHeaderLen+ctChunk+1] ^= 1
+
+	otherKey := make([]byte, symKeyLen)
+	require.NoError(t, randRead(rand.Reader, otherKey))
+
+	otherHeader := append([]byte{}, ct...)
+	otherHeader[streamHeaderLen-1] ^= 1
+
+	cases := map[string][]byte{
+		"truncated at chunk boundary": join(chunk(0), chunk(1)),
+		"truncated inside chunk":      ct[:len(ct)-1],
+		"last chunk removed":          join(chunk(0), chunk(1), chunk(2), chunk(3)),
+		"reordered":                   join(chunk(1), chunk(0), chunk(2), chunk(3), chunk(4)),
+		"extended":                    join(chunk(0), chunk(1), chunk(2), chunk(3), chunk(4), chunk(4)),
+		"flipped":                     flipped,
+		"header":                      otherHeader,
+		"header only":                 ct[:streamHeaderLen],
+	}
+
+	for name, ct := range cases {
+		_, err := ioutil.ReadAll(NewStreamReader(bytes.NewReader(ct), key))
+		require.Error(t, err, name)
+
+		ra, err := NewStreamReaderAt(bytes.NewReader(ct), int64(len(ct)), key)
+		if err == nil {
+			_, err = ra.DecryptChunks(0, ra.Chunks())
+		}
+		require.Error(t, err, name)
+	}
+
+	_, err := ioutil.ReadAll(NewStreamReader(bytes.NewReader(ct), otherKey))
+	require.Error(t, err)
+
+	// untouched chunks of a tampered stream can still be read
+	ra, err := NewStreamReaderAt(bytes.NewReader(flipped), int64(len(flipped)), key)
+	require.NoError(t, err)
+	pt, err := ra.DecryptChunks(2, 3)
+	require.NoError(t, err)
+	require.Equal(t, data[2*chunkSize:], pt)
+	_, err = ra.DecryptChunks(1, 1)
+	require.Error(t, err)
+}
+
+// shortReaderAt drops the last byte of every read past the header without reporting an error
+type shortReaderAt struct {
+	r io.ReaderAt
+}
+
+func (s shortReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off < streamHeaderLen || len(p) == 0 {
+		return s.r.ReadAt(p, off)
+	}
+	n, err := s.r.ReadAt(p[:len(p)-1], off)
+	if err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
+
+func TestStream_ShortReadAt(t *testing.T) {
+	key := make([]byte, symKeyLen)
+	require.NoError(t, randRead(rand.Reader, key))
+	data := make([]byte, 100)
+	ct := sealStream(t, data, key, 32)
+
+	ra, err := NewStreamReaderAt(shortReaderAt{bytes.NewReader(ct)}, int64(len(ct)), key)
+	require.NoError(t, err)
+	pt, err := ra.DecryptChunks(0, 2)
+	require.Equal(t, io.ErrUnexpectedEOF, err)
+	require.Nil(t, pt)
+
+	// a stream which is shorter than its declared size
+	ra, err = NewStreamReaderAt(bytes.NewReader(ct[:len(ct)-1]), int64(len(ct)), key)
+	require.NoError(t, err)
+	_, err = ra.DecryptChunks(0, ra.Chunks())
+	require.Equal(t, io.ErrUnexpectedEOF, err)
+}
+
+func TestStream_Errors(t *testing.T) {
+	key := make([]byte, symKeyLen)
+	require.NoError(t, randRead(rand.Reader, key))
+
+	_, err := NewStreamWriter(ioutil.Discard, key[1:], 0)
+	require.Error(t, err)
+	_, err = NewStreamWriter(ioutil.Discard, key, -1)
+	require.Error(t, err)
+	_, err = NewStreamWriter(ioutil.Discard, key, MaxStreamChunkSize+1)
+	require.Error(t, err)
+
+	_, err = ioutil.ReadAll(NewStreamReader(bytes.NewReader(nil), key))
+	require.EqualError(t, err, "invalid stream header")
+
+	_, err = NewStreamReaderAt(bytes.NewReader(nil), 0, key)
+	require.EqualError(t, err, "invalid stream header")
+}
@@ -0,0 +1,90 @@
+/*
+ * Copyright (C) 2015-2019 Virgil Security Inc.
+ *
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ *     (1) Redistributions of source code must retain the above copyright
+ *     notice, this list of conditions and the following disclaimer.
+ *
+ *     (2) Redistributions in binary form must reproduce the above copyright
+ *     notice, this list of conditions and the following disclaimer in
+ *     the documentation and/or other materials provided with the
+ *     distribution.
+ *
+ *     (3) Neither the name of the copyright holder nor the names of its
+ *     contributors may be used to endorse or promote products derived from
+ *     this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ''AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+ * IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ *
+ * Lead Maintainer: Virgil Security Inc. <support@virgilsecurity.com>
+ */
+
+package phe
+
+import (
+	"crypto/sha512"
+	"io"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/hkdf"
+)
+
+// MaxSubKeyLen is the maximum length of a subkey, the limit of HKDF-SHA512
+const MaxSubKeyLen = 255 * sha512.Size
+
+// KeyDeriver derives independent subkeys, for example for encryption, MAC, a search index or a signing seed,
+// from a 32 byte key. Each subkey is HKDF-SHA512 output whose info encodes the name and the length of the subkey,
+// so subkeys of different names or lengths are unrelated. KeyDeriver is safe for concurrent use
+type KeyDeriver struct {
+	key []byte
+}
+
+// NewKeyDeriver creates a deriver from the key returned by EnrollAccount or CheckResponseAndDecrypt.
+// That key changes whenever the account is enrolled again, so subkeys which must outlive password changes
+// should rather be derived from a data key created by GenerateDataKey
+func NewKeyDeriver(key []byte) (*KeyDeriver, error) {
+	if len(key) != symKeyLen {
+		return nil, errors.New("key must be exactly 32 bytes")
+	}
+
+	return &KeyDeriver{
+		key: append([]byte{}, key...),
+	}, nil
+}
+
+// Derive returns the subkey of the given name and length. The name must not be empty
+func (d *KeyDeriver) Derive(name string, length int) ([]byte, error) {
+	if len(name) == 0 || len(name) > 0xffff {
+		return nil, errors.New("invalid subkey name")
+	}
+
+	if length <= 0 || length > MaxSubKeyLen {
+		return nil, errors.New("invalid subkey length")
+	}
+
+	info := make([]byte, 0, 2+len(name)+2)
+	info = append(info, byte(len(name)>>8), byte(len(name)))
+	info = append(info, name...)
+	info = append(info, byte(length>>8), byte(length))
+
+	subKey := make([]byte, length)
+	if _, err := io.ReadFull(hkdf.New(sha512.New, d.key, deriveSubKey, info), subKey); err != nil {
+		return nil, err
+	}
+	return subKey, nil
+}
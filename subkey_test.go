@@ -0,0 +1,90 @@
+/*
+ * Copyright (C) 2015-2019 Virgil Security Inc.
+ *
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ *     (1) Redistributions of source code must retain the above copyright
+ *     notice, this list of conditions and the following disclaimer.
+ *
+ *     (2) Redistributions in binary form must reproduce the above copyright
+ *     notice, this list of conditions and the following disclaimer in
+ *     the documentation and/or other materials provided with the
+ *     distribution.
+ *
+ *     (3) Neither the name of the copyright holder nor the names of its
+ *     contributors may be used to endorse or promote products derived from
+ *     this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ''AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+ * IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ *
+ * Lead Maintainer: Virgil Security Inc. <support@virgilsecurity.com>
+ */
+
+package phe
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeyDeriver(t *testing.T) {
+	key := bytes.Repeat([]byte{0x2a}, 32)
+	d, err := NewKeyDeriver(key)
+	require.NoError(t, err)
+
+	enc, err := d.Derive("encryption", 32)
+	require.NoError(t, err)
+	require.Equal(t, "57e165805b81ff781c2eb65f4e14220c130f8452390ac6c741f00b4fcf6cfe21", hex.EncodeToString(enc))
+
+	// the deriver keeps its own copy of the key
+	key[0] ^= 1
+	again, err := d.Derive("encryption", 32)
+	require.NoError(t, err)
+	require.Equal(t, enc, again)
+
+	mac, err := d.Derive("mac", 32)
+	require.NoError(t, err)
+	require.NotEqual(t, enc, mac)
+
+	// a longer subkey of the same name doesn't extend the shorter one
+	long, err := d.Derive("encryption", 64)
+	require.NoError(t, err)
+	require.Len(t, long, 64)
+	require.NotEqual(t, enc, long[:32])
+
+	other, err := NewKeyDeriver(key)
+	require.NoError(t, err)
+	otherEnc, err := other.Derive("encryption", 32)
+	require.NoError(t, err)
+	require.NotEqual(t, enc, otherEnc)
+
+	max, err := d.Derive("signing seed", MaxSubKeyLen)
+	require.NoError(t, err)
+	require.Len(t, max, MaxSubKeyLen)
+
+	_, err = d.Derive("", 32)
+	require.EqualError(t, err, "invalid subkey name")
+	_, err = d.Derive("mac", 0)
+	require.EqualError(t, err, "invalid subkey length")
+	_, err = d.Derive("mac", MaxSubKeyLen+1)
+	require.EqualError(t, err, "invalid subkey length")
+	_, err = NewKeyDeriver(key[1:])
+	require.EqualError(t, err, "key must be exactly 32 bytes")
+}
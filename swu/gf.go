@@ -38,89 +38,158 @@ package swu
 
 import (
 	"math/big"
+
+	"github.com/VirgilSecurity/virgil-phe-go/field"
 )
 
-// GF represents galois field over prime
+// GF represents galois field over prime. The arithmetic runs in constant time on fixed-width limbs,
+// math/big is only used to pass the numbers in and out
 type GF struct {
 	P *big.Int
+	f *field.Field
 }
 
 var (
 	one   = big.NewInt(1)
-	two   = big.NewInt(2)
 	three = big.NewInt(3)
 	four  = big.NewInt(4)
 )
 
+// NewGF creates a field modulo an odd prime p
+func NewGF(p *big.Int) *GF {
+	return &GF{P: p, f: field.MustNew(p)}
+}
+
+func (g *GF) field() *field.Field {
+	if g.f == nil {
+		return field.MustNew(g.P)
+	}
+	return g.f
+}
+
+// in converts a number to a field element. Numbers which don't fit the limbs and negative numbers
+// are reduced on the limbs as well, so the running time depends only on the length and the sign of a
+func (g *GF) in(f *field.Field, a *big.Int) *field.Element {
+	abs := new(big.Int).Abs(a)
+	buf := make([]byte, (g.P.BitLen()+63)/64*8)
+	if abs.BitLen() > len(buf)*8 {
+		buf = abs.Bytes()
+	} else {
+		abs.FillBytes(buf)
+	}
+
+	z := g.inBytes(f, buf)
+	if a.Sign() < 0 {
+		f.Neg(z, z)
+	}
+	return z
+}
+
+func (g *GF) inBytes(f *field.Field, a []byte) *field.Element {
+	z := new(field.Element)
+	// SetWideBytes accepts numbers of any length
+	_, _ = f.SetWideBytes(z, a)
+	return z
+}
+
+func (g *GF) out(f *field.Field, z *field.Element) *big.Int {
+	return new(big.Int).SetBytes(f.Bytes(z))
+}
+
 //Neg negates number over GFp
 func (g *GF) Neg(a *big.Int) *big.Int {
-	return new(big.Int).Sub(g.P, a)
+	f := g.field()
+	x := g.in(f, a)
+	return g.out(f, f.Neg(x, x))
 }
 
 //NegBytes negates number over GFp represented by a byte array
 func (g *GF) NegBytes(a []byte) *big.Int {
-	return new(big.Int).Sub(g.P, new(big.Int).SetBytes(a))
+	f := g.field()
+	x := g.inBytes(f, a)
+	return g.out(f, f.Neg(x, x))
 }
 
 //Square does a^2 over GFp
 func (g *GF) Square(a *big.Int) *big.Int {
-	return new(big.Int).Exp(a, two, g.P)
+	f := g.field()
+	x := g.in(f, a)
+	return g.out(f, f.Square(x, x))
 }
 
 //Cube does a^3 over GFp
 func (g *GF) Cube(a *big.Int) *big.Int {
-	return new(big.Int).Exp(a, three, g.P)
+	f := g.field()
+	x := g.in(f, a)
+	var z field.Element
+	f.Square(&z, x)
+	return g.out(f, f.Mul(&z, &z, x))
 }
 
-//Pow does a^b over GFp
+//Pow does a^b over GFp. The running time depends on the length of b but not on its value
 func (g *GF) Pow(a, b *big.Int) *big.Int {
-	return new(big.Int).Exp(a, b, g.P)
+	f := g.field()
+	x := g.in(f, a)
+	e := b.Bytes()
+	if len(e) < f.ByteLen() {
+		e = b.FillBytes(make([]byte, f.ByteLen()))
+	}
+	return g.out(f, f.Exp(x, x, e))
 }
 
-//Inv does modulo inverse over GFp
+//Inv does modulo inverse over GFp, the inverse of zero is zero
 func (g *GF) Inv(a *big.Int) *big.Int {
-	return new(big.Int).ModInverse(a, g.P)
+	f := g.field()
+	x := g.in(f, a)
+	return g.out(f, f.Inv(x, x))
 }
 
 //InvBytes does modulo inverse over GFp represented by a byte array
 func (g *GF) InvBytes(a []byte) *big.Int {
-	return new(big.Int).ModInverse(new(big.Int).SetBytes(a), g.P)
+	f := g.field()
+	x := g.inBytes(f, a)
+	return g.out(f, f.Inv(x, x))
 }
 
 //Add adds two numbers over GFp
 func (g *GF) Add(a, b *big.Int) *big.Int {
-	add := new(big.Int).Add(a, b)
-	return add.Mod(add, g.P)
+	f := g.field()
+	x := g.in(f, a)
+	return g.out(f, f.Add(x, x, g.in(f, b)))
 }
 
 //AddBytes adds two numbers one of which is represented as byte array over GFp
 func (g *GF) AddBytes(a []byte, b *big.Int) *big.Int {
-	add := new(big.Int).Add(new(big.Int).SetBytes(a), b)
-	return add.Mod(add, g.P)
+	f := g.field()
+	x := g.inBytes(f, a)
+	return g.out(f, f.Add(x, x, g.in(f, b)))
 }
 
 //Sub subtracts two numbers over GFp
 func (g *GF) Sub(a, b *big.Int) *big.Int {
-
-	negB := new(big.Int).Sub(a, b)
-	return negB.Mod(negB, g.P)
+	f := g.field()
+	x := g.in(f, a)
+	return g.out(f, f.Sub(x, x, g.in(f, b)))
 }
 
 //Mul multiplies two numbers over GFp
 func (g *GF) Mul(a, b *big.Int) *big.Int {
-	mul := new(big.Int).Mul(a, b)
-	return mul.Mod(mul, g.P)
+	f := g.field()
+	x := g.in(f, a)
+	return g.out(f, f.Mul(x, x, g.in(f, b)))
 }
 
 //MulBytes multiplies two numbers one of which is represented as a byte array over GFp
 func (g *GF) MulBytes(a []byte, b *big.Int) *big.Int {
-	mul := new(big.Int).Mul(new(big.Int).SetBytes(a), b)
-	return mul.Mod(mul, g.P)
+	f := g.field()
+	x := g.inBytes(f, a)
+	return g.out(f, f.Mul(x, x, g.in(f, b)))
 }
 
 // Div multiplies a number by an inverse of another number over GFp
 func (g *GF) Div(a, b *big.Int) *big.Int {
-	invB := g.Inv(b)
-	t := g.Mul(a, invB)
-	return t
+	f := g.field()
+	x := g.in(f, b)
+	f.Inv(x, x)
+	return g.out(f, f.Mul(x, x, g.in(f, a)))
 }
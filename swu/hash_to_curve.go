@@ -0,0 +1,225 @@
+/*
+ * Copyright (C) 2015-2019 Virgil Security Inc.
+ *
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ *     (1) Redistributions of source code must retain the above copyright
+ *     notice, this list of conditions and the following disclaimer.
+ *
+ *     (2) Redistributions in binary form must reproduce the above copyright
+ *     notice, this list of conditions and the following disclaimer in
+ *     the documentation and/or other materials provided with the
+ *     distribution.
+ *
+ *     (3) Neither the name of the copyright holder nor the names of its
+ *     contributors may be used to endorse or promote products derived from
+ *     this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ''AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+ * IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ *
+ * Lead Maintainer: Virgil Security Inc. <support@virgilsecurity.com>
+ */
+
+package swu
+
+/*
+ Implementation of hash_to_curve from RFC 9380 for the P256_XMD:SHA-256_SSWU_RO_ and P384_XMD:SHA-384_SSWU_RO_ suites
+*/
+
+import (
+	"crypto/elliptic"
+	"crypto/sha256"
+	"crypto/sha512"
+	"errors"
+	"hash"
+	"math/big"
+
+	"github.com/VirgilSecurity/virgil-phe-go/field"
+)
+
+// HashToCurve is a random oracle hash_to_curve suite of RFC 9380 for a NIST curve.
+// Both NIST curves have cofactor 1, so no cofactor clearing is needed. The mapping runs in constant time
+type HashToCurve struct {
+	// ID is the suite identifier, such as P256_XMD:SHA-256_SSWU_RO_
+	ID string
+
+	curve   elliptic.Curve
+	f       *field.Field
+	hash    func() hash.Hash
+	l       int // length of the string mapped to one field element
+	a, b, z field.Element
+	one     field.Element
+	c1      []byte        // (p - 3) / 4
+	c2      field.Element // sqrt(-Z)
+}
+
+var (
+	// P256RO is the P256_XMD:SHA-256_SSWU_RO_ suite
+	P256RO = mustNewHashToCurve("P256_XMD:SHA-256_SSWU_RO_", elliptic.P256(), sha256.New, 48, -10)
+	// P384RO is the P384_XMD:SHA-384_SSWU_RO_ suite
+	P384RO = mustNewHashToCurve("P384_XMD:SHA-384_SSWU_RO_", elliptic.P384(), sha512.New384, 72, -12)
+)
+
+func mustNewHashToCurve(id string, curve elliptic.Curve, h func() hash.Hash, l int, z int64) *HashToCurve {
+	params := curve.Params()
+	p := params.P
+	f := field.MustNew(p)
+
+	s := &HashToCurve{
+		ID:    id,
+		curve: curve,
+		f:     f,
+		hash:  h,
+		l:     l,
+		c1:    new(big.Int).Div(new(big.Int).Sub(p, three), four).Bytes(),
+	}
+
+	set := func(z *field.Element, v *big.Int) {
+		f.SetBytes(z, new(big.Int).Mod(v, p).Bytes())
+	}
+
+	set(&s.a, big.NewInt(-3))
+	set(&s.b, params.B)
+	set(&s.z, big.NewInt(z))
+	set(&s.c2, new(big.Int).ModSqrt(new(big.Int).Mod(big.NewInt(-z), p), p))
+	f.SetOne(&s.one)
+	return s
+}
+
+// Hash maps a message to a point, dst is the domain separation tag of the application
+func (s *HashToCurve) Hash(msg, dst []byte) (x, y *big.Int, err error) {
+	u, err := s.hashToField(msg, dst, 2)
+	if err != nil {
+		return
+	}
+
+	x0, y0 := s.mapToCurve(&u[0])
+	x1, y1 := s.mapToCurve(&u[1])
+	x, y = s.curve.Add(x0, y0, x1, y1)
+	return
+}
+
+// hashToField maps a message to count field elements
+func (s *HashToCurve) hashToField(msg, dst []byte, count int) ([]field.Element, error) {
+	uniform, err := ExpandMessageXMD(s.hash, msg, dst, count*s.l)
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]field.Element, count)
+	for i := range res {
+		if _, err = s.f.SetWideBytes(&res[i], uniform[i*s.l:(i+1)*s.l]); err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+// mapToCurve is the straight-line simplified SWU mapping of RFC 9380, appendix F.2
+func (s *HashToCurve) mapToCurve(u *field.Element) (x, y *big.Int) {
+	f := s.f
+	var tv1, tv2, tv3, tv4, tv5, tv6, xe, ye, y1, negTv2 field.Element
+
+	f.Square(&tv1, u)
+	f.Mul(&tv1, &s.z, &tv1)
+	f.Square(&tv2, &tv1)
+	f.Add(&tv2, &tv2, &tv1)
+	f.Add(&tv3, &tv2, &s.one)
+	f.Mul(&tv3, &s.b, &tv3)
+	f.Neg(&negTv2, &tv2)
+	f.Select(&tv4, &s.z, &negTv2, f.IsZero(&tv2))
+	f.Mul(&tv4, &s.a, &tv4)
+	f.Square(&tv2, &tv3)
+	f.Square(&tv6, &tv4)
+	f.Mul(&tv5, &s.a, &tv6)
+	f.Add(&tv2, &tv2, &tv5)
+	f.Mul(&tv2, &tv2, &tv3)
+	f.Mul(&tv6, &tv6, &tv4)
+	f.Mul(&tv5, &s.b, &tv6)
+	f.Add(&tv2, &tv2, &tv5)
+	f.Mul(&xe, &tv1, &tv3)
+	isSquare := s.sqrtRatio(&y1, &tv2, &tv6)
+	f.Mul(&ye, &tv1, u)
+	f.Mul(&ye, &ye, &y1)
+	f.Select(&xe, &tv3, &xe, isSquare)
+	f.Select(&ye, &y1, &ye, isSquare)
+
+	var negY field.Element
+	f.Neg(&negY, &ye)
+	f.Select(&ye, &ye, &negY, 1^(f.Sgn0(u)^f.Sgn0(&ye)))
+
+	f.Inv(&tv4, &tv4)
+	f.Mul(&xe, &xe, &tv4)
+
+	return new(big.Int).SetBytes(f.Bytes(&xe)), new(big.Int).SetBytes(f.Bytes(&ye))
+}
+
+// sqrtRatio sets y = sqrt(u / v) and returns 1 if u / v is a square, otherwise it sets y = sqrt(Z * u / v) and returns 0.
+// It's the optimized version for p = 3 mod 4 of RFC 9380, appendix F.2.1.2
+func (s *HashToCurve) sqrtRatio(y, u, v *field.Element) int {
+	f := s.f
+	var tv1, tv2, tv3, y1, y2 field.Element
+
+	f.Square(&tv1, v)
+	f.Mul(&tv2, u, v)
+	f.Mul(&tv1, &tv1, &tv2)
+	f.Exp(&y1, &tv1, s.c1)
+	f.Mul(&y1, &y1, &tv2)
+	f.Mul(&y2, &y1, &s.c2)
+	f.Square(&tv3, &y1)
+	f.Mul(&tv3, &tv3, v)
+	isQR := f.Equal(&tv3, u)
+	f.Select(y, &y1, &y2, isQR)
+	return isQR
+}
+
+// ExpandMessageXMD is expand_message_xmd of RFC 9380 which produces n uniformly random bytes from a message
+func ExpandMessageXMD(h func() hash.Hash, msg, dst []byte, n int) ([]byte, error) {
+	hh := h()
+	bLen, sLen := hh.Size(), hh.BlockSize()
+
+	ell := (n + bLen - 1) / bLen
+	if ell > 255 || n > 65535 || len(dst) > 255 {
+		return nil, errors.New("invalid expand_message_xmd parameters")
+	}
+
+	dstPrime := append(append([]byte(nil), dst...), byte(len(dst)))
+
+	/* #nosec */
+	hh.Write(make([]byte, sLen))
+	hh.Write(msg)
+	hh.Write([]byte{byte(n >> 8), byte(n), 0})
+	hh.Write(dstPrime)
+	b0 := hh.Sum(nil)
+
+	res := make([]byte, 0, ell*bLen)
+	bi := make([]byte, bLen)
+	for i := 1; i <= ell; i++ {
+		for j := range bi {
+			bi[j] ^= b0[j]
+		}
+
+		hh.Reset()
+		/* #nosec */
+		hh.Write(bi)
+		hh.Write([]byte{byte(i)})
+		hh.Write(dstPrime)
+		bi = hh.Sum(nil)
+		res = append(res, bi...)
+	}
+	return res[:n], nil
+}
@@ -0,0 +1,132 @@
+/*
+ * Copyright (C) 2015-2019 Virgil Security Inc.
+ *
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ *     (1) Redistributions of source code must retain the above copyright
+ *     notice, this list of conditions and the following disclaimer.
+ *
+ *     (2) Redistributions in binary form must reproduce the above copyright
+ *     notice, this list of conditions and the following disclaimer in
+ *     the documentation and/or other materials provided with the
+ *     distribution.
+ *
+ *     (3) Neither the name of the copyright holder nor the names of its
+ *     contributors may be used to endorse or promote products derived from
+ *     this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ''AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+ * IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ *
+ * Lead Maintainer: Virgil Security Inc. <support@virgilsecurity.com>
+ */
+
+package swu
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"math/big"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func hexInt(s string) *big.Int {
+	v, ok := new(big.Int).SetString(s, 16)
+	if !ok {
+		panic("invalid hex")
+	}
+	return v
+}
+
+// test vectors of RFC 9380, appendix K.1
+func TestExpandMessageXMD(t *testing.T) {
+	dst := []byte("QUUX-V01-CS02-with-expander-SHA256-128")
+	vectors := []struct {
+		msg, uniform string
+	}{
+		{"", "68a985b87eb6b46952128911f2a4412bbc302a9d759667f87f7a21d803f07235"},
+		{"abc", "d8ccab23b5985ccea865c6c97b6e5b8350e794e603b4b97902f53a8a0d605615"},
+	}
+
+	for _, v := range vectors {
+		res, err := ExpandMessageXMD(sha256.New, []byte(v.msg), dst, 32)
+		require.NoError(t, err)
+		require.Equal(t, v.uniform, hex.EncodeToString(res))
+	}
+
+	_, err := ExpandMessageXMD(sha256.New, nil, dst, 256*32)
+	require.Error(t, err)
+	_, err = ExpandMessageXMD(sha256.New, nil, make([]byte, 256), 32)
+	require.Error(t, err)
+}
+
+// test vectors of RFC 9380, appendix J.1.1
+func TestHashToCurve_P256(t *testing.T) {
+	dst := []byte("QUUX-V01-CS02-with-P256_XMD:SHA-256_SSWU_RO_")
+	vectors := []struct {
+		msg, x, y string
+	}{
+		{"",
+			"2c15230b26dbc6fc9a37051158c95b79656e17a1a920b11394ca91c44247d3e4",
+			"8a7a74985cc5c776cdfe4b1f19884970453912e9d31528c060be9ab5c43e8415"},
+		{"abc",
+			"0bb8b87485551aa43ed54f009230450b492fead5f1cc91658775dac4a3388a0f",
+			"5c41b3d0731a27a7b14bc0bf0ccded2d8751f83493404c84a88e71ffd424212e"},
+		{"abcdef0123456789",
+			"65038ac8f2b1def042a5df0b33b1f4eca6bff7cb0f9c6c1526811864e544ed80",
+			"cad44d40a656e7aff4002a8de287abc8ae0482b5ae825822bb870d6df9b56ca3"},
+	}
+
+	for _, v := range vectors {
+		x, y, err := P256RO.Hash([]byte(v.msg), dst)
+		require.NoError(t, err)
+		require.Equal(t, hexInt(v.x), x, v.msg)
+		require.Equal(t, hexInt(v.y), y, v.msg)
+	}
+
+	// intermediate values of the empty message
+	u, err := P256RO.hashToField(nil, dst, 2)
+	require.NoError(t, err)
+	require.Equal(t, "ad5342c66a6dd0ff080df1da0ea1c04b96e0330dd89406465eeba11582515009", hex.EncodeToString(P256RO.f.Bytes(&u[0])))
+	require.Equal(t, "8c0f1d43204bd6f6ea70ae8013070a1518b43873bcd850aafa0a9e220e2eea5a", hex.EncodeToString(P256RO.f.Bytes(&u[1])))
+
+	x, y := P256RO.mapToCurve(&u[0])
+	require.Equal(t, hexInt("ab640a12220d3ff283510ff3f4b1953d09fad35795140b1c5d64f313967934d5"), x)
+	require.Equal(t, hexInt("dccb558863804a881d4fff3455716c836cef230e5209594ddd33d85c565b19b1"), y)
+}
+
+// test vectors of RFC 9380, appendix J.2.1
+func TestHashToCurve_P384(t *testing.T) {
+	dst := []byte("QUUX-V01-CS02-with-P384_XMD:SHA-384_SSWU_RO_")
+	x, y, err := P384RO.Hash(nil, dst)
+	require.NoError(t, err)
+	require.Equal(t, hexInt("eb9fe1b4f4e14e7140803c1d99d0a93cd823d2b024040f9c067a8eca1f5a2eeac9ad604973527a356f3fa3aeff0e4d83"), x)
+	require.Equal(t, hexInt("0c21708cff382b7f4643c07b105c2eaec2cead93a917d825601e63c8f21f6abd9abc22c93c2bed6f235954b25048bb1a"), y)
+}
+
+func TestHashToCurve_OnCurve(t *testing.T) {
+	for _, s := range []*HashToCurve{P256RO, P384RO} {
+		msg := make([]byte, 16)
+		for i := 0; i < 200; i++ {
+			msg[0], msg[1] = byte(i), byte(i>>8)
+			x, y, err := s.Hash(msg, []byte("test"))
+			require.NoError(t, err)
+			require.True(t, s.curve.IsOnCurve(x, y))
+		}
+	}
+}
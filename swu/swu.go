@@ -43,81 +43,155 @@ package swu
 import (
 	"crypto/elliptic"
 	"crypto/sha512"
+	"errors"
 	"math/big"
+
+	"github.com/VirgilSecurity/virgil-phe-go/field"
 )
 
+// SWU maps hashes to points of a short Weierstrass curve with a = -3 over a prime field with p = 3 mod 4,
+// such as NIST P-256 and P-384. The mapping runs in constant time
+type SWU struct {
+	curve    elliptic.Curve
+	f        *field.Field
+	a        field.Element // a = -3
+	b        field.Element
+	mba      field.Element
+	one      field.Element
+	p34, p14 []byte
+	hashLen  int
+}
+
 var (
-	p        = elliptic.P256().Params().P
-	a        *big.Int // a = -3
-	b        = elliptic.P256().Params().B
-	mba      *big.Int
-	gf       = &GF{p}
-	p34, p14 *big.Int
+	p256 = MustNew(elliptic.P256())
 	//PointHashLen is the length of a number that represents the point
 	PointHashLen = 32
 )
 
-func init() {
-	a = gf.Neg(three)
-	ba := gf.Div(b, a)
-	mba = gf.Neg(ba)
-	p34 = new(big.Int).Div(a, four) // a ==(p-3)
-	p1 := new(big.Int).Add(p, one)
-	p14 = new(big.Int).Div(p1, four)
+// New creates a mapping to the given curve
+func New(curve elliptic.Curve) (*SWU, error) {
+	params := curve.Params()
+	p := params.P
+
+	if new(big.Int).Mod(p, four).Cmp(three) != 0 {
+		return nil, errors.New("curve prime must be 3 mod 4")
+	}
+
+	f, err := field.New(p)
+	if err != nil {
+		return nil, err
+	}
+
+	gf := NewGF(p)
+	a := gf.Neg(three)
+	s := &SWU{
+		curve:   curve,
+		f:       f,
+		hashLen: (params.BitSize + 7) / 8,
+		// a == (p-3)
+		p34: new(big.Int).Div(a, four).Bytes(),
+		p14: new(big.Int).Div(new(big.Int).Add(p, one), four).Bytes(),
+	}
+
+	f.SetOne(&s.one)
+	if _, err = f.SetBytes(&s.a, a.Bytes()); err != nil {
+		return nil, err
+	}
+	if _, err = f.SetBytes(&s.b, params.B.Bytes()); err != nil {
+		return nil, err
+	}
+	if _, err = f.SetBytes(&s.mba, gf.Neg(gf.Div(params.B, a)).Bytes()); err != nil {
+		return nil, err
+	}
+
+	// a = -3 is assumed by the curve implementations of crypto/elliptic as well, check it on a point
+	probe := make([]byte, s.hashLen)
+	probe[len(probe)-1] = 2
+	x, y, err := s.HashToPoint(probe)
+	if err != nil || !curve.IsOnCurve(x, y) {
+		return nil, errors.New("curve is not supported")
+	}
+	return s, nil
+}
+
+// MustNew is like New but panics if the curve is not supported
+func MustNew(curve elliptic.Curve) *SWU {
+	s, err := New(curve)
+	if err != nil {
+		panic(err)
+	}
+	return s
+}
+
+// HashLen is the length of a hash HashToPoint accepts
+func (s *SWU) HashLen() int {
+	return s.hashLen
 }
 
 //DataToPoint hashes data using SHA-256 and maps it to a point on curve
 func DataToPoint(data []byte) (x, y *big.Int) {
 	hash := sha512.Sum512(data)
-	return HashToPoint(hash[:PointHashLen])
+	// the length is always right
+	x, y, _ = HashToPoint(hash[:PointHashLen])
+	return
+}
+
+//HashToPoint maps 32 byte hash to a point on P-256
+func HashToPoint(hash []byte) (x, y *big.Int, err error) {
+	return p256.HashToPoint(hash)
 }
 
-//HashToPoint maps 32 byte hash to a point on curve
-func HashToPoint(hash []byte) (x, y *big.Int) {
+//HashToPoint maps a hash of HashLen bytes to a point on curve
+func (s *SWU) HashToPoint(hash []byte) (x, y *big.Int, err error) {
 
-	if len(hash) != PointHashLen {
-		panic("invalid hash length")
+	if len(hash) != s.hashLen {
+		return nil, nil, errors.New("invalid hash length")
 	}
 
-	t := new(big.Int).SetBytes(hash)
+	f := s.f
+	var t, alpha, tmp, x2, x3, h2, h3, y2, y3 field.Element
+
+	if _, err = f.SetBytes(&t, hash); err != nil {
+		return nil, nil, err
+	}
 
 	//alpha = -t^2
-	tt := gf.Square(t)
-	alpha := gf.Neg(tt)
-	asq := gf.Square(alpha)
-	asqa := gf.Add(asq, alpha)
-	asqa1 := gf.Add(one, gf.Inv(asqa))
+	f.Neg(&alpha, f.Square(&alpha, &t))
 
 	// x2 = -(b / a) * (1 + 1/(alpha^2+alpha))
-	x2 := gf.Mul(mba, asqa1)
+	f.Add(&tmp, f.Square(&tmp, &alpha), &alpha)
+	f.Add(&tmp, f.Inv(&tmp, &tmp), &s.one)
+	f.Mul(&x2, &s.mba, &tmp)
 
 	//x3 = alpha * x2
-	x3 := gf.Mul(alpha, x2)
-	ax2 := gf.Mul(a, x2)
-	x23 := gf.Cube(x2)
-	x23ax2 := gf.Add(x23, ax2)
+	f.Mul(&x3, &alpha, &x2)
 
 	// h2 = x2^3 + a*x2 + b
-	h2 := gf.Add(x23ax2, b)
-
-	ax3 := gf.Mul(a, x3)
-	x33 := gf.Cube(x3)
-	x33ax3 := gf.Add(x33, ax3)
+	s.rhs(&h2, &x2)
 
 	// h3 = x3^3 + a*x3 + b
-	h3 := gf.Add(x33ax3, b)
+	s.rhs(&h3, &x3)
 
 	// tmp = h2 ^ ((p - 3) // 4)
-	tmp := gf.Pow(h2, p34)
-	tmp2 := gf.Square(tmp)
-	tmp2h2 := gf.Mul(tmp2, h2)
-
-	//if tmp^2 * h2 == 1:
-	if tmp2h2.Cmp(one) == 0 {
-		// return (x2, tmp * h2 )
-		return x2, gf.Mul(tmp, h2)
-	}
+	f.Exp(&tmp, &h2, s.p34)
+	f.Mul(&y2, &tmp, &h2)
+
+	//y3 = h3 ^ ((p+1)//4)
+	f.Exp(&y3, &h3, s.p14)
+
+	//if tmp^2 * h2 == 1 return (x2, tmp * h2) else (x3, y3), both candidates are always computed
+	isSquare := f.Equal(f.Mul(&tmp, &tmp, &y2), &s.one)
+	f.Select(&x2, &x2, &x3, isSquare)
+	f.Select(&y2, &y2, &y3, isSquare)
+
+	return new(big.Int).SetBytes(f.Bytes(&x2)), new(big.Int).SetBytes(f.Bytes(&y2)), nil
+}
 
-	//return (x3, h3 ^ ((p+1)//4))
-	return x3, gf.Pow(h3, p14)
+// rhs sets z = x^3 + a*x + b
+func (s *SWU) rhs(z, x *field.Element) {
+	var ax field.Element
+	s.f.Mul(&ax, &s.a, x)
+	s.f.Mul(z, s.f.Square(z, x), x)
+	s.f.Add(z, z, &ax)
+	s.f.Add(z, z, &s.b)
 }
@@ -38,10 +38,12 @@ package swu
 
 import (
 	"crypto/elliptic"
+	"crypto/rand"
 	"crypto/sha512"
 	"math/big"
 	"testing"
 
+	"github.com/VirgilSecurity/virgil-phe-go/internal/dudect"
 	"github.com/stretchr/testify/require"
 )
 
@@ -64,6 +66,96 @@ func TestSWU(t *testing.T) {
 	}
 }
 
+func TestSWU_P384(t *testing.T) {
+	s, err := New(elliptic.P384())
+	require.NoError(t, err)
+	require.Equal(t, 48, s.HashLen())
+
+	h := sha512.Sum512(buf)
+	for i := 0; i < 1000; i++ {
+		x, y, err := s.HashToPoint(h[:s.HashLen()])
+		require.NoError(t, err)
+		require.True(t, elliptic.P384().IsOnCurve(x, y))
+		h = sha512.Sum512(h[:])
+	}
+
+	_, _, err = s.HashToPoint(buf)
+	require.EqualError(t, err, "invalid hash length")
+}
+
+func TestSWU_Unsupported(t *testing.T) {
+	// P-224 prime is 1 mod 4
+	_, err := New(elliptic.P224())
+	require.Error(t, err)
+}
+
+func TestSWU_ConstantTime(t *testing.T) {
+	if !dudect.Enabled() {
+		t.Skip("timing test, set " + dudect.EnvVar + "=1 to run it")
+	}
+
+	// a fixed hash against random ones, which take both branches of the mapping
+	fixed := make([]byte, PointHashLen)
+	fixed[len(fixed)-1] = 2
+
+	res := dudect.Test(3000, 1, func(class int) func() {
+		hash := append([]byte(nil), fixed...)
+		if class == 1 {
+			_, err := rand.Read(hash)
+			require.NoError(t, err)
+		}
+		return func() { HashToPoint(hash) }
+	})
+	require.True(t, res < dudect.Threshold, "HashToPoint timing depends on the hash, t = %f", res)
+}
+
+func TestGF_ConstantTime(t *testing.T) {
+	if !dudect.Enabled() {
+		t.Skip("timing test, set " + dudect.EnvVar + "=1 to run it")
+	}
+
+	gf := NewGF(c.Params().N)
+	fixed := big.NewInt(1)
+
+	res := dudect.Test(4000, 1, func(class int) func() {
+		x := fixed
+		if class == 1 {
+			var err error
+			x, err = rand.Int(rand.Reader, gf.P)
+			require.NoError(t, err)
+		}
+		return func() { gf.Inv(x) }
+	})
+	require.True(t, res < dudect.Threshold, "Inv timing depends on the value, t = %f", res)
+}
+
+func TestGF(t *testing.T) {
+	for _, p := range []*big.Int{c.Params().N, elliptic.P384().Params().P} {
+		gf := NewGF(p)
+		for i := 0; i < 100; i++ {
+			a, err := rand.Int(rand.Reader, p)
+			require.NoError(t, err)
+			b, err := rand.Int(rand.Reader, p)
+			require.NoError(t, err)
+
+			mod := func(v *big.Int) *big.Int { return v.Mod(v, p) }
+			require.Equal(t, mod(new(big.Int).Add(a, b)), gf.Add(a, b))
+			require.Equal(t, mod(new(big.Int).Sub(a, b)), gf.Sub(a, b))
+			require.Equal(t, mod(new(big.Int).Mul(a, b)), gf.Mul(a, b))
+			require.Equal(t, mod(new(big.Int).Mul(a, b)), gf.MulBytes(a.Bytes(), b))
+			require.Equal(t, new(big.Int).Exp(a, b, p), gf.Pow(a, b))
+			require.Equal(t, new(big.Int).ModInverse(a, p), gf.Inv(a))
+			require.Equal(t, mod(new(big.Int).Mul(a, new(big.Int).ModInverse(b, p))), gf.Div(a, b))
+			require.Equal(t, mod(new(big.Int).Neg(a)), gf.Neg(a))
+		}
+
+		// numbers out of range are reduced
+		require.Equal(t, big.NewInt(1), gf.Add(new(big.Int).Lsh(p, 600), big.NewInt(1)))
+		require.Equal(t, new(big.Int).Sub(p, big.NewInt(1)), gf.Add(big.NewInt(-1), big.NewInt(0)))
+		require.Equal(t, new(big.Int).Sub(p, big.NewInt(5)), gf.Add(new(big.Int).Neg(new(big.Int).Lsh(p, 600)), big.NewInt(-5)))
+	}
+}
+
 func BenchmarkSWU(b *testing.B) {
 	b.ReportAllocs()
 	for i := 0; i < b.N; i++ {
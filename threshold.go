@@ -0,0 +1,623 @@
+/*
+ * Copyright (C) 2015-2019 Virgil Security Inc.
+ *
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ *     (1) Redistributions of source code must retain the above copyright
+ *     notice, this list of conditions and the following disclaimer.
+ *
+ *     (2) Redistributions in binary form must reproduce the above copyright
+ *     notice, this list of conditions and the following disclaimer in
+ *     the documentation and/or other materials provided with the
+ *     distribution.
+ *
+ *     (3) Neither the name of the copyright holder nor the names of its
+ *     contributors may be used to endorse or promote products derived from
+ *     this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ''AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+ * IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ *
+ * Lead Maintainer: Virgil Security Inc. <support@virgilsecurity.com>
+ */
+
+package phe
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/binary"
+	"math/big"
+	"sort"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/pkg/errors"
+)
+
+const (
+	// maxThresholdServers limits the number of rate-limiters sharing one key
+	maxThresholdServers = 255
+	// thresholdNonceLifetime is how long an enrollment nonce issued by a rate-limiter stays valid
+	thresholdNonceLifetime = 5 * time.Minute
+	thresholdCheckLen      = 32
+)
+
+// GenerateThresholdKeypairs splits a new random server key between total rate-limiters so that
+// any threshold of them are needed to enroll and to verify a password, while fewer learn nothing about the key.
+// Keypair i must be given to the rate-limiter with index i + 1. The key itself is never stored anywhere
+func GenerateThresholdKeypairs(threshold, total int, opts ...Option) ([][]byte, error) {
+	if threshold < 1 || total < threshold || total > maxThresholdServers {
+		return nil, errors.New("invalid threshold parameters")
+	}
+
+	o := applyOptions(opts)
+	g, err := getGroup(o.suite)
+	if err != nil {
+		return nil, err
+	}
+
+	protocol, err := checkProtocol(uint32(o.protocol))
+	if err != nil {
+		return nil, err
+	}
+
+	// f(z) = coefs[0] + coefs[1] * z + ... + coefs[threshold - 1] * z ^ (threshold - 1), the key is f(0)
+	coefs := make([][]byte, threshold)
+	for i := range coefs {
+		if coefs[i], err = g.randomScalar(o.rand()); err != nil {
+			return nil, err
+		}
+	}
+
+	privateKeys := make([][]byte, total)
+	pub := &ThresholdPublicKey{
+		Threshold: uint32(threshold),
+		Shares:    make([][]byte, total),
+		Suite:     uint32(g.suite),
+		Protocol:  uint32(protocol),
+	}
+
+	for i := range privateKeys {
+		z := g.padZ(big.NewInt(int64(i + 1)).Bytes())
+		share := coefs[threshold-1]
+		for j := threshold - 2; j >= 0; j-- {
+			share = g.zMulAdd(share, z, coefs[j])
+		}
+
+		privateKeys[i] = share
+		pub.Shares[i] = g.baseBytes(share).Marshal()
+	}
+
+	keypairs := make([][]byte, total)
+	for i := range keypairs {
+		kp, err := proto.Marshal(&ThresholdKeypair{
+			Index:      uint32(i + 1),
+			PrivateKey: privateKeys[i],
+			PublicKey:  pub,
+		})
+		if err != nil {
+			return nil, err
+		}
+		keypairs[i] = kp
+	}
+
+	return keypairs, nil
+}
+
+// GetThresholdPublicKey returns the public part of a threshold keypair which is shared by all rate-limiters and is used by the client
+func GetThresholdPublicKey(thresholdKeypair []byte) ([]byte, error) {
+	kp, err := unmarshalThresholdKeypair(thresholdKeypair)
+	if err != nil {
+		return nil, err
+	}
+
+	return proto.Marshal(kp.PublicKey)
+}
+
+func unmarshalThresholdKeypair(thresholdKeypair []byte) (*ThresholdKeypair, error) {
+	kp := &ThresholdKeypair{}
+	if err := proto.Unmarshal(thresholdKeypair, kp); err != nil {
+		return nil, ErrInvalidKeypair
+	}
+	return kp, nil
+}
+
+// thresholdKey holds the public key shares of all rate-limiters and the logic common to them and the client
+type thresholdKey struct {
+	g           *group
+	protocol    Protocol
+	threshold   uint32
+	shares      []*Point
+	sharesBytes [][]byte
+}
+
+func newThresholdKey(pub *ThresholdPublicKey) (*thresholdKey, error) {
+	g, shares, err := pub.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	protocol, err := checkProtocol(pub.Protocol)
+	if err != nil {
+		return nil, err
+	}
+
+	return &thresholdKey{
+		g:           g,
+		protocol:    protocol,
+		threshold:   pub.Threshold,
+		shares:      shares,
+		sharesBytes: pub.Shares,
+	}, nil
+}
+
+// share returns the public key of the rate-limiter with the given index
+func (k *thresholdKey) share(index uint32) (pub *Point, pubBytes []byte, err error) {
+	if index == 0 || int(index) > len(k.shares) {
+		return nil, nil, errors.New("invalid rate-limiter index")
+	}
+	return k.shares[index-1], k.sharesBytes[index-1], nil
+}
+
+// enrollmentNonce combines the nonces of all rate-limiters taking part in an enrollment into the record's server nonce
+func (k *thresholdKey) enrollmentNonce(nonces []*ThresholdNonce) ([]byte, error) {
+	if len(nonces) < int(k.threshold) || len(nonces) > len(k.shares) {
+		return nil, errors.New("invalid number of enrollment nonces")
+	}
+
+	sorted := append([]*ThresholdNonce(nil), nonces...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].GetIndex() < sorted[j].GetIndex()
+	})
+
+	tuple := make([][]byte, 0, len(sorted)*2)
+	for i, n := range sorted {
+		if _, _, err := k.share(n.GetIndex()); err != nil {
+			return nil, err
+		}
+
+		if len(n.Nonce) != pheNonceLen {
+			return nil, errors.New("invalid enrollment nonce")
+		}
+
+		if i > 0 && sorted[i-1].Index == n.Index {
+			return nil, errors.New("duplicate enrollment nonce")
+		}
+
+		tuple = append(tuple, uint32Bytes(n.Index), n.Nonce)
+	}
+
+	return hash(thresholdNs, tuple...)[:pheNonceLen], nil
+}
+
+// commitmentChallenge is the challenge of the proof attached to a rate-limiter's verification commitment
+func (k *thresholdKey) commitmentChallenge(pubBytes []byte, cm *ThresholdCommitment, ns, c0 []byte) *big.Int {
+	return k.g.hashZ(proofCommitment, pubBytes, k.g.generator, uint32Bytes(cm.Index), cm.Nonce, ns, c0, cm.A, cm.B,
+		cm.Proof.Term1, cm.Proof.Term2, cm.Proof.Term3)
+}
+
+// equalityChallenge is the challenge of the proof that a rate-limiter used its key share to answer
+func (k *thresholdKey) equalityChallenge(pubBytes []byte, index uint32, ns, c0, q, v []byte, proof *ProofOfEquality) *big.Int {
+	return k.g.hashZ(proofEquality, pubBytes, k.g.generator, uint32Bytes(index), ns, c0, q, v, proof.Term1, proof.Term2)
+}
+
+// validateCommitment checks that the commitment was made by the rate-limiter it claims to come from
+func (k *thresholdKey) validateCommitment(cm *ThresholdCommitment, ns, c0Bytes []byte, c0, hs0 *Point) (a, b *Point, err error) {
+	if cm == nil || len(cm.Nonce) != pheNonceLen {
+		return nil, nil, errors.New("invalid commitment")
+	}
+
+	pub, pubBytes, err := k.share(cm.Index)
+	if err != nil {
+		return
+	}
+
+	if a, err = k.g.unmarshalPoint(cm.A); err != nil {
+		return
+	}
+
+	if b, err = k.g.unmarshalPoint(cm.B); err != nil {
+		return
+	}
+
+	term1, term2, term3, blindR, blindX, err := cm.Proof.validate(k.g)
+	if err != nil {
+		return
+	}
+
+	challenge := k.commitmentChallenge(pubBytes, cm, ns, c0Bytes)
+
+	// term1 * (a ** challenge) == c0 ** blind_r
+	// term2 * (b ** challenge) == hs0 ** blind_r
+	// term3 * (X_i ** challenge) == G ** blind_x
+
+	if !term1.Add(a.ScalarMultInt(challenge)).Equal(c0.ScalarMultInt(blindR)) ||
+		!term2.Add(b.ScalarMultInt(challenge)).Equal(hs0.ScalarMultInt(blindR)) ||
+		!term3.Add(pub.ScalarMultInt(challenge)).Equal(k.g.base(blindX)) {
+		return nil, nil, errors.New("invalid commitment proof")
+	}
+
+	return
+}
+
+// sumCommitments validates the commitments of a verification quorum and adds them up
+func (k *thresholdKey) sumCommitments(commitments []*ThresholdCommitment, ns, c0Bytes []byte, c0, hs0 *Point) (a, b *Point, indices []uint32, err error) {
+	if len(commitments) < int(k.threshold) || len(commitments) > len(k.shares) {
+		return nil, nil, nil, errors.New("invalid number of commitments")
+	}
+
+	seen := make(map[uint32]bool, len(commitments))
+	for _, cm := range commitments {
+		ai, bi, err := k.validateCommitment(cm, ns, c0Bytes, c0, hs0)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+
+		if seen[cm.Index] {
+			return nil, nil, nil, errors.New("duplicate commitment")
+		}
+		seen[cm.Index] = true
+		indices = append(indices, cm.Index)
+
+		if a == nil {
+			a, b = ai, bi
+		} else {
+			a, b = a.Add(ai), b.Add(bi)
+		}
+	}
+
+	return
+}
+
+// lagrangeCoefficients returns the coefficients which interpolate the shared key at zero from the shares with the given indices
+func (k *thresholdKey) lagrangeCoefficients(indices []uint32) []*big.Int {
+	gf := k.g.gf
+	res := make([]*big.Int, len(indices))
+	for i, xi := range indices {
+		num, den := big.NewInt(1), big.NewInt(1)
+		for j, xj := range indices {
+			if i == j {
+				continue
+			}
+			num = gf.Mul(num, big.NewInt(int64(xj)))
+			den = gf.Mul(den, gf.Sub(big.NewInt(int64(xj)), big.NewInt(int64(xi))))
+		}
+		res[i] = gf.Div(num, den)
+	}
+	return res
+}
+
+func uint32Bytes(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v)
+	return b
+}
+
+func uint64Bytes(v uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	return b
+}
+
+// ThresholdServer is one of the rate-limiters holding a share of the server key.
+// Enrollment takes two rounds: GetEnrollmentNonce and GetEnrollment,
+// verification takes two rounds as well: CommitVerifyPassword and VerifyPassword.
+// ThresholdServer keeps no state between the rounds and is safe for concurrent use
+type ThresholdServer struct {
+	server *Server
+	index  uint32
+	key    *thresholdKey
+	now    func() time.Time
+}
+
+// NewThresholdServer creates a rate-limiter from one of the keypairs produced by GenerateThresholdKeypairs.
+// WithRandom replaces the source of nonces and proofs. WithRateLimiter limits the attempts CommitVerifyPassword accepts.
+// A rate-limiter doesn't learn whether the password was right, so the limiter is never told about successful attempts
+// and every attempt counts as a failure: the policy should rely on the window rather than on lockout and delays
+// which grow with consecutive failures
+func NewThresholdServer(thresholdKeypair []byte, opts ...Option) (*ThresholdServer, error) {
+	kp, err := unmarshalThresholdKeypair(thresholdKeypair)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := newThresholdKey(kp.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	pub, pubBytes, err := key.share(kp.Index)
+	if err != nil {
+		return nil, err
+	}
+
+	g := key.g
+	if len(kp.PrivateKey) != g.zLen || !g.baseBytes(kp.PrivateKey).Equal(pub) {
+		return nil, ErrInvalidPrivateKey
+	}
+
+	o := applyOptions(opts)
+	return &ThresholdServer{
+		server: &Server{
+			g:               g,
+			protocol:        key.protocol,
+			privateKeyBytes: kp.PrivateKey,
+			publicKey:       pub,
+			publicKeyBytes:  pubBytes,
+			rateLimiter:     o.rateLimiter,
+			random:          o.rand(),
+		},
+		index: kp.Index,
+		key:   key,
+		now:   time.Now,
+	}, nil
+}
+
+// Index returns the rate-limiter's index
+func (s *ThresholdServer) Index() uint32 {
+	return s.index
+}
+
+// GetEnrollmentNonce starts an enrollment by issuing a fresh nonce. The client collects the nonces of
+// at least threshold rate-limiters and sends them all back to each of them with GetEnrollment
+func (s *ThresholdServer) GetEnrollmentNonce() ([]byte, error) {
+	nonce := make([]byte, pheNonceLen)
+	if err := randRead(s.server.random, nonce); err != nil {
+		return nil, err
+	}
+	ts := uint64(s.now().Unix())
+
+	return proto.Marshal(&ThresholdNonce{
+		Index:     s.index,
+		Nonce:     nonce,
+		Timestamp: ts,
+		Tag:       s.nonceTag(nonce, ts),
+	})
+}
+
+// nonceTag authenticates an issued nonce so that the rate-limiter does not need to remember it
+func (s *ThresholdServer) nonceTag(nonce []byte, timestamp uint64) []byte {
+	return hash(thresholdNonce, s.server.privateKeyBytes, uint32Bytes(s.index), nonce, uint64Bytes(timestamp))[:pheNonceLen]
+}
+
+// GetEnrollment answers the enrollment request built by ThresholdClient.CreateEnrollmentRequest.
+// The request must contain a nonce recently issued by this rate-limiter, so that the record's server nonce is fresh
+func (s *ThresholdServer) GetEnrollment(reqBytes []byte) ([]byte, error) {
+	req := &ThresholdEnrollmentRequest{}
+	if err := proto.Unmarshal(reqBytes, req); err != nil {
+		return nil, ErrInvalidRequest
+	}
+
+	ns, err := s.key.enrollmentNonce(req.Nonces)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = s.checkNonce(req.Nonces); err != nil {
+		return nil, err
+	}
+
+	hs0, hs1, c0, c1, err := s.server.eval(ns)
+	if err != nil {
+		return nil, err
+	}
+
+	proof, err := s.server.proveSuccess(hs0, hs1, c0, c1)
+	if err != nil {
+		return nil, err
+	}
+
+	return proto.Marshal(&ThresholdEnrollmentResponse{
+		Index: s.index,
+		Ns:    ns,
+		C0:    c0.Marshal(),
+		C1:    c1.Marshal(),
+		Proof: proof.Success,
+	})
+}
+
+func (s *ThresholdServer) checkNonce(nonces []*ThresholdNonce) error {
+	for _, n := range nonces {
+		if n.Index != s.index {
+			continue
+		}
+
+		if subtle.ConstantTimeCompare(n.Tag, s.nonceTag(n.Nonce, n.Timestamp)) != 1 {
+			return errors.New("invalid enrollment nonce")
+		}
+
+		issued := time.Unix(int64(n.Timestamp), 0)
+		if age := s.now().Sub(issued); age < -thresholdNonceLifetime || age > thresholdNonceLifetime {
+			return errors.New("enrollment nonce expired")
+		}
+		return nil
+	}
+
+	return errors.New("request has no enrollment nonce of this rate-limiter")
+}
+
+// CommitVerifyPassword is the first verification round. It takes a request created by ThresholdClient.CreateVerifyPasswordRequest
+// and returns a commitment to the rate-limiter's randomness. The client collects at least threshold commitments
+// and sends them to each of their rate-limiters with VerifyPassword.
+// Every password guess needs a fresh commitment, so this is where attempts are rate limited. A throttled attempt is returned as *ThrottledError
+func (s *ThresholdServer) CommitVerifyPassword(reqBytes []byte) ([]byte, error) {
+	req := &VerifyPasswordRequest{}
+	if err := proto.Unmarshal(reqBytes, req); err != nil {
+		return nil, ErrInvalidRequest
+	}
+
+	if len(req.Ns) != pheNonceLen {
+		return nil, ErrInvalidRequest
+	}
+
+	if err := s.key.g.checkSuite(req.Suite); err != nil {
+		return nil, err
+	}
+
+	if Protocol(req.Protocol) != s.key.protocol {
+		return nil, ErrProtocolMismatch
+	}
+
+	c0, err := s.key.g.unmarshalPoint(req.C0)
+	if err != nil {
+		return nil, ErrInvalidRequest
+	}
+
+	if s.server.rateLimiter != nil {
+		if err = s.server.rateLimiter.Allow(req.Ns); err != nil {
+			return nil, err
+		}
+	}
+
+	nonce := make([]byte, pheNonceLen)
+	if err = randRead(s.server.random, nonce); err != nil {
+		return nil, err
+	}
+
+	cm, err := s.commit(req.Ns, req.C0, c0, nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	return proto.Marshal(cm)
+}
+
+// commitRandom derives the rate-limiter's randomness from its private key, so that it can be recomputed in the second round
+func (s *ThresholdServer) commitRandom(ns, c0, nonce []byte) []byte {
+	return s.key.g.hashScalar(thresholdCommit, s.server.privateKeyBytes, uint32Bytes(s.index), ns, c0, nonce)
+}
+
+func (s *ThresholdServer) commit(ns, c0Bytes []byte, c0 *Point, nonce []byte) (*ThresholdCommitment, error) {
+	g := s.key.g
+	hs0, err := g.hashToPoint(s.key.protocol, dhs0, ns)
+	if err != nil {
+		return nil, err
+	}
+	r := s.commitRandom(ns, c0Bytes, nonce)
+
+	blindR, err := g.randomScalar(s.server.random)
+	if err != nil {
+		return nil, err
+	}
+
+	blindX, err := g.randomScalar(s.server.random)
+	if err != nil {
+		return nil, err
+	}
+
+	cm := &ThresholdCommitment{
+		Index: s.index,
+		Nonce: nonce,
+		A:     c0.ScalarMult(r).Marshal(),
+		B:     hs0.ScalarMult(r).Marshal(),
+		Proof: &ProofOfCommitment{
+			Term1: c0.ScalarMult(blindR).Marshal(),
+			Term2: hs0.ScalarMult(blindR).Marshal(),
+			Term3: g.baseBytes(blindX).Marshal(),
+		},
+	}
+
+	challenge := g.padZ(s.key.commitmentChallenge(s.server.publicKeyBytes, cm, ns, c0Bytes).Bytes())
+	cm.Proof.BlindR = g.zMulAdd(r, challenge, blindR)
+	cm.Proof.BlindX = g.zMulAdd(s.server.privateKeyBytes, challenge, blindX)
+
+	return cm, nil
+}
+
+// VerifyPassword is the second verification round. It takes a request created by ThresholdClient.CombineCommitments
+// which must include this rate-limiter's commitment, and returns its share of the answer together with a proof
+func (s *ThresholdServer) VerifyPassword(reqBytes []byte) ([]byte, error) {
+	req := &ThresholdVerifyPasswordRequest{}
+	if err := proto.Unmarshal(reqBytes, req); err != nil {
+		return nil, ErrInvalidRequest
+	}
+
+	if len(req.Ns) != pheNonceLen {
+		return nil, ErrInvalidRequest
+	}
+
+	g := s.key.g
+	c0, err := g.unmarshalPoint(req.C0)
+	if err != nil {
+		return nil, ErrInvalidRequest
+	}
+
+	hs0, err := g.hashToPoint(s.key.protocol, dhs0, req.Ns)
+	if err != nil {
+		return nil, err
+	}
+
+	hs1, err := g.hashToPoint(s.key.protocol, dhs1, req.Ns)
+	if err != nil {
+		return nil, err
+	}
+
+	_, b, _, err := s.key.sumCommitments(req.Commitments, req.Ns, req.C0, c0, hs0)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = s.checkCommitment(req.Commitments, req.Ns, req.C0, c0, hs0); err != nil {
+		return nil, err
+	}
+
+	// q = hs1 * (b ** (-1)), v = q ** x_i
+	q := hs1.Add(b.Neg())
+	if q.isInfinity() {
+		return nil, errors.New("invalid commitments")
+	}
+	qBytes := q.Marshal()
+	v := q.ScalarMult(s.server.privateKeyBytes)
+
+	blindX, err := g.randomScalar(s.server.random)
+	if err != nil {
+		return nil, err
+	}
+
+	proof := &ProofOfEquality{
+		Term1: q.ScalarMult(blindX).Marshal(),
+		Term2: g.baseBytes(blindX).Marshal(),
+	}
+
+	vBytes := v.Marshal()
+	challenge := g.padZ(s.key.equalityChallenge(s.server.publicKeyBytes, s.index, req.Ns, req.C0, qBytes, vBytes, proof).Bytes())
+	proof.BlindX = g.zMulAdd(s.server.privateKeyBytes, challenge, blindX)
+
+	return proto.Marshal(&ThresholdVerifyPasswordResponse{
+		Index: s.index,
+		V:     vBytes,
+		Proof: proof,
+	})
+}
+
+// checkCommitment makes sure the rate-limiter's own randomness is part of the request,
+// otherwise the answer would reveal the rate-limiter's share of c1 regardless of the password
+func (s *ThresholdServer) checkCommitment(commitments []*ThresholdCommitment, ns, c0Bytes []byte, c0, hs0 *Point) error {
+	for _, cm := range commitments {
+		if cm.Index != s.index {
+			continue
+		}
+
+		r := s.commitRandom(ns, c0Bytes, cm.Nonce)
+		if !bytes.Equal(cm.A, c0.ScalarMult(r).Marshal()) || !bytes.Equal(cm.B, hs0.ScalarMult(r).Marshal()) {
+			return errors.New("invalid commitment")
+		}
+		return nil
+	}
+
+	return errors.New("request has no commitment of this rate-limiter")
+}
@@ -0,0 +1,447 @@
+/*
+ * Copyright (C) 2015-2019 Virgil Security Inc.
+ *
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ *     (1) Redistributions of source code must retain the above copyright
+ *     notice, this list of conditions and the following disclaimer.
+ *
+ *     (2) Redistributions in binary form must reproduce the above copyright
+ *     notice, this list of conditions and the following disclaimer in
+ *     the documentation and/or other materials provided with the
+ *     distribution.
+ *
+ *     (3) Neither the name of the copyright holder nor the names of its
+ *     contributors may be used to endorse or promote products derived from
+ *     this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ''AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+ * IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ *
+ * Lead Maintainer: Virgil Security Inc. <support@virgilsecurity.com>
+ */
+
+package phe
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"io"
+	"sort"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/pkg/errors"
+)
+
+// ThresholdClient protects & checks passwords using several rate-limiters, at least threshold of which
+// have to answer with valid proofs. A compromised rate-limiter which is below the threshold can neither
+// verify passwords offline nor make the client accept a wrong answer
+type ThresholdClient struct {
+	key              *thresholdKey
+	clientPrivateKey []byte // padded to the fixed length
+	negKey           []byte
+	invKey           []byte
+	random           io.Reader
+}
+
+// NewThresholdClient creates a new client using client's private key and the public key returned by GetThresholdPublicKey
+func NewThresholdClient(thresholdPublicKey []byte, privateKey []byte, opts ...Option) (*ThresholdClient, error) {
+	if len(privateKey) == 0 {
+		return nil, ErrInvalidPrivateKey
+	}
+
+	pub := &ThresholdPublicKey{}
+	if err := proto.Unmarshal(thresholdPublicKey, pub); err != nil {
+		return nil, ErrInvalidPublicKey
+	}
+
+	key, err := newThresholdKey(pub)
+	if err != nil {
+		return nil, err
+	}
+
+	g := key.g
+	sk, err := g.privateScalar(privateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ThresholdClient{
+		key:              key,
+		clientPrivateKey: sk,
+		negKey:           g.zNeg(sk),
+		invKey:           g.zInv(sk),
+		random:           applyOptions(opts).rand(),
+	}, nil
+}
+
+// CreateEnrollmentRequest combines the nonces returned by ThresholdServer.GetEnrollmentNonce of at least threshold rate-limiters.
+// The request must then be sent to each of them
+func (c *ThresholdClient) CreateEnrollmentRequest(nonces [][]byte) ([]byte, error) {
+	req := &ThresholdEnrollmentRequest{}
+	for _, nb := range nonces {
+		n := &ThresholdNonce{}
+		if err := proto.Unmarshal(nb, n); err != nil {
+			return nil, ErrInvalidResponse
+		}
+		req.Nonces = append(req.Nonces, n)
+	}
+
+	if _, err := c.key.enrollmentNonce(req.Nonces); err != nil {
+		return nil, err
+	}
+
+	return proto.Marshal(req)
+}
+
+// EnrollAccount uses the rate-limiters' answers to the enrollment request to create a new Enrollment Record
+// and a random encryption key. Answers with invalid proofs are ignored as long as at least threshold valid ones remain
+func (c *ThresholdClient) EnrollAccount(password []byte, reqBytes []byte, responses [][]byte) (rec []byte, key []byte, err error) {
+	req := &ThresholdEnrollmentRequest{}
+	if err = proto.Unmarshal(reqBytes, req); err != nil {
+		return nil, nil, ErrInvalidRequest
+	}
+
+	ns, err := c.key.enrollmentNonce(req.Nonces)
+	if err != nil {
+		return
+	}
+
+	participants := make(map[uint32]bool, len(req.Nonces))
+	for _, n := range req.Nonces {
+		participants[n.Index] = true
+	}
+
+	c0s := make(map[uint32]*Point)
+	c1s := make(map[uint32]*Point)
+	var indices []uint32
+
+	for _, rb := range responses {
+		if len(indices) == int(c.key.threshold) {
+			break
+		}
+
+		resp := &ThresholdEnrollmentResponse{}
+		if proto.Unmarshal(rb, resp) != nil ||
+			!participants[resp.Index] || c0s[resp.Index] != nil || !bytes.Equal(resp.Ns, ns) {
+			continue
+		}
+
+		c0, err := c.key.g.unmarshalPoint(resp.C0)
+		if err != nil {
+			continue
+		}
+
+		c1, err := c.key.g.unmarshalPoint(resp.C1)
+		if err != nil {
+			continue
+		}
+
+		pub, pubBytes, _ := c.key.share(resp.Index)
+		if !validateProofOfSuccess(c.key.protocol, pub, pubBytes, resp.Proof, ns, c0, c1, resp.C0, resp.C1) {
+			continue
+		}
+
+		c0s[resp.Index], c1s[resp.Index] = c0, c1
+		indices = append(indices, resp.Index)
+	}
+
+	if len(indices) < int(c.key.threshold) {
+		err = errors.New("not enough valid rate-limiter responses")
+		return
+	}
+
+	c0, c1 := c.key.combineShares(indices, c0s), c.key.combineShares(indices, c1s)
+
+	// client nonce and 2 points
+	nc := make([]byte, pheNonceLen)
+	if err = randRead(c.random, nc); err != nil {
+		return
+	}
+
+	hc0, err := c.key.g.hashToPoint(c.key.protocol, dhc0, nc, password)
+	if err != nil {
+		return
+	}
+
+	hc1, err := c.key.g.hashToPoint(c.key.protocol, dhc1, nc, password)
+	if err != nil {
+		return
+	}
+
+	// encryption key in a form of a random point
+	m, key, err := randomKey(c.random, c.key.g, c.key.protocol)
+	if err != nil {
+		return
+	}
+
+	// calculate two enrollment points
+	t0 := c0.Add(hc0.ScalarMult(c.clientPrivateKey))
+	t1 := c1.Add(hc1.ScalarMult(c.clientPrivateKey)).Add(m.ScalarMult(c.clientPrivateKey))
+	if t0.isInfinity() || t1.isInfinity() {
+		return nil, nil, ErrInvalidResponse
+	}
+
+	rec, err = proto.Marshal(&ThresholdEnrollmentRecord{
+		Ns:       ns,
+		Nc:       nc,
+		T0:       t0.Marshal(),
+		T1:       t1.Marshal(),
+		Check:    checkValue(m),
+		Suite:    uint32(c.key.g.suite),
+		Protocol: uint32(c.key.protocol),
+	})
+
+	return
+}
+
+// combineShares interpolates the points computed with the key shares of the given rate-limiters.
+// The indices are sorted in a copy, the caller's slice isn't modified
+func (k *thresholdKey) combineShares(indices []uint32, points map[uint32]*Point) (res *Point) {
+	indices = append([]uint32(nil), indices...)
+	sort.Slice(indices, func(i, j int) bool { return indices[i] < indices[j] })
+	lambdas := k.lagrangeCoefficients(indices)
+	for i, index := range indices {
+		p := points[index].ScalarMultInt(lambdas[i])
+		if res == nil {
+			res = p
+		} else {
+			res = res.Add(p)
+		}
+	}
+	return
+}
+
+// checkValue lets the client recognize the right encryption key without a proof from every rate-limiter
+func checkValue(m *Point) []byte {
+	return hash(thresholdCheck, m.Marshal())[:thresholdCheckLen]
+}
+
+// CreateVerifyPasswordRequest creates the first round request which is sent to at least threshold rate-limiters
+func (c *ThresholdClient) CreateVerifyPasswordRequest(password []byte, recBytes []byte) (req []byte, err error) {
+	rec := &ThresholdEnrollmentRecord{}
+	if err = proto.Unmarshal(recBytes, rec); err != nil {
+		return nil, ErrInvalidRecord
+	}
+
+	c0, _, err := c.c0(password, rec)
+	if err != nil {
+		return
+	}
+
+	return proto.Marshal(&VerifyPasswordRequest{
+		C0:       c0.Marshal(),
+		Ns:       rec.Ns,
+		Suite:    rec.Suite,
+		Protocol: rec.Protocol,
+	})
+}
+
+func (c *ThresholdClient) c0(password []byte, rec *ThresholdEnrollmentRecord) (c0, t1 *Point, err error) {
+	t0, t1, err := rec.validate(c.key.g)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if Protocol(rec.Protocol) != c.key.protocol {
+		return nil, nil, ErrProtocolMismatch
+	}
+
+	//c0 = t0 * (hc0 ** (-self.y))
+
+	hc0, err := c.key.g.hashToPoint(c.key.protocol, dhc0, rec.Nc, password)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	c0 = t0.Add(hc0.ScalarMult(c.negKey))
+	if c0.isInfinity() {
+		return nil, nil, errors.WithMessage(ErrInvalidRecord, "invalid t0")
+	}
+	return c0, t1, nil
+}
+
+// CombineCommitments creates the second round request from the first round request and the rate-limiters' commitments.
+// Invalid commitments are ignored, the request is built from the first threshold valid ones
+// and must be sent to exactly those rate-limiters, all of which then have to answer
+func (c *ThresholdClient) CombineCommitments(reqBytes []byte, commitments [][]byte) ([]byte, error) {
+	req := &VerifyPasswordRequest{}
+	if err := proto.Unmarshal(reqBytes, req); err != nil {
+		return nil, ErrInvalidRequest
+	}
+
+	if len(req.Ns) != pheNonceLen {
+		return nil, ErrInvalidRequest
+	}
+
+	if err := c.key.g.checkSuite(req.Suite); err != nil {
+		return nil, err
+	}
+
+	if Protocol(req.Protocol) != c.key.protocol {
+		return nil, ErrProtocolMismatch
+	}
+
+	c0, err := c.key.g.unmarshalPoint(req.C0)
+	if err != nil {
+		return nil, ErrInvalidRequest
+	}
+
+	hs0, err := c.key.g.hashToPoint(c.key.protocol, dhs0, req.Ns)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &ThresholdVerifyPasswordRequest{
+		Ns: req.Ns,
+		C0: req.C0,
+	}
+
+	seen := make(map[uint32]bool)
+	for _, cb := range commitments {
+		if len(res.Commitments) == int(c.key.threshold) {
+			break
+		}
+
+		cm := &ThresholdCommitment{}
+		if proto.Unmarshal(cb, cm) != nil || seen[cm.Index] {
+			continue
+		}
+
+		if _, _, err = c.key.validateCommitment(cm, req.Ns, req.C0, c0, hs0); err != nil {
+			continue
+		}
+
+		seen[cm.Index] = true
+		res.Commitments = append(res.Commitments, cm)
+	}
+
+	if len(res.Commitments) < int(c.key.threshold) {
+		return nil, errors.New("not enough valid rate-limiter commitments")
+	}
+
+	return proto.Marshal(res)
+}
+
+// CheckResponsesAndDecrypt verifies the answers of all rate-limiters the second round request was sent to
+// and extracts data encryption key if the password is correct. It returns ErrWrongPassword if the password is wrong
+func (c *ThresholdClient) CheckResponsesAndDecrypt(password []byte, recBytes []byte, reqBytes []byte, responses [][]byte) (key []byte, err error) {
+	rec := &ThresholdEnrollmentRecord{}
+	if err = proto.Unmarshal(recBytes, rec); err != nil {
+		return nil, ErrInvalidRecord
+	}
+
+	req := &ThresholdVerifyPasswordRequest{}
+	if err = proto.Unmarshal(reqBytes, req); err != nil {
+		return nil, ErrInvalidRequest
+	}
+
+	c0, t1, err := c.c0(password, rec)
+	if err != nil {
+		return
+	}
+
+	if !bytes.Equal(req.Ns, rec.Ns) || !bytes.Equal(req.C0, c0.Marshal()) {
+		return nil, errors.New("request does not belong to the record")
+	}
+
+	hs0, err := c.key.g.hashToPoint(c.key.protocol, dhs0, rec.Ns)
+	if err != nil {
+		return
+	}
+
+	hs1, err := c.key.g.hashToPoint(c.key.protocol, dhs1, rec.Ns)
+	if err != nil {
+		return
+	}
+
+	a, b, indices, err := c.key.sumCommitments(req.Commitments, req.Ns, req.C0, c0, hs0)
+	if err != nil {
+		return
+	}
+
+	q := hs1.Add(b.Neg())
+	if q.isInfinity() {
+		return nil, errors.New("invalid commitments")
+	}
+	qBytes := q.Marshal()
+
+	quorum := make(map[uint32]bool, len(indices))
+	for _, index := range indices {
+		quorum[index] = true
+	}
+
+	vs := make(map[uint32]*Point, len(indices))
+	for _, rb := range responses {
+		resp := &ThresholdVerifyPasswordResponse{}
+		if proto.Unmarshal(rb, resp) != nil || !quorum[resp.Index] || vs[resp.Index] != nil {
+			continue
+		}
+
+		v, err := c.validateProofOfEquality(resp, req, q, qBytes)
+		if err != nil {
+			continue
+		}
+		vs[resp.Index] = v
+	}
+
+	if len(vs) != len(indices) {
+		return nil, errors.New("not enough valid rate-limiter responses")
+	}
+
+	// z = a * (q ** x), m = ((t1 * (z ** (-1))) * (hc1 ** (-self.y))) ** (self.y ** (-1))
+
+	z := a.Add(c.key.combineShares(indices, vs))
+	hc1, err := c.key.g.hashToPoint(c.key.protocol, dhc1, rec.Nc, password)
+	if err != nil {
+		return
+	}
+
+	m := t1.Add(z.Neg()).Add(hc1.ScalarMult(c.negKey)).ScalarMult(c.invKey)
+	if m.isInfinity() || subtle.ConstantTimeCompare(checkValue(m), rec.Check) != 1 {
+		return nil, ErrWrongPassword
+	}
+
+	return deriveKey(m)
+}
+
+func (c *ThresholdClient) validateProofOfEquality(resp *ThresholdVerifyPasswordResponse, req *ThresholdVerifyPasswordRequest, q *Point, qBytes []byte) (v *Point, err error) {
+	pub, pubBytes, err := c.key.share(resp.Index)
+	if err != nil {
+		return
+	}
+
+	if v, err = c.key.g.unmarshalPoint(resp.V); err != nil {
+		return
+	}
+
+	term1, term2, blindX, err := resp.Proof.validate(c.key.g)
+	if err != nil {
+		return
+	}
+
+	challenge := c.key.equalityChallenge(pubBytes, resp.Index, req.Ns, req.C0, qBytes, resp.V, resp.Proof)
+
+	// term1 * (v ** challenge) == q ** blind_x
+	// term2 * (X_i ** challenge) == G ** blind_x
+
+	if !term1.Add(v.ScalarMultInt(challenge)).Equal(q.ScalarMultInt(blindX)) ||
+		!term2.Add(pub.ScalarMultInt(challenge)).Equal(c.key.g.base(blindX)) {
+		return nil, ErrInvalidProof
+	}
+
+	return
+}
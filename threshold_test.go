@@ -0,0 +1,447 @@
+/*
+ * Copyright (C) 2015-2019 Virgil Security Inc.
+ *
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ *     (1) Redistributions of source code must retain the above copyright
+ *     notice, this list of conditions and the following disclaimer.
+ *
+ *     (2) Redistributions in binary form must reproduce the above copyright
+ *     notice, this list of conditions and the following disclaimer in
+ *     the documentation and/or other materials provided with the
+ *     distribution.
+ *
+ *     (3) Neither the name of the copyright holder nor the names of its
+ *     contributors may be used to endorse or promote products derived from
+ *     this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ''AS IS'' AND ANY EXPRESS OR
+ * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+ * IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ *
+ * Lead Maintainer: Virgil Security Inc. <support@virgilsecurity.com>
+ */
+
+package phe
+
+import (
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/require"
+)
+
+func newThresholdSetup(t testing.TB, threshold, total int) ([]*ThresholdServer, *ThresholdClient) {
+	keypairs, err := GenerateThresholdKeypairs(threshold, total)
+	require.NoError(t, err)
+	require.Len(t, keypairs, total)
+
+	servers := make([]*ThresholdServer, total)
+	for i, kp := range keypairs {
+		servers[i], err = NewThresholdServer(kp)
+		require.NoError(t, err)
+		require.Equal(t, uint32(i+1), servers[i].Index())
+	}
+
+	pub, err := GetThresholdPublicKey(keypairs[0])
+	require.NoError(t, err)
+
+	c, err := NewThresholdClient(pub, generateClientKey(t))
+	require.NoError(t, err)
+	return servers, c
+}
+
+func thresholdEnroll(t testing.TB, c *ThresholdClient, servers ...*ThresholdServer) (rec, key []byte) {
+	var nonces, responses [][]byte
+	for _, s := range servers {
+		nonce, err := s.GetEnrollmentNonce()
+		require.NoError(t, err)
+		nonces = append(nonces, nonce)
+	}
+
+	req, err := c.CreateEnrollmentRequest(nonces)
+	require.NoError(t, err)
+
+	for _, s := range servers {
+		resp, err := s.GetEnrollment(req)
+		require.NoError(t, err)
+		responses = append(responses, resp)
+	}
+
+	rec, key, err = c.EnrollAccount(pwd, req, responses)
+	require.NoError(t, err)
+	return
+}
+
+func thresholdVerify(t *testing.T, c *ThresholdClient, password, rec []byte, servers ...*ThresholdServer) []byte {
+	req, err := c.CreateVerifyPasswordRequest(password, rec)
+	require.NoError(t, err)
+
+	var commitments, responses [][]byte
+	for _, s := range servers {
+		cm, err := s.CommitVerifyPassword(req)
+		require.NoError(t, err)
+		commitments = append(commitments, cm)
+	}
+
+	finalReq, err := c.CombineCommitments(req, commitments)
+	require.NoError(t, err)
+
+	for _, s := range servers {
+		resp, err := s.VerifyPassword(finalReq)
+		require.NoError(t, err)
+		responses = append(responses, resp)
+	}
+
+	key, err := c.CheckResponsesAndDecrypt(password, rec, finalReq, responses)
+	if err == ErrWrongPassword {
+		require.Nil(t, key)
+		return nil
+	}
+	require.NoError(t, err)
+	return key
+}
+
+func TestThreshold_Full(t *testing.T) {
+	servers, c := newThresholdSetup(t, 2, 3)
+
+	rec, key := thresholdEnroll(t, c, servers...)
+	require.Len(t, key, pheClientKeyLen)
+
+	// any two rate-limiters can verify the password
+	require.Equal(t, key, thresholdVerify(t, c, pwd, rec, servers[0], servers[1]))
+	require.Equal(t, key, thresholdVerify(t, c, pwd, rec, servers[1], servers[2]))
+	require.Equal(t, key, thresholdVerify(t, c, pwd, rec, servers[2], servers[0]))
+
+	// enrolled by a quorum, verified by another one
+	rec, key = thresholdEnroll(t, c, servers[0], servers[1])
+	require.Equal(t, key, thresholdVerify(t, c, pwd, rec, servers[2], servers[1]))
+}
+
+func TestThreshold_CombineShares(t *testing.T) {
+	_, c := newThresholdSetup(t, 2, 3)
+
+	points := make(map[uint32]*Point)
+	for i := uint32(1); i <= 3; i++ {
+		points[i], _, _ = c.key.share(i)
+	}
+
+	// every quorum interpolates the same public key, the caller's order is kept
+	indices := []uint32{3, 1}
+	res := c.key.combineShares(indices, points)
+	require.Equal(t, []uint32{3, 1}, indices)
+	require.Equal(t, res, c.key.combineShares([]uint32{2, 3}, points))
+}
+
+func TestThreshold_InvalidPassword(t *testing.T) {
+	servers, c := newThresholdSetup(t, 2, 3)
+
+	rec, _ := thresholdEnroll(t, c, servers...)
+	require.Nil(t, thresholdVerify(t, c, []byte("Password1"), rec, servers[0], servers[2]))
+}
+
+func TestThreshold_SingleServer(t *testing.T) {
+	servers, c := newThresholdSetup(t, 1, 1)
+
+	rec, key := thresholdEnroll(t, c, servers...)
+	require.Equal(t, key, thresholdVerify(t, c, pwd, rec, servers...))
+}
+
+func TestThreshold_InvalidParameters(t *testing.T) {
+	_, err := GenerateThresholdKeypairs(0, 3)
+	require.Error(t, err)
+	_, err = GenerateThresholdKeypairs(4, 3)
+	require.Error(t, err)
+	_, err = GenerateThresholdKeypairs(2, maxThresholdServers+1)
+	require.Error(t, err)
+}
+
+func TestThreshold_InvalidKeypair(t *testing.T) {
+	keypairs, err := GenerateThresholdKeypairs(2, 3)
+	require.NoError(t, err)
+
+	kp := &ThresholdKeypair{}
+	require.NoError(t, proto.Unmarshal(keypairs[0], kp))
+
+	kp.Index = 2
+	b, err := proto.Marshal(kp)
+	require.NoError(t, err)
+	_, err = NewThresholdServer(b)
+	require.Error(t, err)
+
+	kp.Index = 4
+	b, err = proto.Marshal(kp)
+	require.NoError(t, err)
+	_, err = NewThresholdServer(b)
+	require.Error(t, err)
+}
+
+func TestThreshold_EnrollmentToleratesInvalidResponse(t *testing.T) {
+	servers, c := newThresholdSetup(t, 2, 3)
+
+	var nonces, responses [][]byte
+	for _, s := range servers {
+		nonce, err := s.GetEnrollmentNonce()
+		require.NoError(t, err)
+		nonces = append(nonces, nonce)
+	}
+
+	req, err := c.CreateEnrollmentRequest(nonces)
+	require.NoError(t, err)
+
+	for _, s := range servers {
+		resp, err := s.GetEnrollment(req)
+		require.NoError(t, err)
+		responses = append(responses, resp)
+	}
+
+	// the first rate-limiter answers with somebody else's c0
+	bad := &ThresholdEnrollmentResponse{}
+	require.NoError(t, proto.Unmarshal(responses[0], bad))
+	other := &ThresholdEnrollmentResponse{}
+	require.NoError(t, proto.Unmarshal(responses[1], other))
+	bad.C0 = other.C0
+	responses[0], err = proto.Marshal(bad)
+	require.NoError(t, err)
+
+	rec, key, err := c.EnrollAccount(pwd, req, responses)
+	require.NoError(t, err)
+	require.Equal(t, key, thresholdVerify(t, c, pwd, rec, servers[0], servers[1]))
+
+	// one valid answer is not enough
+	_, _, err = c.EnrollAccount(pwd, req, responses[:2])
+	require.Error(t, err)
+}
+
+func TestThreshold_EnrollmentNonce(t *testing.T) {
+	servers, c := newThresholdSetup(t, 2, 3)
+
+	n1, err := servers[0].GetEnrollmentNonce()
+	require.NoError(t, err)
+	n2, err := servers[1].GetEnrollmentNonce()
+	require.NoError(t, err)
+
+	// not enough nonces
+	_, err = c.CreateEnrollmentRequest([][]byte{n1})
+	require.Error(t, err)
+
+	// duplicate nonces
+	_, err = c.CreateEnrollmentRequest([][]byte{n1, n1})
+	require.Error(t, err)
+
+	req, err := c.CreateEnrollmentRequest([][]byte{n1, n2})
+	require.NoError(t, err)
+
+	// the third rate-limiter has no nonce in the request
+	_, err = servers[2].GetEnrollment(req)
+	require.Error(t, err)
+
+	// expired nonce
+	servers[0].now = func() time.Time {
+		return time.Now().Add(thresholdNonceLifetime + time.Minute)
+	}
+	_, err = servers[0].GetEnrollment(req)
+	require.Error(t, err)
+	servers[0].now = time.Now
+
+	// forged nonce
+	n := &ThresholdNonce{}
+	require.NoError(t, proto.Unmarshal(n1, n))
+	n.Timestamp++
+	forged, err := proto.Marshal(n)
+	require.NoError(t, err)
+
+	req, err = c.CreateEnrollmentRequest([][]byte{forged, n2})
+	require.NoError(t, err)
+	_, err = servers[0].GetEnrollment(req)
+	require.Error(t, err)
+}
+
+func TestThreshold_Commitments(t *testing.T) {
+	servers, c := newThresholdSetup(t, 2, 3)
+	rec, _ := thresholdEnroll(t, c, servers...)
+
+	req, err := c.CreateVerifyPasswordRequest(pwd, rec)
+	require.NoError(t, err)
+
+	cm1, err := servers[0].CommitVerifyPassword(req)
+	require.NoError(t, err)
+	cm2, err := servers[1].CommitVerifyPassword(req)
+	require.NoError(t, err)
+
+	// not enough commitments
+	_, err = c.CombineCommitments(req, [][]byte{cm1, cm1})
+	require.Error(t, err)
+
+	finalReq, err := c.CombineCommitments(req, [][]byte{cm1, cm2})
+	require.NoError(t, err)
+
+	// the third rate-limiter did not commit
+	_, err = servers[2].VerifyPassword(finalReq)
+	require.Error(t, err)
+
+	// commitment replaced with one not made by the rate-limiter
+	parsed := &ThresholdVerifyPasswordRequest{}
+	require.NoError(t, proto.Unmarshal(finalReq, parsed))
+	parsed.Commitments[0].Nonce = make([]byte, pheNonceLen)
+	forged, err := proto.Marshal(parsed)
+	require.NoError(t, err)
+	_, err = servers[0].VerifyPassword(forged)
+	require.Error(t, err)
+	_, err = servers[1].VerifyPassword(forged)
+	require.Error(t, err)
+}
+
+func TestThreshold_InvalidVerifyResponse(t *testing.T) {
+	servers, c := newThresholdSetup(t, 2, 3)
+	rec, _ := thresholdEnroll(t, c, servers...)
+
+	req, err := c.CreateVerifyPasswordRequest(pwd, rec)
+	require.NoError(t, err)
+
+	var commitments, responses [][]byte
+	for _, s := range servers[:2] {
+		cm, err := s.CommitVerifyPassword(req)
+		require.NoError(t, err)
+		commitments = append(commitments, cm)
+	}
+
+	finalReq, err := c.CombineCommitments(req, commitments)
+	require.NoError(t, err)
+
+	for _, s := range servers[:2] {
+		resp, err := s.VerifyPassword(finalReq)
+		require.NoError(t, err)
+		responses = append(responses, resp)
+	}
+
+	// the first rate-limiter answers with the second one's share
+	bad := &ThresholdVerifyPasswordResponse{}
+	require.NoError(t, proto.Unmarshal(responses[0], bad))
+	other := &ThresholdVerifyPasswordResponse{}
+	require.NoError(t, proto.Unmarshal(responses[1], other))
+	bad.V = other.V
+	badBytes, err := proto.Marshal(bad)
+	require.NoError(t, err)
+
+	_, err = c.CheckResponsesAndDecrypt(pwd, rec, finalReq, [][]byte{badBytes, responses[1]})
+	require.Error(t, err)
+
+	// every rate-limiter of the quorum must answer
+	_, err = c.CheckResponsesAndDecrypt(pwd, rec, finalReq, responses[1:])
+	require.Error(t, err)
+}
+
+func TestThreshold_Malformed(t *testing.T) {
+	servers, c := newThresholdSetup(t, 2, 3)
+	rec, _ := thresholdEnroll(t, c, servers...)
+	req, err := c.CreateVerifyPasswordRequest(pwd, rec)
+	require.NoError(t, err)
+
+	bad := []byte{0x01, 0x02}
+
+	_, err = servers[0].GetEnrollment(bad)
+	require.Equal(t, ErrInvalidRequest, err)
+	_, err = servers[0].CommitVerifyPassword(bad)
+	require.Equal(t, ErrInvalidRequest, err)
+	_, err = servers[0].VerifyPassword(bad)
+	require.Equal(t, ErrInvalidRequest, err)
+
+	_, err = c.CreateEnrollmentRequest([][]byte{bad})
+	require.Equal(t, ErrInvalidResponse, err)
+	_, _, err = c.EnrollAccount(pwd, bad, nil)
+	require.Equal(t, ErrInvalidRequest, err)
+	_, err = c.CreateVerifyPasswordRequest(pwd, bad)
+	require.Equal(t, ErrInvalidRecord, err)
+	_, err = c.CombineCommitments(bad, nil)
+	require.Equal(t, ErrInvalidRequest, err)
+	_, err = c.CheckResponsesAndDecrypt(pwd, bad, req, nil)
+	require.Equal(t, ErrInvalidRecord, err)
+	_, err = c.CheckResponsesAndDecrypt(pwd, rec, bad, nil)
+	require.Equal(t, ErrInvalidRequest, err)
+
+	_, err = NewThresholdServer(bad)
+	require.Equal(t, ErrInvalidKeypair, err)
+	_, err = NewThresholdClient(bad, generateClientKey(t))
+	require.Equal(t, ErrInvalidPublicKey, err)
+}
+
+// FuzzThresholdServer makes sure no request can crash a threshold rate-limiter
+func TestThreshold_RateLimiter(t *testing.T) {
+	keypairs, err := GenerateThresholdKeypairs(2, 2)
+	require.NoError(t, err)
+	pub, err := GetThresholdPublicKey(keypairs[0])
+	require.NoError(t, err)
+	c, err := NewThresholdClient(pub, generateClientKey(t))
+	require.NoError(t, err)
+
+	limiter := NewMemoryRateLimiter(RateLimitPolicy{Window: time.Hour, MaxAttempts: 2})
+	limited, err := NewThresholdServer(keypairs[0], WithRateLimiter(limiter))
+	require.NoError(t, err)
+	other, err := NewThresholdServer(keypairs[1])
+	require.NoError(t, err)
+
+	rec, key := thresholdEnroll(t, c, limited, other)
+	require.Equal(t, key, thresholdVerify(t, c, pwd, rec, limited, other))
+	require.Nil(t, thresholdVerify(t, c, []byte("wrong"), rec, limited, other))
+
+	req, err := c.CreateVerifyPasswordRequest(pwd, rec)
+	require.NoError(t, err)
+	_, err = limited.CommitVerifyPassword(req)
+	te, ok := err.(*ThrottledError)
+	require.True(t, ok, "%v", err)
+	require.False(t, te.Locked)
+
+	// the other rate-limiter has its own limits
+	_, err = other.CommitVerifyPassword(req)
+	require.NoError(t, err)
+}
+
+func FuzzThresholdServer(f *testing.F) {
+	servers, c := newThresholdSetup(f, 2, 2)
+	s := servers[0]
+
+	var nonces [][]byte
+	for _, srv := range servers {
+		nonce, err := srv.GetEnrollmentNonce()
+		require.NoError(f, err)
+		nonces = append(nonces, nonce)
+	}
+	enrollReq, err := c.CreateEnrollmentRequest(nonces)
+	require.NoError(f, err)
+	rec, _ := thresholdEnroll(f, c, servers...)
+	req, err := c.CreateVerifyPasswordRequest(pwd, rec)
+	require.NoError(f, err)
+	var commitments [][]byte
+	for _, srv := range servers {
+		cm, err := srv.CommitVerifyPassword(req)
+		require.NoError(f, err)
+		commitments = append(commitments, cm)
+	}
+	finalReq, err := c.CombineCommitments(req, commitments)
+	require.NoError(f, err)
+
+	f.Add(enrollReq)
+	f.Add(req)
+	f.Add(finalReq)
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, reqBytes []byte) {
+		_, _ = s.GetEnrollment(reqBytes)
+		_, _ = s.CommitVerifyPassword(reqBytes)
+		_, _ = s.VerifyPassword(reqBytes)
+	})
+}
@@ -37,28 +37,18 @@
 package phe
 
 import (
-	"crypto/aes"
 	"crypto/cipher"
-	"crypto/elliptic"
-	"crypto/rand"
 	"crypto/sha512"
 	"io"
-	"math/big"
 
 	"golang.org/x/crypto/hkdf"
 
-	"github.com/VirgilSecurity/virgil-phe-go/swu"
 	"github.com/golang/protobuf/proto"
 
 	"github.com/pkg/errors"
 )
 
 var (
-	randReader = rand.Reader
-	curve      = elliptic.P256()
-	curveG     = new(Point).ScalarBaseMultInt(new(big.Int).SetUint64(1)).Marshal()
-	gf         = swu.GF{P: curve.Params().N}
-
 	//domains
 	commonPrefix     = []byte{0x56, 0x52, 0x47, 0x4c, 0x50, 0x48, 0x45} //VRGLPHE
 	dhc0             = append(commonPrefix, 0x31)
@@ -70,6 +60,23 @@ var (
 	encrypt          = append(commonPrefix, 0x37)
 	kdfInfoZ         = append(commonPrefix, 0x38)
 	kdfInfoClientKey = append(commonPrefix, 0x39)
+	proofRotation    = append(commonPrefix, 0x3a)
+	thresholdNonce   = append(commonPrefix, 0x3b)
+	thresholdNs      = append(commonPrefix, 0x3c)
+	thresholdCommit  = append(commonPrefix, 0x3d)
+	proofCommitment  = append(commonPrefix, 0x3e)
+	proofEquality    = append(commonPrefix, 0x3f)
+	thresholdCheck   = append(commonPrefix, 0x40)
+	encryptContext   = append(commonPrefix, 0x41)
+	encryptStream    = append(commonPrefix, 0x42)
+	encryptEnvelope  = append(commonPrefix, 0x43)
+	proofErrorV3     = append(commonPrefix, 0x44)
+	keyWrap          = append(commonPrefix, 0x45)
+	recoveryEscrow   = append(commonPrefix, 0x46)
+	recoveryAudit    = append(commonPrefix, 0x47)
+	deriveSubKey     = append(commonPrefix, 0x48)
+	recoverySigning  = append(commonPrefix, 0x49)
+	recoveryNonce    = append(commonPrefix, 0x4a)
 )
 
 const (
@@ -79,16 +86,12 @@ const (
 	symSaltLen      = 32
 	symNonceLen     = 12
 	symTagLen       = 16
-	zLen            = 32
 )
 
-// Read is a helper function that calls Reader.Read using io.ReadFull.
-// On return, n == len(b) if and only if err == nil.
-func randRead(b []byte) {
-	_, err := io.ReadFull(randReader, b)
-	if err != nil {
-		panic(err)
-	}
+// randRead fills b with random bytes from r using io.ReadFull
+func randRead(r io.Reader, b []byte) error {
+	_, err := io.ReadFull(r, b)
+	return errors.Wrap(err, "random read failed")
 }
 
 //hash hashes a slice of byte arrays,
@@ -111,108 +114,123 @@ func initKdf(domain []byte, tuple ...[]byte) io.Reader {
 
 }
 
-// randomZ generates big random 256 bit integer which must be less than curve's N parameter
-func randomZ() (z *big.Int) {
-	rz := makeZ(randReader)
-	for z == nil {
-		// If the scalar is out of range, sample another random number.
-		if rz.Cmp(curve.Params().N) >= 0 {
-			rz = makeZ(randReader)
-		} else {
-			z = rz
-		}
-	}
-	return
-}
+func unmarshalKeypair(serverKeypair []byte) (kp *Keypair, err error) {
 
-// hashZ maps arrays of bytes to an integer less than curve's N parameter
-func hashZ(domain []byte, data ...[]byte) (z *big.Int) {
-	xof := initKdf(domain, data...)
-	rz := makeZ(xof)
-
-	for z == nil {
-		// If the scalar is out of range, extract another number.
-		if rz.Cmp(curve.Params().N) >= 0 {
-			rz = makeZ(xof)
-		} else {
-			z = rz
-		}
+	kp = &Keypair{}
+	err = proto.Unmarshal(serverKeypair, kp)
+	if err != nil {
+		return nil, ErrInvalidKeypair
 	}
+
 	return
 }
 
-func makeZ(reader io.Reader) *big.Int {
-	buf := make([]byte, zLen)
-	n, err := reader.Read(buf)
-	if err != nil || n != zLen {
-		panic("random read failed")
-	}
-	return new(big.Int).SetBytes(buf)
+// Encrypt generates 32 byte salt, uses master key & salt to generate per-data key & nonce with the help of HKDF
+// Salt is concatenated to the ciphertext. WithRandom replaces the source of the salt.
+// If an algorithm is selected by WithAlgorithm, the result is an envelope which records it, see EncryptEnvelope
+func Encrypt(data, key []byte, opts ...Option) ([]byte, error) {
+	return encryptAny(applyOptions(opts), data, key, encrypt, encryptEnvelope, nil)
 }
 
-//padZ makes all bytes equal size adding zeroes to the beginning if necessary
-func padZ(z []byte) []byte {
-	if len(z) == zLen {
-		return z
-	}
+// Decrypt extracts 32 byte salt, derives key & nonce and decrypts ciphertext.
+// It also decrypts envelopes produced by EncryptEnvelope or by Encrypt with WithAlgorithm
+func Decrypt(ciphertext, key []byte) ([]byte, error) {
+	return decryptAny(ciphertext, key, encrypt, encryptEnvelope, nil)
+}
 
-	newZ := make([]byte, zLen)
-	copy(newZ[zLen-len(z):], z)
-	return newZ
+// EncryptWithAD is like Encrypt but also authenticates additional data, such as user ID, column name and record version.
+// The ciphertext can only be decrypted by DecryptWithAD with the same additional data, so it can't be moved
+// to another row or column. The additional data is not a part of the ciphertext
+func EncryptWithAD(data, key, ad []byte, opts ...Option) ([]byte, error) {
+	return encryptAny(applyOptions(opts), data, key, encrypt, encryptEnvelope, ad)
 }
 
-// hashToPoint maps arrays of bytes to a valid curve point
-func hashToPoint(domain []byte, data ...[]byte) *Point {
-	hash := hash(domain, data...)
-	x, y := swu.HashToPoint(hash[:swu.PointHashLen])
-	return &Point{x, y}
+// DecryptWithAD decrypts a ciphertext produced by EncryptWithAD with the same additional data
+func DecryptWithAD(ciphertext, key, ad []byte) ([]byte, error) {
+	return decryptAny(ciphertext, key, encrypt, encryptEnvelope, ad)
 }
 
-func marshalKeypair(publicKey, privateKey []byte) ([]byte, error) {
-	kp := &Keypair{
-		PublicKey:  publicKey,
-		PrivateKey: privateKey,
-	}
+// EncryptWithContext is like EncryptWithAD but in addition binds the context to the per-data key & nonce derived by HKDF,
+// so that no key derived for one context is ever used in another
+func EncryptWithContext(data, key, context []byte, opts ...Option) ([]byte, error) {
+	info := contextInfo(context)
+	return encryptAny(applyOptions(opts), data, key, info, info, context)
+}
 
-	return proto.Marshal(kp)
+// DecryptWithContext decrypts a ciphertext produced by EncryptWithContext with the same context
+func DecryptWithContext(ciphertext, key, context []byte) ([]byte, error) {
+	info := contextInfo(context)
+	return decryptAny(ciphertext, key, info, info, context)
 }
 
-func unmarshalKeypair(serverKeypair []byte) (kp *Keypair, err error) {
+func contextInfo(context []byte) []byte {
+	return append(append([]byte(nil), encryptContext...), context...)
+}
 
-	kp = &Keypair{}
-	err = proto.Unmarshal(serverKeypair, kp)
-	if err != nil {
-		return nil, errors.Wrap(err, "invalid keypair")
+// encryptAny produces an envelope if an algorithm is selected and the legacy AES-256-GCM format otherwise.
+// info and envelopeInfo are the HKDF info of the two formats
+func encryptAny(o *options, data, key, info, envelopeInfo, ad []byte) ([]byte, error) {
+	if o.algorithm != 0 {
+		return sealEnvelope(o.rand(), o.algorithm, data, key, nil, envelopeInfo, ad)
 	}
-
-	return
+	return seal(o.rand(), data, key, info, ad)
 }
 
-// Encrypt generates 32 byte salt, uses master key & salt to generate per-data key & nonce with the help of HKDF
-// Salt is concatenated to the ciphertext
-func Encrypt(data, key []byte) ([]byte, error) {
-
+// decryptAny decrypts both formats of encryptAny
+func decryptAny(ciphertext, key, info, envelopeInfo, ad []byte) ([]byte, error) {
 	if len(key) != symKeyLen {
 		return nil, errors.New("key must be exactly 32 bytes")
 	}
 
-	salt := make([]byte, symSaltLen)
-	randRead(salt)
-
-	kdf := hkdf.New(sha512.New, key, salt, encrypt)
+	if isEnvelope(ciphertext) {
+		res, err := openEnvelope(ciphertext, key, envelopeInfo, ad)
+		if err == nil {
+			return res, nil
+		}
 
-	keyNonce := make([]byte, symKeyLen+symNonceLen)
-	_, err := kdf.Read(keyNonce)
-	if err != nil {
+		// the salt of a legacy ciphertext may start with the envelope magic by chance
+		if res, legacyErr := open(ciphertext, key, info, ad); legacyErr == nil {
+			return res, nil
+		}
 		return nil, err
 	}
 
-	aesgcm, err := aes.NewCipher(keyNonce[:symKeyLen])
+	return open(ciphertext, key, info, ad)
+}
+
+// newAEAD derives per-data key & nonce from the master key and salt using info as HKDF info
+func newAEAD(alg Algorithm, key, salt, info []byte) (aead cipher.AEAD, nonce []byte, err error) {
+	nonceSize := alg.nonceSize()
+	if nonceSize == 0 {
+		return nil, nil, errors.New("unsupported algorithm")
+	}
+
+	kdf := hkdf.New(sha512.New, key, salt, info)
+
+	keyNonce := make([]byte, symKeyLen+nonceSize)
+	if _, err = kdf.Read(keyNonce); err != nil {
+		return
+	}
+
+	aead, err = alg.newCipher(keyNonce[:symKeyLen])
 	if err != nil {
+		return
+	}
+	return aead, keyNonce[symKeyLen:], nil
+}
+
+func seal(random io.Reader, data, key, info, ad []byte) ([]byte, error) {
+
+	if len(key) != symKeyLen {
+		return nil, errors.New("key must be exactly 32 bytes")
+	}
+
+	salt := make([]byte, symSaltLen)
+	if err := randRead(random, salt); err != nil {
 		return nil, err
 	}
 
-	aesGcm, err := cipher.NewGCM(aesgcm)
+	aesGcm, nonce, err := newAEAD(AlgorithmAES256GCM, key, salt, info)
 	if err != nil {
 		return nil, err
 	}
@@ -220,12 +238,11 @@ func Encrypt(data, key []byte) ([]byte, error) {
 	ct := make([]byte, symSaltLen+len(data)+aesGcm.Overhead())
 	copy(ct, salt)
 
-	aesGcm.Seal(ct[:symSaltLen], keyNonce[symKeyLen:], data, nil)
+	aesGcm.Seal(ct[:symSaltLen], nonce, data, ad)
 	return ct, nil
 }
 
-// Decrypt extracts 32 byte salt, derives key & nonce and decrypts ciphertext
-func Decrypt(ciphertext, key []byte) ([]byte, error) {
+func open(ciphertext, key, info, ad []byte) ([]byte, error) {
 	if len(key) != symKeyLen {
 		return nil, errors.New("key must be exactly 32 bytes")
 	}
@@ -234,26 +251,11 @@ func Decrypt(ciphertext, key []byte) ([]byte, error) {
 		return nil, errors.New("invalid ciphertext length")
 	}
 
-	salt := ciphertext[:symSaltLen]
-	kdf := hkdf.New(sha512.New, key, salt, encrypt)
-
-	keyNonce := make([]byte, symKeyLen+symNonceLen)
-	_, err := kdf.Read(keyNonce)
-	if err != nil {
-		return nil, err
-	}
-
-	aesgcm, err := aes.NewCipher(keyNonce[:symKeyLen])
-	if err != nil {
-		return nil, err
-	}
-
-	aesGcm, err := cipher.NewGCM(aesgcm)
+	aesGcm, nonce, err := newAEAD(AlgorithmAES256GCM, key, ciphertext[:symSaltLen], info)
 	if err != nil {
 		return nil, err
 	}
 
 	dst := make([]byte, 0)
-	return aesGcm.Open(dst, keyNonce[symKeyLen:], ciphertext[symSaltLen:], nil)
-
+	return aesGcm.Open(dst, nonce, ciphertext[symSaltLen:], ad)
 }
@@ -47,9 +47,51 @@ import (
 	"github.com/stretchr/testify/require"
 )
 
+// the default group, P-256
+var (
+	curve  = groupP256.curve
+	curveG = groupP256.generator
+	gf     = groupP256.gf
+)
+
+const zLen = 32
+
+// hashZ maps arrays of bytes to a P-256 scalar
+func hashZ(domain []byte, data ...[]byte) *big.Int {
+	return groupP256.hashZ(domain, data...)
+}
+
+// padZ makes P-256 scalars equal size adding zeroes to the beginning if necessary
+func padZ(z []byte) []byte {
+	return groupP256.padZ(z)
+}
+
+// marshalKeypair encodes a P-256 keypair with ProtocolV1
+func marshalKeypair(publicKey, privateKey []byte) ([]byte, error) {
+	return groupP256.marshalKeypair(publicKey, privateKey, ProtocolV1)
+}
+
+// randomZ generates a random P-256 scalar
+func randomZ() *big.Int {
+	z, err := groupP256.randomZ(rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	return z
+}
+
+// hashToPoint maps arrays of bytes to a P-256 point with ProtocolV1
+func hashToPoint(domain []byte, data ...[]byte) *Point {
+	p, err := groupP256.hashToPoint(ProtocolV1, domain, data...)
+	if err != nil {
+		panic(err)
+	}
+	return p
+}
+
 func TestEncrypt(t *testing.T) {
 	key := make([]byte, symKeyLen)
-	randRead(key)
+	require.NoError(t, randRead(rand.Reader, key))
 
 	data := make([]byte, 365)
 
@@ -66,7 +108,7 @@ func TestEncrypt(t *testing.T) {
 
 func TestEncrypt_empty(t *testing.T) {
 	key := make([]byte, symKeyLen)
-	randRead(key)
+	require.NoError(t, randRead(rand.Reader, key))
 
 	data := make([]byte, 0)
 
@@ -83,7 +125,7 @@ func TestEncrypt_empty(t *testing.T) {
 
 func TestEncrypt_badKey(t *testing.T) {
 	key := make([]byte, symKeyLen)
-	randRead(key)
+	require.NoError(t, randRead(rand.Reader, key))
 
 	data := make([]byte, 365)
 
@@ -101,7 +143,7 @@ func TestEncrypt_badKey(t *testing.T) {
 func TestDecrypt_badLength(t *testing.T) {
 	ct := make([]byte, symSaltLen+15)
 	key := make([]byte, symKeyLen)
-	randRead(key)
+	require.NoError(t, randRead(rand.Reader, key))
 	plaintext, err := Decrypt(ct, key)
 
 	require.Error(t, err)
@@ -109,6 +151,121 @@ func TestDecrypt_badLength(t *testing.T) {
 	require.Nil(t, plaintext)
 }
 
+func TestEncryptWithAD(t *testing.T) {
+	key := make([]byte, symKeyLen)
+	require.NoError(t, randRead(rand.Reader, key))
+
+	data := []byte("secret field")
+	adA := []byte("user A|email|v1")
+	adB := []byte("user B|email|v1")
+
+	ciphertext, err := EncryptWithAD(data, key, adA)
+	require.NoError(t, err)
+
+	plaintext, err := DecryptWithAD(ciphertext, key, adA)
+	require.NoError(t, err)
+	require.Equal(t, data, plaintext)
+
+	// moved to another row
+	plaintext, err = DecryptWithAD(ciphertext, key, adB)
+	require.Error(t, err)
+	require.Nil(t, plaintext)
+
+	_, err = Decrypt(ciphertext, key)
+	require.Error(t, err)
+
+	// no additional data is the same as Encrypt
+	ciphertext, err = EncryptWithAD(data, key, nil)
+	require.NoError(t, err)
+	plaintext, err = Decrypt(ciphertext, key)
+	require.NoError(t, err)
+	require.Equal(t, data, plaintext)
+}
+
+func TestEncryptWithContext(t *testing.T) {
+	key := make([]byte, symKeyLen)
+	require.NoError(t, randRead(rand.Reader, key))
+
+	data := []byte("secret field")
+	ctxA := []byte("user A|email|v1")
+
+	ciphertext, err := EncryptWithContext(data, key, ctxA)
+	require.NoError(t, err)
+
+	plaintext, err := DecryptWithContext(ciphertext, key, ctxA)
+	require.NoError(t, err)
+	require.Equal(t, data, plaintext)
+
+	_, err = DecryptWithContext(ciphertext, key, []byte("user B|email|v1"))
+	require.Error(t, err)
+
+	// the per-data key depends on the context, so it can't be decrypted as additional data only
+	_, err = DecryptWithAD(ciphertext, key, ctxA)
+	require.Error(t, err)
+
+	// empty context is still different from Encrypt
+	ciphertext, err = EncryptWithContext(data, key, nil)
+	require.NoError(t, err)
+	_, err = Decrypt(ciphertext, key)
+	require.Error(t, err)
+
+	_, err = EncryptWithContext(data, key[1:], ctxA)
+	require.Error(t, err)
+	_, err = DecryptWithContext(ciphertext[:symSaltLen], key, nil)
+	require.EqualError(t, err, "invalid ciphertext length")
+}
+
+func TestEncrypt_Algorithms(t *testing.T) {
+	key := make([]byte, symKeyLen)
+	require.NoError(t, randRead(rand.Reader, key))
+
+	data := []byte("secret field")
+	ad := []byte("user A|email|v1")
+
+	for _, alg := range []Algorithm{AlgorithmAES256GCM, AlgorithmChaCha20Poly1305, AlgorithmXChaCha20Poly1305} {
+		ct, err := Encrypt(data, key, WithAlgorithm(alg))
+		require.NoError(t, err)
+		ctAD, err := EncryptWithAD(data, key, ad, WithAlgorithm(alg))
+		require.NoError(t, err)
+		ctContext, err := EncryptWithContext(data, key, ad, WithAlgorithm(alg))
+		require.NoError(t, err)
+		ctEmptyContext, err := EncryptWithContext(data, key, nil, WithAlgorithm(alg))
+		require.NoError(t, err)
+
+		// the algorithm is recorded, so decryption doesn't need it
+		for _, c := range [][]byte{ct, ctAD, ctContext, ctEmptyContext} {
+			header, err := ParseEnvelope(c)
+			require.NoError(t, err)
+			require.Equal(t, alg, header.Algorithm)
+		}
+
+		pt, err := Decrypt(ct, key)
+		require.NoError(t, err)
+		require.Equal(t, data, pt)
+		pt, err = DecryptWithAD(ctAD, key, ad)
+		require.NoError(t, err)
+		require.Equal(t, data, pt)
+		pt, err = DecryptWithContext(ctContext, key, ad)
+		require.NoError(t, err)
+		require.Equal(t, data, pt)
+
+		// the formats keep the guarantees of the legacy ones
+		_, err = DecryptWithAD(ctAD, key, []byte("user B|email|v1"))
+		require.Error(t, err)
+		_, err = Decrypt(ctAD, key)
+		require.Error(t, err)
+		_, err = DecryptWithContext(ctContext, key, []byte("user B|email|v1"))
+		require.Error(t, err)
+		_, err = DecryptWithAD(ctContext, key, ad)
+		require.Error(t, err)
+		_, err = Decrypt(ctEmptyContext, key)
+		require.Error(t, err)
+	}
+
+	_, err := Encrypt(data, key, WithAlgorithm(Algorithm(42)))
+	require.Error(t, err)
+}
+
 func TestEncryptVector(t *testing.T) {
 	rnd := []byte{
 		0x2b, 0x1a, 0x49, 0xe2, 0x6c, 0xcc, 0x33, 0xfe,
@@ -152,11 +309,9 @@ func TestEncryptVector(t *testing.T) {
 		0xab, 0x08, 0x2c, 0xb1, 0xa7, 0x36, 0x04, 0xf4,
 	}
 
-	randReader = bytes.NewReader(rnd)
-	ct, err := Encrypt(plaintext, key)
+	ct, err := Encrypt(plaintext, key, WithRandom(bytes.NewReader(rnd)))
 	require.NoError(t, err)
 	require.Equal(t, ciphertext, ct)
-	randReader = rand.Reader
 
 }
 
@@ -56,7 +56,7 @@ var (
 	badPassword           = mustHex("7040737377307264")
 	verifyBadPasswordReq  = mustHex("0a20fc9e1d89fa8b15e391f62b3de357b0f56fe4dec54a008c7556c477bc9679f83d1241045950d1b2c56d8a77645fc784ddaa080066c20e19cbcc4805df27cfde4c88b744b01531b76d6be98f514870a2e4d2f7fa5139e20c7b517c7e8e56120f6dd0f6d3")
 	verifyBadPasswordResp = mustHex("1241041a83e2221aa9796f5a5022c35f8bc764503c0cfb992bbd4eefb22bcd3186d280cf2783030316a538919abe2d697370a31bfba5133c2d679a22aed3327fc1da4722d0020a4104434fd3eb8d9df8ffc12667f09696ead6194ad7a197817bca53670852a4e32c0197dfeb50367622a88969d448daf8a1adf1416b884d2a6ae430820bd8bc36b9e3124104a773a99986143acf4698a2bcf93fa1ad02a8565f0231604d5f655ff70999ff55e4e5b6ef498d52342abf3b3ff72164017e52471abb06011392112058e36a14351a41049afb7fc9904b4fa45ab9993f91af369a6854b0f44d9048792be7327c2f9878172d0d64f9991fbcf6054bd463bf05e16b2e52d07671ad6e9f8c146605b21f61e3224104ea343565b7b2a6b8248e09ed2a3e4c32dbd7af391369be67387d6ccc4ab5baff7486ce95bf34cbaaec2a37ca380c33b10014450ffeec70dfde4a5eeaac5090cc2a2077e964767b16707315626307386c2a9d139dfa54de87a70e998124311d76a1743220f7dff81df7cc0582277944a89a75979766c89ba8e0ff5040fa85707c350521fe")
-	token                 = mustHex("0a20fc9e1d89fa8b15e391f62b3de357b0f56fe4dec54a008c7556c477bc9679f83d122080390531494470be0b296501586bfcd9e131c39e2decc753d4f25fefd2281eea")
+	token                 = mustHex("0a20fc9e1d89fa8b15e391f62b3de357b0f56fe4dec54a008c7556c477bc9679f83d122080390531494470be0b296501586bfcd9e131c39e2decc753d4f25fefd2281eea22650a4104ea343565b7b2a6b8248e09ed2a3e4c32dbd7af391369be67387d6ccc4ab5baff7486ce95bf34cbaaec2a37ca380c33b10014450ffeec70dfde4a5eeaac5090cc122077c572a57282ebc610c832f959b82d97caa107a71058a74c701c0526919ca347")
 	rotatedServerPub      = mustHex("04c3b315ac3bbc101d7f71d31899fa44aecef0b1b879fab84c7f623d1113e6f7228b3399c246b345c6df0fa7af07cf39b558b13af502910d6c3b42d690468c2f1b")
 	rotatedServerSk       = mustHex("001e0d5c37a3627a53fed34b9f3a4236d3f5b6faa72696998a1239903a4bd12b")
 	rotatedClientSk       = mustHex("ceb6e27585f969f5d5c5bfb8bdc8337f369f381cc5e32efdc123ab74b06a441e")
@@ -77,17 +77,14 @@ func mustHex(s string) []byte {
 }
 
 func TestGetEnrollment(t *testing.T) {
-	MockRandom()
-	resp, err := GetEnrollment(getServerKeypair())
+	resp, err := GetEnrollment(getServerKeypair(), mockRandom())
 	require.NoError(t, err)
 	//fmt.Println(hex.EncodeToString(resp))
 	require.Equal(t, enrollmentResponse, resp)
-	EndMock()
 }
 
 func TestEnroll(t *testing.T) {
-	MockRandom()
-	cli, err := NewClient(serverPublic, clientPrivate)
+	cli, err := NewClient(serverPublic, clientPrivate, mockRandom())
 	require.NoError(t, err)
 	rec, key, err := cli.EnrollAccount(password, enrollmentResponse)
 	require.NoError(t, err)
@@ -95,7 +92,6 @@ func TestEnroll(t *testing.T) {
 	//fmt.Println(hex.EncodeToString(key))
 	require.Equal(t, enrollmentRecord, rec)
 	require.Equal(t, recordKey, key)
-	EndMock()
 }
 
 func TestValidPasswordRequest(t *testing.T) {
@@ -108,12 +104,10 @@ func TestValidPasswordRequest(t *testing.T) {
 }
 
 func TestVerifyValidPasswordResponse(t *testing.T) {
-	MockRandom()
-	resp, err := VerifyPassword(getServerKeypair(), verifyPasswordReq)
+	resp, err := VerifyPassword(getServerKeypair(), verifyPasswordReq, mockRandom())
 	require.NoError(t, err)
 	//fmt.Println(hex.EncodeToString(resp))
 	require.Equal(t, verifyPasswordResp, resp)
-	EndMock()
 }
 
 func TestInvalidPasswordRequest(t *testing.T) {
@@ -126,18 +120,14 @@ func TestInvalidPasswordRequest(t *testing.T) {
 }
 
 func TestVerifyInvalidPasswordResponse(t *testing.T) {
-	MockRandom()
-	resp, err := VerifyPassword(getServerKeypair(), verifyBadPasswordReq)
+	resp, err := VerifyPassword(getServerKeypair(), verifyBadPasswordReq, mockRandom())
 	require.NoError(t, err)
 	//fmt.Println(hex.EncodeToString(resp))
 	require.Equal(t, verifyBadPasswordResp, resp)
-
-	EndMock()
 }
 
 func TestRotateServerKeys(t *testing.T) {
-	MockRandom()
-	tkn, newKeypair, err := Rotate(getServerKeypair())
+	tkn, newKeypair, err := Rotate(getServerKeypair(), mockRandom())
 	require.NoError(t, err)
 	kp, err := unmarshalKeypair(newKeypair)
 	require.NoError(t, err)
@@ -147,8 +137,6 @@ func TestRotateServerKeys(t *testing.T) {
 	require.Equal(t, token, tkn)
 	require.Equal(t, rotatedServerSk, kp.PrivateKey)
 	require.Equal(t, rotatedServerPub, kp.PublicKey)
-
-	EndMock()
 }
 
 func TestRotateClientKey(t *testing.T) {
@@ -161,8 +149,12 @@ func TestRotateClientKey(t *testing.T) {
 }
 
 func TestRotateEnrollmentRecord(t *testing.T) {
-	updrec, err := UpdateRecord(enrollmentRecord, token)
+	updrec, err := UpdateRecord(serverPublic, enrollmentRecord, token)
 	require.NoError(t, err)
 	//fmt.Println(hex.EncodeToString(updrec))
 	require.Equal(t, updatedRecord, updrec)
+
+	updrec, err = UpdateRecordUnverified(enrollmentRecord, token)
+	require.NoError(t, err)
+	require.Equal(t, updatedRecord, updrec)
 }